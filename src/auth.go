@@ -2,7 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -22,6 +24,15 @@ var logger = lgr.New(loggerFormat)
 // Auth provides main function and routing
 type Auth struct {
 	AuthService *AuthService
+
+	// Realms are served under /v1/realms/{realm} path
+	Realms map[string]*Auth
+
+	// BasePath is path prefix of the realm endpoints, empty for default realm
+	BasePath string
+
+	// limiter limits requests to the realm endpoints, it is created on start
+	limiter *RateLimiter
 }
 
 // RecoveryEmailPayload represents payload of password recovery email request
@@ -42,6 +53,21 @@ type PasswordResetPayload struct {
 	Password string `json:"password"`
 }
 
+// LoginCodeStartPayload represents request payload for passwordless login start request
+type LoginCodeStartPayload struct {
+	Username string `json:"username"`
+	Audience string `json:"audience"`
+}
+
+// LoginCodeTokenPayload represents request payload for passwordless login token request,
+// it contains either username and emailed code or token of login link
+type LoginCodeTokenPayload struct {
+	Username string `json:"username"`
+	Code     string `json:"code"`
+	Token    string `json:"token"`
+	Audience string `json:"audience"`
+}
+
 func (a *Auth) inviteUser(w http.ResponseWriter, r *http.Request) {
 	a.options(w, r)
 
@@ -212,7 +238,11 @@ func (a *Auth) getToken(w http.ResponseWriter, r *http.Request) {
 	if t == "refresh_token" {
 		logger.Logf("INFO Refreshing token")
 		refToken := strings.Split(r.Header.Get("Authorization"), " ")[1]
-		token, err := a.AuthService.RefreshToken(refToken)
+		accessToken, refreshToken, err := a.AuthService.RefreshToken(refToken, "", "")
+		idToken := ""
+		if err == nil {
+			idToken, err = a.idToken(r, accessToken)
+		}
 		if err != nil {
 			logger.Logf("WARN Cannot refresh token: %s", err.Error())
 			authErr, isAuthErr := err.(s.AuthError)
@@ -222,18 +252,22 @@ func (a *Auth) getToken(w http.ResponseWriter, r *http.Request) {
 				writeError(w, s.AuthError{Msg: err.Error(), Status: 500})
 			}
 		} else {
-			w.Write(s.AR2JSON(&s.AccessTokenResp{AccessToken: token}))
+			w.Write(s.ARR2JSON(&s.AccessAndRefreshTokenResp{AccessToken: accessToken, RefreshToken: refreshToken, IDToken: idToken}))
 		}
 		return
 	}
 	u, p, ok := r.BasicAuth()
 	if ok {
-		accessToken, refreshToken, err := a.AuthService.BasicAuthToken(u, p)
+		accessToken, refreshToken, err := a.AuthService.BasicAuthToken(u, p, r.URL.Query().Get("audience"), a.clientIP(r))
+		idToken := ""
+		if err == nil {
+			idToken, err = a.idToken(r, accessToken)
+		}
 		if err != nil {
 			logger.Logf("WARN Cannot issue token: %s", err.Error())
 			writeError(w, err.(s.AuthError))
 		} else {
-			w.Write(s.ARR2JSON(&s.AccessAndRefreshTokenResp{AccessToken: accessToken, RefreshToken: refreshToken}))
+			w.Write(s.ARR2JSON(&s.AccessAndRefreshTokenResp{AccessToken: accessToken, RefreshToken: refreshToken, IDToken: idToken}))
 		}
 		return
 	}
@@ -241,6 +275,105 @@ func (a *Auth) getToken(w http.ResponseWriter, r *http.Request) {
 	writeError(w, s.AuthError{Msg: "Basic Auth token is missing", Status: 400})
 }
 
+func (a *Auth) oauthToken(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, s.OAuthError{Code: "invalid_request", Description: err.Error(), Status: 400})
+		return
+	}
+
+	req := &s.TokenRequest{
+		GrantType:    r.PostForm.Get("grant_type"),
+		Username:     r.PostForm.Get("username"),
+		Password:     r.PostForm.Get("password"),
+		RefreshToken: r.PostForm.Get("refresh_token"),
+		Code:         r.PostForm.Get("code"),
+		RedirectURI:  r.PostForm.Get("redirect_uri"),
+		CodeVerifier: r.PostForm.Get("code_verifier"),
+		DeviceCode:   r.PostForm.Get("device_code"),
+		ClientID:     r.PostForm.Get("client_id"),
+		ClientSecret: r.PostForm.Get("client_secret"),
+		Scope:        r.PostForm.Get("scope"),
+		Audience:     r.PostForm.Get("audience"),
+		Nonce:        r.PostForm.Get("nonce"),
+		ClientIP:     a.clientIP(r),
+	}
+	// Basic auth authenticates the client, not the user
+	if clientID, secret, ok := r.BasicAuth(); ok {
+		req.ClientID = clientID
+		req.ClientSecret = secret
+	}
+
+	resp, err := a.AuthService.GrantToken(req)
+	if err != nil {
+		logger.Logf("WARN Cannot issue token for %s grant: %s", req.GrantType, err.Error())
+		writeOAuthError(w, toOAuthError(err.(s.AuthError)))
+		return
+	}
+	w.Write(s.OTR2JSON(resp))
+}
+
+// idToken issues ID token for just issued access token when openid scope is requested
+func (a *Auth) idToken(r *http.Request, accessToken string) (string, error) {
+	if !hasScope(r.URL.Query().Get("scope"), openIDScope) {
+		return "", nil
+	}
+	return a.AuthService.IDToken(accessToken, r.URL.Query().Get("nonce"))
+}
+
+func (a *Auth) revokeToken(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	err := r.ParseForm()
+	token := r.PostForm.Get("token")
+	if err != nil || token == "" {
+		logger.Logf("ERROR Token is missing")
+		writeError(w, s.AuthError{Msg: "invalid_request", Status: 400})
+		return
+	}
+
+	err = a.AuthService.RevokeToken(token)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+}
+
+func (a *Auth) introspectToken(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	callerToken := headerItems[1]
+
+	err := r.ParseForm()
+	token := r.PostForm.Get("token")
+	if err != nil || token == "" {
+		logger.Logf("ERROR Token is missing")
+		writeError(w, s.AuthError{Msg: "invalid_request", Status: 400})
+		return
+	}
+
+	resp, err := a.AuthService.IntrospectToken(callerToken, token)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	w.Write(s.IR2JSON(resp))
+}
+
 func (a *Auth) getUsers(w http.ResponseWriter, r *http.Request) {
 	a.options(w, r)
 	w.Header().Add("Content-type", "application/json; charset=utf-8")
@@ -399,78 +532,1302 @@ func (a *Auth) resetPassword(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (a *Auth) options(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "authorization")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PATCH, DELETE, OPTIONS")
+func (a *Auth) getJWKS(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Write(s.JWKS2JSON(a.AuthService.GetJWKS()))
 }
 
-func writeError(w http.ResponseWriter, err s.AuthError) {
-	w.WriteHeader(err.Status)
-	w.Write(s.ER2JSON(&s.ErrorResp{Error: err.Error()}))
+func (a *Auth) getOpenIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	conf, err := a.AuthService.GetOpenIDConfiguration()
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Write(s.OIDC2JSON(conf))
 }
 
-func (a *Auth) start() {
-	r := chi.NewRouter()
+func (a *Auth) getOIDCUserInfo(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
 
-	r.Use(func(h http.Handler) http.Handler {
-		return loggerHandler(h)
-	})
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
 
-	r.Route("/v1", func(r chi.Router) {
-		r.Options("/*", a.options)
-		r.Post("/invite", a.inviteUser)
-		r.Post("/users", a.createUser)
-		r.Patch("/users/{userID}", a.updateUser)
-		r.Delete("/users/{userID}", a.deleteUser)
-		r.Post("/token", a.getToken)
-		r.Get("/userinfo/byid/{userID}", a.getUserById)
-		r.Get("/userinfo/byusername/{username}", a.getUserByUsername)
-		r.Get("/userinfo", a.getUsers)
-		r.Post("/password-recovery/email", a.emailRecoveryCode)
-		r.Post("/password-recovery/exchange", a.exchangeRecoveryCode)
-		r.Post("/password-recovery/reset", a.resetPassword)
-	})
-	http.ListenAndServe(":2525", r)
+	if len(headerItems) < 2 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	userInfo, err := a.AuthService.GetOIDCUserInfo(token)
+	if err != nil {
+		authErr := err.(s.AuthError)
+		if authErr.Status == 401 {
+			w.Header().Set("WWW-Authenticate", "Bearer error=\"invalid_token\"")
+		}
+		writeError(w, authErr)
+		return
+	}
+	w.Write(s.OUI2JSON(userInfo))
 }
 
-func loggerHandler(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		t1 := time.Now()
-		ww := middleware.NewWrapResponseWriter(rw, r.ProtoMajor)
-		logfmt := "INFO %s %s %d %d - %d ms"
-		defer func() {
-			if r.Method != "OPTIONS" {
-				logger.Logf(logfmt, r.Method, r.URL, ww.Status(), ww.BytesWritten(), time.Since(t1).Milliseconds())
+func (a *Auth) authorizePage(w http.ResponseWriter, r *http.Request) {
+	req := parseAuthorizationRequest(r.URL.Query())
+
+	client, err := a.AuthService.GetAuthorizationClient(req)
+	if err != nil {
+		authErr := err.(s.AuthError)
+		writeLoginPage(w, authErr.Status, &LoginPageData{Error: authErr.Msg})
+		return
+	}
+
+	if err = a.AuthService.ValidateAuthorizationRequest(req); err != nil {
+		redirectAuthorizationError(w, r, req, err.(s.OAuthError))
+		return
+	}
+
+	writeLoginPage(w, 200, &LoginPageData{ClientName: client.Name, Request: req, BasePath: a.BasePath})
+}
+
+func (a *Auth) authorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeLoginPage(w, 400, &LoginPageData{Error: "Invalid form"})
+		return
+	}
+	req := parseAuthorizationRequest(r.PostForm)
+
+	code, err := a.AuthService.Authorize(req, r.PostForm.Get("username"), r.PostForm.Get("password"), r.PostForm.Get("otp"), a.clientIP(r))
+	switch e := err.(type) {
+	case nil:
+		redirectAuthorization(w, r, req, url.Values{"code": {code}})
+	case s.OAuthError:
+		redirectAuthorizationError(w, r, req, e)
+	case s.AuthError:
+		data := &LoginPageData{Error: e.Msg, BasePath: a.BasePath}
+		status := e.Status
+		if e.Status == 403 {
+			// Wrong credentials, the user can try again
+			if client, err := a.AuthService.GetAuthorizationClient(req); err == nil {
+				data.ClientName = client.Name
+				data.Request = req
 			}
-		}()
-		h.ServeHTTP(ww, r)
-	})
+			status = 401
+		}
+		writeLoginPage(w, status, data)
+	}
 }
 
-func userIdParse(str string) (int64, error) {
-	userID, err := strconv.Atoi(str)
-	return int64(userID), err
+func parseAuthorizationRequest(values url.Values) *s.AuthorizationRequest {
+	return &s.AuthorizationRequest{
+		ResponseType:        values.Get("response_type"),
+		ClientID:            values.Get("client_id"),
+		RedirectURI:         values.Get("redirect_uri"),
+		Scope:               values.Get("scope"),
+		State:               values.Get("state"),
+		Nonce:               values.Get("nonce"),
+		CodeChallenge:       values.Get("code_challenge"),
+		CodeChallengeMethod: values.Get("code_challenge_method"),
+	}
 }
 
-func selectDaoByConfig(conf Config) dao.UserDao {
-	switch conf.DriverName {
-	case "mongo":
-		return dao.NewMongoUserDao(conf.DatabaseURL, conf.DatabaseName)
-	default:
-		return dao.NewSqlUserDao(conf.DriverName, conf.DatabaseURL, conf.DatabaseName)
+// redirectAuthorization redirects user agent back to the client with given parameters and state
+func redirectAuthorization(w http.ResponseWriter, r *http.Request, req *s.AuthorizationRequest, params url.Values) {
+	u, err := url.Parse(req.RedirectURI)
+	if err != nil {
+		writeLoginPage(w, 400, &LoginPageData{Error: "Invalid redirect URI"})
+		return
+	}
+	query := u.Query()
+	for name := range params {
+		query.Set(name, params.Get(name))
+	}
+	if req.State != "" {
+		query.Set("state", req.State)
 	}
+	u.RawQuery = query.Encode()
+
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, u.String(), http.StatusFound)
 }
 
-func startAuthService(conf Config) {
+func redirectAuthorizationError(w http.ResponseWriter, r *http.Request, req *s.AuthorizationRequest, err s.OAuthError) {
+	logger.Logf("WARN Authorization request of client %s is rejected: %s", req.ClientID, err.Error())
+	params := url.Values{"error": {err.Code}}
+	if err.Description != "" {
+		params.Set("error_description", err.Description)
+	}
+	redirectAuthorization(w, r, req, params)
+}
 
-	var dao = selectDaoByConfig((conf))
+func (a *Auth) deviceAuthorization(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
 
-	mailer := EmailMailer{Email: conf.Email, Password: conf.EmailPassword}
-	service := AuthService{UserDao: dao, Mailer: &mailer, Config: conf}
-	auth := Auth{AuthService: &service}
-	logger.Logf("INFO BrightonUM 1.7.4 is starting")
-	auth.start()
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, s.OAuthError{Code: "invalid_request", Description: err.Error(), Status: 400})
+		return
+	}
+
+	resp, err := a.AuthService.StartDeviceAuthorization(r.PostForm.Get("client_id"), r.PostForm.Get("scope"), a.baseURL(r))
+	if err != nil {
+		writeOAuthError(w, toOAuthError(err.(s.AuthError)))
+		return
+	}
+	w.Write(s.DAR2JSON(resp))
+}
+
+func (a *Auth) devicePage(w http.ResponseWriter, r *http.Request) {
+	writeDevicePage(w, 200, &DevicePageData{UserCode: r.URL.Query().Get("user_code"), BasePath: a.BasePath})
+}
+
+func (a *Auth) verifyDevice(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeDevicePage(w, 400, &DevicePageData{Error: "Invalid form"})
+		return
+	}
+	userCode := r.PostForm.Get("user_code")
+	approve := r.PostForm.Get("action") == "approve"
+
+	err := a.AuthService.ApproveDeviceWithCredentials(userCode, r.PostForm.Get("username"), r.PostForm.Get("password"), r.PostForm.Get("otp"), approve, a.clientIP(r))
+	if err != nil {
+		authErr := err.(s.AuthError)
+		status := authErr.Status
+		if status == 403 {
+			status = 401
+		}
+		writeDevicePage(w, status, &DevicePageData{UserCode: userCode, Error: authErr.Msg, BasePath: a.BasePath})
+		return
+	}
+
+	message := "Device is connected, you can return to it now."
+	if !approve {
+		message = "Device is not connected."
+	}
+	writeDevicePage(w, 200, &DevicePageData{Message: message})
+}
+
+func (a *Auth) approveDevice(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	var payload struct {
+		UserCode string `json:"userCode"`
+		Approve  bool   `json:"approve"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		logger.Logf("ERROR Cannot decode JSON payload")
+		writeError(w, s.AuthError{Msg: err.Error(), Status: 400})
+		return
+	}
+
+	err = a.AuthService.ApproveDevice(payload.UserCode, token, payload.Approve)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+	}
+}
+
+func writeDevicePage(w http.ResponseWriter, status int, data *DevicePageData) {
+	w.Header().Set("Content-type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+	if err := devicePage.Execute(w, data); err != nil {
+		logger.Logf("ERROR Cannot render device page: %s", err.Error())
+	}
+}
+
+func writeLoginPage(w http.ResponseWriter, status int, data *LoginPageData) {
+	w.Header().Set("Content-type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+	if err := loginPage.Execute(w, data); err != nil {
+		logger.Logf("ERROR Cannot render login page: %s", err.Error())
+	}
+}
+
+func (a *Auth) createClient(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	var client s.Client
+	err := json.NewDecoder(r.Body).Decode(&client)
+	if err != nil {
+		logger.Logf("ERROR Cannot decode JSON payload")
+		writeError(w, s.AuthError{Msg: err.Error(), Status: 400})
+		return
+	}
+
+	err = a.AuthService.CreateClient(&client, token)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+
+	w.WriteHeader(201)
+	w.Write(s.C2JSON(&client))
+}
+
+func (a *Auth) getClients(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	clients, err := a.AuthService.GetClients(token)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	w.Write(s.CL2JSON(clients))
+}
+
+func (a *Auth) deleteClient(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	err := a.AuthService.DeleteClient(chi.URLParam(r, "clientID"), token)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+	}
+}
+
+func (a *Auth) unlockUsername(w http.ResponseWriter, r *http.Request) {
+	a.unlock(w, r, a.AuthService.UnlockUsername, chi.URLParam(r, "username"))
+}
+
+func (a *Auth) unlockIP(w http.ResponseWriter, r *http.Request) {
+	a.unlock(w, r, a.AuthService.UnlockIP, chi.URLParam(r, "ip"))
+}
+
+func (a *Auth) unlock(w http.ResponseWriter, r *http.Request, fn func(string, string) error, key string) {
+	a.options(w, r)
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	err := fn(key, token)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+	}
+}
+
+func (a *Auth) rotateKeys(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	kid, err := a.AuthService.RotateKeys(token)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	w.Write(s.KID2JSON(&s.KeyIDResp{KeyID: kid}))
+}
+
+func (a *Auth) mfaToken(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	err := r.ParseForm()
+	challenge := r.PostForm.Get("mfaToken")
+	if err != nil || challenge == "" {
+		logger.Logf("ERROR Challenge token is missing")
+		writeError(w, s.AuthError{Msg: "Challenge token is missing", Status: 400})
+		return
+	}
+
+	accessToken, refreshToken, err := a.AuthService.MFAToken(challenge, r.PostForm.Get("code"))
+	idToken := ""
+	if err == nil {
+		idToken, err = a.idToken(r, accessToken)
+	}
+	if err != nil {
+		logger.Logf("WARN Cannot issue token: %s", err.Error())
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	w.Write(s.ARR2JSON(&s.AccessAndRefreshTokenResp{AccessToken: accessToken, RefreshToken: refreshToken, IDToken: idToken}))
+}
+
+func (a *Auth) startPasswordless(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	var payload LoginCodeStartPayload
+	if r.Body == nil || json.NewDecoder(r.Body).Decode(&payload) != nil || payload.Username == "" {
+		logger.Logf("ERROR Invalid payload")
+		writeError(w, s.AuthError{Msg: "Username is missing", Status: 400})
+		return
+	}
+
+	err := a.AuthService.SendLoginCode(payload.Username, payload.Audience)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+}
+
+func (a *Auth) passwordlessToken(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	var payload LoginCodeTokenPayload
+	if r.Body == nil || json.NewDecoder(r.Body).Decode(&payload) != nil ||
+		(payload.Token == "" && (payload.Username == "" || payload.Code == "")) {
+		logger.Logf("ERROR Invalid payload")
+		writeError(w, s.AuthError{Msg: "Username and code or login token are required", Status: 400})
+		return
+	}
+
+	var accessToken, refreshToken string
+	var err error
+	if payload.Token != "" {
+		accessToken, refreshToken, err = a.AuthService.LoginLinkToken(payload.Token)
+	} else {
+		accessToken, refreshToken, err = a.AuthService.LoginCodeToken(payload.Username, payload.Code, payload.Audience)
+	}
+	idToken := ""
+	if err == nil {
+		idToken, err = a.idToken(r, accessToken)
+	}
+	if err != nil {
+		logger.Logf("WARN Cannot issue token: %s", err.Error())
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	w.Write(s.ARR2JSON(&s.AccessAndRefreshTokenResp{AccessToken: accessToken, RefreshToken: refreshToken, IDToken: idToken}))
+}
+
+func (a *Auth) enrollTOTP(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	resp, err := a.AuthService.EnrollTOTP(token)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	w.Write(s.TE2JSON(resp))
+}
+
+func (a *Auth) confirmTOTP(w http.ResponseWriter, r *http.Request) {
+	a.setTOTP(w, r, a.AuthService.ConfirmTOTP)
+}
+
+func (a *Auth) disableTOTP(w http.ResponseWriter, r *http.Request) {
+	a.setTOTP(w, r, a.AuthService.DisableTOTP)
+}
+
+func (a *Auth) setTOTP(w http.ResponseWriter, r *http.Request, set func(token, code string) error) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	var payload struct {
+		Code string `json:"code"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		logger.Logf("ERROR Cannot decode JSON payload")
+		writeError(w, s.AuthError{Msg: err.Error(), Status: 400})
+		return
+	}
+
+	err = set(token, payload.Code)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+	}
+}
+
+func (a *Auth) getBackupCodes(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	remaining, err := a.AuthService.GetBackupCodesCount(token)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	w.Write(s.BCC2JSON(&s.BackupCodesCountResp{Remaining: remaining}))
+}
+
+func (a *Auth) generateBackupCodes(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	codes, err := a.AuthService.GenerateBackupCodes(token)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	w.Write(s.BC2JSON(&s.BackupCodesResp{Codes: codes}))
+}
+
+func (a *Auth) beginWebAuthnRegistration(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	resp, err := a.AuthService.BeginWebAuthnRegistration(token)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	w.Write(s.WO2JSON(resp))
+}
+
+func (a *Auth) finishWebAuthnRegistration(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	var payload s.WebAuthnFinishRequest
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		logger.Logf("ERROR Cannot decode JSON payload")
+		writeError(w, s.AuthError{Msg: err.Error(), Status: 400})
+		return
+	}
+
+	credential, err := a.AuthService.FinishWebAuthnRegistration(token, &payload)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+
+	w.WriteHeader(201)
+	w.Write(s.WC2JSON(credential))
+}
+
+func (a *Auth) beginWebAuthnLogin(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	var payload struct {
+		Username string `json:"username"`
+		Audience string `json:"audience"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		logger.Logf("ERROR Cannot decode JSON payload")
+		writeError(w, s.AuthError{Msg: err.Error(), Status: 400})
+		return
+	}
+
+	resp, err := a.AuthService.BeginWebAuthnLogin(payload.Username, payload.Audience)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	w.Write(s.WO2JSON(resp))
+}
+
+func (a *Auth) finishWebAuthnLogin(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	var payload s.WebAuthnFinishRequest
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		logger.Logf("ERROR Cannot decode JSON payload")
+		writeError(w, s.AuthError{Msg: err.Error(), Status: 400})
+		return
+	}
+
+	accessToken, refreshToken, err := a.AuthService.FinishWebAuthnLogin(&payload)
+	idToken := ""
+	if err == nil {
+		idToken, err = a.idToken(r, accessToken)
+	}
+	if err != nil {
+		logger.Logf("WARN Cannot issue token: %s", err.Error())
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	w.Write(s.ARR2JSON(&s.AccessAndRefreshTokenResp{AccessToken: accessToken, RefreshToken: refreshToken, IDToken: idToken}))
+}
+
+func (a *Auth) getWebAuthnCredentials(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	credentials, err := a.AuthService.GetWebAuthnCredentials(token)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	w.Write(s.WCL2JSON(credentials))
+}
+
+func (a *Auth) deleteWebAuthnCredential(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	err := a.AuthService.DeleteWebAuthnCredential(chi.URLParam(r, "credentialID"), token)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+	}
+}
+
+func (a *Auth) getRoles(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	roles, err := a.AuthService.GetRoles(token)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	w.Write(s.RL2JSON(roles))
+}
+
+func (a *Auth) saveRole(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	var role s.Role
+	err := json.NewDecoder(r.Body).Decode(&role)
+	if err != nil {
+		logger.Logf("ERROR Cannot decode JSON payload")
+		writeError(w, s.AuthError{Msg: err.Error(), Status: 400})
+		return
+	}
+	role.Name = chi.URLParam(r, "role")
+
+	err = a.AuthService.SaveRole(&role, token)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	w.Write(s.R2JSON(&role))
+}
+
+func (a *Auth) deleteRole(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	err := a.AuthService.DeleteRole(chi.URLParam(r, "role"), token)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+	}
+}
+
+func (a *Auth) getUserAccess(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	userID, err := userIdParse(chi.URLParam(r, "userID"))
+	if err != nil {
+		writeError(w, s.AuthError{Msg: "Cannot parse user ID", Status: 400})
+		return
+	}
+
+	access, err := a.AuthService.GetUserAccess(userID, token)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	w.Write(s.UA2JSON(access))
+}
+
+func (a *Auth) setUserAccess(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	userID, err := userIdParse(chi.URLParam(r, "userID"))
+	if err != nil {
+		writeError(w, s.AuthError{Msg: "Cannot parse user ID", Status: 400})
+		return
+	}
+
+	var access s.UserAccess
+	err = json.NewDecoder(r.Body).Decode(&access)
+	if err != nil {
+		logger.Logf("ERROR Cannot decode JSON payload")
+		writeError(w, s.AuthError{Msg: err.Error(), Status: 400})
+		return
+	}
+
+	err = a.AuthService.SetUserAccess(userID, &access, token)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+	}
+}
+
+func (a *Auth) createGroup(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	var group s.Group
+	err := json.NewDecoder(r.Body).Decode(&group)
+	if err != nil {
+		logger.Logf("ERROR Cannot decode JSON payload")
+		writeError(w, s.AuthError{Msg: err.Error(), Status: 400})
+		return
+	}
+
+	err = a.AuthService.CreateGroup(&group, token)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+
+	w.WriteHeader(201)
+	w.Write(s.G2JSON(&group))
+}
+
+func (a *Auth) getGroups(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	groups, err := a.AuthService.GetGroups(token)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	w.Write(s.GL2JSON(groups))
+}
+
+func (a *Auth) getGroup(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	group, err := a.AuthService.GetGroup(chi.URLParam(r, "groupID"), token)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	w.Write(s.G2JSON(group))
+}
+
+func (a *Auth) updateGroup(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	var group s.Group
+	err := json.NewDecoder(r.Body).Decode(&group)
+	if err != nil {
+		logger.Logf("ERROR Cannot decode JSON payload")
+		writeError(w, s.AuthError{Msg: err.Error(), Status: 400})
+		return
+	}
+	group.ID = chi.URLParam(r, "groupID")
+
+	err = a.AuthService.UpdateGroup(&group, token)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	w.Write(s.G2JSON(&group))
+}
+
+func (a *Auth) deleteGroup(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	err := a.AuthService.DeleteGroup(chi.URLParam(r, "groupID"), token)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+	}
+}
+
+func (a *Auth) getGroupMembers(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+	w.Header().Add("Content-type", "application/json; charset=utf-8")
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	members, err := a.AuthService.GetGroupMembers(chi.URLParam(r, "groupID"), token)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+		return
+	}
+	w.Write(s.UL2JSON(members))
+}
+
+func (a *Auth) addGroupMember(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	a.setGroupMember(w, r, token, true)
+}
+
+func (a *Auth) removeGroupMember(w http.ResponseWriter, r *http.Request) {
+	a.options(w, r)
+
+	authHeader := r.Header.Get("Authorization")
+	headerItems := strings.Split(authHeader, " ")
+
+	if len(headerItems) < 2 {
+		writeError(w, s.AuthError{Msg: "Authorization header is missing or invalid", Status: 401})
+		return
+	}
+
+	token := headerItems[1]
+
+	a.setGroupMember(w, r, token, false)
+}
+
+func (a *Auth) setGroupMember(w http.ResponseWriter, r *http.Request, token string, member bool) {
+	userID, err := userIdParse(chi.URLParam(r, "userID"))
+	if err != nil {
+		writeError(w, s.AuthError{Msg: "Cannot parse user ID", Status: 400})
+		return
+	}
+
+	err = a.AuthService.SetGroupMember(chi.URLParam(r, "groupID"), userID, member, token)
+	if err != nil {
+		writeError(w, err.(s.AuthError))
+	}
+}
+
+func (a *Auth) options(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "authorization")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, PATCH, DELETE, OPTIONS")
+}
+
+func writeError(w http.ResponseWriter, err s.AuthError) {
+	if err.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(err.RetryAfter, 10))
+	}
+	w.WriteHeader(err.Status)
+	w.Write(s.ER2JSON(&s.ErrorResp{Error: err.Error(), MFAToken: err.MFAToken}))
+}
+
+// toOAuthError converts AuthError into RFC 6749 error, code is picked by status when it is not set
+func toOAuthError(err s.AuthError) s.OAuthError {
+	code := err.Code
+	if code == "" {
+		switch {
+		case err.Status >= 500:
+			code = "server_error"
+		case err.Status == 400:
+			code = "invalid_request"
+		case err.Status == 429:
+			code = "temporarily_unavailable"
+		default:
+			code = "invalid_grant"
+		}
+	}
+
+	status := 400
+	switch code {
+	case "invalid_client":
+		status = 401
+	case "mfa_required":
+		status = 403
+	case "temporarily_unavailable":
+		status = 429
+	case "server_error":
+		status = 500
+	}
+	return s.OAuthError{Code: code, Description: err.Msg, Status: status, MFAToken: err.MFAToken, RetryAfter: err.RetryAfter}
+}
+
+func writeOAuthError(w http.ResponseWriter, err s.OAuthError) {
+	if err.Status == 401 {
+		w.Header().Set("WWW-Authenticate", "Basic")
+	}
+	if err.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(err.RetryAfter, 10))
+	}
+	w.WriteHeader(err.Status)
+	w.Write(s.OER2JSON(&s.OAuthErrorResp{Error: err.Code, ErrorDescription: err.Description, MFAToken: err.MFAToken}))
+}
+
+func (a *Auth) start() {
+	r := chi.NewRouter()
+
+	r.Use(func(h http.Handler) http.Handler {
+		return loggerHandler(h)
+	})
+	a.startRateLimiter()
+	for _, realm := range a.Realms {
+		realm.startRateLimiter()
+	}
+	r.Use(a.rateLimit)
+
+	a.routes(r)
+	r.Route("/v1", func(r chi.Router) {
+		a.v1Routes(r)
+		for name, realm := range a.Realms {
+			realm := realm
+			r.Route("/realms/"+name, func(r chi.Router) {
+				realm.routes(r)
+				realm.v1Routes(r)
+			})
+		}
+	})
+	http.ListenAndServe(":2525", r)
+}
+
+// routes registers OAuth and discovery endpoints
+func (a *Auth) routes(r chi.Router) {
+	r.Get("/.well-known/jwks.json", a.getJWKS)
+	r.Get("/.well-known/openid-configuration", a.getOpenIDConfiguration)
+	r.Get("/oauth/authorize", a.authorizePage)
+	r.Post("/oauth/authorize", a.authorize)
+	r.Post("/oauth/token", a.oauthToken)
+	r.Post("/oauth/device_authorization", a.deviceAuthorization)
+	r.Get("/oauth/device", a.devicePage)
+	r.Post("/oauth/device", a.verifyDevice)
+	r.Options("/oauth/token", a.options)
+}
+
+// v1Routes registers user management API
+func (a *Auth) v1Routes(r chi.Router) {
+	r.Options("/*", a.options)
+	r.Post("/invite", a.inviteUser)
+	r.Post("/users", a.createUser)
+	r.Patch("/users/{userID}", a.updateUser)
+	r.Delete("/users/{userID}", a.deleteUser)
+	r.Post("/token", a.getToken)
+	r.Post("/token/revoke", a.revokeToken)
+	r.Post("/token/introspect", a.introspectToken)
+	r.Post("/token/mfa", a.mfaToken)
+	r.Post("/passwordless/start", a.startPasswordless)
+	r.Post("/passwordless/token", a.passwordlessToken)
+	r.Post("/mfa/totp", a.enrollTOTP)
+	r.Post("/mfa/totp/confirm", a.confirmTOTP)
+	r.Post("/mfa/totp/disable", a.disableTOTP)
+	r.Get("/mfa/backup-codes", a.getBackupCodes)
+	r.Post("/mfa/backup-codes", a.generateBackupCodes)
+	r.Post("/webauthn/register/begin", a.beginWebAuthnRegistration)
+	r.Post("/webauthn/register/finish", a.finishWebAuthnRegistration)
+	r.Post("/webauthn/login/begin", a.beginWebAuthnLogin)
+	r.Post("/webauthn/login/finish", a.finishWebAuthnLogin)
+	r.Get("/webauthn/credentials", a.getWebAuthnCredentials)
+	r.Delete("/webauthn/credentials/{credentialID}", a.deleteWebAuthnCredential)
+	r.Get("/userinfo/byid/{userID}", a.getUserById)
+	r.Get("/userinfo/byusername/{username}", a.getUserByUsername)
+	r.Get("/userinfo", a.getUsers)
+	r.Get("/userinfo/me", a.getOIDCUserInfo)
+	r.Post("/userinfo/me", a.getOIDCUserInfo)
+	r.Post("/password-recovery/email", a.emailRecoveryCode)
+	r.Post("/password-recovery/exchange", a.exchangeRecoveryCode)
+	r.Post("/password-recovery/reset", a.resetPassword)
+	r.Post("/keys/rotate", a.rotateKeys)
+	r.Delete("/lockouts/users/{username}", a.unlockUsername)
+	r.Delete("/lockouts/ips/{ip}", a.unlockIP)
+	r.Post("/device/approve", a.approveDevice)
+	r.Post("/clients", a.createClient)
+	r.Get("/clients", a.getClients)
+	r.Delete("/clients/{clientID}", a.deleteClient)
+	r.Get("/roles", a.getRoles)
+	r.Put("/roles/{role}", a.saveRole)
+	r.Delete("/roles/{role}", a.deleteRole)
+	r.Get("/users/{userID}/roles", a.getUserAccess)
+	r.Put("/users/{userID}/roles", a.setUserAccess)
+	r.Post("/groups", a.createGroup)
+	r.Get("/groups", a.getGroups)
+	r.Get("/groups/{groupID}", a.getGroup)
+	r.Patch("/groups/{groupID}", a.updateGroup)
+	r.Delete("/groups/{groupID}", a.deleteGroup)
+	r.Get("/groups/{groupID}/members", a.getGroupMembers)
+	r.Put("/groups/{groupID}/members/{userID}", a.addGroupMember)
+	r.Delete("/groups/{groupID}/members/{userID}", a.removeGroupMember)
+}
+
+func loggerHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		t1 := time.Now()
+		ww := middleware.NewWrapResponseWriter(rw, r.ProtoMajor)
+		logfmt := "INFO %s %s %d %d - %d ms"
+		defer func() {
+			if r.Method != "OPTIONS" {
+				logger.Logf(logfmt, r.Method, r.URL, ww.Status(), ww.BytesWritten(), time.Since(t1).Milliseconds())
+			}
+		}()
+		h.ServeHTTP(ww, r)
+	})
+}
+
+func runPeriodically(interval time.Duration, f func()) {
+	if interval <= 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		f()
+	}
+}
+
+// baseURL returns URL of the realm endpoints the request was sent to
+func (a *Auth) baseURL(r *http.Request) string {
+	return requestBaseURL(r) + a.BasePath
+}
+
+// clientIP returns address of the client, X-Forwarded-For header is taken into account only when it is trusted.
+// The right-most entry is used since it is the one appended by the proxy, the others may be sent by the client.
+func (a *Auth) clientIP(r *http.Request) string {
+	if a.AuthService.Config.TrustForwardedFor {
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			entries := strings.Split(forwarded[len(forwarded)-1], ",")
+			if ip := strings.TrimSpace(entries[len(entries)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// requestBaseURL returns scheme and host the request was sent to
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+func userIdParse(str string) (int64, error) {
+	userID, err := strconv.Atoi(str)
+	return int64(userID), err
+}
+
+func selectDaoByConfig(conf Config, service *AuthService) {
+	switch conf.DriverName {
+	case "mongo":
+		databaseName := conf.DatabaseName
+		if conf.Realm != "" {
+			databaseName += "_" + conf.Realm
+		}
+		userDao := dao.NewMongoUserDao(conf.DatabaseURL, databaseName)
+		service.UserDao = userDao
+		service.RefreshTokenDao = dao.NewMongoRefreshTokenDao(userDao)
+		service.RevocationDao = dao.NewMongoRevocationDao(userDao)
+		service.RoleDao = dao.NewMongoRoleDao(userDao)
+		service.GroupDao = dao.NewMongoGroupDao(userDao)
+		service.ClientDao = dao.NewMongoClientDao(userDao)
+		service.AuthCodeDao = dao.NewMongoAuthorizationCodeDao(userDao)
+		service.DeviceDao = dao.NewMongoDeviceAuthorizationDao(userDao)
+		service.WebAuthnDao = dao.NewMongoWebAuthnDao(userDao)
+		service.LoginAttemptDao = dao.NewMongoLoginAttemptDao(userDao)
+	default:
+		userDao := dao.NewSqlRealmUserDao(conf.DriverName, conf.DatabaseURL, conf.DatabaseName, conf.Realm)
+		service.UserDao = userDao
+		service.RefreshTokenDao = dao.NewSqlRefreshTokenDao(userDao)
+		service.RevocationDao = dao.NewSqlRevocationDao(userDao)
+		service.RoleDao = dao.NewSqlRoleDao(userDao)
+		service.GroupDao = dao.NewSqlGroupDao(userDao)
+		service.ClientDao = dao.NewSqlClientDao(userDao)
+		service.AuthCodeDao = dao.NewSqlAuthorizationCodeDao(userDao)
+		service.DeviceDao = dao.NewSqlDeviceAuthorizationDao(userDao)
+		service.WebAuthnDao = dao.NewSqlWebAuthnDao(userDao)
+		service.LoginAttemptDao = dao.NewSqlLoginAttemptDao(userDao)
+	}
+}
+
+func startAuthService(conf Config) {
+	if err := conf.Validate(); err != nil {
+		logger.Logf("FATAL Invalid configuration: %s", err.Error())
+	}
+	if !conf.OpenIDProvider() {
+		logger.Logf("WARN OpenID Connect discovery is disabled, issuer %s is not an https URL", conf.Issuer)
+	}
+	if conf.LegacyTokensUntil == "" {
+		conf.LegacyTokensUntil = conf.DefaultLegacyTokensUntil(time.Now())
+		logger.Logf("INFO Tokens without iss and aud claims are accepted until %s", conf.LegacyTokensUntil)
+	}
+
+	mailer := EmailMailer{Email: conf.Email, Password: conf.EmailPassword}
+	auth := Auth{AuthService: newAuthService(conf, &mailer), Realms: map[string]*Auth{}}
+
+	for _, spec := range conf.Realms {
+		realmConf, err := conf.RealmConfig(spec)
+		if err != nil {
+			logger.Logf("FATAL Invalid realm: %s", err.Error())
+		}
+		auth.Realms[realmConf.Realm] = &Auth{AuthService: newAuthService(realmConf, &mailer), BasePath: realmPath(realmConf.Realm)}
+		logger.Logf("INFO Realm %s is configured", realmConf.Realm)
+	}
+
+	logger.Logf("INFO BrightonUM 1.7.4 is starting")
+	auth.start()
+}
+
+// newAuthService creates service of the realm with its own keys and persistence
+func newAuthService(conf Config, mailer Mailer) *AuthService {
+	keyProvider, err := NewKeyProvider(conf)
+	if err != nil {
+		logger.Logf("FATAL Cannot load keys: %s", err.Error())
+	}
+	go keyProvider.Watch(conf.KeyReloadInterval)
+
+	service := AuthService{Mailer: mailer, Config: conf, Keys: keyProvider.Keys}
+	selectDaoByConfig(conf, &service)
+	go runPeriodically(conf.RevocationPruneInterval, service.PruneRevokedTokens)
+	go runPeriodically(conf.RevocationPruneInterval, service.PruneRefreshTokens)
+	go runPeriodically(conf.RevocationPruneInterval, service.PruneAuthorizationCodes)
+	go runPeriodically(conf.RevocationPruneInterval, service.PruneDeviceAuthorizations)
+	go runPeriodically(conf.RevocationPruneInterval, service.PruneLoginAttempts)
+	return &service
 }
 
 func main() {
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/adderly/brightonum/src/crypto"
+	st "github.com/adderly/brightonum/src/structs"
+)
+
+const (
+	backupCodeCount  = 10
+	backupCodeLength = 10
+)
+
+// GenerateBackupCodes replaces backup codes of the user with new ones. Only hashes are stored,
+// so the codes are returned only once. Second factor must be enabled.
+func (s *AuthService) GenerateBackupCodes(token string) ([]string, error) {
+	u, err := s.authenticateToken(token, accessTokenUse)
+	if err != nil {
+		return nil, err
+	}
+	if !u.TOTPEnabled {
+		return nil, st.AuthError{Msg: "Second factor is not enabled", Status: 400}
+	}
+
+	codes := make([]string, backupCodeCount)
+	hashes := make([]string, backupCodeCount)
+	for i := range codes {
+		codes[i] = generateBackupCode()
+		hashes[i], err = crypto.Hash(normalizeBackupCode(codes[i]))
+		if err != nil {
+			return nil, st.AuthError{Msg: err.Error(), Status: 500}
+		}
+	}
+	if err = s.UserDao.SetBackupCodes(u.ID, hashes); err != nil {
+		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+	}
+
+	logger.Logf("INFO Backup codes are generated for user %d", u.ID)
+	return codes, nil
+}
+
+// GetBackupCodesCount returns number of backup codes of the user which are not used yet
+func (s *AuthService) GetBackupCodesCount(token string) (int, error) {
+	u, err := s.authenticateToken(token, accessTokenUse)
+	if err != nil {
+		return 0, err
+	}
+	return len(u.BackupCodes), nil
+}
+
+// checkBackupCode redeems backup code of the user, each code is accepted only once
+func (s *AuthService) checkBackupCode(u *st.User, code string) error {
+	code = normalizeBackupCode(code)
+	for _, hash := range u.BackupCodes {
+		if !crypto.Match(code, hash) {
+			continue
+		}
+		used, err := s.UserDao.UseBackupCode(u.ID, hash)
+		if err != nil {
+			return st.AuthError{Msg: err.Error(), Status: 500}
+		}
+		if !used {
+			break
+		}
+		logger.Logf("INFO Backup code is used by user %d, %d left", u.ID, len(u.BackupCodes)-1)
+		return nil
+	}
+	return st.AuthError{Msg: "Authentication code is wrong", Status: 403}
+}
+
+// isBackupCode tells backup codes from TOTP codes which consist of digits only
+func isBackupCode(code string) bool {
+	return len(normalizeBackupCode(code)) == backupCodeLength
+}
+
+// generateBackupCode generates random code formatted as two groups for readability
+func generateBackupCode() string {
+	code := generateTokenID()[:backupCodeLength]
+	return code[:backupCodeLength/2] + "-" + code[backupCodeLength/2:]
+}
+
+// normalizeBackupCode removes separators and spaces users may type
+func normalizeBackupCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.Replace(code, "-", "", -1)
+}
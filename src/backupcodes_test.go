@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adderly/brightonum/src/crypto"
+	"github.com/adderly/brightonum/src/dao"
+	st "github.com/adderly/brightonum/src/structs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestAuthService_GenerateBackupCodes(t *testing.T) {
+	user := createTestUser()
+	user.TOTPEnabled = true
+	disabled := createAnotherTestUser()
+
+	var hashes []string
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+	dao.On("GetByUsername", disabled.Username).Return(&disabled, nil)
+	dao.On("SetBackupCodes", user.ID, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		hashes = args.Get(1).([]string)
+	})
+
+	conf := createTestConfig()
+	s := createTestService(&mailer, &dao, conf)
+
+	codes, err := s.GenerateBackupCodes(issueTestToken(user.ID, user.Username, conf.PrivKeyPath))
+	assert.Nil(t, err)
+	assert.Len(t, codes, backupCodeCount)
+	assert.Len(t, hashes, backupCodeCount)
+	for i, code := range codes {
+		assert.Regexp(t, "^[0-9a-f]{5}-[0-9a-f]{5}$", code)
+		assert.True(t, crypto.Match(normalizeBackupCode(code), hashes[i]))
+	}
+
+	_, err = s.GenerateBackupCodes(issueTestToken(disabled.ID, disabled.Username, conf.PrivKeyPath))
+	assert.Equal(t, st.AuthError{Msg: "Second factor is not enabled", Status: 400}, err)
+}
+
+func TestAuthService_GetBackupCodesCount(t *testing.T) {
+	user := createTestUser()
+	user.BackupCodes = []string{"hash1", "hash2"}
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	conf := createTestConfig()
+	s := createTestService(&mailer, &dao, conf)
+
+	remaining, err := s.GetBackupCodesCount(issueTestToken(user.ID, user.Username, conf.PrivKeyPath))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, remaining)
+}
+
+func TestAuthService_MFAToken_BackupCode(t *testing.T) {
+	hash, _ := crypto.Hash("0123456789")
+	user := createTestUser()
+	user.TOTPEnabled = true
+	user.BackupCodes = []string{hash}
+
+	revocationDao := dao.MockRevocationDao{}
+	revocationDao.On("IsRevoked", mock.Anything).Return(false, nil)
+	revocationDao.On("Revoke", mock.Anything, mock.Anything).Return(nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+	dao.On("UseBackupCode", user.ID, hash).Return(true, nil).Once()
+	dao.On("UseBackupCode", user.ID, hash).Return(false, nil)
+
+	conf := createTestConfig()
+	conf.MFAChallengeLifetime = time.Minute
+	s := createTestService(&mailer, &dao, conf)
+	s.RevocationDao = &revocationDao
+
+	_, _, err := s.BasicAuthToken(user.Username, "oakheart", "", "")
+	challenge := err.(st.AuthError).MFAToken
+
+	_, _, err = s.MFAToken(challenge, "01234-5678a")
+	assert.Equal(t, st.AuthError{Msg: "Authentication code is wrong", Status: 403}, err)
+
+	accessToken, _, err := s.MFAToken(challenge, "01234-56789")
+	assert.Nil(t, err)
+	assert.True(t, testJWTStringField(accessToken, "sub", user.Username))
+	dao.AssertCalled(t, "UseBackupCode", user.ID, hash)
+
+	// Code is redeemed only once
+	_, _, err = s.BasicAuthToken(user.Username, "oakheart", "", "")
+	_, _, err = s.MFAToken(err.(st.AuthError).MFAToken, "0123456789")
+	assert.Equal(t, st.AuthError{Msg: "Authentication code is wrong", Status: 403}, err)
+}
+
+func TestNormalizeBackupCode(t *testing.T) {
+	assert.Equal(t, "0123456789", normalizeBackupCode(" 01234-56789 "))
+	assert.Equal(t, "abcde01234", normalizeBackupCode("ABCDE-01234"))
+	assert.True(t, isBackupCode("abcde-01234"))
+	assert.False(t, isBackupCode("287082"))
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Nesting limit of decoded CBOR items, WebAuthn structures are at most few levels deep
+const cborMaxDepth = 16
+
+var errCBORTruncated = errors.New("CBOR data is truncated")
+
+// decodeCBOR decodes single RFC 8949 data item and returns it with the rest of data.
+// Only definite length items used by WebAuthn are supported: integers are decoded as int64,
+// byte strings as []byte, text strings as string, arrays as []interface{},
+// maps as map[interface{}]interface{}, simple values as bool or nil. Tags are skipped.
+func decodeCBOR(data []byte) (interface{}, []byte, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, errors.New("CBOR data is nested too deep")
+	}
+	if len(data) == 0 {
+		return nil, nil, errCBORTruncated
+	}
+
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	arg, rest, err := decodeCBORArgument(info, data[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, errors.New("CBOR integer is too big")
+		}
+		return int64(arg), rest, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, errors.New("CBOR integer is too big")
+		}
+		return -1 - int64(arg), rest, nil
+	case 2, 3:
+		if arg > uint64(len(rest)) {
+			return nil, nil, errCBORTruncated
+		}
+		if major == 2 {
+			return rest[:arg], rest[arg:], nil
+		}
+		return string(rest[:arg]), rest[arg:], nil
+	case 4:
+		// Every item takes at least one byte
+		if arg > uint64(len(rest)) {
+			return nil, nil, errCBORTruncated
+		}
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item interface{}
+			item, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, rest, nil
+	case 5:
+		if arg > uint64(len(rest)) {
+			return nil, nil, errCBORTruncated
+		}
+		items := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, value interface{}
+			key, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errors.New("CBOR map key must be integer or text")
+			}
+			value, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items[key] = value
+		}
+		return items, rest, nil
+	case 6:
+		return decodeCBORItem(rest, depth+1)
+	default:
+		switch info {
+		case 20:
+			return false, rest, nil
+		case 21:
+			return true, rest, nil
+		case 22, 23:
+			return nil, rest, nil
+		}
+		return nil, nil, errors.New("CBOR simple value is not supported")
+	}
+}
+
+// decodeCBORArgument decodes argument of the initial byte, which is value, length or count
+func decodeCBORArgument(info byte, data []byte) (uint64, []byte, error) {
+	size := 0
+	switch {
+	case info < 24:
+		return uint64(info), data, nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, nil, errors.New("CBOR indefinite length items are not supported")
+	}
+	if len(data) < size {
+		return 0, nil, errCBORTruncated
+	}
+
+	buf := make([]byte, 8)
+	copy(buf[8-size:], data[:size])
+	return binary.BigEndian.Uint64(buf), data[size:], nil
+}
@@ -1,5 +1,32 @@
 package main
 
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAccessTokenLifetime  = time.Hour
+	defaultRefreshTokenLifetime = 365 * 24 * time.Hour
+
+	defaultRecoveryCodeLifetime  = 15 * time.Minute
+	defaultResettingCodeLifetime = 15 * time.Minute
+	defaultRecoveryCodeAttempts  = 5
+	defaultLoginCodeAttempts     = 5
+)
+
+// Claims of access tokens populated from user memberships
+const (
+	rolesClaim  = "roles"
+	groupsClaim = "groups"
+	scopeClaim  = "scope"
+)
+
 // Config provides configuration variables
 type Config struct {
 	// Path to a private key
@@ -8,6 +35,120 @@ type Config struct {
 	// Path to a public key
 	PubKeyPath string `long:"pubkey" required:"true" description:"Path to a public key"`
 
+	// Public keys of previous key pairs, accepted for verification until retirement
+	VerificationKeys []string `long:"verificationKey" required:"false" description:"Public key of a previous key pair accepted for verification, as path[,RFC3339 retirement time]. Can be repeated"`
+
+	// How long the replaced key is accepted after rotation
+	KeyRetirementPeriod time.Duration `long:"keyRetirementPeriod" required:"false" default:"8760h" description:"How long the replaced key is accepted for verification after rotation"`
+
+	// How often key files are checked for changes
+	KeyReloadInterval time.Duration `long:"keyReloadInterval" required:"false" default:"30s" description:"How often key files are checked for changes, 0 disables polling (SIGHUP still reloads keys)"`
+
+	// How often expired entries are removed from token revocation list, refresh tokens, authorization codes, device authorizations and failed password attempts
+	RevocationPruneInterval time.Duration `long:"revocationPruneInterval" required:"false" default:"1h" description:"How often expired entries are removed from token revocation list, refresh tokens, authorization codes, device authorizations and failed password attempts"`
+
+	// Lifetime of access tokens
+	AccessTokenLifetime time.Duration `long:"accessTokenLifetime" required:"false" default:"1h" description:"Lifetime of access tokens"`
+
+	// Lifetime of refresh tokens
+	RefreshTokenLifetime time.Duration `long:"refreshTokenLifetime" required:"false" default:"8760h" description:"Lifetime of refresh tokens"`
+
+	// Token lifetimes overridden for specific audiences
+	AudienceLifetimes []string `long:"audienceLifetime" required:"false" description:"Token lifetimes for an audience as audience=access[,refresh], e.g. mobile=15m,720h. Can be repeated"`
+
+	// Membership claims of access tokens
+	TokenClaims string `long:"tokenClaims" required:"false" default:"roles,groups,scope" description:"Membership claims of access tokens (roles, groups, scope), comma separated"`
+
+	// Membership claims overridden for specific audiences
+	AudienceClaims []string `long:"audienceClaims" required:"false" description:"Membership claims of access tokens for an audience as audience=claim[,claim], e.g. web=roles,groups. Can be repeated"`
+
+	// Issuer of tokens, iss claim
+	Issuer string `long:"issuer" required:"false" default:"brightonum" description:"Issuer of tokens (iss claim)"`
+
+	// Default audience of tokens, aud claim
+	Audience string `long:"audience" required:"false" default:"brightonum" description:"Default audience of tokens (aud claim)"`
+
+	// Tokens issued before iss and aud claims were introduced lack them, they are accepted until this time
+	LegacyTokensUntil string `long:"legacyTokensUntil" required:"false" description:"RFC3339 time until which tokens without iss and aud claims are accepted, e.g. 2021-06-01T00:00:00Z. Defaults to access and refresh token lifetimes after start"`
+
+	// Additional audiences tokens can be requested for
+	Audiences []string `long:"allowedAudience" required:"false" description:"Additional audience tokens can be requested for. Can be repeated"`
+
+	// Lifetime of OAuth authorization codes
+	AuthCodeLifetime time.Duration `long:"authCodeLifetime" required:"false" default:"1m" description:"Lifetime of OAuth authorization codes"`
+
+	// Lifetime of device codes and user codes of device authorization grant
+	DeviceCodeLifetime time.Duration `long:"deviceCodeLifetime" required:"false" default:"10m" description:"Lifetime of device authorization requests"`
+
+	// Minimal interval between token requests of a device
+	DevicePollInterval time.Duration `long:"devicePollInterval" required:"false" default:"5s" description:"Minimal interval between token requests of a device"`
+
+	// Lifetime of passwordless login codes and links
+	LoginCodeLifetime time.Duration `long:"loginCodeLifetime" required:"false" default:"10m" description:"Lifetime of passwordless login codes and links"`
+
+	// Attempts invalidating pending passwordless login
+	LoginCodeAttempts int `long:"loginCodeAttempts" required:"false" default:"5" description:"Number of attempts to enter passwordless login code invalidating the login"`
+
+	// Page of the app exchanging passwordless login link for tokens
+	LoginLinkURL string `long:"loginLinkURL" required:"false" description:"URL of the app page exchanging passwordless login link for tokens, link is not sent when it is not set"`
+
+	// Lifetime of password recovery codes sent by email
+	RecoveryCodeLifetime time.Duration `long:"recoveryCodeLifetime" required:"false" default:"15m" description:"Lifetime of password recovery codes sent by email"`
+
+	// Lifetime of password resetting codes exchanged for recovery ones
+	ResettingCodeLifetime time.Duration `long:"resettingCodeLifetime" required:"false" default:"15m" description:"Lifetime of password resetting codes"`
+
+	// Wrong attempts invalidating pending recovery or resetting code
+	RecoveryCodeAttempts int `long:"recoveryCodeAttempts" required:"false" default:"5" description:"Number of wrong attempts invalidating recovery or resetting code"`
+
+	// Passphrase TOTP secrets are encrypted with, TOTP is disabled when it is not set
+	MFAEncryptionKey string `long:"mfaEncryptionKey" required:"false" description:"Passphrase TOTP secrets of users are encrypted with, enables TOTP second factor"`
+
+	// Lifetime of challenge tokens exchanged for tokens with the second factor
+	MFAChallengeLifetime time.Duration `long:"mfaChallengeLifetime" required:"false" default:"5m" description:"Lifetime of challenge tokens exchanged for tokens with the second factor"`
+
+	// Name of the account issuer shown by authenticator apps
+	TOTPIssuer string `long:"totpIssuer" required:"false" default:"brightonum" description:"Name of the account issuer shown by authenticator apps"`
+
+	// Relying party ID of WebAuthn credentials, WebAuthn is disabled when it is not set
+	WebAuthnRPID string `long:"webauthnRPID" required:"false" description:"Relying party ID of WebAuthn credentials (domain of the app), enables WebAuthn"`
+
+	// Relying party name shown by browsers and authenticators
+	WebAuthnRPName string `long:"webauthnRPName" required:"false" default:"brightonum" description:"Relying party name shown by browsers and authenticators"`
+
+	// Origins WebAuthn ceremonies are accepted from
+	WebAuthnOrigins []string `long:"webauthnOrigin" required:"false" description:"Origin WebAuthn ceremonies are accepted from, https://{webauthnRPID} by default. Can be repeated"`
+
+	// Time given to the user to complete WebAuthn ceremony
+	WebAuthnTimeout time.Duration `long:"webauthnTimeout" required:"false" default:"5m" description:"Time given to the user to complete WebAuthn ceremony"`
+
+	// Allowed clock difference for exp, nbf and iat checks
+	ClockSkew time.Duration `long:"clockSkew" required:"false" default:"30s" description:"Allowed clock difference for exp, nbf and iat checks"`
+
+	// Failed password attempts of username before it is locked, 0 disables lockout
+	LockoutThreshold int `long:"lockoutThreshold" required:"false" default:"5" description:"Failed password attempts of username before it is locked, 0 disables lockout"`
+
+	// Failed password attempts from client IP before it is locked, 0 disables lockout
+	LockoutIPThreshold int `long:"lockoutIPThreshold" required:"false" default:"20" description:"Failed password attempts from client IP before it is locked, 0 disables lockout"`
+
+	// Lockout after reaching threshold, doubled with every next failure
+	LockoutDuration time.Duration `long:"lockoutDuration" required:"false" default:"1m" description:"Lockout after reaching threshold, doubled with every next failure"`
+
+	// Longest lockout
+	LockoutMaxDuration time.Duration `long:"lockoutMaxDuration" required:"false" default:"1h" description:"Longest lockout"`
+
+	// How long failed attempts are counted after the last one
+	LockoutWindow time.Duration `long:"lockoutWindow" required:"false" default:"1h" description:"How long failed password attempts are counted after the last one"`
+
+	// Wrong second factor codes of a user before the second factor is locked, 0 disables the limit
+	MFAMaxAttempts int `long:"mfaMaxAttempts" required:"false" default:"5" description:"Wrong second factor codes of a user before the second factor is locked for lockout window, 0 disables the limit"`
+
+	// Token bucket limits of requests to the routes
+	RateLimits []string `long:"rateLimit" required:"false" default:"*=600/1m" default:"/users=10/1h" default:"/password-recovery/*=10/1h,user" default:"/password-recovery/*=30/1h" default:"/passwordless/start=5/1h,user" default:"/passwordless/token=10/1h,user" description:"Rate limit of a route as route=requests/period[,ip|user], e.g. /users=10/1h,ip. Route is relative to API root, * matches all routes. Can be repeated, empty value disables defaults"`
+
+	// Take client IP from X-Forwarded-For header set by reverse proxy
+	TrustForwardedFor bool `long:"trustForwardedFor" required:"false" description:"Take client IP from the right-most X-Forwarded-For entry, enable only behind reverse proxy which sets it"`
+
 	// MongoDB URL
 	DatabaseURL string `long:"databaseURL" required:"true" description:"URL for MongoDB"`
 
@@ -23,12 +164,285 @@ type Config struct {
 	// Enable debug logging
 	Debug bool `long:"debug" required:"false" description:"Enable debug logging"`
 
-	// Admin ID
-	AdminID int64 `long:"adminID" required:"true" description:"Admin ID"`
+	// User which always has admin role, e.g. to assign roles on fresh installation
+	AdminID int64 `long:"adminID" required:"false" description:"ID of user with admin role"`
 
 	// Enable private mode
 	Private bool `long:"private" required:"false" description:"Private Mode"`
 
 	// The database driver thar will be used
 	DriverName string `long:"driverName" required:"true" description:"Database driver name (mysql, mongodb, etc)"`
+
+	// Realms with separate users, keys and admins
+	Realms []string `long:"realm" required:"false" description:"Realm with separate users and keys as name=privkey,pubkey[,adminID][,private]. Can be repeated"`
+
+	// Realm of the configuration, empty for default one
+	Realm string `no-flag:"true"`
+}
+
+// realmNamePattern allows names which can be used in paths, database and table names
+var realmNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_]{0,31}$`)
+
+// realmSpec describes realm parsed from configuration
+type realmSpec struct {
+	Name        string
+	PrivKeyPath string
+	PubKeyPath  string
+	AdminID     int64
+	Private     bool
+}
+
+// Validate checks values which are not validated by arguments parser
+func (c Config) Validate() error {
+	if strings.Contains(c.Issuer, "://") && !c.OpenIDProvider() {
+		return fmt.Errorf("Invalid issuer %s, expected absolute https URL", c.Issuer)
+	}
+	if c.LegacyTokensUntil != "" {
+		if _, err := time.Parse(time.RFC3339, c.LegacyTokensUntil); err != nil {
+			return fmt.Errorf("Invalid legacy tokens cutoff %s, expected RFC3339 time", c.LegacyTokensUntil)
+		}
+	}
+	for _, spec := range c.AudienceLifetimes {
+		if _, _, _, err := parseAudienceLifetime(spec); err != nil {
+			return err
+		}
+	}
+	if _, err := parseClaims(c.TokenClaims); err != nil {
+		return err
+	}
+	for _, spec := range c.AudienceClaims {
+		if _, _, err := parseAudienceClaims(spec); err != nil {
+			return err
+		}
+	}
+	for _, spec := range c.RateLimits {
+		if spec == "" {
+			continue
+		}
+		if _, err := parseRateLimit(spec); err != nil {
+			return err
+		}
+	}
+	realms := map[string]bool{}
+	for _, spec := range c.Realms {
+		realm, err := parseRealm(spec)
+		if err != nil {
+			return err
+		}
+		if realms[realm.Name] {
+			return fmt.Errorf("Realm %s is configured twice", realm.Name)
+		}
+		realms[realm.Name] = true
+	}
+	return nil
+}
+
+// RealmConfig returns configuration of the realm, it has own keys, admin and registration mode.
+// Issuer gets realm path, so tokens of different realms are distinguishable.
+func (c Config) RealmConfig(spec string) (Config, error) {
+	realm, err := parseRealm(spec)
+	if err != nil {
+		return Config{}, err
+	}
+
+	conf := c
+	conf.Realm = realm.Name
+	conf.Realms = nil
+	conf.PrivKeyPath = realm.PrivKeyPath
+	conf.PubKeyPath = realm.PubKeyPath
+	conf.VerificationKeys = nil
+	conf.AdminID = realm.AdminID
+	conf.Private = realm.Private
+	if conf.Issuer != "" {
+		conf.Issuer = strings.TrimSuffix(conf.Issuer, "/") + realmPath(realm.Name)
+	}
+	return conf, nil
+}
+
+// realmPath returns path prefix of realm endpoints
+func realmPath(realm string) string {
+	return "/v1/realms/" + realm
+}
+
+// TokenLifetimes returns lifetimes of access and refresh tokens for audience
+func (c Config) TokenLifetimes(audience string) (time.Duration, time.Duration) {
+	access, refresh := c.AccessTokenLifetime, c.RefreshTokenLifetime
+	if access <= 0 {
+		access = defaultAccessTokenLifetime
+	}
+	if refresh <= 0 {
+		refresh = defaultRefreshTokenLifetime
+	}
+
+	for _, spec := range c.AudienceLifetimes {
+		aud, audAccess, audRefresh, err := parseAudienceLifetime(spec)
+		if err != nil || aud != audience {
+			continue
+		}
+		access = audAccess
+		if audRefresh > 0 {
+			refresh = audRefresh
+		}
+	}
+	return access, refresh
+}
+
+// LoginCodeMaxAttempts returns number of attempts to enter passwordless login code invalidating the login
+func (c Config) LoginCodeMaxAttempts() int {
+	if c.LoginCodeAttempts <= 0 {
+		return defaultLoginCodeAttempts
+	}
+	return c.LoginCodeAttempts
+}
+
+// RecoveryCodeLimits returns lifetimes of recovery and resetting codes and number of wrong attempts invalidating them
+func (c Config) RecoveryCodeLimits() (time.Duration, time.Duration, int) {
+	recovery, resetting, attempts := c.RecoveryCodeLifetime, c.ResettingCodeLifetime, c.RecoveryCodeAttempts
+	if recovery <= 0 {
+		recovery = defaultRecoveryCodeLifetime
+	}
+	if resetting <= 0 {
+		resetting = defaultResettingCodeLifetime
+	}
+	if attempts <= 0 {
+		attempts = defaultRecoveryCodeAttempts
+	}
+	return recovery, resetting, attempts
+}
+
+// MembershipClaims returns membership claims of access tokens for audience
+func (c Config) MembershipClaims(audience string) []string {
+	claims, _ := parseClaims(c.TokenClaims)
+	for _, spec := range c.AudienceClaims {
+		aud, audClaims, err := parseAudienceClaims(spec)
+		if err == nil && aud == audience {
+			claims = audClaims
+		}
+	}
+	return claims
+}
+
+// OpenIDProvider reports whether issuer can be published as OpenID Connect provider.
+// It has to be absolute https URL, plain http is allowed only for loopback hosts.
+func (c Config) OpenIDProvider() bool {
+	u, err := url.Parse(c.Issuer)
+	if err != nil || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		return u.Hostname() == "localhost" || net.ParseIP(u.Hostname()).IsLoopback()
+	}
+	return false
+}
+
+// DefaultLegacyTokensUntil returns the cutoff of tokens without iss and aud claims when it is not configured,
+// so tokens issued before the upgrade are accepted as long as they may live
+func (c Config) DefaultLegacyTokensUntil(now time.Time) string {
+	return now.Add(c.AccessTokenLifetime + c.RefreshTokenLifetime).UTC().Format(time.RFC3339)
+}
+
+// LegacyTokensAccepted reports whether tokens without iss and aud claims are still accepted at the time
+func (c Config) LegacyTokensAccepted(now time.Time) bool {
+	if c.LegacyTokensUntil == "" {
+		return false
+	}
+	until, err := time.Parse(time.RFC3339, c.LegacyTokensUntil)
+	return err == nil && now.Before(until)
+}
+
+// AllowedAudience reports whether tokens can be issued for and accepted from audience
+func (c Config) AllowedAudience(audience string) bool {
+	if audience == c.Audience {
+		return true
+	}
+	for _, aud := range c.Audiences {
+		if aud == audience {
+			return true
+		}
+	}
+	for _, spec := range c.AudienceLifetimes {
+		if aud, _, _, err := parseAudienceLifetime(spec); err == nil && aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAudienceLifetime parses audience=access[,refresh] lifetime override
+func parseAudienceLifetime(spec string) (string, time.Duration, time.Duration, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", 0, 0, fmt.Errorf("Invalid audience lifetime %s, expected audience=access[,refresh]", spec)
+	}
+
+	durations := strings.SplitN(parts[1], ",", 2)
+	access, err := time.ParseDuration(durations[0])
+	if err != nil || access <= 0 {
+		return "", 0, 0, fmt.Errorf("Invalid access token lifetime in %s", spec)
+	}
+
+	var refresh time.Duration
+	if len(durations) == 2 {
+		refresh, err = time.ParseDuration(durations[1])
+		if err != nil || refresh <= 0 {
+			return "", 0, 0, fmt.Errorf("Invalid refresh token lifetime in %s", spec)
+		}
+	}
+	return parts[0], access, refresh, nil
+}
+
+// parseAudienceClaims parses audience=claim[,claim] claims override, empty list disables claims
+func parseAudienceClaims(spec string) (string, []string, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", nil, fmt.Errorf("Invalid audience claims %s, expected audience=claim[,claim]", spec)
+	}
+	claims, err := parseClaims(parts[1])
+	return parts[0], claims, err
+}
+
+// parseClaims parses comma separated membership claims
+func parseClaims(list string) ([]string, error) {
+	claims := []string{}
+	for _, claim := range strings.Split(list, ",") {
+		claim = strings.TrimSpace(claim)
+		switch claim {
+		case "":
+		case rolesClaim, groupsClaim, scopeClaim:
+			claims = append(claims, claim)
+		default:
+			return nil, fmt.Errorf("Unknown claim %s, expected roles, groups or scope", claim)
+		}
+	}
+	return claims, nil
+}
+
+// parseRealm parses name=privkey,pubkey[,adminID][,private] realm
+func parseRealm(spec string) (realmSpec, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || !realmNamePattern.MatchString(parts[0]) {
+		return realmSpec{}, fmt.Errorf("Invalid realm %s, expected name=privkey,pubkey[,adminID][,private] with lowercase name", spec)
+	}
+
+	options := strings.Split(parts[1], ",")
+	if len(options) < 2 || options[0] == "" || options[1] == "" {
+		return realmSpec{}, fmt.Errorf("Keys are required for realm %s", parts[0])
+	}
+
+	realm := realmSpec{Name: parts[0], PrivKeyPath: options[0], PubKeyPath: options[1]}
+	for _, option := range options[2:] {
+		if option == "private" {
+			realm.Private = true
+			continue
+		}
+		adminID, err := strconv.ParseInt(option, 10, 64)
+		if err != nil {
+			return realmSpec{}, fmt.Errorf("Invalid option %s of realm %s", option, parts[0])
+		}
+		realm.AdminID = adminID
+	}
+	return realm, nil
 }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_TokenLifetimes(t *testing.T) {
+	conf := Config{
+		AccessTokenLifetime:  10 * time.Minute,
+		RefreshTokenLifetime: 48 * time.Hour,
+		AudienceLifetimes:    []string{"mobile=5m,720h", "cli=1m"},
+	}
+
+	access, refresh := conf.TokenLifetimes("")
+	assert.Equal(t, 10*time.Minute, access)
+	assert.Equal(t, 48*time.Hour, refresh)
+
+	access, refresh = conf.TokenLifetimes("mobile")
+	assert.Equal(t, 5*time.Minute, access)
+	assert.Equal(t, 720*time.Hour, refresh)
+
+	access, refresh = conf.TokenLifetimes("cli")
+	assert.Equal(t, time.Minute, access)
+	assert.Equal(t, 48*time.Hour, refresh)
+
+	access, refresh = Config{}.TokenLifetimes("")
+	assert.Equal(t, defaultAccessTokenLifetime, access)
+	assert.Equal(t, defaultRefreshTokenLifetime, refresh)
+}
+
+func TestConfig_RecoveryCodeLimits(t *testing.T) {
+	conf := Config{RecoveryCodeLifetime: 5 * time.Minute, ResettingCodeLifetime: time.Hour, RecoveryCodeAttempts: 3}
+	recovery, resetting, attempts := conf.RecoveryCodeLimits()
+	assert.Equal(t, 5*time.Minute, recovery)
+	assert.Equal(t, time.Hour, resetting)
+	assert.Equal(t, 3, attempts)
+
+	recovery, resetting, attempts = Config{}.RecoveryCodeLimits()
+	assert.Equal(t, defaultRecoveryCodeLifetime, recovery)
+	assert.Equal(t, defaultResettingCodeLifetime, resetting)
+	assert.Equal(t, defaultRecoveryCodeAttempts, attempts)
+}
+
+func TestConfig_AllowedAudience(t *testing.T) {
+	conf := Config{Audience: "api", Audiences: []string{"web"}, AudienceLifetimes: []string{"mobile=5m"}}
+
+	assert.True(t, conf.AllowedAudience("api"))
+	assert.True(t, conf.AllowedAudience("web"))
+	assert.True(t, conf.AllowedAudience("mobile"))
+	assert.False(t, conf.AllowedAudience("other"))
+	assert.False(t, conf.AllowedAudience(""))
+}
+
+func TestConfig_MembershipClaims(t *testing.T) {
+	conf := Config{TokenClaims: "roles,groups,scope", AudienceClaims: []string{"web=roles, groups", "mobile="}}
+
+	assert.Equal(t, []string{"roles", "groups", "scope"}, conf.MembershipClaims("api"))
+	assert.Equal(t, []string{"roles", "groups"}, conf.MembershipClaims("web"))
+	assert.Equal(t, []string{}, conf.MembershipClaims("mobile"))
+	assert.Equal(t, []string{}, Config{}.MembershipClaims("api"))
+}
+
+func TestConfig_RealmConfig(t *testing.T) {
+	conf := Config{
+		PrivKeyPath:      "private.pem",
+		PubKeyPath:       "public.pem",
+		VerificationKeys: []string{"old.pem"},
+		AdminID:          42,
+		Issuer:           "https://auth.example.com/",
+		Realms:           []string{"mobile=mobile.pem,mobile.pub.pem,7,private"},
+	}
+
+	realm, err := conf.RealmConfig(conf.Realms[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "mobile", realm.Realm)
+	assert.Equal(t, "mobile.pem", realm.PrivKeyPath)
+	assert.Equal(t, "mobile.pub.pem", realm.PubKeyPath)
+	assert.Empty(t, realm.VerificationKeys)
+	assert.Empty(t, realm.Realms)
+	assert.Equal(t, int64(7), realm.AdminID)
+	assert.True(t, realm.Private)
+	assert.Equal(t, "https://auth.example.com/v1/realms/mobile", realm.Issuer)
+
+	realm, err = conf.RealmConfig("web=web.pem,web.pub.pem")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), realm.AdminID)
+	assert.False(t, realm.Private)
+
+	_, err = conf.RealmConfig("Web=web.pem,web.pub.pem")
+	assert.NotNil(t, err)
+	_, err = conf.RealmConfig("web=web.pem")
+	assert.NotNil(t, err)
+	_, err = conf.RealmConfig("web=web.pem,web.pub.pem,public")
+	assert.NotNil(t, err)
+}
+
+func TestConfig_Validate(t *testing.T) {
+	assert.Nil(t, Config{Realms: []string{"mobile=a.pem,b.pem", "web=c.pem,d.pem,1"}}.Validate())
+	assert.NotNil(t, Config{Realms: []string{"mobile=a.pem,b.pem", "mobile=c.pem,d.pem"}}.Validate())
+	assert.NotNil(t, Config{Realms: []string{"mobile"}}.Validate())
+	assert.Nil(t, Config{AudienceLifetimes: []string{"mobile=5m,720h"}}.Validate())
+	assert.Nil(t, Config{TokenClaims: "roles,scope", AudienceClaims: []string{"web=groups"}}.Validate())
+	assert.NotNil(t, Config{TokenClaims: "roles,email"}.Validate())
+	assert.NotNil(t, Config{AudienceClaims: []string{"groups"}}.Validate())
+	assert.NotNil(t, Config{AudienceClaims: []string{"web=permissions"}}.Validate())
+	assert.NotNil(t, Config{AudienceLifetimes: []string{"mobile"}}.Validate())
+	assert.NotNil(t, Config{AudienceLifetimes: []string{"mobile=soon"}}.Validate())
+	assert.NotNil(t, Config{AudienceLifetimes: []string{"mobile=5m,-1h"}}.Validate())
+	assert.Nil(t, Config{RateLimits: []string{"*=600/1m", "/password-recovery/*=10/1h,user"}}.Validate())
+	assert.Nil(t, Config{RateLimits: []string{""}}.Validate())
+	assert.NotNil(t, Config{RateLimits: []string{"/users=10"}}.Validate())
+	assert.Nil(t, Config{LegacyTokensUntil: "2021-06-01T00:00:00Z"}.Validate())
+	assert.NotNil(t, Config{LegacyTokensUntil: "June"}.Validate())
+	assert.Nil(t, Config{Issuer: "brightonum"}.Validate())
+	assert.Nil(t, Config{Issuer: "https://auth.example.com"}.Validate())
+	assert.NotNil(t, Config{Issuer: "http://auth.example.com"}.Validate())
+	assert.NotNil(t, Config{Issuer: "https://"}.Validate())
+}
+
+func TestConfig_DefaultLegacyTokensUntil(t *testing.T) {
+	conf := Config{AccessTokenLifetime: time.Hour, RefreshTokenLifetime: 24 * time.Hour}
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	conf.LegacyTokensUntil = conf.DefaultLegacyTokensUntil(now)
+	assert.Equal(t, "2021-06-02T01:00:00Z", conf.LegacyTokensUntil)
+	assert.True(t, conf.LegacyTokensAccepted(now.Add(25*time.Hour-time.Second)))
+	assert.False(t, conf.LegacyTokensAccepted(now.Add(25*time.Hour)))
+}
+
+func TestConfig_OpenIDProvider(t *testing.T) {
+	assert.True(t, Config{Issuer: "https://auth.example.com"}.OpenIDProvider())
+	assert.True(t, Config{Issuer: "https://example.com/auth/"}.OpenIDProvider())
+	assert.True(t, Config{Issuer: "http://localhost:8080"}.OpenIDProvider())
+	assert.True(t, Config{Issuer: "http://127.0.0.1:8080"}.OpenIDProvider())
+	assert.False(t, Config{Issuer: ""}.OpenIDProvider())
+	assert.False(t, Config{Issuer: "brightonum"}.OpenIDProvider())
+	assert.False(t, Config{Issuer: "http://auth.example.com"}.OpenIDProvider())
+	assert.False(t, Config{Issuer: "https://auth.example.com?realm=1"}.OpenIDProvider())
+}
@@ -1,6 +1,14 @@
 package crypto
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -22,3 +30,42 @@ func Match(password, hash string) bool {
 	}
 	return true
 }
+
+// Encrypt encrypts value with AES-GCM using key derived from the passphrase,
+// returning base64 encoded nonce and ciphertext
+func Encrypt(value []byte, passphrase string) (string, error) {
+	gcm, err := newGCM(passphrase)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, value, nil)), nil
+}
+
+// Decrypt decrypts value encrypted by Encrypt with the same passphrase
+func Decrypt(encrypted string, passphrase string) ([]byte, error) {
+	gcm, err := newGCM(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("Encrypted value is too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+func newGCM(passphrase string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(passphrase))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
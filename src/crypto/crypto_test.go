@@ -19,3 +19,23 @@ func TestCrypto(t *testing.T) {
 	matchFail := Match(wrongPassword, hash)
 	assert.False(t, matchFail)
 }
+
+func TestEncrypt(t *testing.T) {
+	value := []byte("12345678901234567890")
+	encrypted, err := Encrypt(value, "secret")
+	assert.Nil(t, err)
+	assert.NotContains(t, encrypted, string(value))
+
+	other, _ := Encrypt(value, "secret")
+	assert.NotEqual(t, encrypted, other)
+
+	decrypted, err := Decrypt(encrypted, "secret")
+	assert.Nil(t, err)
+	assert.Equal(t, value, decrypted)
+
+	_, err = Decrypt(encrypted, "wrong")
+	assert.NotNil(t, err)
+
+	_, err = Decrypt("c2hvcnQ=", "secret")
+	assert.NotNil(t, err)
+}
@@ -27,14 +27,14 @@ type UserDao interface {
 	// Update updates user if exists
 	Update(*structs.User) error
 
-	// SetRecoveryCode sets password recovery code for user id
-	SetRecoveryCode(int64, string) error
+	// SetRecoveryCode sets password recovery code and its issue Unix time for user id, resets wrong attempts
+	SetRecoveryCode(int64, string, int64) error
 
 	// GetRecoveryCode extracts recovery code for user id
 	GetRecoveryCode(int64) (string, error)
 
-	// SetResettingCode sets resetting code and removes recovery one
-	SetResettingCode(int64, string) error
+	// SetResettingCode sets resetting code and its issue Unix time, removes recovery one and resets wrong attempts
+	SetResettingCode(int64, string, int64) error
 
 	// GetResettingCode extracts resetting code for user id
 	GetResettingCode(int64) (string, error)
@@ -42,6 +42,228 @@ type UserDao interface {
 	// ResetPassword updates password and removes resetting code
 	ResetPassword(int64, string) error
 
+	// AddRecoveryAttempt atomically counts attempt to use pending recovery or resetting code of user id
+	// Returns number of attempts
+	AddRecoveryAttempt(int64) (int64, error)
+
+	// InvalidateRecoveryCodes removes recovery and resetting codes of user id
+	InvalidateRecoveryCodes(int64) error
+
+	// SetAccess replaces roles and permissions of user id
+	SetAccess(int64, []string, []string) error
+
+	// SetTOTP sets encrypted TOTP secret and whether it is confirmed
+	SetTOTP(int64, string, bool) error
+
+	// UseTOTPCounter stores time step of accepted TOTP code of user id
+	// Returns false when the same or later step has been already used
+	UseTOTPCounter(int64, int64) (bool, error)
+
+	// SetLoginCode sets hash of passwordless login code, id of login link and their expiration for user id
+	SetLoginCode(int64, string, string, int64) error
+
+	// AddLoginCodeAttempt atomically counts attempt to use code of passwordless login of user id with the given link id
+	// Returns number of attempts, 0 when the login has been already used or replaced
+	AddLoginCodeAttempt(int64, string) (int64, error)
+
+	// ConsumeLoginCode clears passwordless login of user id if it has the given link id
+	// Returns false when it has been already used or replaced
+	ConsumeLoginCode(int64, string) (bool, error)
+
+	// SetBackupCodes replaces hashes of backup codes of user id
+	SetBackupCodes(int64, []string) error
+
+	// UseBackupCode removes hash of used backup code of user id
+	// Returns false when the code has been already used
+	UseBackupCode(int64, string) (bool, error)
+
 	// DeleteById deletes user by id
 	DeleteById(int64) error
 }
+
+// RoleDao provides interface to persisting roles
+type RoleDao interface {
+
+	// SaveRole creates role or replaces permissions of existing one
+	SaveRole(*structs.Role) error
+
+	// GetRole returns nil when role is not found
+	// Returns error if data access error occured
+	GetRole(string) (*structs.Role, error)
+
+	// GetRoles returns all roles or empty list
+	GetRoles() (*[]structs.Role, error)
+
+	// DeleteRole deletes role by name
+	DeleteRole(string) error
+}
+
+// RefreshTokenDao provides interface to persisting refresh token families
+type RefreshTokenDao interface {
+
+	// SaveRefreshToken saves newly issued refresh token
+	SaveRefreshToken(*structs.RefreshToken) error
+
+	// GetRefreshToken returns nil when token is not found
+	// Returns error if data access error occured
+	GetRefreshToken(string) (*structs.RefreshToken, error)
+
+	// MarkRefreshTokenUsed marks token with given id as used.
+	// Returns false if token has been used already.
+	MarkRefreshTokenUsed(string) (bool, error)
+
+	// RevokeRefreshTokenFamily revokes all tokens of the family
+	RevokeRefreshTokenFamily(string) error
+
+	// PruneRefreshTokens removes tokens expired before given Unix time.
+	// Returns number of removed tokens.
+	PruneRefreshTokens(int64) (int64, error)
+}
+
+// RevocationDao provides interface to persisting revoked token ids
+type RevocationDao interface {
+
+	// Revoke saves token id as revoked until given Unix time
+	Revoke(string, int64) error
+
+	// IsRevoked returns true if token id has been revoked
+	IsRevoked(string) (bool, error)
+
+	// PruneRevoked removes entries expired before given Unix time.
+	// Returns number of removed entries.
+	PruneRevoked(int64) (int64, error)
+}
+
+// GroupDao provides interface to persisting groups and their membership
+type GroupDao interface {
+
+	// SaveGroup saves new group
+	SaveGroup(*structs.Group) error
+
+	// UpdateGroup replaces name and roles of group
+	UpdateGroup(*structs.Group) error
+
+	// GetGroup returns nil when group is not found
+	// Returns error if data access error occured
+	GetGroup(string) (*structs.Group, error)
+
+	// GetGroups returns all groups or empty list
+	GetGroups() (*[]structs.Group, error)
+
+	// DeleteGroup deletes group and removes it from groups of its members
+	DeleteGroup(string) error
+
+	// AddGroupMember adds group id to groups of user id
+	AddGroupMember(string, int64) error
+
+	// RemoveGroupMember removes group id from groups of user id
+	RemoveGroupMember(string, int64) error
+
+	// GetGroupMembers returns users which are members of group id or empty list
+	GetGroupMembers(string) (*[]structs.User, error)
+}
+
+// ClientDao provides interface to persisting registered OAuth clients
+type ClientDao interface {
+
+	// SaveClient saves new client
+	SaveClient(*structs.Client) error
+
+	// GetClient returns nil when client is not found
+	// Returns error if data access error occured
+	GetClient(string) (*structs.Client, error)
+
+	// GetClients returns all clients or empty list
+	GetClients() (*[]structs.Client, error)
+
+	// DeleteClient deletes client by id
+	DeleteClient(string) error
+}
+
+// AuthorizationCodeDao provides interface to persisting OAuth authorization codes
+type AuthorizationCodeDao interface {
+
+	// SaveAuthorizationCode saves newly issued code
+	SaveAuthorizationCode(*structs.AuthorizationCode) error
+
+	// ConsumeAuthorizationCode removes code with given id and returns it.
+	// Returns nil when code is not found or has been consumed already.
+	ConsumeAuthorizationCode(string) (*structs.AuthorizationCode, error)
+
+	// PruneAuthorizationCodes removes codes expired before given Unix time.
+	// Returns number of removed codes.
+	PruneAuthorizationCodes(int64) (int64, error)
+}
+
+// DeviceAuthorizationDao provides interface to persisting pending device authorizations
+type DeviceAuthorizationDao interface {
+
+	// SaveDeviceAuthorization saves new device authorization
+	SaveDeviceAuthorization(*structs.DeviceAuthorization) error
+
+	// GetDeviceAuthorizationByUserCode returns nil when authorization is not found
+	// Returns error if data access error occured
+	GetDeviceAuthorizationByUserCode(string) (*structs.DeviceAuthorization, error)
+
+	// SetDeviceAuthorizationStatus sets status and user of pending authorization.
+	// Returns false if authorization is not pending anymore.
+	SetDeviceAuthorizationStatus(string, string, int64) (bool, error)
+
+	// PollDeviceAuthorization sets last polling Unix time and returns authorization as it was before.
+	// Returns nil when authorization is not found.
+	PollDeviceAuthorization(string, int64) (*structs.DeviceAuthorization, error)
+
+	// DeleteDeviceAuthorization deletes authorization by id.
+	// Returns false if it has been deleted already.
+	DeleteDeviceAuthorization(string) (bool, error)
+
+	// PruneDeviceAuthorizations removes authorizations expired before given Unix time.
+	// Returns number of removed authorizations.
+	PruneDeviceAuthorizations(int64) (int64, error)
+}
+
+// WebAuthnDao provides interface to persisting WebAuthn credentials of users
+type WebAuthnDao interface {
+
+	// SaveWebAuthnCredential saves newly registered credential
+	SaveWebAuthnCredential(*structs.WebAuthnCredential) error
+
+	// GetWebAuthnCredential returns nil when credential is not found
+	// Returns error if data access error occured
+	GetWebAuthnCredential(string) (*structs.WebAuthnCredential, error)
+
+	// GetWebAuthnCredentials returns credentials of user id or empty list
+	GetWebAuthnCredentials(int64) (*[]structs.WebAuthnCredential, error)
+
+	// SetWebAuthnSignCount replaces sign count of credential if it still has the given previous value
+	// Returns false when it has been changed concurrently
+	SetWebAuthnSignCount(string, int64, int64) (bool, error)
+
+	// DeleteWebAuthnCredential deletes credential by id
+	DeleteWebAuthnCredential(string) error
+}
+
+// LoginAttemptDao provides interface to persisting failed password attempts
+type LoginAttemptDao interface {
+
+	// GetLoginAttempts returns nil when there are no attempts for the key
+	// Returns error if data access error occured
+	GetLoginAttempts(string) (*structs.LoginAttempts, error)
+
+	// AddLoginFailure atomically increments failures of the key and sets their expiration Unix time
+	// Returns attempts after the increment
+	AddLoginFailure(string, int64) (*structs.LoginAttempts, error)
+
+	// ReleaseLoginAttempt atomically decrements failures of the key, so successful attempt counted in advance is forgotten
+	ReleaseLoginAttempt(string) error
+
+	// SetLoginLockout sets Unix time the key is locked until
+	SetLoginLockout(string, int64) error
+
+	// DeleteLoginAttempts forgets attempts and lockout of the key
+	DeleteLoginAttempts(string) error
+
+	// PruneLoginAttempts removes attempts expired and unlocked before given Unix time.
+	// Returns number of removed entries.
+	PruneLoginAttempts(int64) (int64, error)
+}
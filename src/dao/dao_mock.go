@@ -76,8 +76,8 @@ func (m *MockUserDao) Update(u *structs.User) error {
 	return castedErr
 }
 
-func (m *MockUserDao) SetRecoveryCode(id int64, code string) error {
-	err := m.Called(id, code).Get(0)
+func (m *MockUserDao) SetRecoveryCode(id int64, code string, issuedAt int64) error {
+	err := m.Called(id, code, issuedAt).Get(0)
 	var castedErr error = nil
 	if err != nil {
 		castedErr = err.(error)
@@ -90,8 +90,8 @@ func (m *MockUserDao) GetRecoveryCode(id int64) (string, error) {
 	return args.String(0), args.Error(1)
 }
 
-func (m *MockUserDao) SetResettingCode(id int64, code string) error {
-	return m.Called(id, code).Error(0)
+func (m *MockUserDao) SetResettingCode(id int64, code string, issuedAt int64) error {
+	return m.Called(id, code, issuedAt).Error(0)
 }
 
 func (m *MockUserDao) GetResettingCode(id int64) (string, error) {
@@ -103,6 +103,356 @@ func (m *MockUserDao) ResetPassword(id int64, passwordHash string) error {
 	return m.Called(id, passwordHash).Error(0)
 }
 
+func (m *MockUserDao) AddRecoveryAttempt(id int64) (int64, error) {
+	args := m.Called(id)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *MockUserDao) InvalidateRecoveryCodes(id int64) error {
+	return m.Called(id).Error(0)
+}
+
+func (m *MockUserDao) SetAccess(id int64, roles []string, permissions []string) error {
+	return m.Called(id, roles, permissions).Error(0)
+}
+
+func (m *MockUserDao) SetTOTP(id int64, secret string, enabled bool) error {
+	return m.Called(id, secret, enabled).Error(0)
+}
+
+func (m *MockUserDao) UseTOTPCounter(id int64, counter int64) (bool, error) {
+	args := m.Called(id, counter)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockUserDao) SetLoginCode(id int64, codeHash string, nonce string, expiresAt int64) error {
+	return m.Called(id, codeHash, nonce, expiresAt).Error(0)
+}
+
+func (m *MockUserDao) AddLoginCodeAttempt(id int64, nonce string) (int64, error) {
+	args := m.Called(id, nonce)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *MockUserDao) ConsumeLoginCode(id int64, nonce string) (bool, error) {
+	args := m.Called(id, nonce)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockUserDao) SetBackupCodes(id int64, hashes []string) error {
+	return m.Called(id, hashes).Error(0)
+}
+
+func (m *MockUserDao) UseBackupCode(id int64, hash string) (bool, error) {
+	args := m.Called(id, hash)
+	return args.Bool(0), args.Error(1)
+}
+
 func (m *MockUserDao) DeleteById(id int64) error {
 	return m.Called(id).Error(0)
 }
+
+// MockRoleDao for testing only
+type MockRoleDao struct {
+	mock.Mock
+}
+
+func (m *MockRoleDao) SaveRole(r *structs.Role) error {
+	return m.Called(r).Error(0)
+}
+
+func (m *MockRoleDao) GetRole(name string) (*structs.Role, error) {
+	args := m.Called(name)
+	provided := args.Get(0)
+	if provided == nil {
+		return nil, args.Error(1)
+	}
+	return provided.(*structs.Role), args.Error(1)
+}
+
+func (m *MockRoleDao) GetRoles() (*[]structs.Role, error) {
+	args := m.Called()
+	provided := args.Get(0)
+	if provided == nil {
+		return nil, args.Error(1)
+	}
+	return provided.(*[]structs.Role), args.Error(1)
+}
+
+func (m *MockRoleDao) DeleteRole(name string) error {
+	return m.Called(name).Error(0)
+}
+
+// MockRefreshTokenDao for testing only
+type MockRefreshTokenDao struct {
+	mock.Mock
+}
+
+func (m *MockRefreshTokenDao) SaveRefreshToken(t *structs.RefreshToken) error {
+	return m.Called(t).Error(0)
+}
+
+func (m *MockRefreshTokenDao) GetRefreshToken(id string) (*structs.RefreshToken, error) {
+	args := m.Called(id)
+	provided := args.Get(0)
+	if provided == nil {
+		return nil, args.Error(1)
+	}
+	return provided.(*structs.RefreshToken), args.Error(1)
+}
+
+func (m *MockRefreshTokenDao) MarkRefreshTokenUsed(id string) (bool, error) {
+	args := m.Called(id)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockRefreshTokenDao) RevokeRefreshTokenFamily(family string) error {
+	return m.Called(family).Error(0)
+}
+
+func (m *MockRefreshTokenDao) PruneRefreshTokens(before int64) (int64, error) {
+	args := m.Called(before)
+	return int64(args.Int(0)), args.Error(1)
+}
+
+// MockRevocationDao for testing only
+type MockRevocationDao struct {
+	mock.Mock
+}
+
+func (m *MockRevocationDao) Revoke(id string, expiresAt int64) error {
+	return m.Called(id, expiresAt).Error(0)
+}
+
+func (m *MockRevocationDao) IsRevoked(id string) (bool, error) {
+	args := m.Called(id)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockRevocationDao) PruneRevoked(before int64) (int64, error) {
+	args := m.Called(before)
+	return int64(args.Int(0)), args.Error(1)
+}
+
+// MockClientDao for testing only
+type MockClientDao struct {
+	mock.Mock
+}
+
+func (m *MockClientDao) SaveClient(c *structs.Client) error {
+	return m.Called(c).Error(0)
+}
+
+func (m *MockClientDao) GetClient(id string) (*structs.Client, error) {
+	args := m.Called(id)
+	provided := args.Get(0)
+	if provided == nil {
+		return nil, args.Error(1)
+	}
+	return provided.(*structs.Client), args.Error(1)
+}
+
+func (m *MockClientDao) GetClients() (*[]structs.Client, error) {
+	args := m.Called()
+	provided := args.Get(0)
+	if provided == nil {
+		return nil, args.Error(1)
+	}
+	return provided.(*[]structs.Client), args.Error(1)
+}
+
+func (m *MockClientDao) DeleteClient(id string) error {
+	return m.Called(id).Error(0)
+}
+
+// MockAuthorizationCodeDao for testing only
+type MockAuthorizationCodeDao struct {
+	mock.Mock
+}
+
+func (m *MockAuthorizationCodeDao) SaveAuthorizationCode(c *structs.AuthorizationCode) error {
+	return m.Called(c).Error(0)
+}
+
+func (m *MockAuthorizationCodeDao) ConsumeAuthorizationCode(id string) (*structs.AuthorizationCode, error) {
+	args := m.Called(id)
+	provided := args.Get(0)
+	if provided == nil {
+		return nil, args.Error(1)
+	}
+	return provided.(*structs.AuthorizationCode), args.Error(1)
+}
+
+func (m *MockAuthorizationCodeDao) PruneAuthorizationCodes(before int64) (int64, error) {
+	args := m.Called(before)
+	return int64(args.Int(0)), args.Error(1)
+}
+
+// MockDeviceAuthorizationDao for testing only
+type MockDeviceAuthorizationDao struct {
+	mock.Mock
+}
+
+func (m *MockDeviceAuthorizationDao) SaveDeviceAuthorization(d *structs.DeviceAuthorization) error {
+	return m.Called(d).Error(0)
+}
+
+func (m *MockDeviceAuthorizationDao) GetDeviceAuthorizationByUserCode(userCode string) (*structs.DeviceAuthorization, error) {
+	args := m.Called(userCode)
+	provided := args.Get(0)
+	if provided == nil {
+		return nil, args.Error(1)
+	}
+	return provided.(*structs.DeviceAuthorization), args.Error(1)
+}
+
+func (m *MockDeviceAuthorizationDao) SetDeviceAuthorizationStatus(id string, status string, userID int64) (bool, error) {
+	args := m.Called(id, status, userID)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockDeviceAuthorizationDao) PollDeviceAuthorization(id string, polledAt int64) (*structs.DeviceAuthorization, error) {
+	args := m.Called(id, polledAt)
+	provided := args.Get(0)
+	if provided == nil {
+		return nil, args.Error(1)
+	}
+	return provided.(*structs.DeviceAuthorization), args.Error(1)
+}
+
+func (m *MockDeviceAuthorizationDao) DeleteDeviceAuthorization(id string) (bool, error) {
+	args := m.Called(id)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockDeviceAuthorizationDao) PruneDeviceAuthorizations(before int64) (int64, error) {
+	args := m.Called(before)
+	return int64(args.Int(0)), args.Error(1)
+}
+
+// MockGroupDao for testing only
+type MockGroupDao struct {
+	mock.Mock
+}
+
+func (m *MockGroupDao) SaveGroup(g *structs.Group) error {
+	return m.Called(g).Error(0)
+}
+
+func (m *MockGroupDao) UpdateGroup(g *structs.Group) error {
+	return m.Called(g).Error(0)
+}
+
+func (m *MockGroupDao) GetGroup(id string) (*structs.Group, error) {
+	args := m.Called(id)
+	provided := args.Get(0)
+	if provided == nil {
+		return nil, args.Error(1)
+	}
+	return provided.(*structs.Group), args.Error(1)
+}
+
+func (m *MockGroupDao) GetGroups() (*[]structs.Group, error) {
+	args := m.Called()
+	provided := args.Get(0)
+	if provided == nil {
+		return nil, args.Error(1)
+	}
+	return provided.(*[]structs.Group), args.Error(1)
+}
+
+func (m *MockGroupDao) DeleteGroup(id string) error {
+	return m.Called(id).Error(0)
+}
+
+func (m *MockGroupDao) AddGroupMember(id string, userID int64) error {
+	return m.Called(id, userID).Error(0)
+}
+
+func (m *MockGroupDao) RemoveGroupMember(id string, userID int64) error {
+	return m.Called(id, userID).Error(0)
+}
+
+func (m *MockGroupDao) GetGroupMembers(id string) (*[]structs.User, error) {
+	args := m.Called(id)
+	provided := args.Get(0)
+	if provided == nil {
+		return nil, args.Error(1)
+	}
+	return provided.(*[]structs.User), args.Error(1)
+}
+
+// MockWebAuthnDao for testing only
+type MockWebAuthnDao struct {
+	mock.Mock
+}
+
+func (m *MockWebAuthnDao) SaveWebAuthnCredential(c *structs.WebAuthnCredential) error {
+	return m.Called(c).Error(0)
+}
+
+func (m *MockWebAuthnDao) GetWebAuthnCredential(id string) (*structs.WebAuthnCredential, error) {
+	args := m.Called(id)
+	provided := args.Get(0)
+	if provided == nil {
+		return nil, args.Error(1)
+	}
+	return provided.(*structs.WebAuthnCredential), args.Error(1)
+}
+
+func (m *MockWebAuthnDao) GetWebAuthnCredentials(userID int64) (*[]structs.WebAuthnCredential, error) {
+	args := m.Called(userID)
+	provided := args.Get(0)
+	if provided == nil {
+		return nil, args.Error(1)
+	}
+	return provided.(*[]structs.WebAuthnCredential), args.Error(1)
+}
+
+func (m *MockWebAuthnDao) SetWebAuthnSignCount(id string, prev int64, count int64) (bool, error) {
+	args := m.Called(id, prev, count)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockWebAuthnDao) DeleteWebAuthnCredential(id string) error {
+	return m.Called(id).Error(0)
+}
+
+type MockLoginAttemptDao struct {
+	mock.Mock
+}
+
+func (m *MockLoginAttemptDao) GetLoginAttempts(key string) (*structs.LoginAttempts, error) {
+	args := m.Called(key)
+	provided := args.Get(0)
+	if provided == nil {
+		return nil, args.Error(1)
+	}
+	return provided.(*structs.LoginAttempts), args.Error(1)
+}
+
+func (m *MockLoginAttemptDao) AddLoginFailure(key string, expiresAt int64) (*structs.LoginAttempts, error) {
+	args := m.Called(key, expiresAt)
+	provided := args.Get(0)
+	if provided == nil {
+		return nil, args.Error(1)
+	}
+	return provided.(*structs.LoginAttempts), args.Error(1)
+}
+
+func (m *MockLoginAttemptDao) ReleaseLoginAttempt(key string) error {
+	return m.Called(key).Error(0)
+}
+
+func (m *MockLoginAttemptDao) SetLoginLockout(key string, lockedUntil int64) error {
+	return m.Called(key, lockedUntil).Error(0)
+}
+
+func (m *MockLoginAttemptDao) DeleteLoginAttempts(key string) error {
+	return m.Called(key).Error(0)
+}
+
+func (m *MockLoginAttemptDao) PruneLoginAttempts(before int64) (int64, error) {
+	args := m.Called(before)
+	return args.Get(0).(int64), args.Error(1)
+}
@@ -45,7 +45,7 @@ func NewMongoUserDao(URL string, databaseName string) *MongoUserDao {
 	}
 	logger.Logf("INFO Connected to MongoDB")
 
-	sigChan := make(chan os.Signal)
+	sigChan := make(chan os.Signal, 1)
 	go func() {
 		for range sigChan {
 			logger.Logf("INFO disconnecting from MongoDB")
@@ -227,9 +227,9 @@ func (d *MongoUserDao) Update(u *s.User) error {
 	return err
 }
 
-// SetRecoveryCode sets password recovery code for user id
-func (d *MongoUserDao) SetRecoveryCode(id int64, code string) error {
-	return d.setFieldAndWipeOtherForId(id, "recoveryCode", code, "resettingCode")
+// SetRecoveryCode sets password recovery code and its issue time for user id
+func (d *MongoUserDao) SetRecoveryCode(id int64, code string, issuedAt int64) error {
+	return d.setCodeAndWipeOtherForId(id, "recoveryCode", code, "resettingCode", issuedAt)
 }
 
 // GetRecoveryCode extracts recovery code for user id
@@ -237,9 +237,9 @@ func (d *MongoUserDao) GetRecoveryCode(id int64) (string, error) {
 	return d.getStringFieldForId(id, "recoveryCode")
 }
 
-// SetResettingCode sets resetting code and removes recovery one
-func (d *MongoUserDao) SetResettingCode(id int64, code string) error {
-	return d.setFieldAndWipeOtherForId(id, "resettingCode", code, "recoveryCode")
+// SetResettingCode sets resetting code and its issue time, removes recovery one
+func (d *MongoUserDao) SetResettingCode(id int64, code string, issuedAt int64) error {
+	return d.setCodeAndWipeOtherForId(id, "resettingCode", code, "recoveryCode", issuedAt)
 }
 
 // GetResettingCode extracts resetting code for user id
@@ -252,6 +252,106 @@ func (d *MongoUserDao) ResetPassword(id int64, passwordHash string) error {
 	return d.setFieldAndWipeOtherForId(id, "password", passwordHash, "resettingCode")
 }
 
+// AddRecoveryAttempt atomically counts attempt to use pending recovery or resetting code
+func (d *MongoUserDao) AddRecoveryAttempt(id int64) (int64, error) {
+	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
+
+	var result s.User
+	opt := options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"recoveryAttempts": 1})
+	err := collection.FindOneAndUpdate(d.Ctx, bson.M{"_id": id}, bson.M{"$inc": bson.M{"recoveryAttempts": 1}}, opt).Decode(&result)
+	if err != nil {
+		return 0, err
+	}
+	return result.RecoveryAttempts, nil
+}
+
+// InvalidateRecoveryCodes removes recovery and resetting codes
+func (d *MongoUserDao) InvalidateRecoveryCodes(id int64) error {
+	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
+	_, err := collection.UpdateOne(d.Ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"recoveryCode": "", "resettingCode": ""}})
+	return err
+}
+
+// SetAccess replaces roles and permissions of user id
+func (d *MongoUserDao) SetAccess(id int64, roles []string, permissions []string) error {
+	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
+	_, err := collection.UpdateOne(d.Ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"roles": roles, "permissions": permissions}})
+	return err
+}
+
+// SetTOTP sets encrypted TOTP secret and whether it is confirmed
+func (d *MongoUserDao) SetTOTP(id int64, secret string, enabled bool) error {
+	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
+	_, err := collection.UpdateOne(d.Ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"totpSecret": secret, "totpEnabled": enabled}})
+	return err
+}
+
+// UseTOTPCounter stores time step of accepted TOTP code unless the same or later step has been used
+func (d *MongoUserDao) UseTOTPCounter(id int64, counter int64) (bool, error) {
+	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
+	filter := bson.M{"_id": id, "$or": bson.A{
+		bson.M{"totpCounter": bson.M{"$lt": counter}},
+		bson.M{"totpCounter": bson.M{"$exists": false}},
+	}}
+	res, err := collection.UpdateOne(d.Ctx, filter, bson.M{"$set": bson.M{"totpCounter": counter}})
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+// SetLoginCode sets hash of passwordless login code, id of login link and their expiration
+func (d *MongoUserDao) SetLoginCode(id int64, codeHash string, nonce string, expiresAt int64) error {
+	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
+	update := bson.M{"loginCode": codeHash, "loginNonce": nonce, "loginExpiresAt": expiresAt, "loginAttempts": 0}
+	_, err := collection.UpdateOne(d.Ctx, bson.M{"_id": id}, bson.M{"$set": update})
+	return err
+}
+
+// AddLoginCodeAttempt atomically counts attempt to use passwordless login code, returns 0 when login has been already used
+func (d *MongoUserDao) AddLoginCodeAttempt(id int64, nonce string) (int64, error) {
+	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
+
+	var result s.User
+	opt := options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"loginAttempts": 1})
+	err := collection.FindOneAndUpdate(d.Ctx, bson.M{"_id": id, "loginNonce": nonce}, bson.M{"$inc": bson.M{"loginAttempts": 1}}, opt).Decode(&result)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return result.LoginAttempts, nil
+}
+
+// ConsumeLoginCode clears passwordless login if it has the given link id, returns false when it has been already used
+func (d *MongoUserDao) ConsumeLoginCode(id int64, nonce string) (bool, error) {
+	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
+	update := bson.M{"loginCode": "", "loginNonce": "", "loginExpiresAt": 0, "loginAttempts": 0}
+	res, err := collection.UpdateOne(d.Ctx, bson.M{"_id": id, "loginNonce": nonce}, bson.M{"$set": update})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+// SetBackupCodes replaces hashes of backup codes of user id
+func (d *MongoUserDao) SetBackupCodes(id int64, hashes []string) error {
+	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
+	_, err := collection.UpdateOne(d.Ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"backupCodes": hashes}})
+	return err
+}
+
+// UseBackupCode removes hash of used backup code, returns false when it has been already removed
+func (d *MongoUserDao) UseBackupCode(id int64, hash string) (bool, error) {
+	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
+	res, err := collection.UpdateOne(d.Ctx, bson.M{"_id": id, "backupCodes": hash}, bson.M{"$pull": bson.M{"backupCodes": hash}})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
 // DeleteById deletes user by id
 func (d *MongoUserDao) DeleteById(id int64) error {
 	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
@@ -274,6 +374,15 @@ func (d *MongoUserDao) getStringFieldForId(id int64, field string) (string, erro
 	return result[field].(string), nil
 }
 
+func (d *MongoUserDao) setCodeAndWipeOtherForId(id int64, fieldToSet string, code string, fieldToWipe string, issuedAt int64) error {
+	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
+
+	updateBody := bson.M{fieldToSet: code, fieldToWipe: "", "recoveryIssuedAt": issuedAt, "recoveryAttempts": 0}
+
+	_, err := collection.UpdateOne(d.Ctx, bson.M{"_id": id}, bson.M{"$set": updateBody})
+	return err
+}
+
 func (d *MongoUserDao) setFieldAndWipeOtherForId(id int64, fieldToSet string, value string, fieldToWipe string) error {
 	collection := d.Client.Database(d.DatabaseName).Collection(collectionName)
 
@@ -0,0 +1,131 @@
+package dao
+
+import (
+	"context"
+
+	s "github.com/adderly/brightonum/src/structs"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const clientsCollectionName string = "clients"
+
+// MongoClientDao provides ClientDao implementation via MongoDB
+type MongoClientDao struct {
+	Client       *mongo.Client
+	DatabaseName string
+	Ctx          context.Context
+}
+
+// NewMongoClientDao creates instance of MongoClientDao sharing connection with user dao
+func NewMongoClientDao(d *MongoUserDao) *MongoClientDao {
+	return &MongoClientDao{Client: d.Client, DatabaseName: d.DatabaseName, Ctx: d.Ctx}
+}
+
+// SaveClient saves new client
+func (d *MongoClientDao) SaveClient(c *s.Client) error {
+	collection := d.Client.Database(d.DatabaseName).Collection(clientsCollectionName)
+	_, err := collection.InsertOne(d.Ctx, c)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// GetClient returns nil when client is not found
+func (d *MongoClientDao) GetClient(id string) (*s.Client, error) {
+	result := &s.Client{}
+
+	collection := d.Client.Database(d.DatabaseName).Collection(clientsCollectionName)
+	err := collection.FindOne(d.Ctx, bson.M{"_id": id}).Decode(result)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// GetClients returns all clients or empty list
+func (d *MongoClientDao) GetClients() (*[]s.Client, error) {
+	result := []s.Client{}
+
+	collection := d.Client.Database(d.DatabaseName).Collection(clientsCollectionName)
+	cursor, err := collection.Find(d.Ctx, bson.M{})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+	if err = cursor.All(d.Ctx, &result); err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// DeleteClient deletes client by id
+func (d *MongoClientDao) DeleteClient(id string) error {
+	collection := d.Client.Database(d.DatabaseName).Collection(clientsCollectionName)
+	_, err := collection.DeleteOne(d.Ctx, bson.M{"_id": id})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+const authorizationCodesCollectionName string = "authorizationCodes"
+
+// MongoAuthorizationCodeDao provides AuthorizationCodeDao implementation via MongoDB
+type MongoAuthorizationCodeDao struct {
+	Client       *mongo.Client
+	DatabaseName string
+	Ctx          context.Context
+}
+
+// NewMongoAuthorizationCodeDao creates instance of MongoAuthorizationCodeDao sharing connection with user dao
+func NewMongoAuthorizationCodeDao(d *MongoUserDao) *MongoAuthorizationCodeDao {
+	return &MongoAuthorizationCodeDao{Client: d.Client, DatabaseName: d.DatabaseName, Ctx: d.Ctx}
+}
+
+// SaveAuthorizationCode saves newly issued code
+func (d *MongoAuthorizationCodeDao) SaveAuthorizationCode(c *s.AuthorizationCode) error {
+	collection := d.Client.Database(d.DatabaseName).Collection(authorizationCodesCollectionName)
+	_, err := collection.InsertOne(d.Ctx, c)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// ConsumeAuthorizationCode atomically removes code and returns it, nil if it is not found
+func (d *MongoAuthorizationCodeDao) ConsumeAuthorizationCode(id string) (*s.AuthorizationCode, error) {
+	result := &s.AuthorizationCode{}
+
+	collection := d.Client.Database(d.DatabaseName).Collection(authorizationCodesCollectionName)
+	err := collection.FindOneAndDelete(d.Ctx, bson.M{"_id": id}).Decode(result)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// PruneAuthorizationCodes removes codes expired before given Unix time
+func (d *MongoAuthorizationCodeDao) PruneAuthorizationCodes(before int64) (int64, error) {
+	collection := d.Client.Database(d.DatabaseName).Collection(authorizationCodesCollectionName)
+	res, err := collection.DeleteMany(d.Ctx, bson.M{"expiresAt": bson.M{"$lt": before}})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
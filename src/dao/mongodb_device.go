@@ -0,0 +1,108 @@
+package dao
+
+import (
+	"context"
+
+	s "github.com/adderly/brightonum/src/structs"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const deviceAuthorizationsCollectionName string = "deviceAuthorizations"
+
+// MongoDeviceAuthorizationDao provides DeviceAuthorizationDao implementation via MongoDB
+type MongoDeviceAuthorizationDao struct {
+	Client       *mongo.Client
+	DatabaseName string
+	Ctx          context.Context
+}
+
+// NewMongoDeviceAuthorizationDao creates instance of MongoDeviceAuthorizationDao sharing connection with user dao
+func NewMongoDeviceAuthorizationDao(d *MongoUserDao) *MongoDeviceAuthorizationDao {
+	return &MongoDeviceAuthorizationDao{Client: d.Client, DatabaseName: d.DatabaseName, Ctx: d.Ctx}
+}
+
+// SaveDeviceAuthorization saves new device authorization
+func (d *MongoDeviceAuthorizationDao) SaveDeviceAuthorization(a *s.DeviceAuthorization) error {
+	collection := d.Client.Database(d.DatabaseName).Collection(deviceAuthorizationsCollectionName)
+	_, err := collection.InsertOne(d.Ctx, a)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// GetDeviceAuthorizationByUserCode returns nil when authorization is not found
+func (d *MongoDeviceAuthorizationDao) GetDeviceAuthorizationByUserCode(userCode string) (*s.DeviceAuthorization, error) {
+	return d.findOne(bson.M{"userCode": userCode})
+}
+
+// SetDeviceAuthorizationStatus sets status of pending authorization, returns false if it is not pending
+func (d *MongoDeviceAuthorizationDao) SetDeviceAuthorizationStatus(id string, status string, userID int64) (bool, error) {
+	collection := d.Client.Database(d.DatabaseName).Collection(deviceAuthorizationsCollectionName)
+	res, err := collection.UpdateOne(
+		d.Ctx,
+		bson.M{"_id": id, "status": s.DeviceAuthorizationPending},
+		bson.M{"$set": bson.M{"status": status, "userId": userID}})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+// PollDeviceAuthorization sets last polling time and returns authorization as it was before
+func (d *MongoDeviceAuthorizationDao) PollDeviceAuthorization(id string, polledAt int64) (*s.DeviceAuthorization, error) {
+	result := &s.DeviceAuthorization{}
+
+	collection := d.Client.Database(d.DatabaseName).Collection(deviceAuthorizationsCollectionName)
+	err := collection.FindOneAndUpdate(d.Ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"lastPolledAt": polledAt}}).Decode(result)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// DeleteDeviceAuthorization deletes authorization, returns false if it has been deleted already
+func (d *MongoDeviceAuthorizationDao) DeleteDeviceAuthorization(id string) (bool, error) {
+	collection := d.Client.Database(d.DatabaseName).Collection(deviceAuthorizationsCollectionName)
+	res, err := collection.DeleteOne(d.Ctx, bson.M{"_id": id})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return false, err
+	}
+	return res.DeletedCount == 1, nil
+}
+
+// PruneDeviceAuthorizations removes authorizations expired before given Unix time
+func (d *MongoDeviceAuthorizationDao) PruneDeviceAuthorizations(before int64) (int64, error) {
+	collection := d.Client.Database(d.DatabaseName).Collection(deviceAuthorizationsCollectionName)
+	res, err := collection.DeleteMany(d.Ctx, bson.M{"expiresAt": bson.M{"$lt": before}})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+func (d *MongoDeviceAuthorizationDao) findOne(filter bson.M) (*s.DeviceAuthorization, error) {
+	result := &s.DeviceAuthorization{}
+
+	collection := d.Client.Database(d.DatabaseName).Collection(deviceAuthorizationsCollectionName)
+	err := collection.FindOne(d.Ctx, filter).Decode(result)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+
+	return result, nil
+}
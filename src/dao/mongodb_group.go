@@ -0,0 +1,134 @@
+package dao
+
+import (
+	"context"
+
+	s "github.com/adderly/brightonum/src/structs"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const groupsCollectionName string = "groups"
+
+// MongoGroupDao provides GroupDao implementation via MongoDB, membership is stored in users collection
+type MongoGroupDao struct {
+	Client       *mongo.Client
+	DatabaseName string
+	Ctx          context.Context
+}
+
+// NewMongoGroupDao creates instance of MongoGroupDao sharing connection with user dao
+func NewMongoGroupDao(d *MongoUserDao) *MongoGroupDao {
+	return &MongoGroupDao{Client: d.Client, DatabaseName: d.DatabaseName, Ctx: d.Ctx}
+}
+
+// SaveGroup saves new group
+func (d *MongoGroupDao) SaveGroup(g *s.Group) error {
+	collection := d.Client.Database(d.DatabaseName).Collection(groupsCollectionName)
+	_, err := collection.InsertOne(d.Ctx, g)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// UpdateGroup replaces name and roles of group
+func (d *MongoGroupDao) UpdateGroup(g *s.Group) error {
+	collection := d.Client.Database(d.DatabaseName).Collection(groupsCollectionName)
+	_, err := collection.UpdateOne(d.Ctx, bson.M{"_id": g.ID}, bson.M{"$set": bson.M{"name": g.Name, "roles": g.Roles}})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// GetGroup returns nil when group is not found
+func (d *MongoGroupDao) GetGroup(id string) (*s.Group, error) {
+	result := &s.Group{}
+
+	collection := d.Client.Database(d.DatabaseName).Collection(groupsCollectionName)
+	err := collection.FindOne(d.Ctx, bson.M{"_id": id}).Decode(result)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// GetGroups returns all groups or empty list
+func (d *MongoGroupDao) GetGroups() (*[]s.Group, error) {
+	result := []s.Group{}
+
+	collection := d.Client.Database(d.DatabaseName).Collection(groupsCollectionName)
+	cursor, err := collection.Find(d.Ctx, bson.M{})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+	if err = cursor.All(d.Ctx, &result); err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// DeleteGroup deletes group and removes it from groups of its members
+func (d *MongoGroupDao) DeleteGroup(id string) error {
+	users := d.Client.Database(d.DatabaseName).Collection(collectionName)
+	_, err := users.UpdateMany(d.Ctx, bson.M{"groups": id}, bson.M{"$pull": bson.M{"groups": id}})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return err
+	}
+
+	collection := d.Client.Database(d.DatabaseName).Collection(groupsCollectionName)
+	_, err = collection.DeleteOne(d.Ctx, bson.M{"_id": id})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// AddGroupMember adds group id to groups of user id
+func (d *MongoGroupDao) AddGroupMember(id string, userID int64) error {
+	users := d.Client.Database(d.DatabaseName).Collection(collectionName)
+	_, err := users.UpdateOne(d.Ctx, bson.M{"_id": userID}, bson.M{"$addToSet": bson.M{"groups": id}})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// RemoveGroupMember removes group id from groups of user id
+func (d *MongoGroupDao) RemoveGroupMember(id string, userID int64) error {
+	users := d.Client.Database(d.DatabaseName).Collection(collectionName)
+	_, err := users.UpdateOne(d.Ctx, bson.M{"_id": userID}, bson.M{"$pull": bson.M{"groups": id}})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// GetGroupMembers returns users which are members of group id or empty list
+func (d *MongoGroupDao) GetGroupMembers(id string) (*[]s.User, error) {
+	result := []s.User{}
+
+	users := d.Client.Database(d.DatabaseName).Collection(collectionName)
+	cursor, err := users.Find(d.Ctx, bson.M{"groups": id})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+	if err = cursor.All(d.Ctx, &result); err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+
+	return &result, nil
+}
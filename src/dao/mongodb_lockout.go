@@ -0,0 +1,101 @@
+package dao
+
+import (
+	"context"
+
+	s "github.com/adderly/brightonum/src/structs"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const loginAttemptsCollectionName string = "loginAttempts"
+
+// MongoLoginAttemptDao provides LoginAttemptDao implementation via MongoDB
+type MongoLoginAttemptDao struct {
+	Client       *mongo.Client
+	DatabaseName string
+	Ctx          context.Context
+}
+
+// NewMongoLoginAttemptDao creates instance of MongoLoginAttemptDao sharing connection with user dao
+func NewMongoLoginAttemptDao(d *MongoUserDao) *MongoLoginAttemptDao {
+	return &MongoLoginAttemptDao{Client: d.Client, DatabaseName: d.DatabaseName, Ctx: d.Ctx}
+}
+
+// GetLoginAttempts returns nil when there are no attempts for the key
+func (d *MongoLoginAttemptDao) GetLoginAttempts(key string) (*s.LoginAttempts, error) {
+	result := &s.LoginAttempts{}
+
+	collection := d.Client.Database(d.DatabaseName).Collection(loginAttemptsCollectionName)
+	err := collection.FindOne(d.Ctx, bson.M{"_id": key}).Decode(result)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// AddLoginFailure atomically increments failures of the key and returns attempts after the increment
+func (d *MongoLoginAttemptDao) AddLoginFailure(key string, expiresAt int64) (*s.LoginAttempts, error) {
+	result := &s.LoginAttempts{}
+
+	collection := d.Client.Database(d.DatabaseName).Collection(loginAttemptsCollectionName)
+	err := collection.FindOneAndUpdate(
+		d.Ctx,
+		bson.M{"_id": key},
+		bson.M{"$inc": bson.M{"failures": 1}, "$set": bson.M{"expiresAt": expiresAt}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(result)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// ReleaseLoginAttempt atomically decrements failures of the key
+func (d *MongoLoginAttemptDao) ReleaseLoginAttempt(key string) error {
+	collection := d.Client.Database(d.DatabaseName).Collection(loginAttemptsCollectionName)
+	_, err := collection.UpdateOne(d.Ctx, bson.M{"_id": key, "failures": bson.M{"$gt": 0}}, bson.M{"$inc": bson.M{"failures": -1}})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// SetLoginLockout sets Unix time the key is locked until
+func (d *MongoLoginAttemptDao) SetLoginLockout(key string, lockedUntil int64) error {
+	collection := d.Client.Database(d.DatabaseName).Collection(loginAttemptsCollectionName)
+	_, err := collection.UpdateOne(d.Ctx, bson.M{"_id": key}, bson.M{"$set": bson.M{"lockedUntil": lockedUntil}})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// DeleteLoginAttempts forgets attempts and lockout of the key
+func (d *MongoLoginAttemptDao) DeleteLoginAttempts(key string) error {
+	collection := d.Client.Database(d.DatabaseName).Collection(loginAttemptsCollectionName)
+	_, err := collection.DeleteOne(d.Ctx, bson.M{"_id": key})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// PruneLoginAttempts removes attempts expired and unlocked before given Unix time
+func (d *MongoLoginAttemptDao) PruneLoginAttempts(before int64) (int64, error) {
+	collection := d.Client.Database(d.DatabaseName).Collection(loginAttemptsCollectionName)
+	res, err := collection.DeleteMany(d.Ctx, bson.M{"expiresAt": bson.M{"$lt": before}, "lockedUntil": bson.M{"$lt": before}})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
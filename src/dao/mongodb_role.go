@@ -0,0 +1,80 @@
+package dao
+
+import (
+	"context"
+
+	s "github.com/adderly/brightonum/src/structs"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const rolesCollectionName string = "roles"
+
+// MongoRoleDao provides RoleDao implementation via MongoDB
+type MongoRoleDao struct {
+	Client       *mongo.Client
+	DatabaseName string
+	Ctx          context.Context
+}
+
+// NewMongoRoleDao creates instance of MongoRoleDao sharing connection with user dao
+func NewMongoRoleDao(d *MongoUserDao) *MongoRoleDao {
+	return &MongoRoleDao{Client: d.Client, DatabaseName: d.DatabaseName, Ctx: d.Ctx}
+}
+
+// SaveRole creates role or replaces permissions of existing one
+func (d *MongoRoleDao) SaveRole(r *s.Role) error {
+	collection := d.Client.Database(d.DatabaseName).Collection(rolesCollectionName)
+	_, err := collection.ReplaceOne(d.Ctx, bson.M{"_id": r.Name}, r, options.Replace().SetUpsert(true))
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// GetRole returns nil when role is not found
+func (d *MongoRoleDao) GetRole(name string) (*s.Role, error) {
+	result := &s.Role{}
+
+	collection := d.Client.Database(d.DatabaseName).Collection(rolesCollectionName)
+	err := collection.FindOne(d.Ctx, bson.M{"_id": name}).Decode(result)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// GetRoles returns all roles or empty list
+func (d *MongoRoleDao) GetRoles() (*[]s.Role, error) {
+	result := []s.Role{}
+
+	collection := d.Client.Database(d.DatabaseName).Collection(rolesCollectionName)
+	cursor, err := collection.Find(d.Ctx, bson.M{})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+	if err = cursor.All(d.Ctx, &result); err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// DeleteRole deletes role by name
+func (d *MongoRoleDao) DeleteRole(name string) error {
+	collection := d.Client.Database(d.DatabaseName).Collection(rolesCollectionName)
+	_, err := collection.DeleteOne(d.Ctx, bson.M{"_id": name})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
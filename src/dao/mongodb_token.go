@@ -0,0 +1,131 @@
+package dao
+
+import (
+	"context"
+
+	s "github.com/adderly/brightonum/src/structs"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const refreshTokensCollectionName string = "refreshTokens"
+
+// MongoRefreshTokenDao provides RefreshTokenDao implementation via MongoDB
+type MongoRefreshTokenDao struct {
+	Client       *mongo.Client
+	DatabaseName string
+	Ctx          context.Context
+}
+
+// NewMongoRefreshTokenDao creates instance of MongoRefreshTokenDao sharing connection with user dao
+func NewMongoRefreshTokenDao(d *MongoUserDao) *MongoRefreshTokenDao {
+	return &MongoRefreshTokenDao{Client: d.Client, DatabaseName: d.DatabaseName, Ctx: d.Ctx}
+}
+
+// SaveRefreshToken saves newly issued refresh token
+func (d *MongoRefreshTokenDao) SaveRefreshToken(t *s.RefreshToken) error {
+	collection := d.Client.Database(d.DatabaseName).Collection(refreshTokensCollectionName)
+	_, err := collection.InsertOne(d.Ctx, t)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// GetRefreshToken returns nil when token is not found
+func (d *MongoRefreshTokenDao) GetRefreshToken(id string) (*s.RefreshToken, error) {
+	result := &s.RefreshToken{}
+
+	collection := d.Client.Database(d.DatabaseName).Collection(refreshTokensCollectionName)
+	err := collection.FindOne(d.Ctx, bson.M{"_id": id}).Decode(result)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// MarkRefreshTokenUsed marks token as used, returns false if it has been used already
+func (d *MongoRefreshTokenDao) MarkRefreshTokenUsed(id string) (bool, error) {
+	collection := d.Client.Database(d.DatabaseName).Collection(refreshTokensCollectionName)
+	res, err := collection.UpdateOne(d.Ctx, bson.M{"_id": id, "used": false}, bson.M{"$set": bson.M{"used": true}})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+// RevokeRefreshTokenFamily revokes all tokens of the family
+func (d *MongoRefreshTokenDao) RevokeRefreshTokenFamily(family string) error {
+	collection := d.Client.Database(d.DatabaseName).Collection(refreshTokensCollectionName)
+	_, err := collection.UpdateMany(d.Ctx, bson.M{"family": family}, bson.M{"$set": bson.M{"revoked": true}})
+	return err
+}
+
+// PruneRefreshTokens removes tokens expired before given Unix time, used and revoked ones included
+func (d *MongoRefreshTokenDao) PruneRefreshTokens(before int64) (int64, error) {
+	collection := d.Client.Database(d.DatabaseName).Collection(refreshTokensCollectionName)
+	res, err := collection.DeleteMany(d.Ctx, bson.M{"expiresAt": bson.M{"$lt": before}})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+const revokedTokensCollectionName string = "revokedTokens"
+
+// MongoRevocationDao provides RevocationDao implementation via MongoDB
+type MongoRevocationDao struct {
+	Client       *mongo.Client
+	DatabaseName string
+	Ctx          context.Context
+}
+
+// NewMongoRevocationDao creates instance of MongoRevocationDao sharing connection with user dao
+func NewMongoRevocationDao(d *MongoUserDao) *MongoRevocationDao {
+	return &MongoRevocationDao{Client: d.Client, DatabaseName: d.DatabaseName, Ctx: d.Ctx}
+}
+
+// Revoke saves token id as revoked until given Unix time
+func (d *MongoRevocationDao) Revoke(id string, expiresAt int64) error {
+	collection := d.Client.Database(d.DatabaseName).Collection(revokedTokensCollectionName)
+	_, err := collection.UpdateOne(
+		d.Ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"expiresAt": expiresAt}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// IsRevoked returns true if token id has been revoked
+func (d *MongoRevocationDao) IsRevoked(id string) (bool, error) {
+	collection := d.Client.Database(d.DatabaseName).Collection(revokedTokensCollectionName)
+	count, err := collection.CountDocuments(d.Ctx, bson.M{"_id": id})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// PruneRevoked removes entries expired before given Unix time
+func (d *MongoRevocationDao) PruneRevoked(before int64) (int64, error) {
+	collection := d.Client.Database(d.DatabaseName).Collection(revokedTokensCollectionName)
+	res, err := collection.DeleteMany(d.Ctx, bson.M{"expiresAt": bson.M{"$lt": before}})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
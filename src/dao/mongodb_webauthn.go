@@ -0,0 +1,90 @@
+package dao
+
+import (
+	"context"
+
+	s "github.com/adderly/brightonum/src/structs"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const webAuthnCredentialsCollectionName string = "webauthnCredentials"
+
+// MongoWebAuthnDao provides WebAuthnDao implementation via MongoDB
+type MongoWebAuthnDao struct {
+	Client       *mongo.Client
+	DatabaseName string
+	Ctx          context.Context
+}
+
+// NewMongoWebAuthnDao creates instance of MongoWebAuthnDao sharing connection with user dao
+func NewMongoWebAuthnDao(d *MongoUserDao) *MongoWebAuthnDao {
+	return &MongoWebAuthnDao{Client: d.Client, DatabaseName: d.DatabaseName, Ctx: d.Ctx}
+}
+
+// SaveWebAuthnCredential saves newly registered credential
+func (d *MongoWebAuthnDao) SaveWebAuthnCredential(c *s.WebAuthnCredential) error {
+	collection := d.Client.Database(d.DatabaseName).Collection(webAuthnCredentialsCollectionName)
+	_, err := collection.InsertOne(d.Ctx, c)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// GetWebAuthnCredential returns nil when credential is not found
+func (d *MongoWebAuthnDao) GetWebAuthnCredential(id string) (*s.WebAuthnCredential, error) {
+	result := &s.WebAuthnCredential{}
+
+	collection := d.Client.Database(d.DatabaseName).Collection(webAuthnCredentialsCollectionName)
+	err := collection.FindOne(d.Ctx, bson.M{"_id": id}).Decode(result)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// GetWebAuthnCredentials returns credentials of user id or empty list
+func (d *MongoWebAuthnDao) GetWebAuthnCredentials(userID int64) (*[]s.WebAuthnCredential, error) {
+	result := []s.WebAuthnCredential{}
+
+	collection := d.Client.Database(d.DatabaseName).Collection(webAuthnCredentialsCollectionName)
+	cursor, err := collection.Find(d.Ctx, bson.M{"userId": userID})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+	if err = cursor.All(d.Ctx, &result); err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// SetWebAuthnSignCount replaces sign count of credential if it still has the given previous value
+func (d *MongoWebAuthnDao) SetWebAuthnSignCount(id string, prev int64, count int64) (bool, error) {
+	collection := d.Client.Database(d.DatabaseName).Collection(webAuthnCredentialsCollectionName)
+	res, err := collection.UpdateOne(d.Ctx, bson.M{"_id": id, "signCount": prev}, bson.M{"$set": bson.M{"signCount": count}})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+// DeleteWebAuthnCredential deletes credential by id
+func (d *MongoWebAuthnDao) DeleteWebAuthnCredential(id string) error {
+	collection := d.Client.Database(d.DatabaseName).Collection(webAuthnCredentialsCollectionName)
+	_, err := collection.DeleteOne(d.Ctx, bson.M{"_id": id})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
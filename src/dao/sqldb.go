@@ -2,6 +2,7 @@ package dao
 
 import (
 	"context"
+	"encoding/json"
 	"os"
 	"os/signal"
 	"strings"
@@ -13,6 +14,7 @@ import (
 
 	"xorm.io/builder"
 	"xorm.io/xorm"
+	"xorm.io/xorm/names"
 )
 
 // SqlUserDao provides UserDao implementation via MongoDB
@@ -24,6 +26,12 @@ type SqlUserDao struct {
 
 // NewSqlUserDao creates instance of MysqlUserDao
 func NewSqlUserDao(driverName string, driverUrl string, databaseName string) *SqlUserDao {
+	return NewSqlRealmUserDao(driverName, driverUrl, databaseName, "")
+}
+
+// NewSqlRealmUserDao creates instance of MysqlUserDao which keeps tables of the realm,
+// they are prefixed with realm name. Empty realm means tables without prefix.
+func NewSqlRealmUserDao(driverName string, driverUrl string, databaseName string, realm string) *SqlUserDao {
 	ctx, cancel := context.WithCancel(context.Background())
 	dbClient, err := xorm.NewEngine(driverName, driverUrl)
 
@@ -31,13 +39,16 @@ func NewSqlUserDao(driverName string, driverUrl string, databaseName string) *Sq
 		logger.Logf("ERROR Failed to dial sql url: '%s'", driverUrl)
 		panic(err)
 	}
+	if realm != "" {
+		dbClient.SetTableMapper(names.NewPrefixMapper(names.SnakeMapper{}, realm+"_"))
+	}
 
 	if err = dbClient.Sync2(new(s.User)); err != nil {
 		logger.Logf("orm failed to initialized User table: %v", err)
 	}
 	logger.Logf("INFO Connected to SQLDb")
 
-	sigChan := make(chan os.Signal)
+	sigChan := make(chan os.Signal, 1)
 	go func() {
 		for range sigChan {
 			logger.Logf("INFO disconnecting from SQLDb")
@@ -152,13 +163,14 @@ func (d *SqlUserDao) Update(u *s.User) error {
 	return err
 }
 
-// SetRecoveryCode sets password recovery code for user id
-func (d *SqlUserDao) SetRecoveryCode(id int64, code string) error {
+// SetRecoveryCode sets password recovery code and its issue time for user id
+func (d *SqlUserDao) SetRecoveryCode(id int64, code string, issuedAt int64) error {
 
 	user := &s.User{}
 	user.RecoveryCode = code
 	user.ResettingCode = " "
-	_, err := d.Db.ID(id).Update(user)
+	user.RecoveryIssuedAt = issuedAt
+	_, err := d.Db.ID(id).MustCols("recovery_attempts").Update(user)
 
 	return err
 }
@@ -171,12 +183,13 @@ func (d *SqlUserDao) GetRecoveryCode(id int64) (string, error) {
 	return user.RecoveryCode, err
 }
 
-// SetResettingCode sets resetting code and removes recovery one
-func (d *SqlUserDao) SetResettingCode(id int64, code string) error {
+// SetResettingCode sets resetting code and its issue time, removes recovery one
+func (d *SqlUserDao) SetResettingCode(id int64, code string, issuedAt int64) error {
 	user := &s.User{}
 	user.ResettingCode = code
 	user.RecoveryCode = " "
-	_, err := d.Db.ID(id).Update(user)
+	user.RecoveryIssuedAt = issuedAt
+	_, err := d.Db.ID(id).MustCols("recovery_attempts").Update(user)
 	return err
 }
 
@@ -197,6 +210,119 @@ func (d *SqlUserDao) ResetPassword(id int64, passwordHash string) error {
 	return err
 }
 
+// AddRecoveryAttempt atomically counts attempt to use pending recovery or resetting code
+func (d *SqlUserDao) AddRecoveryAttempt(id int64) (int64, error) {
+	if _, err := d.Db.ID(id).Incr("recovery_attempts").Update(&s.User{}); err != nil {
+		return 0, err
+	}
+	user := s.User{}
+	_, err := d.Db.ID(id).Cols("recovery_attempts").Get(&user)
+	return user.RecoveryAttempts, err
+}
+
+// InvalidateRecoveryCodes removes recovery and resetting codes
+func (d *SqlUserDao) InvalidateRecoveryCodes(id int64) error {
+	user := &s.User{RecoveryCode: " ", ResettingCode: " "}
+	_, err := d.Db.ID(id).Cols("recovery_code", "resetting_code").Update(user)
+	return err
+}
+
+// SetAccess replaces roles and permissions of user id
+func (d *SqlUserDao) SetAccess(id int64, roles []string, permissions []string) error {
+	user := &s.User{Roles: roles, Permissions: permissions}
+	_, err := d.Db.ID(id).Cols("roles", "permissions").Update(user)
+	return err
+}
+
+// SetTOTP sets encrypted TOTP secret and whether it is confirmed
+func (d *SqlUserDao) SetTOTP(id int64, secret string, enabled bool) error {
+	user := &s.User{TOTPSecret: secret, TOTPEnabled: enabled}
+	_, err := d.Db.ID(id).Cols("totp_secret", "totp_enabled").Update(user)
+	return err
+}
+
+// UseTOTPCounter stores time step of accepted TOTP code unless the same or later step has been used
+func (d *SqlUserDao) UseTOTPCounter(id int64, counter int64) (bool, error) {
+	user := &s.User{TOTPCounter: counter}
+	affected, err := d.Db.ID(id).Where("totp_counter < ? OR totp_counter IS NULL", counter).Cols("totp_counter").Update(user)
+	if err != nil {
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+// SetLoginCode sets hash of passwordless login code, id of login link and their expiration
+func (d *SqlUserDao) SetLoginCode(id int64, codeHash string, nonce string, expiresAt int64) error {
+	user := &s.User{LoginCode: codeHash, LoginNonce: nonce, LoginExpiresAt: expiresAt}
+	_, err := d.Db.ID(id).Cols("login_code", "login_nonce", "login_expires_at", "login_attempts").Update(user)
+	return err
+}
+
+// AddLoginCodeAttempt atomically counts attempt to use passwordless login code, returns 0 when login has been already used
+func (d *SqlUserDao) AddLoginCodeAttempt(id int64, nonce string) (int64, error) {
+	affected, err := d.Db.ID(id).Where(builder.Eq{"login_nonce": nonce}).Incr("login_attempts").Update(&s.User{})
+	if err != nil || affected == 0 {
+		return 0, err
+	}
+	user := s.User{}
+	_, err = d.Db.ID(id).Cols("login_attempts").Get(&user)
+	return user.LoginAttempts, err
+}
+
+// ConsumeLoginCode clears passwordless login if it has the given link id, returns false when it has been already used
+func (d *SqlUserDao) ConsumeLoginCode(id int64, nonce string) (bool, error) {
+	affected, err := d.Db.ID(id).
+		Where(builder.Eq{"login_nonce": nonce}).
+		Cols("login_code", "login_nonce", "login_expires_at", "login_attempts").
+		Update(&s.User{})
+	if err != nil {
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+// SetBackupCodes replaces hashes of backup codes of user id
+func (d *SqlUserDao) SetBackupCodes(id int64, hashes []string) error {
+	user := &s.User{BackupCodes: hashes}
+	_, err := d.Db.ID(id).Cols("backup_codes").Update(user)
+	return err
+}
+
+// UseBackupCode removes hash of used backup code, returns false when it has been already removed.
+// Codes are replaced only if they are not changed since read, otherwise they are read again.
+func (d *SqlUserDao) UseBackupCode(id int64, hash string) (bool, error) {
+	for {
+		var stored string
+		found, err := d.Db.Table(new(s.User)).ID(id).Cols("backup_codes").Get(&stored)
+		if err != nil || !found {
+			return false, err
+		}
+		codes := []string{}
+		if stored != "" {
+			if err = json.Unmarshal([]byte(stored), &codes); err != nil {
+				return false, err
+			}
+		}
+
+		remaining := []string{}
+		for _, h := range codes {
+			if h != hash {
+				remaining = append(remaining, h)
+			}
+		}
+		if len(remaining) == len(codes) {
+			return false, nil
+		}
+		affected, err := d.Db.ID(id).
+			Where(builder.Eq{"backup_codes": stored}).
+			Cols("backup_codes").
+			Update(&s.User{BackupCodes: remaining})
+		if err != nil || affected == 1 {
+			return affected == 1, err
+		}
+	}
+}
+
 // DeleteById deletes user by id
 func (d *SqlUserDao) DeleteById(id int64) error {
 	q := builder.Expr("ID = ?", id)
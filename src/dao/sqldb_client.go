@@ -0,0 +1,129 @@
+package dao
+
+import (
+	"context"
+
+	s "github.com/adderly/brightonum/src/structs"
+
+	"xorm.io/builder"
+	"xorm.io/xorm"
+)
+
+// SqlClientDao provides ClientDao implementation via SQL database
+type SqlClientDao struct {
+	Db  *xorm.Engine
+	Ctx context.Context
+}
+
+// NewSqlClientDao creates instance of SqlClientDao sharing connection with user dao
+func NewSqlClientDao(d *SqlUserDao) *SqlClientDao {
+	if err := d.Db.Sync2(new(s.Client)); err != nil {
+		logger.Logf("orm failed to initialized Client table: %v", err)
+	}
+	return &SqlClientDao{Db: d.Db, Ctx: d.Ctx}
+}
+
+// SaveClient saves new client
+func (d *SqlClientDao) SaveClient(c *s.Client) error {
+	_, err := d.Db.Insert(c)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// GetClient returns nil when client is not found
+func (d *SqlClientDao) GetClient(id string) (*s.Client, error) {
+	result := &s.Client{}
+
+	found, err := d.Db.ID(id).Get(result)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+	if !found {
+		return nil, nil
+	}
+
+	return result, nil
+}
+
+// GetClients returns all clients or empty list
+func (d *SqlClientDao) GetClients() (*[]s.Client, error) {
+	result := []s.Client{}
+
+	err := d.Db.Find(&result)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// DeleteClient deletes client by id
+func (d *SqlClientDao) DeleteClient(id string) error {
+	_, err := d.Db.ID(id).Delete(&s.Client{})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// SqlAuthorizationCodeDao provides AuthorizationCodeDao implementation via SQL database
+type SqlAuthorizationCodeDao struct {
+	Db  *xorm.Engine
+	Ctx context.Context
+}
+
+// NewSqlAuthorizationCodeDao creates instance of SqlAuthorizationCodeDao sharing connection with user dao
+func NewSqlAuthorizationCodeDao(d *SqlUserDao) *SqlAuthorizationCodeDao {
+	if err := d.Db.Sync2(new(s.AuthorizationCode)); err != nil {
+		logger.Logf("orm failed to initialized AuthorizationCode table: %v", err)
+	}
+	return &SqlAuthorizationCodeDao{Db: d.Db, Ctx: d.Ctx}
+}
+
+// SaveAuthorizationCode saves newly issued code
+func (d *SqlAuthorizationCodeDao) SaveAuthorizationCode(c *s.AuthorizationCode) error {
+	_, err := d.Db.Insert(c)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// ConsumeAuthorizationCode removes code and returns it, nil if it is not found.
+// Only the caller which actually deleted the row gets the code.
+func (d *SqlAuthorizationCodeDao) ConsumeAuthorizationCode(id string) (*s.AuthorizationCode, error) {
+	result := &s.AuthorizationCode{}
+
+	found, err := d.Db.ID(id).Get(result)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+	if !found {
+		return nil, nil
+	}
+
+	affected, err := d.Db.ID(id).Delete(&s.AuthorizationCode{})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+	if affected != 1 {
+		return nil, nil
+	}
+
+	return result, nil
+}
+
+// PruneAuthorizationCodes removes codes expired before given Unix time
+func (d *SqlAuthorizationCodeDao) PruneAuthorizationCodes(before int64) (int64, error) {
+	affected, err := d.Db.Where(builder.Lt{"expires_at": before}).Delete(&s.AuthorizationCode{})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return affected, err
+}
@@ -0,0 +1,103 @@
+package dao
+
+import (
+	"context"
+
+	s "github.com/adderly/brightonum/src/structs"
+
+	"xorm.io/builder"
+	"xorm.io/xorm"
+)
+
+// SqlDeviceAuthorizationDao provides DeviceAuthorizationDao implementation via SQL database
+type SqlDeviceAuthorizationDao struct {
+	Db  *xorm.Engine
+	Ctx context.Context
+}
+
+// NewSqlDeviceAuthorizationDao creates instance of SqlDeviceAuthorizationDao sharing connection with user dao
+func NewSqlDeviceAuthorizationDao(d *SqlUserDao) *SqlDeviceAuthorizationDao {
+	if err := d.Db.Sync2(new(s.DeviceAuthorization)); err != nil {
+		logger.Logf("orm failed to initialized DeviceAuthorization table: %v", err)
+	}
+	return &SqlDeviceAuthorizationDao{Db: d.Db, Ctx: d.Ctx}
+}
+
+// SaveDeviceAuthorization saves new device authorization
+func (d *SqlDeviceAuthorizationDao) SaveDeviceAuthorization(a *s.DeviceAuthorization) error {
+	_, err := d.Db.Insert(a)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// GetDeviceAuthorizationByUserCode returns nil when authorization is not found
+func (d *SqlDeviceAuthorizationDao) GetDeviceAuthorizationByUserCode(userCode string) (*s.DeviceAuthorization, error) {
+	result := &s.DeviceAuthorization{}
+
+	found, err := d.Db.Where(builder.Eq{"user_code": userCode}).Get(result)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+	if !found {
+		return nil, nil
+	}
+
+	return result, nil
+}
+
+// SetDeviceAuthorizationStatus sets status of pending authorization, returns false if it is not pending
+func (d *SqlDeviceAuthorizationDao) SetDeviceAuthorizationStatus(id string, status string, userID int64) (bool, error) {
+	// Only non-zero fields are updated
+	affected, err := d.Db.ID(id).
+		Where(builder.Eq{"status": s.DeviceAuthorizationPending}).
+		Update(&s.DeviceAuthorization{Status: status, UserID: userID})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+// PollDeviceAuthorization sets last polling time and returns authorization as it was before
+func (d *SqlDeviceAuthorizationDao) PollDeviceAuthorization(id string, polledAt int64) (*s.DeviceAuthorization, error) {
+	result := &s.DeviceAuthorization{}
+
+	found, err := d.Db.ID(id).Get(result)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+	if !found {
+		return nil, nil
+	}
+
+	_, err = d.Db.ID(id).Update(&s.DeviceAuthorization{LastPolledAt: polledAt})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// DeleteDeviceAuthorization deletes authorization, returns false if it has been deleted already
+func (d *SqlDeviceAuthorizationDao) DeleteDeviceAuthorization(id string) (bool, error) {
+	affected, err := d.Db.ID(id).Delete(&s.DeviceAuthorization{})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+// PruneDeviceAuthorizations removes authorizations expired before given Unix time
+func (d *SqlDeviceAuthorizationDao) PruneDeviceAuthorizations(before int64) (int64, error) {
+	affected, err := d.Db.Where(builder.Lt{"expires_at": before}).Delete(&s.DeviceAuthorization{})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return affected, err
+}
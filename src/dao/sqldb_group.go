@@ -0,0 +1,177 @@
+package dao
+
+import (
+	"context"
+
+	s "github.com/adderly/brightonum/src/structs"
+
+	"xorm.io/builder"
+	"xorm.io/xorm"
+)
+
+// SqlGroupDao provides GroupDao implementation via SQL database, membership is stored in users table
+type SqlGroupDao struct {
+	Db  *xorm.Engine
+	Ctx context.Context
+}
+
+// NewSqlGroupDao creates instance of SqlGroupDao sharing connection with user dao
+func NewSqlGroupDao(d *SqlUserDao) *SqlGroupDao {
+	if err := d.Db.Sync2(new(s.Group)); err != nil {
+		logger.Logf("orm failed to initialized Group table: %v", err)
+	}
+	return &SqlGroupDao{Db: d.Db, Ctx: d.Ctx}
+}
+
+// SaveGroup saves new group
+func (d *SqlGroupDao) SaveGroup(g *s.Group) error {
+	_, err := d.Db.Insert(g)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// UpdateGroup replaces name and roles of group
+func (d *SqlGroupDao) UpdateGroup(g *s.Group) error {
+	_, err := d.Db.ID(g.ID).Cols("name", "roles").Update(g)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// GetGroup returns nil when group is not found
+func (d *SqlGroupDao) GetGroup(id string) (*s.Group, error) {
+	result := &s.Group{}
+
+	found, err := d.Db.ID(id).Get(result)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+	if !found {
+		return nil, nil
+	}
+
+	return result, nil
+}
+
+// GetGroups returns all groups or empty list
+func (d *SqlGroupDao) GetGroups() (*[]s.Group, error) {
+	result := []s.Group{}
+
+	err := d.Db.Find(&result)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// DeleteGroup deletes group and removes it from groups of its members
+func (d *SqlGroupDao) DeleteGroup(id string) error {
+	session := d.Db.NewSession()
+	defer session.Close()
+
+	err := session.Begin()
+	if err == nil {
+		var members []s.User
+		members, err = findGroupMembers(session, id)
+		for i := 0; err == nil && i < len(members); i++ {
+			err = updateMembership(session, &members[i], id, false)
+		}
+	}
+	if err == nil {
+		_, err = session.ID(id).Delete(&s.Group{})
+	}
+	if err == nil {
+		err = session.Commit()
+	}
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// AddGroupMember adds group id to groups of user id
+func (d *SqlGroupDao) AddGroupMember(id string, userID int64) error {
+	return d.setMembership(id, userID, true)
+}
+
+// RemoveGroupMember removes group id from groups of user id
+func (d *SqlGroupDao) RemoveGroupMember(id string, userID int64) error {
+	return d.setMembership(id, userID, false)
+}
+
+// GetGroupMembers returns users which are members of group id or empty list
+func (d *SqlGroupDao) GetGroupMembers(id string) (*[]s.User, error) {
+	session := d.Db.NewSession()
+	defer session.Close()
+
+	result, err := findGroupMembers(session, id)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (d *SqlGroupDao) setMembership(id string, userID int64, member bool) error {
+	session := d.Db.NewSession()
+	defer session.Close()
+
+	err := session.Begin()
+	if err == nil {
+		u := s.User{}
+		var found bool
+		found, err = session.ID(userID).Get(&u)
+		if err == nil && found {
+			err = updateMembership(session, &u, id, member)
+		}
+	}
+	if err == nil {
+		err = session.Commit()
+	}
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// findGroupMembers matches group id in JSON list of user groups
+func findGroupMembers(session *xorm.Session, id string) ([]s.User, error) {
+	candidates := []s.User{}
+	err := session.Where(builder.Like{"member_of", `"` + id + `"`}).Find(&candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	// LIKE treats underscore as wildcard, so matches are checked exactly
+	result := []s.User{}
+	for _, u := range candidates {
+		for _, group := range u.Groups {
+			if group == id {
+				result = append(result, u)
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+func updateMembership(session *xorm.Session, u *s.User, id string, member bool) error {
+	groups := []string{}
+	for _, group := range u.Groups {
+		if group != id {
+			groups = append(groups, group)
+		}
+	}
+	if member {
+		groups = append(groups, id)
+	}
+	u.Groups = groups
+	_, err := session.ID(u.ID).Cols("member_of").Update(u)
+	return err
+}
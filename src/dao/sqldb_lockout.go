@@ -0,0 +1,97 @@
+package dao
+
+import (
+	"context"
+
+	s "github.com/adderly/brightonum/src/structs"
+
+	"xorm.io/builder"
+	"xorm.io/xorm"
+)
+
+// SqlLoginAttemptDao provides LoginAttemptDao implementation via SQL database
+type SqlLoginAttemptDao struct {
+	Db  *xorm.Engine
+	Ctx context.Context
+}
+
+// NewSqlLoginAttemptDao creates instance of SqlLoginAttemptDao sharing connection with user dao
+func NewSqlLoginAttemptDao(d *SqlUserDao) *SqlLoginAttemptDao {
+	if err := d.Db.Sync2(new(s.LoginAttempts)); err != nil {
+		logger.Logf("orm failed to initialized LoginAttempts table: %v", err)
+	}
+	return &SqlLoginAttemptDao{Db: d.Db, Ctx: d.Ctx}
+}
+
+// GetLoginAttempts returns nil when there are no attempts for the key
+func (d *SqlLoginAttemptDao) GetLoginAttempts(key string) (*s.LoginAttempts, error) {
+	result := &s.LoginAttempts{}
+
+	found, err := d.Db.ID(key).Get(result)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+	if !found {
+		return nil, nil
+	}
+
+	return result, nil
+}
+
+// AddLoginFailure atomically increments failures of the key and returns attempts after the increment
+func (d *SqlLoginAttemptDao) AddLoginFailure(key string, expiresAt int64) (*s.LoginAttempts, error) {
+	affected, err := d.Db.ID(key).Incr("failures").Cols("expires_at").Update(&s.LoginAttempts{ExpiresAt: expiresAt})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+	if affected == 0 {
+		// Insert fails when another replica inserts the key first, its failure is counted by update then
+		if _, err = d.Db.Insert(&s.LoginAttempts{ID: key, Failures: 1, ExpiresAt: expiresAt}); err != nil {
+			_, err = d.Db.ID(key).Incr("failures").Cols("expires_at").Update(&s.LoginAttempts{ExpiresAt: expiresAt})
+		}
+		if err != nil {
+			logger.Logf("ERROR %s", err)
+			return nil, err
+		}
+	}
+
+	return d.GetLoginAttempts(key)
+}
+
+// ReleaseLoginAttempt atomically decrements failures of the key
+func (d *SqlLoginAttemptDao) ReleaseLoginAttempt(key string) error {
+	_, err := d.Db.ID(key).Where(builder.Gt{"failures": 0}).Decr("failures").Update(&s.LoginAttempts{})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// SetLoginLockout sets Unix time the key is locked until
+func (d *SqlLoginAttemptDao) SetLoginLockout(key string, lockedUntil int64) error {
+	_, err := d.Db.ID(key).Cols("locked_until").Update(&s.LoginAttempts{LockedUntil: lockedUntil})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// DeleteLoginAttempts forgets attempts and lockout of the key
+func (d *SqlLoginAttemptDao) DeleteLoginAttempts(key string) error {
+	_, err := d.Db.ID(key).Delete(&s.LoginAttempts{})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// PruneLoginAttempts removes attempts expired and unlocked before given Unix time
+func (d *SqlLoginAttemptDao) PruneLoginAttempts(before int64) (int64, error) {
+	affected, err := d.Db.Where(builder.Lt{"expires_at": before}.And(builder.Lt{"locked_until": before})).Delete(&s.LoginAttempts{})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return affected, err
+}
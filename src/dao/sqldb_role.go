@@ -0,0 +1,77 @@
+package dao
+
+import (
+	"context"
+
+	s "github.com/adderly/brightonum/src/structs"
+
+	"xorm.io/xorm"
+)
+
+// SqlRoleDao provides RoleDao implementation via SQL database
+type SqlRoleDao struct {
+	Db  *xorm.Engine
+	Ctx context.Context
+}
+
+// NewSqlRoleDao creates instance of SqlRoleDao sharing connection with user dao
+func NewSqlRoleDao(d *SqlUserDao) *SqlRoleDao {
+	if err := d.Db.Sync2(new(s.Role)); err != nil {
+		logger.Logf("orm failed to initialized Role table: %v", err)
+	}
+	return &SqlRoleDao{Db: d.Db, Ctx: d.Ctx}
+}
+
+// SaveRole creates role or replaces permissions of existing one
+func (d *SqlRoleDao) SaveRole(r *s.Role) error {
+	exists, err := d.Db.ID(r.Name).Exist(&s.Role{})
+	if err == nil {
+		if exists {
+			_, err = d.Db.ID(r.Name).Cols("permissions").Update(r)
+		} else {
+			_, err = d.Db.Insert(r)
+		}
+	}
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// GetRole returns nil when role is not found
+func (d *SqlRoleDao) GetRole(name string) (*s.Role, error) {
+	result := &s.Role{}
+
+	found, err := d.Db.ID(name).Get(result)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+	if !found {
+		return nil, nil
+	}
+
+	return result, nil
+}
+
+// GetRoles returns all roles or empty list
+func (d *SqlRoleDao) GetRoles() (*[]s.Role, error) {
+	result := []s.Role{}
+
+	err := d.Db.Find(&result)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// DeleteRole deletes role by name
+func (d *SqlRoleDao) DeleteRole(name string) error {
+	_, err := d.Db.ID(name).Delete(&s.Role{})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
@@ -0,0 +1,80 @@
+package dao
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	s "github.com/adderly/brightonum/src/structs"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func createTestSqlUserDao(t *testing.T) *SqlUserDao {
+	dir, err := ioutil.TempDir("", "brightonum")
+	assert.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return NewSqlUserDao("sqlite3", "file:"+filepath.Join(dir, "users.db")+"?_busy_timeout=5000", "")
+}
+
+func TestSqlUserDao_UseBackupCode(t *testing.T) {
+	d := createTestSqlUserDao(t)
+	_, err := d.Db.Insert(&s.User{ID: 1, Username: "alle"})
+	assert.Nil(t, err)
+	assert.Nil(t, d.SetBackupCodes(1, []string{"a", "b", "c"}))
+
+	// Parallel requests redeem the same code only once
+	results := make(chan bool, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			used, err := d.UseBackupCode(1, "b")
+			assert.Nil(t, err)
+			results <- used
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	used := 0
+	for r := range results {
+		if r {
+			used++
+		}
+	}
+	assert.Equal(t, 1, used)
+
+	// Other codes are kept
+	used2, err := d.UseBackupCode(1, "b")
+	assert.Nil(t, err)
+	assert.False(t, used2)
+	used2, err = d.UseBackupCode(1, "a")
+	assert.Nil(t, err)
+	assert.True(t, used2)
+	used2, err = d.UseBackupCode(1, "c")
+	assert.Nil(t, err)
+	assert.True(t, used2)
+}
+
+func TestSqlRefreshTokenDao_PruneRefreshTokens(t *testing.T) {
+	d := NewSqlRefreshTokenDao(createTestSqlUserDao(t))
+	assert.Nil(t, d.SaveRefreshToken(&s.RefreshToken{ID: "used", Family: "f", Used: true, ExpiresAt: 100}))
+	assert.Nil(t, d.SaveRefreshToken(&s.RefreshToken{ID: "revoked", Family: "f", Revoked: true, ExpiresAt: 100}))
+	assert.Nil(t, d.SaveRefreshToken(&s.RefreshToken{ID: "live", Family: "f", ExpiresAt: 300}))
+
+	pruned, err := d.PruneRefreshTokens(200)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), pruned)
+
+	stored, err := d.GetRefreshToken("used")
+	assert.Nil(t, err)
+	assert.Nil(t, stored)
+	stored, err = d.GetRefreshToken("live")
+	assert.Nil(t, err)
+	assert.NotNil(t, stored)
+}
@@ -0,0 +1,124 @@
+package dao
+
+import (
+	"context"
+
+	s "github.com/adderly/brightonum/src/structs"
+
+	"xorm.io/builder"
+	"xorm.io/xorm"
+)
+
+// SqlRefreshTokenDao provides RefreshTokenDao implementation via SQL database
+type SqlRefreshTokenDao struct {
+	Db  *xorm.Engine
+	Ctx context.Context
+}
+
+// NewSqlRefreshTokenDao creates instance of SqlRefreshTokenDao sharing connection with user dao
+func NewSqlRefreshTokenDao(d *SqlUserDao) *SqlRefreshTokenDao {
+	if err := d.Db.Sync2(new(s.RefreshToken)); err != nil {
+		logger.Logf("orm failed to initialized RefreshToken table: %v", err)
+	}
+	return &SqlRefreshTokenDao{Db: d.Db, Ctx: d.Ctx}
+}
+
+// SaveRefreshToken saves newly issued refresh token
+func (d *SqlRefreshTokenDao) SaveRefreshToken(t *s.RefreshToken) error {
+	_, err := d.Db.Insert(t)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// GetRefreshToken returns nil when token is not found
+func (d *SqlRefreshTokenDao) GetRefreshToken(id string) (*s.RefreshToken, error) {
+	result := &s.RefreshToken{}
+
+	found, err := d.Db.ID(id).Get(result)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+	if !found {
+		return nil, nil
+	}
+
+	return result, nil
+}
+
+// MarkRefreshTokenUsed marks token as used, returns false if it has been used already
+func (d *SqlRefreshTokenDao) MarkRefreshTokenUsed(id string) (bool, error) {
+	affected, err := d.Db.ID(id).Where(builder.Eq{"used": false}).Cols("used").Update(&s.RefreshToken{Used: true})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+// RevokeRefreshTokenFamily revokes all tokens of the family
+func (d *SqlRefreshTokenDao) RevokeRefreshTokenFamily(family string) error {
+	_, err := d.Db.Where(builder.Eq{"family": family}).Cols("revoked").Update(&s.RefreshToken{Revoked: true})
+	return err
+}
+
+// PruneRefreshTokens removes tokens expired before given Unix time, used and revoked ones included
+func (d *SqlRefreshTokenDao) PruneRefreshTokens(before int64) (int64, error) {
+	affected, err := d.Db.Where(builder.Lt{"expires_at": before}).Delete(&s.RefreshToken{})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return affected, err
+}
+
+// SqlRevocationDao provides RevocationDao implementation via SQL database
+type SqlRevocationDao struct {
+	Db  *xorm.Engine
+	Ctx context.Context
+}
+
+// NewSqlRevocationDao creates instance of SqlRevocationDao sharing connection with user dao
+func NewSqlRevocationDao(d *SqlUserDao) *SqlRevocationDao {
+	if err := d.Db.Sync2(new(s.RevokedToken)); err != nil {
+		logger.Logf("orm failed to initialized RevokedToken table: %v", err)
+	}
+	return &SqlRevocationDao{Db: d.Db, Ctx: d.Ctx}
+}
+
+// Revoke saves token id as revoked until given Unix time
+func (d *SqlRevocationDao) Revoke(id string, expiresAt int64) error {
+	exists, err := d.Db.ID(id).Exist(&s.RevokedToken{})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	_, err = d.Db.Insert(&s.RevokedToken{ID: id, ExpiresAt: expiresAt})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// IsRevoked returns true if token id has been revoked
+func (d *SqlRevocationDao) IsRevoked(id string) (bool, error) {
+	exists, err := d.Db.ID(id).Exist(&s.RevokedToken{})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return exists, err
+}
+
+// PruneRevoked removes entries expired before given Unix time
+func (d *SqlRevocationDao) PruneRevoked(before int64) (int64, error) {
+	affected, err := d.Db.Where(builder.Lt{"expires_at": before}).Delete(&s.RevokedToken{})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return affected, err
+}
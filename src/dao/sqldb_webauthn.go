@@ -0,0 +1,84 @@
+package dao
+
+import (
+	"context"
+
+	s "github.com/adderly/brightonum/src/structs"
+
+	"xorm.io/builder"
+	"xorm.io/xorm"
+)
+
+// SqlWebAuthnDao provides WebAuthnDao implementation via SQL database
+type SqlWebAuthnDao struct {
+	Db  *xorm.Engine
+	Ctx context.Context
+}
+
+// NewSqlWebAuthnDao creates instance of SqlWebAuthnDao sharing connection with user dao
+func NewSqlWebAuthnDao(d *SqlUserDao) *SqlWebAuthnDao {
+	if err := d.Db.Sync2(new(s.WebAuthnCredential)); err != nil {
+		logger.Logf("orm failed to initialized WebAuthnCredential table: %v", err)
+	}
+	return &SqlWebAuthnDao{Db: d.Db, Ctx: d.Ctx}
+}
+
+// SaveWebAuthnCredential saves newly registered credential
+func (d *SqlWebAuthnDao) SaveWebAuthnCredential(c *s.WebAuthnCredential) error {
+	_, err := d.Db.Insert(c)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
+
+// GetWebAuthnCredential returns nil when credential is not found
+func (d *SqlWebAuthnDao) GetWebAuthnCredential(id string) (*s.WebAuthnCredential, error) {
+	result := &s.WebAuthnCredential{}
+
+	found, err := d.Db.ID(id).Get(result)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+	if !found {
+		return nil, nil
+	}
+
+	return result, nil
+}
+
+// GetWebAuthnCredentials returns credentials of user id or empty list
+func (d *SqlWebAuthnDao) GetWebAuthnCredentials(userID int64) (*[]s.WebAuthnCredential, error) {
+	result := []s.WebAuthnCredential{}
+
+	err := d.Db.Where(builder.Eq{"user_id": userID}).Find(&result)
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// SetWebAuthnSignCount replaces sign count of credential if it still has the given previous value
+func (d *SqlWebAuthnDao) SetWebAuthnSignCount(id string, prev int64, count int64) (bool, error) {
+	affected, err := d.Db.ID(id).
+		Where(builder.Eq{"sign_count": prev}).
+		Cols("sign_count").
+		Update(&s.WebAuthnCredential{SignCount: count})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+// DeleteWebAuthnCredential deletes credential by id
+func (d *SqlWebAuthnDao) DeleteWebAuthnCredential(id string) error {
+	_, err := d.Db.ID(id).Delete(&s.WebAuthnCredential{})
+	if err != nil {
+		logger.Logf("ERROR %s", err)
+	}
+	return err
+}
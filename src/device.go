@@ -0,0 +1,224 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	st "github.com/adderly/brightonum/src/structs"
+)
+
+const deviceCodeGrant = "urn:ietf:params:oauth:grant-type:device_code"
+
+// RFC 8628 section 6.1: consonants only, so codes are easy to type and do not form words
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+const userCodeLength = 8
+
+// StartDeviceAuthorization starts RFC 8628 device authorization of the client.
+// User approves it on verification page relative to given base URL.
+func (s *AuthService) StartDeviceAuthorization(clientID string, scope string, baseURL string) (*st.DeviceAuthorizationResp, error) {
+	client, err := s.ClientDao.GetClient(clientID)
+	if err != nil {
+		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if client == nil {
+		return nil, st.AuthError{Msg: "Unknown client", Status: 401, Code: "invalid_client"}
+	}
+
+	deviceCode := generateTokenID()
+	userCode, err := s.generateUserCode()
+	if err != nil {
+		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	interval := int64(s.Config.DevicePollInterval.Seconds())
+
+	err = s.DeviceDao.SaveDeviceAuthorization(&st.DeviceAuthorization{
+		ID:        hashCode(deviceCode),
+		UserCode:  userCode,
+		ClientID:  clientID,
+		Scope:     scope,
+		Status:    st.DeviceAuthorizationPending,
+		Interval:  interval,
+		ExpiresAt: time.Now().Add(s.Config.DeviceCodeLifetime).UTC().Unix(),
+	})
+	if err != nil {
+		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+	}
+
+	formatted := formatUserCode(userCode)
+	verificationURI := s.publicURL(baseURL) + "/oauth/device"
+	return &st.DeviceAuthorizationResp{
+		DeviceCode:              deviceCode,
+		UserCode:                formatted,
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?user_code=" + url.QueryEscape(formatted),
+		ExpiresIn:               int64(s.Config.DeviceCodeLifetime.Seconds()),
+		Interval:                interval,
+	}, nil
+}
+
+// DeviceCodeToken issues tokens for approved device authorization.
+// Polling more often than allowed interval results in slow_down error.
+func (s *AuthService) DeviceCodeToken(deviceCode string, clientID string) (string, string, string, error) {
+	now := time.Now().UTC().Unix()
+	id := hashCode(deviceCode)
+
+	d, err := s.DeviceDao.PollDeviceAuthorization(id, now)
+	if err != nil {
+		return "", "", "", st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if d == nil || d.ClientID != clientID {
+		return "", "", "", st.AuthError{Msg: "Device code is not valid", Status: 400, Code: "invalid_grant"}
+	}
+	if d.ExpiresAt < now {
+		return "", "", "", st.AuthError{Msg: "Device code is expired", Status: 400, Code: "expired_token"}
+	}
+	if d.LastPolledAt > 0 && now-d.LastPolledAt < d.Interval {
+		return "", "", "", st.AuthError{Msg: "Polling is too frequent", Status: 400, Code: "slow_down"}
+	}
+
+	switch d.Status {
+	case st.DeviceAuthorizationPending:
+		return "", "", "", st.AuthError{Msg: "Authorization is pending", Status: 400, Code: "authorization_pending"}
+	case st.DeviceAuthorizationDenied:
+		if _, err = s.DeviceDao.DeleteDeviceAuthorization(id); err != nil {
+			return "", "", "", st.AuthError{Msg: err.Error(), Status: 500}
+		}
+		return "", "", "", st.AuthError{Msg: "Authorization is denied", Status: 400, Code: "access_denied"}
+	}
+
+	// Approved authorization can be exchanged for tokens only once
+	deleted, err := s.DeviceDao.DeleteDeviceAuthorization(id)
+	if err != nil {
+		return "", "", "", st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if !deleted {
+		return "", "", "", st.AuthError{Msg: "Device code is not valid", Status: 400, Code: "invalid_grant"}
+	}
+
+	u, err := s.UserDao.Get(d.UserID)
+	if err != nil {
+		return "", "", "", st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if u == nil {
+		return "", "", "", st.AuthError{Msg: "Device code is not valid", Status: 400, Code: "invalid_grant"}
+	}
+
+	authTime := time.Now().UTC().Unix()
+	accessToken, err := s.issueAccessToken(u, s.Config.Audience, authTime)
+	if err != nil {
+		return "", "", "", err
+	}
+	refreshToken, err := s.issueRefreshToken(u, "", "", s.Config.Audience, authTime)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	idToken := ""
+	if hasScope(d.Scope, openIDScope) {
+		idToken, err = s.issueIDToken(u, clientID, "", authTime)
+		if err != nil {
+			return "", "", "", err
+		}
+	}
+
+	logger.Logf("INFO Device of client %s is authorized by user %d", clientID, u.ID)
+	return accessToken, refreshToken, idToken, nil
+}
+
+// ApproveDevice approves or denies device authorization on behalf of access token owner
+func (s *AuthService) ApproveDevice(userCode string, token string, approve bool) error {
+	u, err := s.authenticateToken(token, accessTokenUse)
+	if err != nil {
+		return err
+	}
+	return s.setDeviceDecision(userCode, u, approve)
+}
+
+// ApproveDeviceWithCredentials approves or denies device authorization on behalf of user signed in
+// on verification page, failures are counted for client ip as well
+func (s *AuthService) ApproveDeviceWithCredentials(userCode, username, password, otp string, approve bool, ip string) error {
+	u, err := s.checkCredentials(username, password, otp, ip)
+	if err != nil {
+		return err
+	}
+	return s.setDeviceDecision(userCode, u, approve)
+}
+
+func (s *AuthService) setDeviceDecision(userCode string, u *st.User, approve bool) error {
+	invalidErr := st.AuthError{Msg: "Code is not valid or expired", Status: 400}
+
+	d, err := s.DeviceDao.GetDeviceAuthorizationByUserCode(normalizeUserCode(userCode))
+	if err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if d == nil || d.ExpiresAt < time.Now().UTC().Unix() {
+		return invalidErr
+	}
+
+	status := st.DeviceAuthorizationDenied
+	if approve {
+		status = st.DeviceAuthorizationApproved
+	}
+	updated, err := s.DeviceDao.SetDeviceAuthorizationStatus(d.ID, status, u.ID)
+	if err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if !updated {
+		return invalidErr
+	}
+
+	logger.Logf("INFO Device authorization of client %s is %s by user %d", d.ClientID, status, u.ID)
+	return nil
+}
+
+// PruneDeviceAuthorizations removes expired device authorizations
+func (s *AuthService) PruneDeviceAuthorizations() {
+	pruned, err := s.DeviceDao.PruneDeviceAuthorizations(time.Now().UTC().Unix())
+	if err != nil {
+		logger.Logf("ERROR Cannot prune device authorizations: %s", err.Error())
+		return
+	}
+	logger.Logf("DEBUG Pruned %d device authorizations", pruned)
+}
+
+// generateUserCode generates user code which is not used by another pending authorization
+func (s *AuthService) generateUserCode() (string, error) {
+	for {
+		var b strings.Builder
+		for i := 0; i < userCodeLength; i++ {
+			n, err := crand.Int(crand.Reader, big.NewInt(int64(len(userCodeAlphabet))))
+			if err != nil {
+				return "", err
+			}
+			b.WriteByte(userCodeAlphabet[n.Int64()])
+		}
+
+		existing, err := s.DeviceDao.GetDeviceAuthorizationByUserCode(b.String())
+		if err != nil {
+			return "", err
+		}
+		if existing == nil {
+			return b.String(), nil
+		}
+	}
+}
+
+// formatUserCode splits user code into two halves for readability, e.g. WDJB-MJHT
+func formatUserCode(code string) string {
+	return code[:userCodeLength/2] + "-" + code[userCodeLength/2:]
+}
+
+// normalizeUserCode removes separators and spaces typed by user
+func normalizeUserCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adderly/brightonum/src/dao"
+	st "github.com/adderly/brightonum/src/structs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestAuthService_StartDeviceAuthorization(t *testing.T) {
+	client := createTestClient()
+
+	clientDao := dao.MockClientDao{}
+	clientDao.On("GetClient", client.ID).Return(&client, nil)
+	clientDao.On("GetClient", "unknown").Return(nil, nil)
+
+	var saved *st.DeviceAuthorization
+	deviceDao := dao.MockDeviceAuthorizationDao{}
+	deviceDao.On("GetDeviceAuthorizationByUserCode", mock.Anything).Return(nil, nil)
+	deviceDao.On("SaveDeviceAuthorization", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		saved = args.Get(0).(*st.DeviceAuthorization)
+	})
+
+	dao := dao.MockUserDao{}
+
+	conf := createTestConfig()
+	conf.DeviceCodeLifetime = 10 * time.Minute
+	conf.DevicePollInterval = 5 * time.Second
+	s := createTestService(&mailer, &dao, conf)
+	s.ClientDao = &clientDao
+	s.DeviceDao = &deviceDao
+
+	resp, err := s.StartDeviceAuthorization(client.ID, "openid", "https://auth.example.com/")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://auth.example.com/oauth/device", resp.VerificationURI)
+	assert.Equal(t, resp.VerificationURI+"?user_code="+resp.UserCode, resp.VerificationURIComplete)
+	assert.Equal(t, int64(600), resp.ExpiresIn)
+	assert.Equal(t, int64(5), resp.Interval)
+	assert.Regexp(t, "^["+userCodeAlphabet+"]{4}-["+userCodeAlphabet+"]{4}$", resp.UserCode)
+
+	assert.Equal(t, hashCode(resp.DeviceCode), saved.ID)
+	assert.Equal(t, normalizeUserCode(resp.UserCode), saved.UserCode)
+	assert.Equal(t, st.DeviceAuthorizationPending, saved.Status)
+	assert.Equal(t, "openid", saved.Scope)
+
+	_, err = s.StartDeviceAuthorization("unknown", "", "https://auth.example.com")
+	assert.Equal(t, st.AuthError{Msg: "Unknown client", Status: 401, Code: "invalid_client"}, err)
+}
+
+func TestAuthService_DeviceCodeToken(t *testing.T) {
+	user := createTestUser()
+	expiresAt := time.Now().Add(time.Minute).Unix()
+	lastPolled := time.Now().Add(-time.Minute).Unix()
+
+	pending := st.DeviceAuthorization{ClientID: "cli", Status: st.DeviceAuthorizationPending, Interval: 5, ExpiresAt: expiresAt}
+	fast := pending
+	fast.LastPolledAt = time.Now().Unix()
+	expired := pending
+	expired.ExpiresAt = time.Now().Add(-time.Second).Unix()
+	denied := pending
+	denied.Status = st.DeviceAuthorizationDenied
+	approved := st.DeviceAuthorization{
+		ClientID:     "cli",
+		Scope:        "openid",
+		Status:       st.DeviceAuthorizationApproved,
+		UserID:       user.ID,
+		Interval:     5,
+		LastPolledAt: lastPolled,
+		ExpiresAt:    expiresAt,
+	}
+
+	deviceDao := dao.MockDeviceAuthorizationDao{}
+	deviceDao.On("PollDeviceAuthorization", hashCode("pending"), mock.Anything).Return(&pending, nil)
+	deviceDao.On("PollDeviceAuthorization", hashCode("fast"), mock.Anything).Return(&fast, nil)
+	deviceDao.On("PollDeviceAuthorization", hashCode("expired"), mock.Anything).Return(&expired, nil)
+	deviceDao.On("PollDeviceAuthorization", hashCode("denied"), mock.Anything).Return(&denied, nil)
+	deviceDao.On("PollDeviceAuthorization", hashCode("approved"), mock.Anything).Return(&approved, nil)
+	deviceDao.On("PollDeviceAuthorization", hashCode("unknown"), mock.Anything).Return(nil, nil)
+	deviceDao.On("DeleteDeviceAuthorization", hashCode("denied")).Return(true, nil)
+	deviceDao.On("DeleteDeviceAuthorization", hashCode("approved")).Return(true, nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("Get", user.ID).Return(&user, nil)
+
+	s := createTestService(&mailer, &dao, createTestConfig())
+	s.DeviceDao = &deviceDao
+
+	accessToken, refreshToken, idToken, err := s.DeviceCodeToken("approved", "cli")
+	assert.Nil(t, err)
+	assert.True(t, testJWTStringField(accessToken, "token_use", "access"))
+	assert.True(t, testJWTStringField(refreshToken, "token_use", "refresh"))
+	assert.True(t, testJWTStringField(idToken, "aud", "cli"))
+	deviceDao.AssertCalled(t, "DeleteDeviceAuthorization", hashCode("approved"))
+
+	_, _, _, err = s.DeviceCodeToken("approved", "other")
+	assert.Equal(t, "invalid_grant", err.(st.AuthError).Code)
+
+	_, _, _, err = s.DeviceCodeToken("unknown", "cli")
+	assert.Equal(t, "invalid_grant", err.(st.AuthError).Code)
+
+	_, _, _, err = s.DeviceCodeToken("pending", "cli")
+	assert.Equal(t, "authorization_pending", err.(st.AuthError).Code)
+
+	_, _, _, err = s.DeviceCodeToken("fast", "cli")
+	assert.Equal(t, "slow_down", err.(st.AuthError).Code)
+
+	_, _, _, err = s.DeviceCodeToken("expired", "cli")
+	assert.Equal(t, "expired_token", err.(st.AuthError).Code)
+
+	_, _, _, err = s.DeviceCodeToken("denied", "cli")
+	assert.Equal(t, "access_denied", err.(st.AuthError).Code)
+	deviceDao.AssertCalled(t, "DeleteDeviceAuthorization", hashCode("denied"))
+}
+
+func TestAuthService_ApproveDeviceWithCredentials(t *testing.T) {
+	user := createTestUser()
+	pending := st.DeviceAuthorization{ID: "id", UserCode: "WDJBMJHT", ClientID: "cli", ExpiresAt: time.Now().Add(time.Minute).Unix()}
+	expired := pending
+	expired.ExpiresAt = time.Now().Add(-time.Second).Unix()
+
+	deviceDao := dao.MockDeviceAuthorizationDao{}
+	deviceDao.On("GetDeviceAuthorizationByUserCode", "WDJBMJHT").Return(&pending, nil)
+	deviceDao.On("GetDeviceAuthorizationByUserCode", "BCDFGHJK").Return(&expired, nil)
+	deviceDao.On("GetDeviceAuthorizationByUserCode", "XXXXXXXX").Return(nil, nil)
+	deviceDao.On("SetDeviceAuthorizationStatus", "id", st.DeviceAuthorizationApproved, user.ID).Return(true, nil)
+	deviceDao.On("SetDeviceAuthorizationStatus", "id", st.DeviceAuthorizationDenied, user.ID).Return(false, nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := createTestService(&mailer, &dao, createTestConfig())
+	s.DeviceDao = &deviceDao
+
+	err := s.ApproveDeviceWithCredentials("wdjb-mjht", user.Username, "oakheart", "", true, "")
+	assert.Nil(t, err)
+	deviceDao.AssertCalled(t, "SetDeviceAuthorizationStatus", "id", st.DeviceAuthorizationApproved, user.ID)
+
+	invalidErr := st.AuthError{Msg: "Code is not valid or expired", Status: 400}
+
+	// Decision has been already made
+	err = s.ApproveDeviceWithCredentials("WDJB-MJHT", user.Username, "oakheart", "", false, "")
+	assert.Equal(t, invalidErr, err)
+
+	err = s.ApproveDeviceWithCredentials("BCDF-GHJK", user.Username, "oakheart", "", true, "")
+	assert.Equal(t, invalidErr, err)
+
+	err = s.ApproveDeviceWithCredentials("XXXX-XXXX", user.Username, "oakheart", "", true, "")
+	assert.Equal(t, invalidErr, err)
+
+	err = s.ApproveDeviceWithCredentials("WDJB-MJHT", user.Username, "wrong", "", true, "")
+	assert.Equal(t, st.AuthError{Msg: "Username or password is wrong", Status: 403}, err)
+}
+
+func TestFormatUserCode(t *testing.T) {
+	assert.Equal(t, "WDJB-MJHT", formatUserCode("WDJBMJHT"))
+	assert.Equal(t, "WDJBMJHT", normalizeUserCode(" wdjb-mjht "))
+	assert.Equal(t, "WDJBMJHT", normalizeUserCode(strings.ToLower(formatUserCode("WDJBMJHT"))))
+}
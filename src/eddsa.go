@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/ed25519"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// SigningMethodEdDSA implements EdDSA (Ed25519) signing method, which is missing in jwt package
+type SigningMethodEdDSA struct{}
+
+// EdDSA signing method
+var signingMethodEdDSA = &SigningMethodEdDSA{}
+
+func init() {
+	jwt.RegisterSigningMethod(signingMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return signingMethodEdDSA
+	})
+}
+
+// Alg returns name of the algorithm
+func (m *SigningMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+// Verify verifies signature of signingString with ed25519.PublicKey
+func (m *SigningMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	pubKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(pubKey, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+// Sign signs signingString with ed25519.PrivateKey
+func (m *SigningMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	privKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	return jwt.EncodeSegment(ed25519.Sign(privKey, []byte(signingString))), nil
+}
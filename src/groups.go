@@ -0,0 +1,171 @@
+package main
+
+import (
+	"regexp"
+
+	st "github.com/adderly/brightonum/src/structs"
+)
+
+var groupIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// CreateGroup creates group, group ID is generated when missing
+func (s *AuthService) CreateGroup(g *st.Group, token string) error {
+	if _, err := s.authorize(token, groupsWritePermission); err != nil {
+		return err
+	}
+
+	if err := s.validateGroup(g); err != nil {
+		return err
+	}
+
+	if g.ID == "" {
+		g.ID = generateTokenID()
+	} else {
+		if !groupIDPattern.MatchString(g.ID) {
+			return st.AuthError{Msg: "Invalid group ID", Status: 400}
+		}
+		existing, err := s.GroupDao.GetGroup(g.ID)
+		if err != nil {
+			return st.AuthError{Msg: err.Error(), Status: 500}
+		}
+		if existing != nil {
+			return st.AuthError{Msg: "Group already exists", Status: 400}
+		}
+	}
+
+	if err := s.GroupDao.SaveGroup(g); err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+
+	logger.Logf("INFO Group %s is created", g.ID)
+	return nil
+}
+
+// UpdateGroup replaces name and roles of existing group
+func (s *AuthService) UpdateGroup(g *st.Group, token string) error {
+	if _, err := s.authorize(token, groupsWritePermission); err != nil {
+		return err
+	}
+
+	if err := s.validateGroup(g); err != nil {
+		return err
+	}
+	if _, err := s.getGroup(g.ID); err != nil {
+		return err
+	}
+
+	if err := s.GroupDao.UpdateGroup(g); err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	return nil
+}
+
+// GetGroup returns group by ID
+func (s *AuthService) GetGroup(id string, token string) (*st.Group, error) {
+	if _, err := s.authorize(token, groupsReadPermission); err != nil {
+		return nil, err
+	}
+	return s.getGroup(id)
+}
+
+// GetGroups returns all groups
+func (s *AuthService) GetGroups(token string) (*[]st.Group, error) {
+	if _, err := s.authorize(token, groupsReadPermission); err != nil {
+		return nil, err
+	}
+
+	groups, err := s.GroupDao.GetGroups()
+	if err != nil {
+		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	return groups, nil
+}
+
+// DeleteGroup deletes group, its members lose the membership
+func (s *AuthService) DeleteGroup(id string, token string) error {
+	if _, err := s.authorize(token, groupsWritePermission); err != nil {
+		return err
+	}
+
+	if err := s.GroupDao.DeleteGroup(id); err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+
+	logger.Logf("INFO Group %s is deleted", id)
+	return nil
+}
+
+// GetGroupMembers returns info of users which are members of the group
+func (s *AuthService) GetGroupMembers(id string, token string) (*[]st.UserInfo, error) {
+	if _, err := s.authorize(token, groupsReadPermission); err != nil {
+		return nil, err
+	}
+	if _, err := s.getGroup(id); err != nil {
+		return nil, err
+	}
+
+	members, err := s.GroupDao.GetGroupMembers(id)
+	if err != nil {
+		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	return mapToUserInfoList(members), nil
+}
+
+// SetGroupMember adds user to the group or removes it
+func (s *AuthService) SetGroupMember(id string, userID int64, member bool, token string) error {
+	if _, err := s.authorize(token, groupsWritePermission); err != nil {
+		return err
+	}
+	if _, err := s.getGroup(id); err != nil {
+		return err
+	}
+
+	userExists, err := s.userExists(userID)
+	if err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if !userExists {
+		return st.AuthError{Msg: "User does not exist", Status: 404}
+	}
+
+	if member {
+		err = s.GroupDao.AddGroupMember(id, userID)
+	} else {
+		err = s.GroupDao.RemoveGroupMember(id, userID)
+	}
+	if err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+
+	logger.Logf("INFO Membership of user %d in group %s is set to %t", userID, id, member)
+	return nil
+}
+
+// getGroup returns existing group or 404 error
+func (s *AuthService) getGroup(id string) (*st.Group, error) {
+	g, err := s.GroupDao.GetGroup(id)
+	if err != nil {
+		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if g == nil {
+		return nil, st.AuthError{Msg: "Group does not exist", Status: 404}
+	}
+	return g, nil
+}
+
+func (s *AuthService) validateGroup(g *st.Group) error {
+	if g.Name == "" {
+		return st.AuthError{Msg: "Group name is required", Status: 400}
+	}
+	for _, name := range g.Roles {
+		role, err := s.getRole(name)
+		if err != nil {
+			return st.AuthError{Msg: err.Error(), Status: 500}
+		}
+		if role == nil {
+			return st.AuthError{Msg: "Role " + name + " does not exist", Status: 400}
+		}
+	}
+	g.Roles = nonNil(g.Roles)
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/adderly/brightonum/src/dao"
+	st "github.com/adderly/brightonum/src/structs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestAuthService_CreateGroup(t *testing.T) {
+	user := createTestUser()
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+
+	roleDao := dao.MockRoleDao{}
+	roleDao.On("GetRole", "support").Return(&st.Role{Name: "support"}, nil)
+	roleDao.On("GetRole", "unknown").Return(nil, nil)
+
+	groupDao := dao.MockGroupDao{}
+	groupDao.On("GetGroup", "team").Return(nil, nil).Once()
+	groupDao.On("GetGroup", "team").Return(&st.Group{ID: "team"}, nil)
+	groupDao.On("SaveGroup", mock.Anything).Return(nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := createTestService(&mailer, &dao, createTestConfig())
+	s.RoleDao = &roleDao
+	s.GroupDao = &groupDao
+
+	group := st.Group{ID: "team", Name: "Team", Roles: []string{"support"}}
+	err := s.CreateGroup(&group, token)
+	assert.Nil(t, err)
+	groupDao.AssertCalled(t, "SaveGroup", &group)
+
+	err = s.CreateGroup(&st.Group{ID: "team", Name: "Team"}, token)
+	assert.Equal(t, st.AuthError{Msg: "Group already exists", Status: 400}, err)
+
+	generated := st.Group{Name: "Other"}
+	err = s.CreateGroup(&generated, token)
+	assert.Nil(t, err)
+	assert.Len(t, generated.ID, 32)
+	assert.Equal(t, []string{}, generated.Roles)
+
+	err = s.CreateGroup(&st.Group{ID: "bad id", Name: "Bad"}, token)
+	assert.Equal(t, st.AuthError{Msg: "Invalid group ID", Status: 400}, err)
+
+	err = s.CreateGroup(&st.Group{Name: "Other", Roles: []string{"unknown"}}, token)
+	assert.Equal(t, st.AuthError{Msg: "Role unknown does not exist", Status: 400}, err)
+
+	err = s.CreateGroup(&st.Group{ID: "nameless"}, token)
+	assert.Equal(t, st.AuthError{Msg: "Group name is required", Status: 400}, err)
+}
+
+func TestAuthService_CreateGroup_Forbidden(t *testing.T) {
+	user := createTestUser()
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&st.User{ID: 43, Username: user.Username, Permissions: []string{groupsReadPermission}}, nil)
+
+	s := createTestService(&mailer, &dao, createTestConfig())
+
+	err := s.CreateGroup(&st.Group{ID: "team", Name: "Team"}, token)
+	assert.Equal(t, st.AuthError{Msg: "Permission groups:write is required", Status: 403}, err)
+}
+
+func TestAuthService_SetGroupMember(t *testing.T) {
+	user := createTestUser()
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+	member := createAnotherTestUser()
+	member.Groups = []string{"team"}
+
+	groupDao := dao.MockGroupDao{}
+	groupDao.On("GetGroup", "team").Return(&st.Group{ID: "team", Name: "Team"}, nil)
+	groupDao.On("GetGroup", "unknown").Return(nil, nil)
+	groupDao.On("AddGroupMember", "team", member.ID).Return(nil)
+	groupDao.On("RemoveGroupMember", "team", member.ID).Return(nil)
+	groupDao.On("GetGroupMembers", "team").Return(&[]st.User{member}, nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+	dao.On("Get", member.ID).Return(&member, nil)
+	dao.On("Get", int64(44)).Return(nil, nil)
+
+	s := createTestService(&mailer, &dao, createTestConfig())
+	s.GroupDao = &groupDao
+
+	err := s.SetGroupMember("team", member.ID, true, token)
+	assert.Nil(t, err)
+	groupDao.AssertCalled(t, "AddGroupMember", "team", member.ID)
+
+	members, err := s.GetGroupMembers("team", token)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"team"}, (*members)[0].Groups)
+
+	err = s.SetGroupMember("team", member.ID, false, token)
+	assert.Nil(t, err)
+	groupDao.AssertCalled(t, "RemoveGroupMember", "team", member.ID)
+
+	err = s.SetGroupMember("team", 44, true, token)
+	assert.Equal(t, st.AuthError{Msg: "User does not exist", Status: 404}, err)
+
+	err = s.SetGroupMember("unknown", member.ID, true, token)
+	assert.Equal(t, st.AuthError{Msg: "Group does not exist", Status: 404}, err)
+
+	_, err = s.GetGroupMembers("unknown", token)
+	assert.Equal(t, st.AuthError{Msg: "Group does not exist", Status: 404}, err)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	st "github.com/adderly/brightonum/src/structs"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// signingMethodFor returns signing method matching type of the key
+func signingMethodFor(key crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256, nil
+		case elliptic.P384():
+			return jwt.SigningMethodES384, nil
+		case elliptic.P521():
+			return jwt.SigningMethodES512, nil
+		}
+		return nil, fmt.Errorf("Unsupported elliptic curve %s", k.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return signingMethodEdDSA, nil
+	}
+	return nil, fmt.Errorf("Unsupported key type %T", key)
+}
+
+// publicJWK converts public key into JWK used for signature verification
+func publicJWK(key crypto.PublicKey) (st.JSONWebKey, error) {
+	method, err := signingMethodFor(key)
+	if err != nil {
+		return st.JSONWebKey{}, err
+	}
+	jwk := st.JSONWebKey{Alg: method.Alg(), Use: "sig"}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(k.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = k.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(padBytes(k.X.Bytes(), size))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(padBytes(k.Y.Bytes(), size))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(k)
+	}
+
+	jwk.Kid = thumbprint(jwk)
+	return jwk, nil
+}
+
+// thumbprint calculates RFC 7638 JWK thumbprint, which is used as key id
+func thumbprint(jwk st.JSONWebKey) string {
+	// Required members only, in lexicographic order
+	var members interface{}
+	switch jwk.Kty {
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{jwk.Crv, jwk.Kty, jwk.X, jwk.Y}
+	case "OKP":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X}
+	default:
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N}
+	}
+	data, _ := json.Marshal(members)
+
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	result := make([]byte, size)
+	copy(result[size-len(b):], b)
+	return result
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// KeyProvider parses keys once and keeps key ring in sync with key files.
+// Keys are reloaded on SIGHUP or when modification of key files is detected.
+type KeyProvider struct {
+	Keys   *KeyRing
+	Config Config
+
+	fileStates map[string]fileState
+	done       chan struct{}
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewKeyProvider loads keys from configured files
+func NewKeyProvider(conf Config) (*KeyProvider, error) {
+	keys, err := NewKeyRingFromConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &KeyProvider{Keys: keys, Config: conf, done: make(chan struct{})}
+	p.fileStates = p.currentFileStates()
+	return p, nil
+}
+
+// Reload loads key pair from files and makes it active if key has changed.
+// Invalid key files are rejected and logged, previously loaded keys stay in use.
+func (p *KeyProvider) Reload() {
+	next, err := reloadKeyRing(p.Keys, p.Config)
+	if err == errActiveKey {
+		logger.Logf("DEBUG Key files contain active key, nothing to reload")
+		return
+	}
+	if err != nil {
+		logger.Logf("ERROR Rejected key reload, keeping key %s: %s", p.Keys.Active().ID, err.Error())
+		return
+	}
+	logger.Logf("INFO Signing key reloaded, new key id %s", next.ID)
+}
+
+// Watch reloads keys on SIGHUP and polls key files for changes with given interval.
+// Polling is disabled for non-positive interval. Blocks until Stop is called.
+func (p *KeyProvider) Watch(interval time.Duration) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	defer signal.Stop(sigChan)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-sigChan:
+			logger.Logf("INFO SIGHUP received, reloading keys")
+			p.fileStates = p.currentFileStates()
+			p.Reload()
+		case <-tick:
+			states := p.currentFileStates()
+			if p.filesChanged(states) {
+				logger.Logf("INFO Key files changed, reloading keys")
+				p.fileStates = states
+				p.Reload()
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// Stop stops watching
+func (p *KeyProvider) Stop() {
+	close(p.done)
+}
+
+func (p *KeyProvider) currentFileStates() map[string]fileState {
+	result := map[string]fileState{}
+	for _, path := range []string{p.Config.PrivKeyPath, p.Config.PubKeyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		result[path] = fileState{modTime: info.ModTime(), size: info.Size()}
+	}
+	return result
+}
+
+func (p *KeyProvider) filesChanged(states map[string]fileState) bool {
+	if len(states) != len(p.fileStates) {
+		return true
+	}
+	for path, state := range states {
+		if p.fileStates[path] != state {
+			return true
+		}
+	}
+	return false
+}
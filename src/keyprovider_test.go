@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyProvider_Reload(t *testing.T) {
+	conf := createTempKeyConfig(t)
+	defer os.RemoveAll(filepath.Dir(conf.PrivKeyPath))
+
+	p, err := NewKeyProvider(conf)
+	assert.Nil(t, err)
+	initial := p.Keys.Active()
+
+	p.Reload()
+	assert.Equal(t, initial, p.Keys.Active())
+
+	ioutil.WriteFile(conf.PrivKeyPath, []byte("garbage"), 0600)
+	p.Reload()
+	assert.Equal(t, initial, p.Keys.Active())
+
+	copyTestFile(t, "../test_data/private2.pem", conf.PrivKeyPath)
+	p.Reload()
+	assert.Equal(t, initial, p.Keys.Active())
+
+	copyTestFile(t, "../test_data/public2.pem", conf.PubKeyPath)
+	p.Reload()
+	assert.NotEqual(t, initial.ID, p.Keys.Active().ID)
+	assert.NotNil(t, p.Keys.Get(initial.ID))
+}
+
+func TestKeyProvider_Watch(t *testing.T) {
+	conf := createTempKeyConfig(t)
+	defer os.RemoveAll(filepath.Dir(conf.PrivKeyPath))
+
+	p, err := NewKeyProvider(conf)
+	assert.Nil(t, err)
+	initial := p.Keys.Active()
+
+	go p.Watch(10 * time.Millisecond)
+	defer p.Stop()
+
+	copyTestFile(t, "../test_data/private2.pem", conf.PrivKeyPath)
+	copyTestFile(t, "../test_data/public2.pem", conf.PubKeyPath)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(conf.PrivKeyPath, future, future)
+	os.Chtimes(conf.PubKeyPath, future, future)
+
+	assert.Eventually(t, func() bool {
+		return p.Keys.Active().ID != initial.ID
+	}, time.Second, 10*time.Millisecond)
+}
+
+func createTempKeyConfig(t *testing.T) Config {
+	dir, err := ioutil.TempDir("", "brightonum-keys")
+	assert.Nil(t, err)
+
+	conf := Config{
+		PrivKeyPath:         filepath.Join(dir, "private.pem"),
+		PubKeyPath:          filepath.Join(dir, "public.pem"),
+		KeyRetirementPeriod: time.Hour,
+	}
+	copyTestFile(t, "../test_data/private.pem", conf.PrivKeyPath)
+	copyTestFile(t, "../test_data/public.pem", conf.PubKeyPath)
+	return conf
+}
+
+func copyTestFile(t *testing.T, from string, to string) {
+	data, err := ioutil.ReadFile(from)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(to, data, 0600))
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	st "github.com/adderly/brightonum/src/structs"
+
+	"github.com/golang-jwt/jwt"
+)
+
+var errActiveKey = errors.New("Key files contain active key already")
+
+// SigningKey is a key used for issuing and verification of tokens
+type SigningKey struct {
+	// ID is RFC 7638 thumbprint of the public key, sent as kid header
+	ID string
+
+	// Method is signing algorithm matching type of the key
+	Method jwt.SigningMethod
+
+	// Private is nil for verification-only keys
+	Private crypto.Signer
+
+	Public crypto.PublicKey
+
+	// JWK is public key in RFC 7517 format
+	JWK st.JSONWebKey
+
+	// RetireAt is the moment after which key is not accepted anymore, zero for no retirement
+	RetireAt time.Time
+}
+
+func (k *SigningKey) retired(now time.Time) bool {
+	return !k.RetireAt.IsZero() && now.After(k.RetireAt)
+}
+
+// KeyRing holds active signing key and older keys used only for verification until retirement
+type KeyRing struct {
+	mu       sync.RWMutex
+	active   *SigningKey
+	previous []*SigningKey
+}
+
+// NewKeyRing creates key ring with given active key and verification-only keys
+func NewKeyRing(active *SigningKey, previous ...*SigningKey) *KeyRing {
+	return &KeyRing{active: active, previous: previous}
+}
+
+// NewKeyRingFromConfig loads active key pair and verification keys from files
+func NewKeyRingFromConfig(conf Config) (*KeyRing, error) {
+	active, err := loadSigningKey(conf.PrivKeyPath, conf.PubKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	previous := []*SigningKey{}
+	for _, spec := range conf.VerificationKeys {
+		key, err := loadVerificationKey(spec)
+		if err != nil {
+			return nil, err
+		}
+		previous = append(previous, key)
+	}
+
+	return NewKeyRing(active, previous...), nil
+}
+
+// Active returns key used for signing new tokens
+func (k *KeyRing) Active() *SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active
+}
+
+// Get returns key by id or nil if key is unknown or retired.
+// Empty id resolves to active key to keep accepting tokens issued without kid header.
+func (k *KeyRing) Get(kid string) *SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if kid == "" || kid == k.active.ID {
+		return k.active
+	}
+	now := time.Now()
+	for _, key := range k.previous {
+		if key.ID == kid && !key.retired(now) {
+			return key
+		}
+	}
+	return nil
+}
+
+// Keys returns active key followed by all not yet retired previous keys
+func (k *KeyRing) Keys() []*SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	now := time.Now()
+	result := []*SigningKey{k.active}
+	for _, key := range k.previous {
+		if !key.retired(now) {
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+// Rotate makes next key active. Current active key is kept for verification until retireAt.
+func (k *KeyRing) Rotate(next *SigningKey, retireAt time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.rotate(next, retireAt)
+}
+
+// RotateIfChanged makes next key active unless it is active already. Comparison and rotation
+// happen under the same lock, so concurrent reloads rotate only once.
+func (k *KeyRing) RotateIfChanged(next *SigningKey, retireAt time.Time) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if next.ID == k.active.ID {
+		return false
+	}
+	k.rotate(next, retireAt)
+	return true
+}
+
+func (k *KeyRing) rotate(next *SigningKey, retireAt time.Time) {
+	now := time.Now()
+	demoted := *k.active
+	demoted.Private = nil
+	demoted.RetireAt = retireAt
+
+	previous := []*SigningKey{&demoted}
+	for _, key := range k.previous {
+		if key.ID != next.ID && !key.retired(now) {
+			previous = append(previous, key)
+		}
+	}
+
+	k.active = next
+	k.previous = previous
+}
+
+// reloadKeyRing loads key pair from configured files and makes it active if it differs from the current one.
+// Invalid files leave the ring untouched.
+func reloadKeyRing(ring *KeyRing, conf Config) (*SigningKey, error) {
+	next, err := loadSigningKey(conf.PrivKeyPath, conf.PubKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	if !ring.RotateIfChanged(next, time.Now().Add(conf.KeyRetirementPeriod)) {
+		return nil, errActiveKey
+	}
+	return next, nil
+}
+
+func loadSigningKey(privKeyPath string, pubKeyPath string) (*SigningKey, error) {
+	keyData, err := ioutil.ReadFile(privKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	privKey, err := parsePrivateKey(keyData)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse private key %s: %s", privKeyPath, err.Error())
+	}
+
+	key, err := loadPublicKey(pubKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	if !publicKeysEqual(privKey.Public(), key.Public) {
+		return nil, fmt.Errorf("Public key %s does not match private key %s", pubKeyPath, privKeyPath)
+	}
+
+	key.Private = privKey
+	return key, nil
+}
+
+// loadVerificationKey loads public key described as path[,RFC3339 retirement time]
+func loadVerificationKey(spec string) (*SigningKey, error) {
+	parts := strings.SplitN(spec, ",", 2)
+
+	key, err := loadPublicKey(parts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if len(parts) == 2 {
+		key.RetireAt, err = time.Parse(time.RFC3339, parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid retirement time for key %s: %s", parts[0], err.Error())
+		}
+	}
+	return key, nil
+}
+
+// loadPublicKey loads RSA, ECDSA or Ed25519 public key and picks signing method by its type
+func loadPublicKey(pubKeyPath string) (*SigningKey, error) {
+	keyData, err := ioutil.ReadFile(pubKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, err := parsePublicKey(keyData)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse public key %s: %s", pubKeyPath, err.Error())
+	}
+
+	method, err := signingMethodFor(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	jwk, err := publicJWK(pubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SigningKey{ID: jwk.Kid, Method: method, Public: pubKey, JWK: jwk}, nil
+}
+
+// parsePrivateKey parses PKCS #1, SEC 1 or PKCS #8 private key in PEM format
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("Key must be PEM encoded")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// parsePublicKey parses PKIX or PKCS #1 public key in PEM format
+func parsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("Key must be PEM encoded")
+	}
+
+	if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+		return cert.PublicKey, nil
+	}
+	return x509.ParsePKCS1PublicKey(block.Bytes)
+}
+
+func publicKeysEqual(a crypto.PublicKey, b crypto.PublicKey) bool {
+	comparable, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && comparable.Equal(b)
+}
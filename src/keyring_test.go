@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyRing_Get(t *testing.T) {
+	active, err := loadSigningKey("../test_data/private2.pem", "../test_data/public2.pem")
+	assert.Nil(t, err)
+	previous, err := loadVerificationKey("../test_data/public.pem")
+	assert.Nil(t, err)
+
+	ring := NewKeyRing(active, previous)
+	assert.Equal(t, active, ring.Get(""))
+	assert.Equal(t, active, ring.Get(active.ID))
+	assert.Equal(t, previous, ring.Get(previous.ID))
+	assert.Nil(t, ring.Get("unknown"))
+	assert.Len(t, ring.Keys(), 2)
+}
+
+func TestKeyRing_Retirement(t *testing.T) {
+	active, _ := loadSigningKey("../test_data/private2.pem", "../test_data/public2.pem")
+	retired, err := loadVerificationKey("../test_data/public.pem," + time.Now().Add(-time.Minute).Format(time.RFC3339))
+	assert.Nil(t, err)
+
+	ring := NewKeyRing(active, retired)
+	assert.Nil(t, ring.Get(retired.ID))
+	assert.Equal(t, []*SigningKey{active}, ring.Keys())
+
+	_, err = loadVerificationKey("../test_data/public.pem,tomorrow")
+	assert.NotNil(t, err)
+}
+
+func TestKeyRing_Rotate(t *testing.T) {
+	first, _ := loadSigningKey("../test_data/private.pem", "../test_data/public.pem")
+	second, _ := loadSigningKey("../test_data/private2.pem", "../test_data/public2.pem")
+
+	ring := NewKeyRing(first)
+	ring.Rotate(second, time.Now().Add(time.Hour))
+
+	assert.Equal(t, second, ring.Active())
+	assert.Equal(t, second, ring.Get(""))
+	old := ring.Get(first.ID)
+	assert.NotNil(t, old)
+	assert.Nil(t, old.Private)
+	assert.Len(t, ring.Keys(), 2)
+
+	ring.Rotate(first, time.Now().Add(-time.Second))
+	assert.Equal(t, first, ring.Active())
+	assert.Nil(t, ring.Get(second.ID))
+}
+
+func TestKeyRing_RotateIfChanged(t *testing.T) {
+	first, _ := loadSigningKey("../test_data/private.pem", "../test_data/public.pem")
+	second, _ := loadSigningKey("../test_data/private2.pem", "../test_data/public2.pem")
+
+	ring := NewKeyRing(first)
+	rotated := make(chan bool, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rotated <- ring.RotateIfChanged(second, time.Now().Add(time.Hour))
+		}()
+	}
+	wg.Wait()
+	close(rotated)
+
+	count := 0
+	for r := range rotated {
+		if r {
+			count++
+		}
+	}
+	assert.Equal(t, 1, count)
+	assert.Equal(t, second, ring.Active())
+	assert.Len(t, ring.Keys(), 2)
+	assert.Nil(t, ring.Get(first.ID).Private)
+}
+
+func TestLoadSigningKey_Mismatch(t *testing.T) {
+	_, err := loadSigningKey("../test_data/private.pem", "../test_data/public2.pem")
+	assert.NotNil(t, err)
+}
+
+func TestLoadSigningKey_KeyTypes(t *testing.T) {
+	ec, err := loadSigningKey("../test_data/ec_private.pem", "../test_data/ec_public.pem")
+	assert.Nil(t, err)
+	assert.Equal(t, "ES256", ec.Method.Alg())
+	assert.Equal(t, "EC", ec.JWK.Kty)
+
+	ed, err := loadSigningKey("../test_data/ed25519_private.pem", "../test_data/ed25519_public.pem")
+	assert.Nil(t, err)
+	assert.Equal(t, "EdDSA", ed.Method.Alg())
+	assert.Equal(t, "OKP", ed.JWK.Kty)
+
+	_, err = loadSigningKey("../test_data/ec_private.pem", "../test_data/ed25519_public.pem")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/adderly/brightonum/src/crypto"
+	st "github.com/adderly/brightonum/src/structs"
+)
+
+const (
+	lockoutUserPrefix = "user:"
+	lockoutIPPrefix   = "ip:"
+	lockoutMFAPrefix  = "mfa:"
+)
+
+// lockoutKey is a key failed password attempts are counted by with threshold of its lockout
+type lockoutKey struct {
+	key       string
+	threshold int
+}
+
+// checkPassword checks password of the user. Attempts are counted per username and client IP,
+// both are locked out for exponentially growing time after reaching thresholds. Empty IP is not counted.
+func (s *AuthService) checkPassword(username, password, ip string) (*st.User, error) {
+	keys := s.lockoutKeys(username, ip)
+	attempts, err := s.reserveLoginAttempt(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := s.UserDao.GetByUsername(username)
+	if err != nil {
+		s.releaseLoginAttempt(keys)
+		return nil, st.AuthError{Msg: "Cannot extract user", Status: 500}
+	}
+	if u == nil || !crypto.Match(password, u.Password) {
+		s.lockOutFailed(keys, attempts)
+		return nil, st.AuthError{Msg: "Username or password is wrong", Status: 403}
+	}
+
+	// Attempts of the IP are not reset, otherwise any known password would allow guessing others
+	userKey := lockoutUserPrefix + strings.ToLower(username)
+	for _, k := range keys {
+		if k.key == userKey {
+			err = s.LoginAttemptDao.DeleteLoginAttempts(k.key)
+		} else {
+			err = s.LoginAttemptDao.ReleaseLoginAttempt(k.key)
+		}
+		if err != nil {
+			return nil, st.AuthError{Msg: err.Error(), Status: 500}
+		}
+	}
+	return u, nil
+}
+
+// UnlockUsername forgets failed password and second factor attempts and lockout of username
+func (s *AuthService) UnlockUsername(username string, token string) error {
+	if err := s.unlock(lockoutUserPrefix+strings.ToLower(username), token); err != nil {
+		return err
+	}
+	if err := s.LoginAttemptDao.DeleteLoginAttempts(lockoutMFAPrefix + strings.ToLower(username)); err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	return nil
+}
+
+// UnlockIP forgets failed password attempts and lockout of client IP
+func (s *AuthService) UnlockIP(ip string, token string) error {
+	return s.unlock(lockoutIPPrefix+ip, token)
+}
+
+// PruneLoginAttempts removes failed password attempts which are not counted anymore
+func (s *AuthService) PruneLoginAttempts() {
+	pruned, err := s.LoginAttemptDao.PruneLoginAttempts(time.Now().UTC().Unix())
+	if err != nil {
+		logger.Logf("ERROR Cannot prune login attempts: %s", err.Error())
+		return
+	}
+	logger.Logf("DEBUG Pruned %d login attempts", pruned)
+}
+
+func (s *AuthService) unlock(key string, token string) error {
+	if _, err := s.authorize(token, usersWritePermission); err != nil {
+		return err
+	}
+	if err := s.LoginAttemptDao.DeleteLoginAttempts(key); err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	logger.Logf("INFO %s is unlocked", key)
+	return nil
+}
+
+// lockoutKeys returns keys of the attempt, keys with disabled lockout are omitted
+func (s *AuthService) lockoutKeys(username, ip string) []lockoutKey {
+	keys := []lockoutKey{}
+	if s.Config.LockoutThreshold > 0 {
+		keys = append(keys, lockoutKey{lockoutUserPrefix + strings.ToLower(username), s.Config.LockoutThreshold})
+	}
+	if s.Config.LockoutIPThreshold > 0 && ip != "" {
+		keys = append(keys, lockoutKey{lockoutIPPrefix + ip, s.Config.LockoutIPThreshold})
+	}
+	return keys
+}
+
+// checkLockout returns 429 error when any of the keys is locked, otherwise their attempts
+func (s *AuthService) checkLockout(keys []lockoutKey) (map[string]*st.LoginAttempts, error) {
+	now := time.Now().UTC().Unix()
+	attempts := map[string]*st.LoginAttempts{}
+	for _, k := range keys {
+		a, err := s.LoginAttemptDao.GetLoginAttempts(k.key)
+		if err != nil {
+			return nil, st.AuthError{Msg: err.Error(), Status: 500}
+		}
+		if a == nil {
+			continue
+		}
+		if a.LockedUntil > now {
+			logger.Logf("WARN %s is locked out for %d seconds", k.key, a.LockedUntil-now)
+			return nil, st.AuthError{Msg: "Too many failed attempts, try again later", Status: 429, RetryAfter: a.LockedUntil - now}
+		}
+		attempts[k.key] = a
+	}
+	return attempts, nil
+}
+
+// reserveLoginAttempt counts password attempt for the keys before the password is checked, so parallel
+// guesses can not get past thresholds. Over threshold only the attempt following an expired lockout is
+// checked, the ones racing it are rejected with 429 error and lock the key out again.
+// Returns attempts of the keys including this one.
+func (s *AuthService) reserveLoginAttempt(keys []lockoutKey) (map[string]*st.LoginAttempts, error) {
+	previous, err := s.checkLockout(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	attempts := map[string]*st.LoginAttempts{}
+	for i, k := range keys {
+		a, err := s.countAttempt(k.key, previous[k.key], now)
+		if err != nil {
+			s.releaseLoginAttempt(keys[:i])
+			return nil, st.AuthError{Msg: err.Error(), Status: 500}
+		}
+		attempts[k.key] = a
+
+		p := previous[k.key]
+		if a.Failures > int64(k.threshold) && (p == nil || a.Failures != p.Failures+1) {
+			lockout := s.lockOut(k, a, now)
+			return nil, st.AuthError{Msg: "Too many failed attempts, try again later", Status: 429, RetryAfter: int64(lockout.Seconds())}
+		}
+	}
+	return attempts, nil
+}
+
+// releaseLoginAttempt forgets attempt reserved for the keys which was not checked.
+// Errors are only logged as the attempt is rejected anyway.
+func (s *AuthService) releaseLoginAttempt(keys []lockoutKey) {
+	for _, k := range keys {
+		if err := s.LoginAttemptDao.ReleaseLoginAttempt(k.key); err != nil {
+			logger.Logf("ERROR Cannot release login attempt: %s", err.Error())
+		}
+	}
+}
+
+// lockOutFailed locks out keys of failed attempt which reach threshold
+func (s *AuthService) lockOutFailed(keys []lockoutKey, attempts map[string]*st.LoginAttempts) {
+	now := time.Now().UTC()
+	for _, k := range keys {
+		if a := attempts[k.key]; a.Failures >= int64(k.threshold) {
+			s.lockOut(k, a, now)
+		}
+	}
+}
+
+// lockOut locks the key out for time doubled by every failure over threshold and returns it.
+// Errors are only logged as the attempt is rejected anyway.
+func (s *AuthService) lockOut(k lockoutKey, a *st.LoginAttempts, now time.Time) time.Duration {
+	lockout := lockoutDuration(s.Config.LockoutDuration, s.Config.LockoutMaxDuration, a.Failures-int64(k.threshold))
+	if err := s.LoginAttemptDao.SetLoginLockout(k.key, now.Add(lockout).Unix()); err != nil {
+		logger.Logf("ERROR Cannot lock out %s: %s", k.key, err.Error())
+		return lockout
+	}
+	logger.Logf("WARN %s is locked out for %s after %d failed attempts", k.key, lockout, a.Failures)
+	return lockout
+}
+
+// countAttempt atomically counts attempt of the key for lockout window and returns attempts including it.
+// Expired attempts are pruned periodically, they must not be counted until then, so previous ones are
+// forgotten first when they are expired.
+func (s *AuthService) countAttempt(key string, previous *st.LoginAttempts, now time.Time) (*st.LoginAttempts, error) {
+	if previous != nil && previous.ExpiresAt < now.Unix() {
+		if err := s.LoginAttemptDao.DeleteLoginAttempts(key); err != nil {
+			return nil, err
+		}
+	}
+	return s.LoginAttemptDao.AddLoginFailure(key, now.Add(s.Config.LockoutWindow).Unix())
+}
+
+// reserveMFAAttempt counts second factor attempt of the user before its code is checked, so parallel
+// guesses can not exceed the limit. Returns attempts of the window including this one, nil when the limit
+// is disabled, and 429 error when the limit has been reached already.
+func (s *AuthService) reserveMFAAttempt(u *st.User) (*st.LoginAttempts, error) {
+	if s.Config.MFAMaxAttempts <= 0 {
+		return nil, nil
+	}
+	key := lockoutMFAPrefix + strings.ToLower(u.Username)
+	a, err := s.LoginAttemptDao.GetLoginAttempts(key)
+	if err != nil {
+		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	a, err = s.countAttempt(key, a, time.Now().UTC())
+	if err != nil {
+		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if a.Failures > int64(s.Config.MFAMaxAttempts) {
+		return a, s.mfaLockedError(a)
+	}
+	return a, nil
+}
+
+// resetMFAAttempts forgets second factor attempts of the user after successful check
+func (s *AuthService) resetMFAAttempts(u *st.User) error {
+	if s.Config.MFAMaxAttempts <= 0 {
+		return nil
+	}
+	if err := s.LoginAttemptDao.DeleteLoginAttempts(lockoutMFAPrefix + strings.ToLower(u.Username)); err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	return nil
+}
+
+// mfaLockedError returns 429 error telling when the second factor can be tried again
+func (s *AuthService) mfaLockedError(a *st.LoginAttempts) error {
+	retryAfter := a.ExpiresAt - time.Now().UTC().Unix()
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	return st.AuthError{Msg: "Too many wrong authentication codes, try again later", Status: 429, RetryAfter: retryAfter}
+}
+
+// lockoutDuration doubles base duration for every failure over threshold up to max
+func lockoutDuration(base, max time.Duration, overThreshold int64) time.Duration {
+	d := base
+	for i := int64(0); i < overThreshold && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		return max
+	}
+	return d
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adderly/brightonum/src/dao"
+	st "github.com/adderly/brightonum/src/structs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func createTestLockoutConfig() Config {
+	conf := createTestConfig()
+	conf.LockoutThreshold = 3
+	conf.LockoutIPThreshold = 10
+	conf.LockoutDuration = time.Minute
+	conf.LockoutMaxDuration = time.Hour
+	conf.LockoutWindow = time.Hour
+	return conf
+}
+
+func TestAuthService_BasicAuthToken_Lockout(t *testing.T) {
+	user := createTestUser()
+
+	attemptDao := dao.MockLoginAttemptDao{}
+	attemptDao.On("GetLoginAttempts", "user:alle").Return(&st.LoginAttempts{Failures: 3, LockedUntil: time.Now().Add(-time.Minute).Unix(), ExpiresAt: time.Now().Add(time.Hour).Unix()}, nil)
+	attemptDao.On("GetLoginAttempts", "ip:192.0.2.1").Return(nil, nil)
+	attemptDao.On("AddLoginFailure", "user:alle", mock.Anything).Return(&st.LoginAttempts{ID: "user:alle", Failures: 4}, nil)
+	attemptDao.On("AddLoginFailure", "ip:192.0.2.1", mock.Anything).Return(&st.LoginAttempts{ID: "ip:192.0.2.1", Failures: 1}, nil)
+	var lockedUntil int64
+	attemptDao.On("SetLoginLockout", "user:alle", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		lockedUntil = args.Get(1).(int64)
+	})
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", "Alle").Return(&user, nil)
+
+	s := createTestService(&MailerMock{}, &dao, createTestLockoutConfig())
+	s.LoginAttemptDao = &attemptDao
+
+	_, _, err := s.BasicAuthToken("Alle", "wrong", "", "192.0.2.1")
+	assert.Equal(t, 403, err.(st.AuthError).Status)
+
+	// Attempt after expired lockout is checked, its failure doubles the lockout
+	assert.InDelta(t, time.Now().Add(2*time.Minute).Unix(), lockedUntil, 2)
+	attemptDao.AssertNotCalled(t, "SetLoginLockout", "ip:192.0.2.1", mock.Anything)
+}
+
+func TestAuthService_BasicAuthToken_LockedOut(t *testing.T) {
+	user := createTestUser()
+
+	attemptDao := dao.MockLoginAttemptDao{}
+	attemptDao.On("GetLoginAttempts", "user:alle").Return(&st.LoginAttempts{Failures: 3, LockedUntil: time.Now().Add(time.Minute).Unix()}, nil)
+
+	dao := dao.MockUserDao{}
+
+	s := createTestService(&MailerMock{}, &dao, createTestLockoutConfig())
+	s.LoginAttemptDao = &attemptDao
+
+	_, _, err := s.BasicAuthToken(user.Username, "oakheart", "", "192.0.2.1")
+	authErr := err.(st.AuthError)
+	assert.Equal(t, 429, authErr.Status)
+	assert.InDelta(t, 60, authErr.RetryAfter, 2)
+	dao.AssertNotCalled(t, "GetByUsername", mock.Anything)
+}
+
+func TestAuthService_Authorize_LockedOutIP(t *testing.T) {
+	user := createTestUser()
+	client := createTestClient()
+
+	clientDao := dao.MockClientDao{}
+	clientDao.On("GetClient", client.ID).Return(&client, nil)
+	attemptDao := dao.MockLoginAttemptDao{}
+	attemptDao.On("GetLoginAttempts", "user:alle").Return(nil, nil)
+	attemptDao.On("GetLoginAttempts", "ip:192.0.2.1").Return(&st.LoginAttempts{Failures: 10, LockedUntil: time.Now().Add(time.Minute).Unix()}, nil)
+
+	dao := dao.MockUserDao{}
+
+	s := createTestService(&MailerMock{}, &dao, createTestLockoutConfig())
+	s.ClientDao = &clientDao
+	s.LoginAttemptDao = &attemptDao
+
+	req := createTestAuthorizationRequest()
+	_, err := s.Authorize(&req, user.Username, "oakheart", "", "192.0.2.1")
+	assert.Equal(t, 429, err.(st.AuthError).Status)
+
+	err = s.ApproveDeviceWithCredentials("WDJB-MJHT", user.Username, "oakheart", "", true, "192.0.2.1")
+	assert.Equal(t, 429, err.(st.AuthError).Status)
+	dao.AssertNotCalled(t, "GetByUsername", mock.Anything)
+}
+
+func TestAuthService_BasicAuthToken_ResetsAttempts(t *testing.T) {
+	user := createTestUser()
+
+	attemptDao := dao.MockLoginAttemptDao{}
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	attemptDao.On("GetLoginAttempts", "user:alle").Return(&st.LoginAttempts{Failures: 2, ExpiresAt: expiresAt}, nil)
+	attemptDao.On("GetLoginAttempts", "ip:192.0.2.1").Return(&st.LoginAttempts{Failures: 2, ExpiresAt: expiresAt}, nil)
+	attemptDao.On("AddLoginFailure", mock.Anything, mock.Anything).Return(&st.LoginAttempts{Failures: 3}, nil)
+	attemptDao.On("DeleteLoginAttempts", "user:alle").Return(nil)
+	attemptDao.On("ReleaseLoginAttempt", "ip:192.0.2.1").Return(nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := createTestService(&MailerMock{}, &dao, createTestLockoutConfig())
+	s.LoginAttemptDao = &attemptDao
+
+	accessToken, _, err := s.BasicAuthToken(user.Username, "oakheart", "", "192.0.2.1")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, accessToken)
+	attemptDao.AssertCalled(t, "DeleteLoginAttempts", "user:alle")
+	attemptDao.AssertNotCalled(t, "DeleteLoginAttempts", "ip:192.0.2.1")
+	attemptDao.AssertCalled(t, "ReleaseLoginAttempt", "ip:192.0.2.1")
+	attemptDao.AssertNotCalled(t, "SetLoginLockout", mock.Anything, mock.Anything)
+}
+
+func TestAuthService_BasicAuthToken_ParallelGuesses(t *testing.T) {
+	user := createTestUser()
+
+	// All guesses read attempts before any of them is counted
+	attemptDao := dao.MockLoginAttemptDao{}
+	attemptDao.On("GetLoginAttempts", "user:alle").Return(nil, nil)
+	for i := int64(1); i <= 10; i++ {
+		attemptDao.On("AddLoginFailure", "user:alle", mock.Anything).Return(&st.LoginAttempts{Failures: i}, nil).Once()
+	}
+	attemptDao.On("SetLoginLockout", "user:alle", mock.Anything).Return(nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	conf := createTestLockoutConfig()
+	conf.LockoutIPThreshold = 0
+	s := createTestService(&MailerMock{}, &dao, conf)
+	s.LoginAttemptDao = &attemptDao
+
+	statuses := make(chan int, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := s.BasicAuthToken(user.Username, "wrong", "", "")
+			statuses <- err.(st.AuthError).Status
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	counts := map[int]int{}
+	for status := range statuses {
+		counts[status]++
+	}
+	// Only guesses within threshold are checked
+	assert.Equal(t, map[int]int{403: 3, 429: 7}, counts)
+}
+
+func TestAuthService_BasicAuthToken_ExpiredAttempts(t *testing.T) {
+	user := createTestUser()
+
+	attemptDao := dao.MockLoginAttemptDao{}
+	attemptDao.On("GetLoginAttempts", "user:alle").Return(&st.LoginAttempts{Failures: 5, ExpiresAt: time.Now().Add(-time.Minute).Unix()}, nil)
+	attemptDao.On("DeleteLoginAttempts", "user:alle").Return(nil)
+	attemptDao.On("AddLoginFailure", "user:alle", mock.Anything).Return(&st.LoginAttempts{Failures: 1}, nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	conf := createTestLockoutConfig()
+	conf.LockoutIPThreshold = 0
+	s := createTestService(&MailerMock{}, &dao, conf)
+	s.LoginAttemptDao = &attemptDao
+
+	_, _, err := s.BasicAuthToken(user.Username, "wrong", "", "192.0.2.1")
+	assert.Equal(t, 403, err.(st.AuthError).Status)
+	attemptDao.AssertCalled(t, "DeleteLoginAttempts", "user:alle")
+	attemptDao.AssertNotCalled(t, "SetLoginLockout", mock.Anything, mock.Anything)
+}
+
+func TestAuthService_UnlockUsername(t *testing.T) {
+	user := createTestUser()
+	user2 := createAnotherTestUser()
+
+	attemptDao := dao.MockLoginAttemptDao{}
+	attemptDao.On("DeleteLoginAttempts", "user:sarah").Return(nil)
+	attemptDao.On("DeleteLoginAttempts", "mfa:sarah").Return(nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+	dao.On("GetByUsername", user2.Username).Return(&user2, nil)
+
+	s := createTestService(&MailerMock{}, &dao, createTestLockoutConfig())
+	s.LoginAttemptDao = &attemptDao
+
+	err := s.UnlockUsername("Sarah", issueTestToken(user2.ID, user2.Username, "../test_data/private.pem"))
+	assert.Equal(t, 403, err.(st.AuthError).Status)
+	attemptDao.AssertNotCalled(t, "DeleteLoginAttempts", mock.Anything)
+
+	err = s.UnlockUsername("Sarah", issueTestToken(user.ID, user.Username, "../test_data/private.pem"))
+	assert.Nil(t, err)
+	attemptDao.AssertCalled(t, "DeleteLoginAttempts", "user:sarah")
+	attemptDao.AssertCalled(t, "DeleteLoginAttempts", "mfa:sarah")
+}
+
+func TestLockoutDuration(t *testing.T) {
+	assert.Equal(t, time.Minute, lockoutDuration(time.Minute, time.Hour, 0))
+	assert.Equal(t, 8*time.Minute, lockoutDuration(time.Minute, time.Hour, 3))
+	assert.Equal(t, time.Hour, lockoutDuration(time.Minute, time.Hour, 100))
+}
@@ -8,6 +8,7 @@ import (
 type Mailer interface {
 	SendRecoveryCode(string, string) error
 	SendInviteCode(string, string) error
+	SendLoginCode(string, string, string) error
 }
 
 // EmailMailer sends emails
@@ -43,3 +44,18 @@ func (m *EmailMailer) SendInviteCode(to string, code string) error {
 		"\r\n")
 	return smtp.SendMail("smtp.gmail.com:587", auth, m.Email, []string{to}, msg)
 }
+
+// SendLoginCode sends passwordless login code and link, link is omitted when it is empty
+func (m *EmailMailer) SendLoginCode(to string, code string, link string) error {
+	auth := smtp.PlainAuth("", m.Email, m.Password, "smtp.gmail.com")
+
+	body := "Your login code: " + code + "\r\n"
+	if link != "" {
+		body += "Or follow the link to log in: " + link + "\r\n"
+	}
+	msg := []byte("To: " + to + "\r\n" +
+		"Subject: AirPicHub login code\r\n" +
+		"\r\n" +
+		body)
+	return smtp.SendMail("smtp.gmail.com:587", auth, m.Email, []string{to}, msg)
+}
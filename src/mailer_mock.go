@@ -18,3 +18,8 @@ func (m *MailerMock) SendRecoveryCode(to string, code string) error {
 func (m *MailerMock) SendInviteCode(to string, code string) error {
 	return m.Called(to, code).Error(0)
 }
+
+// SendLoginCode mock sending passwordless login code and link
+func (m *MailerMock) SendLoginCode(to string, code string, link string) error {
+	return m.Called(to, code, link).Error(0)
+}
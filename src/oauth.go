@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/adderly/brightonum/src/crypto"
+	st "github.com/adderly/brightonum/src/structs"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	passwordGrant          = "password"
+	refreshTokenGrant      = "refresh_token"
+	authorizationCodeGrant = "authorization_code"
+	clientCredentialsGrant = "client_credentials"
+	codeResponseType       = "code"
+	pkceMethodS256         = "S256"
+)
+
+// RFC 7636 code challenge and verifier are 43-128 characters of unreserved URI characters
+var pkceValuePattern = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+// GrantToken issues tokens for RFC 6749 token request of any supported grant type.
+// ID token is issued for openid scope of password and refresh token grants as well.
+func (s *AuthService) GrantToken(req *st.TokenRequest) (*st.OAuthTokenResp, error) {
+	var accessToken, refreshToken, idToken string
+	var err error
+
+	switch req.GrantType {
+	case passwordGrant:
+		accessToken, refreshToken, err = s.BasicAuthToken(req.Username, req.Password, req.Audience, req.ClientIP)
+	case refreshTokenGrant:
+		if req.RefreshToken == "" {
+			return nil, st.AuthError{Msg: "Refresh token is missing", Status: 400}
+		}
+		accessToken, refreshToken, err = s.RefreshToken(req.RefreshToken, req.ClientID, req.ClientSecret)
+	case authorizationCodeGrant:
+		accessToken, refreshToken, idToken, err = s.ExchangeAuthorizationCode(req.Code, req.ClientID, req.ClientSecret, req.RedirectURI, req.CodeVerifier)
+	case clientCredentialsGrant:
+		accessToken, err = s.ClientCredentialsToken(req.ClientID, req.ClientSecret, req.Scope, req.Audience)
+	case deviceCodeGrant:
+		accessToken, refreshToken, idToken, err = s.DeviceCodeToken(req.DeviceCode, req.ClientID)
+	case "":
+		return nil, st.AuthError{Msg: "Grant type is missing", Status: 400}
+	default:
+		return nil, st.AuthError{Msg: "Grant type is not supported: " + req.GrantType, Status: 400, Code: "unsupported_grant_type"}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Client credentials grant has no user, hence neither refresh nor ID token
+	if idToken == "" && refreshToken != "" && hasScope(req.Scope, openIDScope) {
+		idToken, err = s.IDToken(accessToken, req.Nonce)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return newTokenResponse(accessToken, refreshToken, idToken), nil
+}
+
+// newTokenResponse builds token response, lifetime and scope are taken from just issued access token
+func newTokenResponse(accessToken, refreshToken, idToken string) *st.OAuthTokenResp {
+	claims := jwt.MapClaims{}
+	new(jwt.Parser).ParseUnverified(accessToken, claims)
+
+	return &st.OAuthTokenResp{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    claimInt(claims, "exp") - time.Now().UTC().Unix(),
+		RefreshToken: refreshToken,
+		IDToken:      idToken,
+		Scope:        claimString(claims, "scope"),
+	}
+}
+
+// GetAuthorizationClient returns client of authorization request with registered redirect URI.
+// Such errors must not be redirected back to the client, they are shown to the user instead.
+func (s *AuthService) GetAuthorizationClient(req *st.AuthorizationRequest) (*st.Client, error) {
+	if req.ClientID == "" {
+		return nil, st.AuthError{Msg: "Client ID is missing", Status: 400}
+	}
+	client, err := s.ClientDao.GetClient(req.ClientID)
+	if err != nil {
+		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if client == nil {
+		return nil, st.AuthError{Msg: "Unknown client", Status: 400}
+	}
+	if !client.HasRedirectURI(req.RedirectURI) {
+		return nil, st.AuthError{Msg: "Redirect URI is not registered for the client", Status: 400}
+	}
+	return client, nil
+}
+
+// ValidateAuthorizationRequest checks authorization request of known client.
+// Returns OAuthError which is redirected back to the client.
+func (s *AuthService) ValidateAuthorizationRequest(req *st.AuthorizationRequest) error {
+	if req.ResponseType != codeResponseType {
+		return st.OAuthError{Code: "unsupported_response_type", Description: "Only code response type is supported", Status: 400}
+	}
+	if req.CodeChallengeMethod != pkceMethodS256 || !pkceValuePattern.MatchString(req.CodeChallenge) {
+		return st.OAuthError{Code: "invalid_request", Description: "PKCE code challenge with S256 method is required", Status: 400}
+	}
+	return nil
+}
+
+// Authorize checks user credentials and issues authorization code for the request, failures are counted for client ip as well
+func (s *AuthService) Authorize(req *st.AuthorizationRequest, username, password, otp string, ip string) (string, error) {
+	if _, err := s.GetAuthorizationClient(req); err != nil {
+		return "", err
+	}
+	if err := s.ValidateAuthorizationRequest(req); err != nil {
+		return "", err
+	}
+
+	user, err := s.checkCredentials(username, password, otp, ip)
+	if err != nil {
+		return "", err
+	}
+
+	code := generateTokenID()
+	err = s.AuthCodeDao.SaveAuthorizationCode(&st.AuthorizationCode{
+		ID:            hashCode(code),
+		ClientID:      req.ClientID,
+		RedirectURI:   req.RedirectURI,
+		UserID:        user.ID,
+		Scope:         req.Scope,
+		Nonce:         req.Nonce,
+		CodeChallenge: req.CodeChallenge,
+		ExpiresAt:     time.Now().Add(s.Config.AuthCodeLifetime).UTC().Unix(),
+	})
+	if err != nil {
+		return "", st.AuthError{Msg: err.Error(), Status: 500}
+	}
+
+	logger.Logf("INFO Authorization code is issued for user %d and client %s", user.ID, req.ClientID)
+	return code, nil
+}
+
+// ExchangeAuthorizationCode exchanges authorization code for access and refresh tokens.
+// Code can be used only once, client, redirect URI and PKCE verifier must match the authorization request.
+// Confidential client has to present its secret. ID token is issued for openid scope, otherwise it is empty.
+func (s *AuthService) ExchangeAuthorizationCode(code, clientID, secret, redirectURI, verifier string) (string, string, string, error) {
+	invalidErr := st.AuthError{Msg: "Authorization code is not valid", Status: 400, Code: "invalid_grant"}
+
+	if err := s.checkClientSecret(clientID, secret); err != nil {
+		return "", "", "", err
+	}
+
+	stored, err := s.AuthCodeDao.ConsumeAuthorizationCode(hashCode(code))
+	if err != nil {
+		return "", "", "", st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if stored == nil || stored.ExpiresAt < time.Now().UTC().Unix() {
+		return "", "", "", invalidErr
+	}
+	if stored.ClientID != clientID || stored.RedirectURI != redirectURI {
+		logger.Logf("WARN Authorization code of client %s is used by client %s", stored.ClientID, clientID)
+		return "", "", "", invalidErr
+	}
+	if !verifyCodeChallenge(stored.CodeChallenge, verifier) {
+		logger.Logf("WARN PKCE verification failed for client %s", clientID)
+		return "", "", "", invalidErr
+	}
+
+	u, err := s.UserDao.Get(stored.UserID)
+	if err != nil {
+		return "", "", "", st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if u == nil {
+		return "", "", "", invalidErr
+	}
+
+	authTime := time.Now().UTC().Unix()
+	accessToken, err := s.issueAccessToken(u, s.Config.Audience, authTime)
+	if err != nil {
+		return "", "", "", err
+	}
+	refreshToken, err := s.issueRefreshToken(u, "", clientID, s.Config.Audience, authTime)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	idToken := ""
+	if hasScope(stored.Scope, openIDScope) {
+		// ID token is meant for the client itself
+		idToken, err = s.issueIDToken(u, clientID, stored.Nonce, authTime)
+		if err != nil {
+			return "", "", "", err
+		}
+	}
+	return accessToken, refreshToken, idToken, nil
+}
+
+// ClientCredentialsToken issues access token for confidential client authenticated with its secret.
+// Subject of the token is the client. Empty scope stands for all scopes allowed for the client.
+func (s *AuthService) ClientCredentialsToken(clientID, secret, scope, audience string) (string, error) {
+	audience, err := s.resolveAudience(audience)
+	if err != nil {
+		return "", err
+	}
+
+	client, err := s.authenticateClient(clientID, secret)
+	if err != nil {
+		return "", err
+	}
+	if !client.Confidential {
+		return "", st.AuthError{Msg: "Client credentials grant is allowed only for confidential clients", Status: 400, Code: "unauthorized_client"}
+	}
+
+	scopes := strings.Fields(scope)
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+	for _, requested := range scopes {
+		if !client.HasScope(requested) {
+			return "", st.AuthError{Msg: "Scope is not allowed for the client: " + requested, Status: 400, Code: "invalid_scope"}
+		}
+	}
+
+	lifetime, _ := s.Config.TokenLifetimes(audience)
+	claims := s.standardClaims(audience, lifetime)
+	claims["sub"] = client.ID
+	claims["client_id"] = client.ID
+	claims["token_use"] = accessTokenUse
+	claims["jti"] = generateTokenID()
+	if len(scopes) > 0 {
+		claims["scope"] = strings.Join(scopes, " ")
+	}
+
+	logger.Logf("INFO Access token is issued for client %s", client.ID)
+	return s.signToken(claims)
+}
+
+// authenticateClient returns confidential client with matching secret
+func (s *AuthService) authenticateClient(clientID string, secret string) (*st.Client, error) {
+	client, err := s.ClientDao.GetClient(clientID)
+	if err != nil {
+		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if client == nil || client.SecretHash == "" || !crypto.Match(secret, client.SecretHash) {
+		logger.Logf("WARN Authentication of client %s failed", clientID)
+		return nil, st.AuthError{Msg: "Client authentication failed", Status: 401, Code: "invalid_client"}
+	}
+	return client, nil
+}
+
+// checkClientSecret authenticates client when it is confidential, public and unknown clients have no secret to check
+func (s *AuthService) checkClientSecret(clientID string, secret string) error {
+	client, err := s.ClientDao.GetClient(clientID)
+	if err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if client == nil || !client.Confidential {
+		return nil
+	}
+	_, err = s.authenticateClient(clientID, secret)
+	return err
+}
+
+// PruneAuthorizationCodes removes expired authorization codes which have never been exchanged
+func (s *AuthService) PruneAuthorizationCodes() {
+	pruned, err := s.AuthCodeDao.PruneAuthorizationCodes(time.Now().UTC().Unix())
+	if err != nil {
+		logger.Logf("ERROR Cannot prune authorization codes: %s", err.Error())
+		return
+	}
+	logger.Logf("DEBUG Pruned %d authorization codes", pruned)
+}
+
+// CreateClient registers OAuth client, client ID is generated when missing.
+// Secret of confidential client is generated and returned in the client only once.
+func (s *AuthService) CreateClient(c *st.Client, token string) error {
+	if _, err := s.authorize(token, clientsWritePermission); err != nil {
+		return err
+	}
+
+	if c.Name == "" {
+		return st.AuthError{Msg: "Client name is required", Status: 400}
+	}
+	if !c.Confidential && len(c.RedirectURIs) == 0 {
+		return st.AuthError{Msg: "Redirect URIs are required for public client", Status: 400}
+	}
+	if !c.Confidential && len(c.Scopes) > 0 {
+		return st.AuthError{Msg: "Scopes can be set only for confidential client", Status: 400}
+	}
+	for _, uri := range c.RedirectURIs {
+		if !validRedirectURI(uri) {
+			return st.AuthError{Msg: "Invalid redirect URI " + uri, Status: 400}
+		}
+	}
+
+	if c.ID == "" {
+		c.ID = generateTokenID()
+	} else {
+		existing, err := s.ClientDao.GetClient(c.ID)
+		if err != nil {
+			return st.AuthError{Msg: err.Error(), Status: 500}
+		}
+		if existing != nil {
+			return st.AuthError{Msg: "Client already exists", Status: 400}
+		}
+	}
+
+	c.Secret = ""
+	c.SecretHash = ""
+	secret := ""
+	if c.Confidential {
+		secret = generateTokenID() + generateTokenID()
+		hash, err := crypto.Hash(secret)
+		if err != nil {
+			logger.Logf("ERROR Failed to hash client secret, %s", err.Error())
+			return st.AuthError{Msg: err.Error(), Status: 500}
+		}
+		c.SecretHash = hash
+	}
+
+	err := s.ClientDao.SaveClient(c)
+	if err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	c.Secret = secret
+	return nil
+}
+
+// GetClients returns all registered OAuth clients
+func (s *AuthService) GetClients(token string) (*[]st.Client, error) {
+	if _, err := s.authorize(token, clientsReadPermission); err != nil {
+		return nil, err
+	}
+
+	clients, err := s.ClientDao.GetClients()
+	if err != nil {
+		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	return clients, nil
+}
+
+// DeleteClient removes registered OAuth client
+func (s *AuthService) DeleteClient(id string, token string) error {
+	if _, err := s.authorize(token, clientsWritePermission); err != nil {
+		return err
+	}
+
+	err := s.ClientDao.DeleteClient(id)
+	if err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	return nil
+}
+
+// verifyCodeChallenge checks RFC 7636 S256 code challenge against code verifier
+func verifyCodeChallenge(challenge string, verifier string) bool {
+	if !pkceValuePattern.MatchString(verifier) {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// hashCode returns SHA-256 hash of the code, which is stored instead of the code itself
+func hashCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// validRedirectURI checks that redirect URI is absolute and has no fragment.
+// Custom schemes are allowed for mobile apps.
+func validRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	return err == nil && u.IsAbs() && u.Fragment == ""
+}
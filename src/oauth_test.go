@@ -0,0 +1,372 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adderly/brightonum/src/crypto"
+	"github.com/adderly/brightonum/src/dao"
+	st "github.com/adderly/brightonum/src/structs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// RFC 7636 Appendix B example
+const (
+	testCodeVerifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	testCodeChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+func TestAuthService_GrantToken(t *testing.T) {
+	user := createTestUser()
+	jobs := createTestConfidentialClient()
+
+	clientDao := dao.MockClientDao{}
+	clientDao.On("GetClient", jobs.ID).Return(&jobs, nil)
+	tokenDao := dao.MockRefreshTokenDao{}
+	tokenDao.On("SaveRefreshToken", mock.Anything).Return(nil)
+	tokenDao.On("GetRefreshToken", mock.Anything).Return(&st.RefreshToken{Family: "family"}, nil)
+	tokenDao.On("MarkRefreshTokenUsed", mock.Anything).Return(true, nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := createTestService(&mailer, &dao, createTestConfig())
+	s.ClientDao = &clientDao
+	s.RefreshTokenDao = &tokenDao
+
+	resp, err := s.GrantToken(&st.TokenRequest{GrantType: "password", Username: user.Username, Password: "oakheart", Scope: "openid"})
+	assert.Nil(t, err)
+	assert.Equal(t, "Bearer", resp.TokenType)
+	assert.True(t, resp.ExpiresIn >= 3599 && resp.ExpiresIn <= 3600)
+	assert.True(t, testJWTStringField(resp.AccessToken, "token_use", "access"))
+	assert.True(t, testJWTStringField(resp.RefreshToken, "token_use", "refresh"))
+	assert.True(t, testJWTStringField(resp.IDToken, "token_use", "id"))
+
+	resp, err = s.GrantToken(&st.TokenRequest{GrantType: "refresh_token", RefreshToken: resp.RefreshToken})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, resp.AccessToken)
+	assert.NotEmpty(t, resp.RefreshToken)
+	assert.Empty(t, resp.IDToken)
+
+	resp, err = s.GrantToken(&st.TokenRequest{GrantType: "client_credentials", ClientID: jobs.ID, ClientSecret: "secret", Scope: "reports:read"})
+	assert.Nil(t, err)
+	assert.Empty(t, resp.RefreshToken)
+	assert.Equal(t, "reports:read", resp.Scope)
+
+	_, err = s.GrantToken(&st.TokenRequest{GrantType: "password", Username: user.Username, Password: "wrong"})
+	assert.Equal(t, st.AuthError{Msg: "Username or password is wrong", Status: 403}, err)
+
+	_, err = s.GrantToken(&st.TokenRequest{GrantType: "implicit"})
+	assert.Equal(t, st.AuthError{Msg: "Grant type is not supported: implicit", Status: 400, Code: "unsupported_grant_type"}, err)
+
+	_, err = s.GrantToken(&st.TokenRequest{})
+	assert.Equal(t, st.AuthError{Msg: "Grant type is missing", Status: 400}, err)
+}
+
+func TestToOAuthError(t *testing.T) {
+	assert.Equal(t,
+		st.OAuthError{Code: "invalid_grant", Description: "Username or password is wrong", Status: 400},
+		toOAuthError(st.AuthError{Msg: "Username or password is wrong", Status: 403}))
+	assert.Equal(t,
+		st.OAuthError{Code: "invalid_request", Description: "Unknown audience", Status: 400},
+		toOAuthError(st.AuthError{Msg: "Unknown audience", Status: 400}))
+	assert.Equal(t,
+		st.OAuthError{Code: "invalid_client", Description: "Client authentication failed", Status: 401},
+		toOAuthError(st.AuthError{Msg: "Client authentication failed", Status: 401, Code: "invalid_client"}))
+	assert.Equal(t,
+		st.OAuthError{Code: "server_error", Description: "db is down", Status: 500},
+		toOAuthError(st.AuthError{Msg: "db is down", Status: 500}))
+}
+
+func TestAuthService_Authorize(t *testing.T) {
+	user := createTestUser()
+	client := createTestClient()
+
+	clientDao := dao.MockClientDao{}
+	clientDao.On("GetClient", client.ID).Return(&client, nil)
+	clientDao.On("GetClient", "unknown").Return(nil, nil)
+	codeDao := dao.MockAuthorizationCodeDao{}
+	codeDao.On("SaveAuthorizationCode", mock.MatchedBy(func(c *st.AuthorizationCode) bool {
+		return len(c.ID) == 64 && c.ClientID == client.ID && c.UserID == user.ID &&
+			c.CodeChallenge == testCodeChallenge && c.Nonce == "nonce" &&
+			c.ExpiresAt > time.Now().Unix()
+	})).Return(nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	conf := createTestConfig()
+	conf.AuthCodeLifetime = time.Minute
+	s := createTestService(&mailer, &dao, conf)
+	s.ClientDao = &clientDao
+	s.AuthCodeDao = &codeDao
+
+	req := createTestAuthorizationRequest()
+	code, err := s.Authorize(&req, user.Username, "oakheart", "", "")
+	assert.Nil(t, err)
+	assert.Len(t, code, 32)
+	codeDao.AssertNumberOfCalls(t, "SaveAuthorizationCode", 1)
+
+	_, err = s.Authorize(&req, user.Username, "wrong", "", "")
+	assert.Equal(t, st.AuthError{Msg: "Username or password is wrong", Status: 403}, err)
+
+	req.CodeChallengeMethod = "plain"
+	_, err = s.Authorize(&req, user.Username, "oakheart", "", "")
+	assert.Equal(t, "invalid_request", err.(st.OAuthError).Code)
+
+	req = createTestAuthorizationRequest()
+	req.ResponseType = "token"
+	_, err = s.Authorize(&req, user.Username, "oakheart", "", "")
+	assert.Equal(t, "unsupported_response_type", err.(st.OAuthError).Code)
+
+	req = createTestAuthorizationRequest()
+	req.RedirectURI = "https://evil.example.com/callback"
+	_, err = s.Authorize(&req, user.Username, "oakheart", "", "")
+	assert.Equal(t, st.AuthError{Msg: "Redirect URI is not registered for the client", Status: 400}, err)
+
+	req.ClientID = "unknown"
+	_, err = s.Authorize(&req, user.Username, "oakheart", "", "")
+	assert.Equal(t, st.AuthError{Msg: "Unknown client", Status: 400}, err)
+}
+
+func TestAuthService_ExchangeAuthorizationCode(t *testing.T) {
+	user := createTestUser()
+	client := createTestClient()
+	stored := st.AuthorizationCode{
+		ClientID:      client.ID,
+		RedirectURI:   client.RedirectURIs[0],
+		UserID:        user.ID,
+		Scope:         "openid",
+		Nonce:         "nonce",
+		CodeChallenge: testCodeChallenge,
+		ExpiresAt:     time.Now().Add(time.Minute).Unix(),
+	}
+	expired := stored
+	expired.ExpiresAt = time.Now().Add(-time.Second).Unix()
+
+	codeDao := dao.MockAuthorizationCodeDao{}
+	codeDao.On("ConsumeAuthorizationCode", hashCode("valid")).Return(&stored, nil)
+	codeDao.On("ConsumeAuthorizationCode", hashCode("expired")).Return(&expired, nil)
+	codeDao.On("ConsumeAuthorizationCode", hashCode("used")).Return(nil, nil)
+
+	clientDao := dao.MockClientDao{}
+	clientDao.On("GetClient", client.ID).Return(&client, nil)
+	clientDao.On("GetClient", "other").Return(nil, nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("Get", user.ID).Return(&user, nil)
+
+	s := createTestService(&mailer, &dao, createTestConfig())
+	s.AuthCodeDao = &codeDao
+	s.ClientDao = &clientDao
+
+	accessToken, refreshToken, idToken, err := s.ExchangeAuthorizationCode("valid", client.ID, "", client.RedirectURIs[0], testCodeVerifier)
+	assert.Nil(t, err)
+	assert.True(t, testJWTStringField(accessToken, "token_use", "access"))
+	assert.True(t, testJWTStringField(refreshToken, "token_use", "refresh"))
+	assert.True(t, testJWTStringField(idToken, "aud", client.ID))
+	assert.True(t, testJWTStringField(idToken, "nonce", "nonce"))
+
+	invalidErr := st.AuthError{Msg: "Authorization code is not valid", Status: 400, Code: "invalid_grant"}
+
+	_, _, _, err = s.ExchangeAuthorizationCode("valid", client.ID, "", client.RedirectURIs[0], "wrong-verifier-wrong-verifier-wrong-verifier")
+	assert.Equal(t, invalidErr, err)
+
+	_, _, _, err = s.ExchangeAuthorizationCode("valid", "other", "", client.RedirectURIs[0], testCodeVerifier)
+	assert.Equal(t, invalidErr, err)
+
+	_, _, _, err = s.ExchangeAuthorizationCode("expired", client.ID, "", client.RedirectURIs[0], testCodeVerifier)
+	assert.Equal(t, invalidErr, err)
+
+	_, _, _, err = s.ExchangeAuthorizationCode("used", client.ID, "", client.RedirectURIs[0], testCodeVerifier)
+	assert.Equal(t, invalidErr, err)
+}
+
+func TestAuthService_GrantToken_ConfidentialClient(t *testing.T) {
+	user := createTestUser()
+	jobs := createTestConfidentialClient()
+	jobs.RedirectURIs = []string{"https://jobs.example.com/callback"}
+	spa := createTestClient()
+	stored := st.AuthorizationCode{
+		ClientID:      jobs.ID,
+		RedirectURI:   jobs.RedirectURIs[0],
+		UserID:        user.ID,
+		CodeChallenge: testCodeChallenge,
+		ExpiresAt:     time.Now().Add(time.Minute).Unix(),
+	}
+
+	codeDao := dao.MockAuthorizationCodeDao{}
+	codeDao.On("ConsumeAuthorizationCode", hashCode("valid")).Return(&stored, nil)
+	clientDao := dao.MockClientDao{}
+	clientDao.On("GetClient", jobs.ID).Return(&jobs, nil)
+	clientDao.On("GetClient", spa.ID).Return(&spa, nil)
+	tokenDao := dao.MockRefreshTokenDao{}
+	tokenDao.On("SaveRefreshToken", mock.Anything).Return(nil)
+	tokenDao.On("GetRefreshToken", mock.Anything).Return(&st.RefreshToken{Family: "family"}, nil)
+	tokenDao.On("MarkRefreshTokenUsed", mock.Anything).Return(true, nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("Get", user.ID).Return(&user, nil)
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := createTestService(&mailer, &dao, createTestConfig())
+	s.AuthCodeDao = &codeDao
+	s.ClientDao = &clientDao
+	s.RefreshTokenDao = &tokenDao
+
+	clientErr := st.AuthError{Msg: "Client authentication failed", Status: 401, Code: "invalid_client"}
+	codeReq := st.TokenRequest{GrantType: "authorization_code", Code: "valid", ClientID: jobs.ID, RedirectURI: jobs.RedirectURIs[0], CodeVerifier: testCodeVerifier}
+
+	// Code is not consumed until the client is authenticated
+	_, err := s.GrantToken(&codeReq)
+	assert.Equal(t, clientErr, err)
+	codeDao.AssertNotCalled(t, "ConsumeAuthorizationCode", mock.Anything)
+
+	codeReq.ClientSecret = "secret"
+	resp, err := s.GrantToken(&codeReq)
+	assert.Nil(t, err)
+	assert.True(t, testJWTStringField(resp.RefreshToken, "client_id", jobs.ID))
+
+	// Refresh token of confidential client requires its secret
+	_, err = s.GrantToken(&st.TokenRequest{GrantType: "refresh_token", RefreshToken: resp.RefreshToken})
+	assert.Equal(t, clientErr, err)
+
+	_, err = s.GrantToken(&st.TokenRequest{GrantType: "refresh_token", RefreshToken: resp.RefreshToken, ClientID: jobs.ID, ClientSecret: "wrong"})
+	assert.Equal(t, clientErr, err)
+
+	_, err = s.GrantToken(&st.TokenRequest{GrantType: "refresh_token", RefreshToken: resp.RefreshToken, ClientID: spa.ID})
+	assert.Equal(t, st.AuthError{Msg: "Refresh token is not valid", Status: 403}, err)
+	tokenDao.AssertNotCalled(t, "MarkRefreshTokenUsed", mock.Anything)
+
+	resp, err = s.GrantToken(&st.TokenRequest{GrantType: "refresh_token", RefreshToken: resp.RefreshToken, ClientID: jobs.ID, ClientSecret: "secret"})
+	assert.Nil(t, err)
+	assert.True(t, testJWTStringField(resp.RefreshToken, "client_id", jobs.ID))
+}
+
+func TestAuthService_CreateClient(t *testing.T) {
+	user := createTestUser()
+	adminToken := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+
+	clientDao := dao.MockClientDao{}
+	clientDao.On("GetClient", "spa").Return(&st.Client{ID: "spa"}, nil)
+	clientDao.On("SaveClient", mock.Anything).Return(nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := createTestService(&mailer, &dao, createTestConfig())
+	s.ClientDao = &clientDao
+
+	client := st.Client{Name: "Mobile", RedirectURIs: []string{"com.example.app:/callback"}}
+	err := s.CreateClient(&client, adminToken)
+	assert.Nil(t, err)
+	assert.Len(t, client.ID, 32)
+
+	client = st.Client{ID: "spa", Name: "SPA", RedirectURIs: []string{"https://app.example.com/callback"}}
+	err = s.CreateClient(&client, adminToken)
+	assert.Equal(t, st.AuthError{Msg: "Client already exists", Status: 400}, err)
+
+	client = st.Client{Name: "SPA", RedirectURIs: []string{"/callback"}}
+	err = s.CreateClient(&client, adminToken)
+	assert.Equal(t, st.AuthError{Msg: "Invalid redirect URI /callback", Status: 400}, err)
+
+	client = st.Client{Name: "Jobs", Confidential: true, Scopes: []string{"reports:read"}}
+	err = s.CreateClient(&client, adminToken)
+	assert.Nil(t, err)
+	assert.Len(t, client.Secret, 64)
+	assert.True(t, crypto.Match(client.Secret, client.SecretHash))
+
+	client = st.Client{Name: "SPA", RedirectURIs: []string{"https://app.example.com"}, Scopes: []string{"reports:read"}}
+	err = s.CreateClient(&client, adminToken)
+	assert.Equal(t, st.AuthError{Msg: "Scopes can be set only for confidential client", Status: 400}, err)
+}
+
+func TestAuthService_ClientCredentialsToken(t *testing.T) {
+	user := createTestUser()
+	callerToken := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+	jobs := createTestConfidentialClient()
+	spa := createTestClient()
+	// Client with username as client ID
+	shadow := createTestConfidentialClient()
+	shadow.ID = user.Username
+
+	clientDao := dao.MockClientDao{}
+	clientDao.On("GetClient", jobs.ID).Return(&jobs, nil)
+	clientDao.On("GetClient", spa.ID).Return(&spa, nil)
+	clientDao.On("GetClient", shadow.ID).Return(&shadow, nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := createTestService(&mailer, &dao, createTestConfig())
+	s.ClientDao = &clientDao
+
+	token, err := s.ClientCredentialsToken(jobs.ID, "secret", "", "")
+	assert.Nil(t, err)
+	assert.True(t, testJWTStringField(token, "sub", jobs.ID))
+	assert.True(t, testJWTStringField(token, "client_id", jobs.ID))
+	assert.True(t, testJWTStringField(token, "scope", "reports:read reports:write"))
+	assert.Nil(t, exctractField(token, "userId", nil))
+
+	introspection, err := s.IntrospectToken(callerToken, token)
+	assert.Nil(t, err)
+	assert.True(t, introspection.Active)
+	assert.Equal(t, jobs.ID, introspection.ClientID)
+	assert.Equal(t, "reports:read reports:write", introspection.Scope)
+
+	token, err = s.ClientCredentialsToken(jobs.ID, "secret", "reports:read", "")
+	assert.Nil(t, err)
+	assert.True(t, testJWTStringField(token, "scope", "reports:read"))
+
+	_, err = s.ClientCredentialsToken(jobs.ID, "secret", "users:delete", "")
+	assert.Equal(t, st.AuthError{Msg: "Scope is not allowed for the client: users:delete", Status: 400, Code: "invalid_scope"}, err)
+
+	_, err = s.ClientCredentialsToken(jobs.ID, "wrong", "", "")
+	assert.Equal(t, st.AuthError{Msg: "Client authentication failed", Status: 401, Code: "invalid_client"}, err)
+
+	_, err = s.ClientCredentialsToken(spa.ID, "", "", "")
+	assert.Equal(t, st.AuthError{Msg: "Client authentication failed", Status: 401, Code: "invalid_client"}, err)
+
+	// Client token does not authenticate user with the same name
+	token, err = s.ClientCredentialsToken(shadow.ID, "secret", "", "")
+	assert.Nil(t, err)
+	_, valid := s.validateToken(token)
+	assert.False(t, valid)
+}
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	assert.True(t, verifyCodeChallenge(testCodeChallenge, testCodeVerifier))
+	assert.False(t, verifyCodeChallenge(testCodeChallenge, testCodeVerifier+"x"))
+	assert.False(t, verifyCodeChallenge(testCodeChallenge, "short"))
+}
+
+func createTestClient() st.Client {
+	return st.Client{ID: "spa", Name: "SPA", RedirectURIs: []string{"https://app.example.com/callback"}}
+}
+
+// Confidential client with "secret" secret
+func createTestConfidentialClient() st.Client {
+	secretHash, _ := crypto.Hash("secret")
+	return st.Client{
+		ID:           "jobs",
+		Name:         "Jobs",
+		Confidential: true,
+		Scopes:       []string{"reports:read", "reports:write"},
+		SecretHash:   secretHash,
+	}
+}
+
+func createTestAuthorizationRequest() st.AuthorizationRequest {
+	return st.AuthorizationRequest{
+		ResponseType:        "code",
+		ClientID:            "spa",
+		RedirectURI:         "https://app.example.com/callback",
+		Scope:               "openid",
+		State:               "xyz",
+		Nonce:               "nonce",
+		CodeChallenge:       testCodeChallenge,
+		CodeChallengeMethod: "S256",
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	st "github.com/adderly/brightonum/src/structs"
+)
+
+const (
+	idTokenUse  = "id"
+	openIDScope = "openid"
+)
+
+// IDToken issues OpenID Connect ID token for the owner of given access token.
+// ID token has the same audience as access token, nonce is copied when given.
+func (s *AuthService) IDToken(accessToken string, nonce string) (string, error) {
+	claims, err := s.parseToken(accessToken, accessTokenUse)
+	if authErr, ok := err.(st.AuthError); ok {
+		return "", authErr
+	}
+	if err != nil {
+		return "", st.AuthError{Msg: "Invalid token", Status: 401}
+	}
+
+	u, err := s.UserDao.GetByUsername(fmt.Sprintf("%s", claims["sub"]))
+	if err != nil {
+		return "", st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if u == nil {
+		return "", st.AuthError{Msg: "Invalid token", Status: 401}
+	}
+
+	return s.issueIDToken(u, claimString(claims, "aud"), nonce, authTime(claims))
+}
+
+// issueIDToken issues ID token, authTime is Unix time of the original authentication
+func (s *AuthService) issueIDToken(user *st.User, audience string, nonce string, authTime int64) (string, error) {
+	lifetime, _ := s.Config.TokenLifetimes(audience)
+	claims := s.standardClaims(audience, lifetime)
+	claims["sub"] = user.Username
+	claims["token_use"] = idTokenUse
+	if authTime > 0 {
+		claims["auth_time"] = authTime
+	}
+	claims["preferred_username"] = user.Username
+	claims["email"] = user.Email
+	claims["given_name"] = user.FirstName
+	claims["family_name"] = user.LastName
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+
+	return s.signToken(claims)
+}
+
+// GetOIDCUserInfo returns OpenID Connect claims of the access token owner
+func (s *AuthService) GetOIDCUserInfo(token string) (*st.OIDCUserInfo, error) {
+	u, err := s.authenticateToken(token, accessTokenUse)
+	if err != nil {
+		return nil, err
+	}
+	return st.NewOIDCUserInfo(mapToUserInfo(u)), nil
+}
+
+// GetOpenIDConfiguration returns OpenID Provider Metadata with endpoints relative to issuer.
+// Relying parties require issuer to be https URL the metadata is discovered from, otherwise 404 is returned.
+func (s *AuthService) GetOpenIDConfiguration() (*st.OpenIDConfiguration, error) {
+	if !s.Config.OpenIDProvider() {
+		return nil, st.AuthError{Msg: "OpenID Connect discovery requires issuer to be an https URL", Status: 404}
+	}
+	issuer := s.Config.Issuer
+	baseURL := strings.TrimSuffix(issuer, "/")
+
+	// Issuer of a realm is its API root already, user management API of default realm is under /v1
+	apiRoot := baseURL
+	if s.Config.Realm == "" {
+		apiRoot += "/v1"
+	}
+
+	algs := []string{}
+	for _, key := range s.Keys.Keys() {
+		if !contains(algs, key.Method.Alg()) {
+			algs = append(algs, key.Method.Alg())
+		}
+	}
+
+	conf := &st.OpenIDConfiguration{
+		Issuer:                           issuer,
+		AuthorizationEndpoint:            baseURL + "/oauth/authorize",
+		TokenEndpoint:                    baseURL + "/oauth/token",
+		DeviceAuthorizationEndpoint:      baseURL + "/oauth/device_authorization",
+		UserInfoEndpoint:                 apiRoot + "/userinfo/me",
+		JWKSURI:                          baseURL + "/.well-known/jwks.json",
+		RevocationEndpoint:               apiRoot + "/token/revoke",
+		IntrospectionEndpoint:            apiRoot + "/token/introspect",
+		ScopesSupported:                  []string{openIDScope, "profile", "email"},
+		ResponseTypesSupported:           []string{codeResponseType},
+		GrantTypesSupported:              []string{passwordGrant, refreshTokenGrant, authorizationCodeGrant, clientCredentialsGrant, deviceCodeGrant},
+		CodeChallengeMethodsSupported:    []string{pkceMethodS256},
+		TokenEndpointAuthMethods:         []string{"none", "client_secret_basic", "client_secret_post"},
+		SubjectTypesSupported:            []string{"public"},
+		IDTokenSigningAlgValuesSupported: algs,
+		ClaimsSupported: []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce",
+			"preferred_username", "name", "given_name", "family_name", "email"},
+	}
+	return conf, nil
+}
+
+// publicURL returns issuer when it is URL, otherwise given base URL of the request
+func (s *AuthService) publicURL(baseURL string) string {
+	issuer := s.Config.Issuer
+	if strings.HasPrefix(issuer, "https://") || strings.HasPrefix(issuer, "http://") {
+		baseURL = issuer
+	}
+	return strings.TrimSuffix(baseURL, "/")
+}
+
+// hasScope checks whether space separated scope list contains given scope
+func hasScope(scope string, name string) bool {
+	return contains(strings.Fields(scope), name)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
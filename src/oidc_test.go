@@ -0,0 +1,126 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adderly/brightonum/src/dao"
+	st "github.com/adderly/brightonum/src/structs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestAuthService_IDToken(t *testing.T) {
+	user := createTestUser()
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	conf := createTestConfig()
+	conf.Issuer = "brightonum"
+	conf.Audience = "brightonum"
+	s := createTestService(&mailer, &dao, conf)
+	accessToken, refreshToken, err := s.BasicAuthToken(user.Username, "oakheart", "", "")
+	assert.Nil(t, err)
+
+	idToken, err := s.IDToken(accessToken, "n-0S6_WzA2Mj")
+	assert.Nil(t, err)
+	assert.True(t, testJWTHeader(idToken, "kid", s.Keys.Active().ID))
+	assert.True(t, testJWTStringField(idToken, "sub", user.Username))
+	assert.True(t, testJWTStringField(idToken, "iss", "brightonum"))
+	assert.True(t, testJWTStringField(idToken, "aud", "brightonum"))
+	assert.True(t, testJWTStringField(idToken, "token_use", "id"))
+	assert.True(t, testJWTStringField(idToken, "nonce", "n-0S6_WzA2Mj"))
+	assert.True(t, testJWTStringField(idToken, "email", user.Email))
+	assert.True(t, testJWTStringField(idToken, "given_name", user.FirstName))
+	assert.True(t, testJWTStringField(idToken, "family_name", user.LastName))
+
+	// ID token is not accepted instead of access token
+	_, valid := s.validateToken(idToken)
+	assert.False(t, valid)
+
+	_, err = s.IDToken(refreshToken, "")
+	assert.Equal(t, st.AuthError{Msg: "Expected access token, got refresh token", Status: 401}, err)
+}
+
+func TestAuthService_IDToken_AuthTimeAfterRefresh(t *testing.T) {
+	user := createTestUser()
+	authTime := time.Now().Add(-time.Hour).Unix()
+
+	tokenDao := dao.MockRefreshTokenDao{}
+	tokenDao.On("SaveRefreshToken", mock.Anything).Return(nil)
+	tokenDao.On("GetRefreshToken", mock.Anything).Return(&st.RefreshToken{Family: "family"}, nil)
+	tokenDao.On("MarkRefreshTokenUsed", mock.Anything).Return(true, nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := createTestService(&mailer, &dao, createTestConfig())
+	s.RefreshTokenDao = &tokenDao
+	refreshToken, err := s.issueRefreshToken(&user, "family", "", "", authTime)
+	assert.Nil(t, err)
+
+	accessToken, refreshToken, err := s.RefreshToken(refreshToken, "", "")
+	assert.Nil(t, err)
+	assert.True(t, testJWTIntField(refreshToken, "auth_time", int(authTime)))
+
+	idToken, err := s.IDToken(accessToken, "")
+	assert.Nil(t, err)
+	assert.True(t, testJWTIntField(idToken, "auth_time", int(authTime)))
+}
+
+func TestAuthService_GetOIDCUserInfo(t *testing.T) {
+	user := createTestUser()
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := createTestService(&mailer, &dao, createTestConfig())
+	userInfo, err := s.GetOIDCUserInfo(token)
+	assert.Nil(t, err)
+	assert.Equal(t, &st.OIDCUserInfo{
+		Sub:               "alle",
+		PreferredUsername: "alle",
+		Name:              "test user",
+		GivenName:         "test",
+		FamilyName:        "user",
+		Email:             "test@email.com",
+		UserID:            42,
+	}, userInfo)
+
+	_, err = s.GetOIDCUserInfo("invalid")
+	assert.Equal(t, st.AuthError{Msg: "Invalid token", Status: 401}, err)
+}
+
+func TestAuthService_GetOpenIDConfiguration(t *testing.T) {
+	dao := dao.MockUserDao{}
+	s := createTestService(&mailer, &dao, createTestConfig())
+
+	_, err := s.GetOpenIDConfiguration()
+	assert.Equal(t, 404, err.(st.AuthError).Status)
+
+	s.Config.Issuer = "brightonum"
+	_, err = s.GetOpenIDConfiguration()
+	assert.Equal(t, 404, err.(st.AuthError).Status)
+
+	s.Config.Issuer = "https://auth.example.com/"
+	conf, err := s.GetOpenIDConfiguration()
+	assert.Nil(t, err)
+	assert.Equal(t, "https://auth.example.com/", conf.Issuer)
+	assert.Equal(t, "https://auth.example.com/oauth/token", conf.TokenEndpoint)
+	assert.Equal(t, "https://auth.example.com/v1/userinfo/me", conf.UserInfoEndpoint)
+	assert.Equal(t, "https://auth.example.com/.well-known/jwks.json", conf.JWKSURI)
+	assert.Equal(t, []string{"RS256"}, conf.IDTokenSigningAlgValuesSupported)
+	assert.Contains(t, conf.ScopesSupported, "openid")
+
+	s.Config, _ = s.Config.RealmConfig("mobile=../test_data/private.pem,../test_data/public.pem")
+	conf, err = s.GetOpenIDConfiguration()
+	assert.Nil(t, err)
+	assert.Equal(t, "https://auth.example.com/v1/realms/mobile", conf.Issuer)
+	assert.Equal(t, "https://auth.example.com/v1/realms/mobile/oauth/token", conf.TokenEndpoint)
+	assert.Equal(t, "https://auth.example.com/v1/realms/mobile/userinfo/me", conf.UserInfoEndpoint)
+	assert.Equal(t, "https://auth.example.com/v1/realms/mobile/token/revoke", conf.RevocationEndpoint)
+	assert.Equal(t, "https://auth.example.com/v1/realms/mobile/token/introspect", conf.IntrospectionEndpoint)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"html/template"
+
+	st "github.com/adderly/brightonum/src/structs"
+)
+
+// LoginPageData represents data of the hosted login page
+type LoginPageData struct {
+	ClientName string
+	Error      string
+	Request    *st.AuthorizationRequest
+
+	// Path prefix of the realm endpoints
+	BasePath string
+}
+
+// DevicePageData represents data of the device verification page
+type DevicePageData struct {
+	UserCode string
+	Error    string
+	Message  string
+
+	// Path prefix of the realm endpoints
+	BasePath string
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Sign in</title>
+  <style>
+    body { font-family: sans-serif; background: #f4f4f4; }
+    main { max-width: 320px; margin: 10vh auto; padding: 24px; background: #fff; border-radius: 4px; }
+    label, input, button { display: block; width: 100%; box-sizing: border-box; }
+    input { margin: 4px 0 16px; padding: 8px; }
+    button { padding: 8px; }
+    .error { color: #b00020; }
+  </style>
+</head>
+<body>
+<main>
+  {{if .ClientName}}<h2>Sign in to {{.ClientName}}</h2>{{else}}<h2>Sign in</h2>{{end}}
+  {{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+  {{with .Request}}
+  <form method="post" action="{{$.BasePath}}/oauth/authorize">
+    <input type="hidden" name="response_type" value="{{.ResponseType}}">
+    <input type="hidden" name="client_id" value="{{.ClientID}}">
+    <input type="hidden" name="redirect_uri" value="{{.RedirectURI}}">
+    <input type="hidden" name="scope" value="{{.Scope}}">
+    <input type="hidden" name="state" value="{{.State}}">
+    <input type="hidden" name="nonce" value="{{.Nonce}}">
+    <input type="hidden" name="code_challenge" value="{{.CodeChallenge}}">
+    <input type="hidden" name="code_challenge_method" value="{{.CodeChallengeMethod}}">
+    <label for="username">Username</label>
+    <input id="username" name="username" autocomplete="username" required autofocus>
+    <label for="password">Password</label>
+    <input id="password" name="password" type="password" autocomplete="current-password" required>
+    <label for="otp">Authentication or backup code, if enabled</label>
+    <input id="otp" name="otp" inputmode="numeric" autocomplete="one-time-code">
+    <button type="submit">Sign in</button>
+  </form>
+  {{end}}
+</main>
+</body>
+</html>
+`))
+
+var devicePage = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Connect a device</title>
+  <style>
+    body { font-family: sans-serif; background: #f4f4f4; }
+    main { max-width: 320px; margin: 10vh auto; padding: 24px; background: #fff; border-radius: 4px; }
+    label, input, button { display: block; width: 100%; box-sizing: border-box; }
+    input { margin: 4px 0 16px; padding: 8px; }
+    button { padding: 8px; margin-bottom: 8px; }
+    .error { color: #b00020; }
+  </style>
+</head>
+<body>
+<main>
+  <h2>Connect a device</h2>
+  {{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+  {{if .Message}}<p>{{.Message}}</p>{{else}}
+  <p>Check that the code matches the one shown on your device.</p>
+  <form method="post" action="{{.BasePath}}/oauth/device">
+    <label for="user_code">Code</label>
+    <input id="user_code" name="user_code" value="{{.UserCode}}" autocomplete="off" required>
+    <label for="username">Username</label>
+    <input id="username" name="username" autocomplete="username" required>
+    <label for="password">Password</label>
+    <input id="password" name="password" type="password" autocomplete="current-password" required>
+    <label for="otp">Authentication or backup code, if enabled</label>
+    <input id="otp" name="otp" inputmode="numeric" autocomplete="one-time-code">
+    <button type="submit" name="action" value="approve">Approve</button>
+    <button type="submit" name="action" value="deny">Deny</button>
+  </form>
+  {{end}}
+</main>
+</body>
+</html>
+`))
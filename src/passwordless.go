@@ -0,0 +1,198 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"fmt"
+	"math/big"
+	"net/url"
+	"time"
+
+	"github.com/adderly/brightonum/src/crypto"
+	st "github.com/adderly/brightonum/src/structs"
+)
+
+const (
+	loginTokenUse   = "login"
+	loginCodeDigits = 6
+)
+
+// SendLoginCode emails one time login code to the user, and login link when LoginLinkURL is configured.
+// New code replaces the previous one, the code and the link are valid until either of them is used.
+func (s *AuthService) SendLoginCode(username string, audience string) error {
+	audience, err := s.resolveAudience(audience)
+	if err != nil {
+		return err
+	}
+
+	u, err := s.UserDao.GetByUsername(username)
+	if err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if u == nil || u.Email == "" {
+		return st.AuthError{Msg: "Username does not registered or email is absent", Status: 404}
+	}
+
+	code, err := generateLoginCode()
+	if err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	codeHash, err := crypto.Hash(code)
+	if err != nil {
+		logger.Logf("ERROR Failed to hash code, %s", err.Error())
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+
+	nonce := generateTokenID()
+	expiresAt := time.Now().Add(s.Config.LoginCodeLifetime)
+	link, err := s.loginLink(u, nonce, audience)
+	if err != nil {
+		return err
+	}
+
+	if err = s.UserDao.SetLoginCode(u.ID, codeHash, nonce, expiresAt.Unix()); err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if err = s.Mailer.SendLoginCode(u.Email, code, link); err != nil {
+		logger.Logf("ERROR Email was not sent: " + err.Error())
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+
+	logger.Logf("INFO Login code is sent to user %d", u.ID)
+	return nil
+}
+
+// LoginCodeToken exchanges emailed login code for access and refresh tokens.
+// When the second factor is enabled, mfa_required error with challenge token is returned instead.
+func (s *AuthService) LoginCodeToken(username, code string, audience string) (string, string, error) {
+	invalidErr := st.AuthError{Msg: "Login code is wrong or expired", Status: 403}
+
+	audience, err := s.resolveAudience(audience)
+	if err != nil {
+		return "", "", err
+	}
+
+	u, err := s.UserDao.GetByUsername(username)
+	if err != nil {
+		return "", "", st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if u == nil || u.LoginCode == "" || u.LoginExpiresAt < time.Now().Unix() {
+		return "", "", invalidErr
+	}
+
+	matched, _, err := matchLimitedCode(code, u.LoginCode, s.Config.LoginCodeMaxAttempts(),
+		func() (int64, error) { return s.UserDao.AddLoginCodeAttempt(u.ID, u.LoginNonce) },
+		func() error {
+			logger.Logf("WARN Passwordless login of user %d is invalidated after too many wrong codes", u.ID)
+			_, err := s.UserDao.ConsumeLoginCode(u.ID, u.LoginNonce)
+			return err
+		})
+	if err != nil {
+		return "", "", st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if !matched {
+		return "", "", invalidErr
+	}
+
+	return s.consumeLogin(u, u.LoginNonce, audience, invalidErr)
+}
+
+// LoginLinkToken exchanges token of emailed login link for access and refresh tokens.
+// Audience of the issued tokens is the one login was started for.
+func (s *AuthService) LoginLinkToken(token string) (string, string, error) {
+	invalidErr := st.AuthError{Msg: "Login link is not valid", Status: 401}
+
+	claims, err := s.parseToken(token, loginTokenUse)
+	if err != nil {
+		return "", "", invalidErr
+	}
+	nonce, _ := claims["jti"].(string)
+	userID, _ := claims["userId"].(float64)
+	if nonce == "" {
+		return "", "", invalidErr
+	}
+
+	u, err := s.UserDao.GetByUsername(fmt.Sprintf("%s", claims["sub"]))
+	if err != nil {
+		return "", "", st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if u == nil || u.ID != int64(userID) {
+		return "", "", invalidErr
+	}
+
+	audience, _ := claims["aud"].(string)
+	audience, err = s.resolveAudience(audience)
+	if err != nil {
+		return "", "", err
+	}
+
+	return s.consumeLogin(u, nonce, audience, invalidErr)
+}
+
+// consumeLogin invalidates pending login of the user and issues tokens,
+// invalidErr is returned when the login has been already used or replaced
+func (s *AuthService) consumeLogin(u *st.User, nonce string, audience string, invalidErr error) (string, string, error) {
+	consumed, err := s.UserDao.ConsumeLoginCode(u.ID, nonce)
+	if err != nil {
+		return "", "", st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if !consumed {
+		return "", "", invalidErr
+	}
+
+	if u.TOTPEnabled {
+		return "", "", s.mfaChallenge(u, audience)
+	}
+
+	authTime := time.Now().UTC().Unix()
+	tokenString, err := s.issueAccessToken(u, audience, authTime)
+	if err != nil {
+		return "", "", err
+	}
+	refreshTokenString, err := s.issueRefreshToken(u, "", "", audience, authTime)
+	if err != nil {
+		return "", "", err
+	}
+
+	logger.Logf("INFO User %d logged in without password", u.ID)
+	return tokenString, refreshTokenString, nil
+}
+
+// loginLink returns URL of the app page with signed login token, or empty string when LoginLinkURL is not set
+func (s *AuthService) loginLink(u *st.User, nonce string, audience string) (string, error) {
+	if s.Config.LoginLinkURL == "" {
+		return "", nil
+	}
+
+	claims := s.standardClaims(audience, s.Config.LoginCodeLifetime)
+	claims["sub"] = u.Username
+	claims["userId"] = u.ID
+	claims["token_use"] = loginTokenUse
+	claims["jti"] = nonce
+
+	t, err := s.signToken(claims)
+	if err != nil {
+		return "", err
+	}
+
+	link, err := url.Parse(s.Config.LoginLinkURL)
+	if err != nil {
+		return "", st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	query := link.Query()
+	query.Set("token", t)
+	link.RawQuery = query.Encode()
+	return link.String(), nil
+}
+
+// generateLoginCode generates numeric code with cryptographically secure generator
+func generateLoginCode() (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < loginCodeDigits; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := crand.Int(crand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", loginCodeDigits, n.Int64()), nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/adderly/brightonum/src/crypto"
+	"github.com/adderly/brightonum/src/dao"
+	st "github.com/adderly/brightonum/src/structs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func createTestPasswordlessConfig() Config {
+	conf := createTestConfig()
+	conf.LoginCodeLifetime = time.Minute
+	conf.LoginLinkURL = "https://example.com/login"
+	conf.MFAChallengeLifetime = time.Minute
+	return conf
+}
+
+func TestAuthService_SendLoginCode(t *testing.T) {
+	user := createTestUser()
+
+	var code, link, codeHash, nonce string
+	mailer := MailerMock{}
+	mailer.On("SendLoginCode", user.Email, mock.Anything, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		code, link = args.String(1), args.String(2)
+	})
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+	dao.On("SetLoginCode", user.ID, mock.Anything, mock.Anything, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		codeHash, nonce = args.String(1), args.String(2)
+	})
+
+	s := createTestService(&mailer, &dao, createTestPasswordlessConfig())
+
+	err := s.SendLoginCode(user.Username, "")
+	assert.Nil(t, err)
+	assert.Len(t, code, loginCodeDigits)
+	assert.True(t, crypto.Match(code, codeHash))
+
+	parsed, err := url.Parse(link)
+	assert.Nil(t, err)
+	assert.Equal(t, "example.com", parsed.Host)
+	token := parsed.Query().Get("token")
+	assert.True(t, testJWTStringField(token, "token_use", loginTokenUse))
+	assert.True(t, testJWTStringField(token, "jti", nonce))
+}
+
+func TestAuthService_SendLoginCode_NoLink(t *testing.T) {
+	user := createTestUser()
+
+	mailer := MailerMock{}
+	mailer.On("SendLoginCode", user.Email, mock.Anything, "").Return(nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+	dao.On("SetLoginCode", user.ID, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+
+	conf := createTestPasswordlessConfig()
+	conf.LoginLinkURL = ""
+	s := createTestService(&mailer, &dao, conf)
+
+	err := s.SendLoginCode(user.Username, "")
+	assert.Nil(t, err)
+	mailer.AssertExpectations(t)
+}
+
+func TestAuthService_SendLoginCode_UnknownUser(t *testing.T) {
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", "nobody").Return(nil, nil)
+
+	s := createTestService(&MailerMock{}, &dao, createTestPasswordlessConfig())
+
+	err := s.SendLoginCode("nobody", "")
+	assert.Equal(t, 404, err.(st.AuthError).Status)
+}
+
+func TestAuthService_LoginCodeToken(t *testing.T) {
+	user := createTestUser()
+	user.LoginCode = hashedCode
+	user.LoginNonce = "nonce"
+	user.LoginExpiresAt = time.Now().Add(time.Minute).Unix()
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+	dao.On("AddLoginCodeAttempt", user.ID, "nonce").Return(int64(1), nil).Once()
+	dao.On("AddLoginCodeAttempt", user.ID, "nonce").Return(int64(2), nil).Once()
+	dao.On("AddLoginCodeAttempt", user.ID, "nonce").Return(int64(0), nil)
+	dao.On("ConsumeLoginCode", user.ID, "nonce").Return(true, nil).Once()
+
+	s := createTestService(&MailerMock{}, &dao, createTestPasswordlessConfig())
+
+	_, _, err := s.LoginCodeToken(user.Username, "000000", "")
+	assert.Equal(t, 403, err.(st.AuthError).Status)
+
+	accessToken, refreshToken, err := s.LoginCodeToken(user.Username, code, "")
+	assert.Nil(t, err)
+	assert.True(t, testJWTStringField(accessToken, "sub", user.Username))
+	assert.True(t, testJWTStringField(refreshToken, "token_use", refreshTokenUse))
+
+	// Code is single use
+	_, _, err = s.LoginCodeToken(user.Username, code, "")
+	assert.Equal(t, 403, err.(st.AuthError).Status)
+	dao.AssertNumberOfCalls(t, "ConsumeLoginCode", 1)
+}
+
+func TestAuthService_LoginCodeToken_AttemptLimit(t *testing.T) {
+	user := createTestUser()
+	user.LoginCode = hashedCode
+	user.LoginNonce = "nonce"
+	user.LoginExpiresAt = time.Now().Add(time.Minute).Unix()
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+	for i := 1; i <= 4; i++ {
+		dao.On("AddLoginCodeAttempt", user.ID, "nonce").Return(int64(i), nil).Once()
+	}
+	dao.On("ConsumeLoginCode", user.ID, "nonce").Return(true, nil)
+
+	conf := createTestPasswordlessConfig()
+	conf.LoginCodeAttempts = 3
+	s := createTestService(&MailerMock{}, &dao, conf)
+
+	for i := 0; i < 3; i++ {
+		_, _, err := s.LoginCodeToken(user.Username, "000000", "")
+		assert.Equal(t, 403, err.(st.AuthError).Status)
+	}
+	// Login is invalidated after the last allowed wrong code
+	dao.AssertNumberOfCalls(t, "ConsumeLoginCode", 1)
+
+	// Right code is rejected once the limit is reached
+	_, _, err := s.LoginCodeToken(user.Username, code, "")
+	assert.Equal(t, 403, err.(st.AuthError).Status)
+	dao.AssertNumberOfCalls(t, "ConsumeLoginCode", 1)
+}
+
+func TestAuthService_LoginCodeToken_Expired(t *testing.T) {
+	user := createTestUser()
+	user.LoginCode = hashedCode
+	user.LoginNonce = "nonce"
+	user.LoginExpiresAt = time.Now().Add(-time.Minute).Unix()
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := createTestService(&MailerMock{}, &dao, createTestPasswordlessConfig())
+
+	_, _, err := s.LoginCodeToken(user.Username, code, "")
+	assert.Equal(t, 403, err.(st.AuthError).Status)
+	dao.AssertNotCalled(t, "ConsumeLoginCode", mock.Anything, mock.Anything)
+}
+
+func TestAuthService_LoginCodeToken_SecondFactor(t *testing.T) {
+	user := createTestUser()
+	user.LoginCode = hashedCode
+	user.LoginNonce = "nonce"
+	user.LoginExpiresAt = time.Now().Add(time.Minute).Unix()
+	user.TOTPEnabled = true
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+	dao.On("AddLoginCodeAttempt", user.ID, "nonce").Return(int64(1), nil)
+	dao.On("ConsumeLoginCode", user.ID, "nonce").Return(true, nil)
+
+	s := createTestService(&MailerMock{}, &dao, createTestPasswordlessConfig())
+
+	_, _, err := s.LoginCodeToken(user.Username, code, "")
+	authErr := err.(st.AuthError)
+	assert.Equal(t, "mfa_required", authErr.Code)
+	assert.True(t, testJWTStringField(authErr.MFAToken, "token_use", mfaTokenUse))
+}
+
+func TestAuthService_LoginLinkToken(t *testing.T) {
+	user := createTestUser()
+
+	var link string
+	mailer := MailerMock{}
+	mailer.On("SendLoginCode", user.Email, mock.Anything, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		link = args.String(2)
+	})
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+	dao.On("SetLoginCode", user.ID, mock.Anything, mock.Anything, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		user.LoginNonce = args.String(2)
+	})
+	dao.On("ConsumeLoginCode", user.ID, mock.Anything).Return(true, nil).Once()
+	dao.On("ConsumeLoginCode", user.ID, mock.Anything).Return(false, nil)
+
+	s := createTestService(&mailer, &dao, createTestPasswordlessConfig())
+
+	err := s.SendLoginCode(user.Username, "")
+	assert.Nil(t, err)
+	parsed, _ := url.Parse(link)
+	token := parsed.Query().Get("token")
+
+	accessToken, _, err := s.LoginLinkToken(token)
+	assert.Nil(t, err)
+	assert.True(t, testJWTStringField(accessToken, "sub", user.Username))
+	dao.AssertCalled(t, "ConsumeLoginCode", user.ID, user.LoginNonce)
+
+	// Link is single use
+	_, _, err = s.LoginLinkToken(token)
+	assert.Equal(t, 401, err.(st.AuthError).Status)
+
+	accessToken = issueTestToken(user.ID, user.Username, "../test_data/private.pem")
+	_, _, err = s.LoginLinkToken(accessToken)
+	assert.Equal(t, 401, err.(st.AuthError).Status)
+}
+
+func TestGenerateLoginCode(t *testing.T) {
+	code, err := generateLoginCode()
+	assert.Nil(t, err)
+	assert.Regexp(t, "^[0-9]{6}$", code)
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+
+	st "github.com/adderly/brightonum/src/structs"
+)
+
+const (
+	rateLimitByIP   = "ip"
+	rateLimitByUser = "user"
+
+	// Largest request body read to find username of user keyed limits
+	rateLimitMaxBody = 64 * 1024
+
+	// User key of requests with body too large to find username in
+	rateLimitOversizedUser = "*oversized"
+
+	// Largest number of buckets, usernames are supplied by clients and could grow them without bound
+	rateLimitMaxBuckets = 100000
+
+	// User key of requests whose bucket does not fit, they share one bucket per limit
+	rateLimitOverflowUser = "*overflow"
+)
+
+// Routes which handlers read form payload, handlers of other routes decode JSON payload
+var rateLimitFormRoutes = []string{"/oauth/*", "/token", "/token/revoke", "/token/introspect"}
+
+// rateLimit allows requests to the route per period, route "*" stands for all routes
+type rateLimit struct {
+	route    string
+	requests int
+	period   time.Duration
+	by       string
+}
+
+// tokenBucket holds tokens left at the time of the last update
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// RateLimiter is in-memory token bucket limiter of the realm endpoints.
+// Bucket is kept per limit and IP or user, it is refilled evenly during the period.
+type RateLimiter struct {
+	limits     []rateLimit
+	mu         sync.Mutex
+	buckets    map[string]*tokenBucket
+	maxBuckets int
+}
+
+// rateLimitStatus describes the most restrictive limit applied to the request
+type rateLimitStatus struct {
+	limit     rateLimit
+	remaining int
+	reset     time.Duration
+}
+
+// NewRateLimiter creates limiter from route=requests/period[,ip|user] specs, empty specs are ignored
+func NewRateLimiter(specs []string) (*RateLimiter, error) {
+	limiter := &RateLimiter{buckets: map[string]*tokenBucket{}, maxBuckets: rateLimitMaxBuckets}
+	for _, spec := range specs {
+		if spec == "" {
+			continue
+		}
+		limit, err := parseRateLimit(spec)
+		if err != nil {
+			return nil, err
+		}
+		limiter.limits = append(limiter.limits, limit)
+	}
+	return limiter, nil
+}
+
+// take consumes a token of every bucket of the request, nothing is consumed when any of them is empty.
+// Buckets by IP are checked first, so requests denied by them create no buckets of client supplied usernames.
+// Returns status of the most restrictive bucket.
+func (l *RateLimiter) take(limits []rateLimit, keys []string, now time.Time) (rateLimitStatus, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	buckets := make([]*tokenBucket, len(limits))
+	for _, by := range []string{rateLimitByIP, rateLimitByUser} {
+		for i, limit := range limits {
+			if limit.by == by {
+				buckets[i] = l.bucket(limit, keys[i], now)
+			}
+		}
+
+		var denied *rateLimitStatus
+		for i, b := range buckets {
+			if b == nil || b.tokens >= 1 {
+				continue
+			}
+			wait := limits[i].duration(1 - b.tokens)
+			if denied == nil || wait > denied.reset {
+				denied = &rateLimitStatus{limit: limits[i], remaining: 0, reset: wait}
+			}
+		}
+		if denied != nil {
+			return *denied, false
+		}
+	}
+
+	status := rateLimitStatus{remaining: math.MaxInt32}
+	for i, b := range buckets {
+		b.tokens--
+		if int(b.tokens) < status.remaining {
+			status = rateLimitStatus{limit: limits[i], remaining: int(b.tokens), reset: limits[i].duration(float64(limits[i].requests) - b.tokens)}
+		}
+	}
+	return status, true
+}
+
+// bucket returns refilled bucket of the key, it is created when missing.
+// User keyed limit gets the shared overflow bucket when there is no room for a new one.
+func (l *RateLimiter) bucket(limit rateLimit, key string, now time.Time) *tokenBucket {
+	b, ok := l.buckets[key]
+	if !ok && limit.by == rateLimitByUser && len(l.buckets) >= l.maxBuckets {
+		key = limit.key(rateLimitOverflowUser)
+		b, ok = l.buckets[key]
+	}
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit.requests), updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(limit.requests), b.tokens+now.Sub(b.updated).Seconds()*limit.rate())
+	b.updated = now
+	return b
+}
+
+// prune removes buckets which have been refilled completely
+func (l *RateLimiter) prune() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for key, b := range l.buckets {
+		if now.Sub(b.updated) > l.longestPeriod() {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *RateLimiter) longestPeriod() time.Duration {
+	longest := time.Duration(0)
+	for _, limit := range l.limits {
+		if limit.period > longest {
+			longest = limit.period
+		}
+	}
+	return longest
+}
+
+// key returns bucket key of the limit for IP or user
+func (l rateLimit) key(subject string) string {
+	return fmt.Sprintf("%s %s %s:%s", l.route, l.period, l.by, subject)
+}
+
+// rate returns number of tokens added per second
+func (l rateLimit) rate() float64 {
+	return float64(l.requests) / l.period.Seconds()
+}
+
+// duration returns time the bucket needs to get tokens
+func (l rateLimit) duration(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate() * float64(time.Second))
+}
+
+// matches reports whether the limit applies to route path relative to API root, e.g. /users
+func (l rateLimit) matches(route string) bool {
+	if l.route == "*" {
+		return true
+	}
+	matched, _ := path.Match(l.route, route)
+	return matched
+}
+
+// rateLimit rejects requests exceeding limits of the realm with 429 status, RateLimit-* headers
+// describe the most restrictive limit applied to the request
+func (a *Auth) rateLimit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target, route := a.routeAuth(r.URL.Path)
+		if target.limiter == nil || r.Method == http.MethodOptions {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		limits := []rateLimit{}
+		keys := []string{}
+		username := ""
+		for _, limit := range target.limiter.limits {
+			if !limit.matches(route) {
+				continue
+			}
+			key := target.clientIP(r)
+			if limit.by == rateLimitByUser {
+				if username == "" {
+					username = target.requestUsername(r, route)
+				}
+				if username == "" {
+					continue
+				}
+				key = strings.ToLower(username)
+			}
+			limits = append(limits, limit)
+			keys = append(keys, limit.key(key))
+		}
+		if len(limits) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		status, allowed := target.limiter.take(limits, keys, time.Now())
+		reset := int64(math.Ceil(status.reset.Seconds()))
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(status.limit.requests))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(status.remaining))
+		w.Header().Set("RateLimit-Reset", strconv.FormatInt(reset, 10))
+		w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", status.limit.requests, int64(status.limit.period.Seconds())))
+		if !allowed {
+			logger.Logf("WARN Rate limit %s=%d/%s of %s is exceeded", status.limit.route, status.limit.requests, status.limit.period, status.limit.by)
+			a.options(w, r)
+			w.Header().Add("Content-type", "application/json; charset=utf-8")
+			writeError(w, st.AuthError{Msg: "Too many requests, try again later", Status: 429, RetryAfter: reset})
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// startRateLimiter creates limiter from configuration of the realm and prunes it periodically
+func (a *Auth) startRateLimiter() {
+	limiter, err := NewRateLimiter(a.AuthService.Config.RateLimits)
+	if err != nil {
+		logger.Logf("FATAL Invalid rate limit: %s", err.Error())
+		return
+	}
+	if len(limiter.limits) == 0 {
+		return
+	}
+	a.limiter = limiter
+	go runPeriodically(limiter.longestPeriod(), limiter.prune)
+}
+
+// routeAuth returns realm the path belongs to and route relative to its API root,
+// e.g. /v1/users and /v1/realms/mobile/users are both /users
+func (a *Auth) routeAuth(p string) (*Auth, string) {
+	for _, realm := range a.Realms {
+		if strings.HasPrefix(p, realm.BasePath+"/") {
+			return realm, strings.TrimPrefix(p, realm.BasePath)
+		}
+	}
+	if strings.HasPrefix(p, "/v1/") {
+		return a, strings.TrimPrefix(p, "/v1")
+	}
+	return a, p
+}
+
+// requestUsername returns user of the request: owner of valid bearer token, basic auth username
+// or username field of the payload parsed the same way the handler of the route does.
+// Empty string is returned for anonymous requests.
+func (a *Auth) requestUsername(r *http.Request, route string) string {
+	if username, _, ok := r.BasicAuth(); ok {
+		return username
+	}
+	if items := strings.Split(r.Header.Get("Authorization"), " "); len(items) == 2 && items[0] == "Bearer" {
+		return a.AuthService.tokenSubject(items[1])
+	}
+	if r.Body == nil {
+		return ""
+	}
+
+	// Body is restored for the handler, the part beyond limit is not read
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, rateLimitMaxBody))
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	if err != nil {
+		return ""
+	}
+
+	username := ""
+	if isFormRoute(route) {
+		// Form is parsed only for content type the handler accepts
+		form := &http.Request{Method: r.Method, Header: r.Header, Body: ioutil.NopCloser(bytes.NewReader(body))}
+		form.ParseForm()
+		username = form.PostForm.Get("username")
+	} else {
+		// Handlers decode JSON regardless of content type
+		var payload struct {
+			Username string `json:"username"`
+		}
+		json.NewDecoder(bytes.NewReader(body)).Decode(&payload)
+		username = payload.Username
+	}
+	// Username beyond the read part would skip the limit, so such requests share one bucket
+	if username == "" && len(body) == rateLimitMaxBody {
+		return rateLimitOversizedUser
+	}
+	return username
+}
+
+// isFormRoute returns true when handler of the route reads form payload
+func isFormRoute(route string) bool {
+	for _, r := range rateLimitFormRoutes {
+		if matched, _ := path.Match(r, route); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenSubject returns subject of token with valid signature and time claims, revocation is not checked
+func (s *AuthService) tokenSubject(t string) string {
+	parser := jwt.Parser{SkipClaimsValidation: true}
+	token, err := parser.Parse(t, s.verificationKey)
+	if err != nil {
+		return ""
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid || s.validateClaims(claims) != nil {
+		return ""
+	}
+	sub, _ := claims["sub"].(string)
+	return sub
+}
+
+// parseRateLimit parses route=requests/period[,ip|user] limit, e.g. /password-recovery/*=10/1h,user
+func parseRateLimit(spec string) (rateLimit, error) {
+	invalidErr := fmt.Errorf("Invalid rate limit %s, expected route=requests/period[,ip|user]", spec)
+
+	i := strings.LastIndex(spec, "=")
+	if i <= 0 {
+		return rateLimit{}, invalidErr
+	}
+	limit := rateLimit{route: spec[:i], by: rateLimitByIP}
+	if limit.route != "*" && !strings.HasPrefix(limit.route, "/") {
+		return rateLimit{}, invalidErr
+	}
+	if _, err := path.Match(limit.route, "/"); err != nil {
+		return rateLimit{}, invalidErr
+	}
+
+	parts := strings.SplitN(spec[i+1:], ",", 2)
+	if len(parts) == 2 {
+		limit.by = parts[1]
+		if limit.by != rateLimitByIP && limit.by != rateLimitByUser {
+			return rateLimit{}, invalidErr
+		}
+	}
+	rate := strings.SplitN(parts[0], "/", 2)
+	if len(rate) != 2 {
+		return rateLimit{}, invalidErr
+	}
+	requests, err := strconv.Atoi(rate[0])
+	if err != nil || requests <= 0 {
+		return rateLimit{}, fmt.Errorf("Invalid number of requests in %s", spec)
+	}
+	period, err := time.ParseDuration(rate[1])
+	if err != nil || period <= 0 {
+		return rateLimit{}, fmt.Errorf("Invalid period in %s", spec)
+	}
+	limit.requests = requests
+	limit.period = period
+	return limit, nil
+}
+
+// readCloser reads restored body and closes the original one
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
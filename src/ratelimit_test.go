@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter_Take(t *testing.T) {
+	limiter, err := NewRateLimiter([]string{"/users=2/1m", "*=10/1m"})
+	assert.Nil(t, err)
+	limits := limiter.limits
+	keys := []string{"users ip:192.0.2.1", "all ip:192.0.2.1"}
+	now := time.Now()
+
+	status, allowed := limiter.take(limits, keys, now)
+	assert.True(t, allowed)
+	assert.Equal(t, 1, status.remaining)
+	assert.Equal(t, "/users", status.limit.route)
+	assert.Equal(t, 30*time.Second, status.reset)
+
+	_, allowed = limiter.take(limits, keys, now)
+	assert.True(t, allowed)
+
+	status, allowed = limiter.take(limits, keys, now)
+	assert.False(t, allowed)
+	assert.Equal(t, 0, status.remaining)
+	assert.Equal(t, 30*time.Second, status.reset)
+
+	// Rejected request does not consume tokens of other buckets
+	assert.Equal(t, 8.0, limiter.buckets["all ip:192.0.2.1"].tokens)
+
+	// Bucket is refilled evenly
+	_, allowed = limiter.take(limits, keys, now.Add(30*time.Second))
+	assert.True(t, allowed)
+	_, allowed = limiter.take(limits, keys, now.Add(30*time.Second))
+	assert.False(t, allowed)
+}
+
+func TestRateLimiter_Take_UserBuckets(t *testing.T) {
+	limiter, err := NewRateLimiter([]string{"*=2/1m", "/passwordless/start=5/1h,user"})
+	assert.Nil(t, err)
+	limiter.maxBuckets = 3
+	ipLimit, userLimit := limiter.limits[0], limiter.limits[1]
+	now := time.Now()
+
+	take := func(ip, username string) bool {
+		_, allowed := limiter.take(limiter.limits, []string{ipLimit.key(ip), userLimit.key(username)}, now)
+		return allowed
+	}
+
+	// Requests denied by IP create no user buckets
+	assert.True(t, take("192.0.2.1", "alle"))
+	assert.True(t, take("192.0.2.1", "eve"))
+	assert.False(t, take("192.0.2.1", "todd"))
+	assert.Len(t, limiter.buckets, 3)
+	assert.Nil(t, limiter.buckets[userLimit.key("todd")])
+
+	// Users beyond the cap share one bucket
+	assert.True(t, take("192.0.2.2", "todd"))
+	assert.True(t, take("192.0.2.3", "kate"))
+	assert.Nil(t, limiter.buckets[userLimit.key("todd")])
+	assert.Equal(t, 3.0, limiter.buckets[userLimit.key(rateLimitOverflowUser)].tokens)
+	assert.Equal(t, 4.0, limiter.buckets[userLimit.key("alle")].tokens)
+}
+
+func TestRateLimiter_Prune(t *testing.T) {
+	limiter, _ := NewRateLimiter([]string{"*=10/1m"})
+	limiter.take(limiter.limits, []string{"old"}, time.Now().Add(-2*time.Minute))
+	limiter.take(limiter.limits, []string{"new"}, time.Now())
+
+	limiter.prune()
+	assert.Len(t, limiter.buckets, 1)
+	assert.NotNil(t, limiter.buckets["new"])
+}
+
+func TestParseRateLimit(t *testing.T) {
+	limit, err := parseRateLimit("/password-recovery/*=10/1h,user")
+	assert.Nil(t, err)
+	assert.Equal(t, rateLimit{route: "/password-recovery/*", requests: 10, period: time.Hour, by: rateLimitByUser}, limit)
+	assert.True(t, limit.matches("/password-recovery/email"))
+	assert.False(t, limit.matches("/users"))
+
+	limit, err = parseRateLimit("*=600/1m")
+	assert.Nil(t, err)
+	assert.Equal(t, rateLimitByIP, limit.by)
+	assert.True(t, limit.matches("/oauth/token"))
+
+	for _, spec := range []string{"/users", "users=1/1m", "/users=0/1m", "/users=1/0s", "/users=1", "/users=1/1m,client", "/[=1/1m"} {
+		_, err = parseRateLimit(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
+
+func TestAuth_RouteAuth(t *testing.T) {
+	realm := &Auth{BasePath: realmPath("mobile")}
+	a := &Auth{Realms: map[string]*Auth{"mobile": realm}}
+
+	target, route := a.routeAuth("/v1/users")
+	assert.Equal(t, a, target)
+	assert.Equal(t, "/users", route)
+
+	target, route = a.routeAuth("/oauth/token")
+	assert.Equal(t, a, target)
+	assert.Equal(t, "/oauth/token", route)
+
+	target, route = a.routeAuth("/v1/realms/mobile/password-recovery/email")
+	assert.Equal(t, realm, target)
+	assert.Equal(t, "/password-recovery/email", route)
+}
+
+func TestAuth_RequestUsername(t *testing.T) {
+	a := &Auth{AuthService: &AuthService{}}
+
+	r, _ := http.NewRequest(http.MethodPost, "/v1/password-recovery/email", strings.NewReader(`{"username": "sarah69"}`))
+	assert.Equal(t, "sarah69", a.requestUsername(r, "/password-recovery/email"))
+	body, _ := ioutil.ReadAll(r.Body)
+	assert.Equal(t, `{"username": "sarah69"}`, string(body))
+
+	r, _ = http.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader("grant_type=password&username=sarah69"))
+	r.Header.Set("Content-type", "application/x-www-form-urlencoded")
+	assert.Equal(t, "sarah69", a.requestUsername(r, "/oauth/token"))
+	r.ParseForm()
+	assert.Equal(t, "password", r.PostForm.Get("grant_type"))
+
+	r, _ = http.NewRequest(http.MethodPost, "/v1/token", nil)
+	r.SetBasicAuth("sarah69", "oakheart")
+	assert.Equal(t, "sarah69", a.requestUsername(r, "/token"))
+}
+
+func TestAuth_RequestUsername_MismatchedContentType(t *testing.T) {
+	a := &Auth{AuthService: &AuthService{}}
+
+	// JSON handler decodes the payload whatever content type is sent
+	r, _ := http.NewRequest(http.MethodPost, "/v1/passwordless/token", strings.NewReader(`{"username": "sarah69", "code": "123987"}`))
+	r.Header.Set("Content-type", "application/x-www-form-urlencoded")
+	assert.Equal(t, "sarah69", a.requestUsername(r, "/passwordless/token"))
+
+	r, _ = http.NewRequest(http.MethodPost, "/v1/passwordless/token", strings.NewReader(`{"username": "sarah69"} trailing`))
+	assert.Equal(t, "sarah69", a.requestUsername(r, "/passwordless/token"))
+
+	// Form handler ignores the payload of other content types
+	r, _ = http.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader("username=sarah69"))
+	r.Header.Set("Content-type", "application/json")
+	assert.Equal(t, "", a.requestUsername(r, "/oauth/token"))
+
+	payload := `{"padding": "` + strings.Repeat("x", rateLimitMaxBody) + `", "username": "sarah69"}`
+	r, _ = http.NewRequest(http.MethodPost, "/v1/passwordless/token", strings.NewReader(payload))
+	assert.Equal(t, rateLimitOversizedUser, a.requestUsername(r, "/passwordless/token"))
+	body, _ := ioutil.ReadAll(r.Body)
+	assert.Equal(t, payload, string(body))
+}
+
+func TestAuth_ClientIP(t *testing.T) {
+	a := &Auth{AuthService: &AuthService{}}
+
+	r, _ := http.NewRequest(http.MethodPost, "/v1/token", nil)
+	r.RemoteAddr = "192.0.2.1:4711"
+	r.Header.Add("X-Forwarded-For", "198.51.100.7")
+	assert.Equal(t, "192.0.2.1", a.clientIP(r))
+
+	// Only the entry appended by the proxy is trusted, the client can send the others
+	a.AuthService.Config.TrustForwardedFor = true
+	r.Header.Set("X-Forwarded-For", "203.0.113.9, 198.51.100.7")
+	assert.Equal(t, "198.51.100.7", a.clientIP(r))
+
+	r.Header.Add("X-Forwarded-For", "198.51.100.8")
+	assert.Equal(t, "198.51.100.8", a.clientIP(r))
+
+	r.Header.Del("X-Forwarded-For")
+	assert.Equal(t, "192.0.2.1", a.clientIP(r))
+}
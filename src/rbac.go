@@ -0,0 +1,267 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+
+	st "github.com/adderly/brightonum/src/structs"
+)
+
+// Permissions checked by the service itself, others can be defined for resource services
+const (
+	usersReadPermission     = "users:read"
+	usersWritePermission    = "users:write"
+	invitesCreatePermission = "invites:create"
+	clientsReadPermission   = "clients:read"
+	clientsWritePermission  = "clients:write"
+	keysRotatePermission    = "keys:rotate"
+	rolesReadPermission     = "roles:read"
+	rolesWritePermission    = "roles:write"
+	groupsReadPermission    = "groups:read"
+	groupsWritePermission   = "groups:write"
+)
+
+// adminRole is built in, it has all permissions checked by the service and cannot be changed
+const adminRole = "admin"
+
+var adminPermissions = []string{
+	usersReadPermission,
+	usersWritePermission,
+	invitesCreatePermission,
+	clientsReadPermission,
+	clientsWritePermission,
+	keysRotatePermission,
+	rolesReadPermission,
+	rolesWritePermission,
+	groupsReadPermission,
+	groupsWritePermission,
+}
+
+var roleNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+var permissionPattern = regexp.MustCompile(`^[A-Za-z0-9_.:*/-]{1,128}$`)
+
+// authorize authenticates access token and checks that its owner has the permission
+func (s *AuthService) authorize(token string, permission string) (*st.User, error) {
+	u, err := s.authenticateToken(token, accessTokenUse)
+	if err != nil {
+		return nil, err
+	}
+	permitted, err := s.hasPermission(u, permission)
+	if err != nil {
+		return nil, err
+	}
+	if !permitted {
+		return nil, st.AuthError{Msg: "Permission " + permission + " is required", Status: 403}
+	}
+	return u, nil
+}
+
+func (s *AuthService) hasPermission(u *st.User, permission string) (bool, error) {
+	permissions, err := s.userPermissions(u)
+	if err != nil {
+		return false, err
+	}
+	return contains(permissions, permission), nil
+}
+
+// userRoles returns roles assigned to the user directly and via groups,
+// admin role is implied for configured admin. Groups which have been deleted are ignored.
+func (s *AuthService) userRoles(u *st.User) ([]string, error) {
+	roles := []string{}
+	if s.Config.AdminID != 0 && u.ID == s.Config.AdminID {
+		roles = append(roles, adminRole)
+	}
+	roles = appendMissing(roles, u.Roles...)
+
+	for _, id := range u.Groups {
+		g, err := s.GroupDao.GetGroup(id)
+		if err != nil {
+			return nil, st.AuthError{Msg: err.Error(), Status: 500}
+		}
+		if g != nil {
+			roles = appendMissing(roles, g.Roles...)
+		}
+	}
+	return roles, nil
+}
+
+// userPermissions returns sorted permissions granted to the user directly and via roles.
+// Roles which have been deleted are ignored.
+func (s *AuthService) userPermissions(u *st.User) ([]string, error) {
+	granted := map[string]bool{}
+	for _, p := range u.Permissions {
+		granted[p] = true
+	}
+
+	roles, err := s.userRoles(u)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range roles {
+		role, err := s.getRole(name)
+		if err != nil {
+			return nil, st.AuthError{Msg: err.Error(), Status: 500}
+		}
+		if role == nil {
+			continue
+		}
+		for _, p := range role.Permissions {
+			granted[p] = true
+		}
+	}
+
+	result := make([]string, 0, len(granted))
+	for p := range granted {
+		result = append(result, p)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func (s *AuthService) getRole(name string) (*st.Role, error) {
+	if name == adminRole {
+		return &st.Role{Name: adminRole, Permissions: adminPermissions}, nil
+	}
+	return s.RoleDao.GetRole(name)
+}
+
+// GetRoles returns built in admin role and all stored roles
+func (s *AuthService) GetRoles(token string) (*[]st.Role, error) {
+	if _, err := s.authorize(token, rolesReadPermission); err != nil {
+		return nil, err
+	}
+
+	roles, err := s.RoleDao.GetRoles()
+	if err != nil {
+		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+	}
+
+	result := []st.Role{{Name: adminRole, Permissions: adminPermissions}}
+	result = append(result, *roles...)
+	return &result, nil
+}
+
+// SaveRole creates role or replaces its permissions
+func (s *AuthService) SaveRole(r *st.Role, token string) error {
+	if _, err := s.authorize(token, rolesWritePermission); err != nil {
+		return err
+	}
+
+	if !roleNamePattern.MatchString(r.Name) {
+		return st.AuthError{Msg: "Invalid role name", Status: 400}
+	}
+	if r.Name == adminRole {
+		return st.AuthError{Msg: "Role admin cannot be changed", Status: 400}
+	}
+	if err := validatePermissions(r.Permissions); err != nil {
+		return err
+	}
+	r.Permissions = nonNil(r.Permissions)
+
+	if err := s.RoleDao.SaveRole(r); err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+
+	logger.Logf("INFO Role %s is saved with permissions %v", r.Name, r.Permissions)
+	return nil
+}
+
+// DeleteRole deletes role, users which have it lose its permissions
+func (s *AuthService) DeleteRole(name string, token string) error {
+	if _, err := s.authorize(token, rolesWritePermission); err != nil {
+		return err
+	}
+
+	if name == adminRole {
+		return st.AuthError{Msg: "Role admin cannot be changed", Status: 400}
+	}
+
+	if err := s.RoleDao.DeleteRole(name); err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+
+	logger.Logf("INFO Role %s is deleted", name)
+	return nil
+}
+
+// GetUserAccess returns roles and permissions assigned to user
+func (s *AuthService) GetUserAccess(id int64, token string) (*st.UserAccess, error) {
+	if _, err := s.authorize(token, rolesReadPermission); err != nil {
+		return nil, err
+	}
+
+	u, err := s.UserDao.Get(id)
+	if err != nil {
+		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if u == nil {
+		return nil, st.AuthError{Msg: "User does not exist", Status: 404}
+	}
+
+	return &st.UserAccess{Roles: nonNil(u.Roles), Permissions: nonNil(u.Permissions)}, nil
+}
+
+// SetUserAccess replaces roles and permissions assigned to user.
+// Roles must exist, permissions are not limited to ones checked by the service.
+func (s *AuthService) SetUserAccess(id int64, access *st.UserAccess, token string) error {
+	if _, err := s.authorize(token, rolesWritePermission); err != nil {
+		return err
+	}
+
+	for _, name := range access.Roles {
+		role, err := s.getRole(name)
+		if err != nil {
+			return st.AuthError{Msg: err.Error(), Status: 500}
+		}
+		if role == nil {
+			return st.AuthError{Msg: "Role " + name + " does not exist", Status: 400}
+		}
+	}
+	if err := validatePermissions(access.Permissions); err != nil {
+		return err
+	}
+
+	userExists, err := s.userExists(id)
+	if err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if !userExists {
+		return st.AuthError{Msg: "User does not exist", Status: 404}
+	}
+
+	roles, permissions := nonNil(access.Roles), nonNil(access.Permissions)
+	if err = s.UserDao.SetAccess(id, roles, permissions); err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+
+	logger.Logf("INFO User %d is granted roles %v and permissions %v", id, roles, permissions)
+	return nil
+}
+
+// appendMissing appends items which are not in the list yet
+func appendMissing(list []string, items ...string) []string {
+	for _, item := range items {
+		if !contains(list, item) {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// nonNil returns empty list instead of nil one, so it is serialized as JSON array
+func nonNil(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
+
+func validatePermissions(permissions []string) error {
+	for _, p := range permissions {
+		if !permissionPattern.MatchString(p) {
+			return st.AuthError{Msg: "Invalid permission " + p, Status: 400}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adderly/brightonum/src/dao"
+	st "github.com/adderly/brightonum/src/structs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestAuthService_UserPermissions(t *testing.T) {
+	roleDao := dao.MockRoleDao{}
+	roleDao.On("GetRole", "support").Return(&st.Role{Name: "support", Permissions: []string{"users:read", "tickets:write"}}, nil)
+	roleDao.On("GetRole", "deleted").Return(nil, nil)
+
+	dao := dao.MockUserDao{}
+
+	s := createTestService(&mailer, &dao, createTestConfig())
+	s.RoleDao = &roleDao
+
+	u := st.User{ID: 43, Roles: []string{"support", "deleted"}, Permissions: []string{"invites:create", "users:read"}}
+	permissions, err := s.userPermissions(&u)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"invites:create", "tickets:write", "users:read"}, permissions)
+
+	admin := createTestUser()
+	permissions, err = s.userPermissions(&admin)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, adminPermissions, permissions)
+	roles, err := s.userRoles(&admin)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{adminRole}, roles)
+
+	permissions, err = s.userPermissions(&st.User{ID: 44})
+	assert.Nil(t, err)
+	assert.Empty(t, permissions)
+}
+
+func TestAuthService_InviteUser_Permission(t *testing.T) {
+	user := createTestUser()
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+	inviter := st.User{ID: 43, Username: user.Username, Roles: []string{"support"}}
+
+	roleDao := dao.MockRoleDao{}
+	roleDao.On("GetRole", "support").Return(&st.Role{Name: "support", Permissions: []string{invitesCreatePermission}}, nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&inviter, nil)
+	dao.On("Save", mock.Anything).Return(99)
+
+	m := MailerMock{}
+	m.On("SendInviteCode", "bojack@horseman.com", mock.Anything).Return(nil)
+
+	s := createTestService(&m, &dao, createTestConfig())
+	s.RoleDao = &roleDao
+
+	err := s.InviteUser("bojack@horseman.com", token)
+	assert.Nil(t, err)
+	m.AssertExpectations(t)
+
+	_, err = s.RotateKeys(token)
+	assert.Equal(t, st.AuthError{Msg: "Permission keys:rotate is required", Status: 403}, err)
+}
+
+func TestAuthService_DeleteUser_Permission(t *testing.T) {
+	user := createTestUser()
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&st.User{ID: 43, Username: user.Username, Permissions: []string{usersWritePermission}}, nil).Once()
+	dao.On("GetByUsername", user.Username).Return(&st.User{ID: 43, Username: user.Username}, nil)
+	dao.On("DeleteById", int64(44)).Return(nil)
+
+	s := createTestService(&mailer, &dao, createTestConfig())
+
+	err := s.DeleteUser(44, token)
+	assert.Nil(t, err)
+
+	err = s.DeleteUser(44, token)
+	assert.Equal(t, st.AuthError{Msg: "Invalid token", Status: 401}, err)
+	dao.AssertNumberOfCalls(t, "DeleteById", 1)
+}
+
+func TestAuthService_SaveRole(t *testing.T) {
+	user := createTestUser()
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+
+	roleDao := dao.MockRoleDao{}
+	roleDao.On("SaveRole", &st.Role{Name: "support", Permissions: []string{"users:read"}}).Return(nil)
+	roleDao.On("GetRoles").Return(&[]st.Role{{Name: "support", Permissions: []string{"users:read"}}}, nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := createTestService(&mailer, &dao, createTestConfig())
+	s.RoleDao = &roleDao
+
+	err := s.SaveRole(&st.Role{Name: "support", Permissions: []string{"users:read"}}, token)
+	assert.Nil(t, err)
+
+	err = s.SaveRole(&st.Role{Name: adminRole}, token)
+	assert.Equal(t, st.AuthError{Msg: "Role admin cannot be changed", Status: 400}, err)
+
+	err = s.SaveRole(&st.Role{Name: "bad name"}, token)
+	assert.Equal(t, st.AuthError{Msg: "Invalid role name", Status: 400}, err)
+
+	err = s.SaveRole(&st.Role{Name: "support", Permissions: []string{"users read"}}, token)
+	assert.Equal(t, st.AuthError{Msg: "Invalid permission users read", Status: 400}, err)
+
+	roles, err := s.GetRoles(token)
+	assert.Nil(t, err)
+	assert.Len(t, *roles, 2)
+	assert.Equal(t, adminRole, (*roles)[0].Name)
+}
+
+func TestAuthService_SetUserAccess(t *testing.T) {
+	user := createTestUser()
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+
+	roleDao := dao.MockRoleDao{}
+	roleDao.On("GetRole", "support").Return(&st.Role{Name: "support"}, nil)
+	roleDao.On("GetRole", "unknown").Return(nil, nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+	dao.On("Get", int64(43)).Return(&st.User{ID: 43}, nil)
+	dao.On("Get", int64(44)).Return(nil, nil)
+	dao.On("SetAccess", int64(43), []string{"support"}, []string{}).Return(nil)
+
+	s := createTestService(&mailer, &dao, createTestConfig())
+	s.RoleDao = &roleDao
+
+	err := s.SetUserAccess(43, &st.UserAccess{Roles: []string{"support"}}, token)
+	assert.Nil(t, err)
+	dao.AssertCalled(t, "SetAccess", int64(43), []string{"support"}, []string{})
+
+	err = s.SetUserAccess(43, &st.UserAccess{Roles: []string{"unknown"}}, token)
+	assert.Equal(t, st.AuthError{Msg: "Role unknown does not exist", Status: 400}, err)
+
+	err = s.SetUserAccess(44, &st.UserAccess{Roles: []string{"support"}}, token)
+	assert.Equal(t, st.AuthError{Msg: "User does not exist", Status: 404}, err)
+
+	access, err := s.GetUserAccess(43, token)
+	assert.Nil(t, err)
+	assert.Equal(t, &st.UserAccess{Roles: []string{}, Permissions: []string{}}, access)
+}
+
+func TestAuthService_IssueAccessToken_MembershipClaims(t *testing.T) {
+	roleDao := dao.MockRoleDao{}
+	roleDao.On("GetRole", "support").Return(&st.Role{Name: "support", Permissions: []string{"users:read", "tickets:write"}}, nil)
+	roleDao.On("GetRole", "actor").Return(&st.Role{Name: "actor", Permissions: []string{"scripts:read"}}, nil)
+
+	groupDao := dao.MockGroupDao{}
+	groupDao.On("GetGroup", "horsin-around").Return(&st.Group{ID: "horsin-around", Roles: []string{"actor", "support"}}, nil)
+
+	dao := dao.MockUserDao{}
+
+	conf := createTestConfig()
+	conf.TokenClaims = "roles,groups,scope"
+	conf.AudienceClaims = []string{"web=groups", "mobile="}
+	s := createTestService(&mailer, &dao, conf)
+	s.RoleDao = &roleDao
+	s.GroupDao = &groupDao
+
+	u := st.User{ID: 43, Username: "bojack", Roles: []string{"support"}, Groups: []string{"horsin-around"}}
+
+	token, err := s.issueAccessToken(&u, "", time.Now().Unix())
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"support", "actor"}, exctractField(token, "roles", nil))
+	assert.Equal(t, []interface{}{"horsin-around"}, exctractField(token, "groups", nil))
+	assert.True(t, testJWTStringField(token, "scope", "scripts:read tickets:write users:read"))
+
+	token, err = s.issueAccessToken(&u, "web", time.Now().Unix())
+	assert.Nil(t, err)
+	assert.Nil(t, exctractField(token, "roles", nil))
+	assert.Equal(t, []interface{}{"horsin-around"}, exctractField(token, "groups", nil))
+	assert.Nil(t, exctractField(token, "scope", nil))
+
+	token, err = s.issueAccessToken(&u, "mobile", time.Now().Unix())
+	assert.Nil(t, err)
+	assert.Nil(t, exctractField(token, "groups", nil))
+
+	// User without memberships gets empty lists and no scope
+	token, err = s.issueAccessToken(&st.User{ID: 44, Username: "todd"}, "", time.Now().Unix())
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{}, exctractField(token, "roles", nil))
+	assert.Equal(t, []interface{}{}, exctractField(token, "groups", nil))
+	assert.Nil(t, exctractField(token, "scope", nil))
+}
@@ -1,10 +1,11 @@
 package main
 
 import (
+	crand "crypto/rand"
+	"encoding/hex"
 	"fmt"
-	"io/ioutil"
-	"math/rand"
-	"strconv"
+	"math/big"
+	"strings"
 
 	"github.com/adderly/brightonum/src/crypto"
 	"github.com/adderly/brightonum/src/dao"
@@ -17,20 +18,38 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
+const (
+	accessTokenUse  = "access"
+	refreshTokenUse = "refresh"
+)
+
 // AuthService provides all auth operations
 type AuthService struct {
-	Mailer  Mailer
-	UserDao dao.UserDao
-	Config  Config
+	Mailer          Mailer
+	UserDao         dao.UserDao
+	RefreshTokenDao dao.RefreshTokenDao
+	RevocationDao   dao.RevocationDao
+	RoleDao         dao.RoleDao
+	GroupDao        dao.GroupDao
+	ClientDao       dao.ClientDao
+	AuthCodeDao     dao.AuthorizationCodeDao
+	DeviceDao       dao.DeviceAuthorizationDao
+	WebAuthnDao     dao.WebAuthnDao
+	LoginAttemptDao dao.LoginAttemptDao
+	Config          Config
+	Keys            *KeyRing
 }
 
 // InviteUser sends invite code for given email
 func (s *AuthService) InviteUser(email string, token string) error {
-	if !s.validateAdminToken(token) {
-		return st.AuthError{Msg: "Available only for admin", Status: 403}
+	if _, err := s.authorize(token, invitesCreatePermission); err != nil {
+		return err
 	}
 
-	var code = generateCode(32)
+	code, err := generateCode(32)
+	if err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
 	var user = st.User{Email: email, InviteCode: code}
 
 	id := s.UserDao.Save(&user)
@@ -38,7 +57,7 @@ func (s *AuthService) InviteUser(email string, token string) error {
 		return st.AuthError{Msg: "Cannot save user invite", Status: 500}
 	}
 
-	err := s.Mailer.SendInviteCode(email, code)
+	err = s.Mailer.SendInviteCode(email, code)
 	if err != nil {
 		logger.Logf("ERROR Email was not sent: " + err.Error())
 		return st.AuthError{Msg: err.Error(), Status: 500}
@@ -47,11 +66,6 @@ func (s *AuthService) InviteUser(email string, token string) error {
 	return err
 }
 
-func (s *AuthService) validateAdminToken(token string) bool {
-	u, valid := s.validateToken(token)
-	return valid && u.ID == s.Config.AdminID
-}
-
 // CreateUser creates new User
 func (s *AuthService) CreateUser(u *st.User) error {
 	logger.Logf("DEBUG creating user")
@@ -98,9 +112,18 @@ func (s *AuthService) CreateUser(u *st.User) error {
 func (s *AuthService) UpdateUser(u *st.User, token string) error {
 	logger.Logf("DEBUG Updating user with id %d", u.ID)
 
-	tokenUser, valid := s.validateToken(token)
-	if !valid || tokenUser.ID != u.ID {
-		return st.AuthError{Msg: "Invalid token", Status: 401}
+	tokenUser, err := s.authenticateToken(token, accessTokenUse)
+	if err != nil {
+		return err
+	}
+	if tokenUser.ID != u.ID {
+		permitted, err := s.hasPermission(tokenUser, usersWritePermission)
+		if err != nil {
+			return err
+		}
+		if !permitted {
+			return st.AuthError{Msg: "Invalid token", Status: 401}
+		}
 	}
 
 	if !validateUpdatePayload(u) {
@@ -125,12 +148,21 @@ func (s *AuthService) UpdateUser(u *st.User, token string) error {
 
 // DeleteUser delets user
 func (s *AuthService) DeleteUser(id int64, token string) error {
-	tokenUser, valid := s.validateToken(token)
-	if !valid || tokenUser.ID != id && tokenUser.ID != s.Config.AdminID {
-		return st.AuthError{Msg: "Invalid token", Status: 401}
+	tokenUser, err := s.authenticateToken(token, accessTokenUse)
+	if err != nil {
+		return err
+	}
+	if tokenUser.ID != id {
+		permitted, err := s.hasPermission(tokenUser, usersWritePermission)
+		if err != nil {
+			return err
+		}
+		if !permitted {
+			return st.AuthError{Msg: "Invalid token", Status: 401}
+		}
 	}
 
-	err := s.UserDao.DeleteById(id)
+	err = s.UserDao.DeleteById(id)
 	if err != nil {
 		return st.AuthError{Msg: err.Error(), Status: 500}
 	}
@@ -155,24 +187,31 @@ func (s *AuthService) userExists(id int64) (bool, error) {
 	return u != nil, nil
 }
 
-// BasicAuthToken issues new token by username and password
-func (s *AuthService) BasicAuthToken(username, password string) (string, string, error) {
-	user, err := s.UserDao.GetByUsername(username)
-
+// BasicAuthToken issues new token by username and password for given audience.
+// Empty audience stands for the default one. When the user has second factor enabled
+// mfa_required error with challenge token is returned instead, see MFAToken.
+// Failed attempts are counted per username and client IP, see checkPassword.
+func (s *AuthService) BasicAuthToken(username, password string, audience string, ip string) (string, string, error) {
+	audience, err := s.resolveAudience(audience)
 	if err != nil {
-		return "", "", st.AuthError{Msg: "Cannot extract user", Status: 500}
+		return "", "", err
 	}
 
-	if user == nil || !crypto.Match(password, user.Password) {
-		return "", "", st.AuthError{Msg: "Username or password is wrong", Status: 403}
+	user, err := s.checkPassword(username, password, ip)
+	if err != nil {
+		return "", "", err
+	}
+	if user.TOTPEnabled {
+		return "", "", s.mfaChallenge(user, audience)
 	}
 
-	tokenString, err := s.issueAccessToken(user)
+	authTime := time.Now().UTC().Unix()
+	tokenString, err := s.issueAccessToken(user, audience, authTime)
 	if err != nil {
 		return "", "", err
 	}
 
-	refreshTokenString, err := s.issueRefreshToken(user)
+	refreshTokenString, err := s.issueRefreshToken(user, "", "", audience, authTime)
 	if err != nil {
 		return "", "", err
 	}
@@ -180,27 +219,123 @@ func (s *AuthService) BasicAuthToken(username, password string) (string, string,
 	return tokenString, refreshTokenString, nil
 }
 
-func (s *AuthService) issueAccessToken(user *st.User) (string, error) {
+// resolveAudience returns default audience for empty one and checks that audience is allowed
+func (s *AuthService) resolveAudience(audience string) (string, error) {
+	if audience == "" {
+		return s.Config.Audience, nil
+	}
+	if !s.Config.AllowedAudience(audience) {
+		return "", st.AuthError{Msg: "Unknown audience", Status: 400}
+	}
+	return audience, nil
+}
+
+// issueAccessToken issues access token, authTime is Unix time of the authentication it continues
+func (s *AuthService) issueAccessToken(user *st.User, audience string, authTime int64) (string, error) {
 	if user == nil {
 		return "", st.AuthError{Msg: "User is missing", Status: 403}
 	}
 
-	keyData, err := ioutil.ReadFile(s.Config.PrivKeyPath)
-	if err != nil {
-		return "", st.AuthError{Msg: err.Error(), Status: 500}
+	lifetime, _ := s.Config.TokenLifetimes(audience)
+	claims := s.standardClaims(audience, lifetime)
+	claims["sub"] = user.Username
+	claims["userId"] = user.ID
+	claims["token_use"] = accessTokenUse
+	claims["jti"] = generateTokenID()
+	claims["auth_time"] = authTime
+
+	if err := s.addMembershipClaims(claims, user, audience); err != nil {
+		return "", err
+	}
+
+	return s.signToken(claims)
+}
+
+// addMembershipClaims adds roles, groups and permissions (as scope) of the user
+// configured for the audience, so resource services can authorize requests by token alone
+func (s *AuthService) addMembershipClaims(claims jwt.MapClaims, user *st.User, audience string) error {
+	for _, claim := range s.Config.MembershipClaims(audience) {
+		switch claim {
+		case rolesClaim:
+			roles, err := s.userRoles(user)
+			if err != nil {
+				return err
+			}
+			claims[rolesClaim] = roles
+		case groupsClaim:
+			claims[groupsClaim] = nonNil(user.Groups)
+		case scopeClaim:
+			permissions, err := s.userPermissions(user)
+			if err != nil {
+				return err
+			}
+			if len(permissions) > 0 {
+				claims[scopeClaim] = strings.Join(permissions, " ")
+			}
+		}
 	}
-	key, err := jwt.ParseRSAPrivateKeyFromPEM(keyData)
+	return nil
+}
+
+// issueRefreshToken issues refresh token continuing given token family. Empty family starts new one.
+// Authentication time is carried through the family, so ID tokens issued after refresh keep it.
+func (s *AuthService) issueRefreshToken(user *st.User, family string, clientID string, audience string, authTime int64) (string, error) {
+	id := generateTokenID()
+	if family == "" {
+		family = id
+	}
+	_, lifetime := s.Config.TokenLifetimes(audience)
+	claims := s.standardClaims(audience, lifetime)
+
+	err := s.RefreshTokenDao.SaveRefreshToken(&st.RefreshToken{
+		ID:        id,
+		Family:    family,
+		UserID:    user.ID,
+		ExpiresAt: claims["exp"].(int64),
+	})
 	if err != nil {
 		return "", st.AuthError{Msg: err.Error(), Status: 500}
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
-		"sub":    user.Username,
-		"userId": user.ID,
-		"exp":    time.Now().Add(time.Hour).UTC().Unix(),
-	})
+	claims["sub"] = user.Username
+	claims["token_use"] = refreshTokenUse
+	claims["jti"] = id
+	claims["fam"] = family
+	claims["auth_time"] = authTime
+	// Refresh token issued to a client can be used only by it
+	if clientID != "" {
+		claims["client_id"] = clientID
+	}
+
+	return s.signToken(claims)
+}
+
+// standardClaims returns registered claims for token with given audience and lifetime.
+// iss and aud are omitted when not configured.
+func (s *AuthService) standardClaims(audience string, lifetime time.Duration) jwt.MapClaims {
+	now := time.Now().UTC()
+	claims := jwt.MapClaims{
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+		"exp": now.Add(lifetime).Unix(),
+	}
+	if s.Config.Issuer != "" {
+		claims["iss"] = s.Config.Issuer
+	}
+	if audience != "" {
+		claims["aud"] = audience
+	}
+	return claims
+}
+
+// signToken signs claims with active key and puts its id into kid header
+func (s *AuthService) signToken(claims jwt.MapClaims) (string, error) {
+	key := s.Keys.Active()
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
 
-	tokenString, err := token.SignedString(key)
+	tokenString, err := token.SignedString(key.Private)
 	if err != nil {
 		return "", st.AuthError{Msg: err.Error(), Status: 500}
 	}
@@ -208,107 +343,415 @@ func (s *AuthService) issueAccessToken(user *st.User) (string, error) {
 	return tokenString, nil
 }
 
-func (s *AuthService) issueRefreshToken(user *st.User) (string, error) {
-	keyData, err := ioutil.ReadFile(s.Config.PrivKeyPath)
-	if err != nil {
-		return "", st.AuthError{Msg: err.Error(), Status: 500}
+// verificationKey picks public key from key ring by kid header of the token
+// Signing method of the token must match type of the key.
+func (s *AuthService) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key := s.Keys.Get(kid)
+	if key == nil {
+		return nil, fmt.Errorf("Unknown or retired key: %s", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.Public, nil
+}
+
+// RefreshToken exchanges refresh token for new access and refresh tokens of the same family.
+// Refresh token can be used only once, reuse revokes whole family.
+// Token issued to a client is accepted only from it, confidential client has to present its secret.
+func (s *AuthService) RefreshToken(t string, clientID string, secret string) (string, string, error) {
+	invalidErr := st.AuthError{Msg: "Refresh token is not valid", Status: 403}
+
+	claims, err := s.parseToken(t, refreshTokenUse)
+	if authErr, ok := err.(st.AuthError); ok {
+		return "", "", authErr
 	}
-	key, err := jwt.ParseRSAPrivateKeyFromPEM(keyData)
 	if err != nil {
-		return "", st.AuthError{Msg: err.Error(), Status: 500}
+		return "", "", invalidErr
 	}
 
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
-		"sub": user.Username,
-		"exp": time.Now().AddDate(1, 0, 0).UTC().Unix(),
-	})
+	id, _ := claims["jti"].(string)
+	if id == "" {
+		return "", "", invalidErr
+	}
+	tokenClient := claimString(claims, "client_id")
+	if tokenClient != "" {
+		if clientID != "" && clientID != tokenClient {
+			logger.Logf("WARN Refresh token of client %s is used by client %s", tokenClient, clientID)
+			return "", "", invalidErr
+		}
+		if err = s.checkClientSecret(tokenClient, secret); err != nil {
+			return "", "", err
+		}
+	}
+	stored, err := s.RefreshTokenDao.GetRefreshToken(id)
+	if err != nil {
+		return "", "", st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if stored == nil || stored.Revoked {
+		return "", "", invalidErr
+	}
 
-	refreshTokenString, err := refreshToken.SignedString(key)
+	firstUse, err := s.RefreshTokenDao.MarkRefreshTokenUsed(id)
 	if err != nil {
-		return "", st.AuthError{Msg: err.Error(), Status: 500}
+		return "", "", st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if !firstUse {
+		logger.Logf("WARN Refresh token %s is reused, revoking family %s", id, stored.Family)
+		err = s.RefreshTokenDao.RevokeRefreshTokenFamily(stored.Family)
+		if err != nil {
+			return "", "", st.AuthError{Msg: err.Error(), Status: 500}
+		}
+		return "", "", st.AuthError{Msg: "Refresh token has been used already, all related tokens are revoked", Status: 403}
 	}
 
-	return refreshTokenString, nil
-}
+	u, err := s.UserDao.GetByUsername(fmt.Sprintf("%s", claims["sub"]))
+	if err != nil {
+		return "", "", st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if u == nil {
+		return "", "", invalidErr
+	}
 
-// RefreshToken refreshes existing token
-func (s *AuthService) RefreshToken(t string) (string, error) {
-	u, ok := s.validateToken(t)
-	if ok {
-		accessToken, err := s.issueAccessToken(u)
-		return accessToken, err
+	audience := claimString(claims, "aud")
+	accessToken, err := s.issueAccessToken(u, audience, authTime(claims))
+	if err != nil {
+		return "", "", err
+	}
+	refreshToken, err := s.issueRefreshToken(u, stored.Family, tokenClient, audience, authTime(claims))
+	if err != nil {
+		return "", "", err
 	}
-	return "", st.AuthError{Msg: "Refresh token is not valid", Status: 403}
+	return accessToken, refreshToken, nil
 }
 
-func (s *AuthService) validateToken(t string) (*st.User, bool) {
-	keyData, err := ioutil.ReadFile(s.Config.PubKeyPath)
+// parseToken verifies token and checks that it is of expected use.
+// Returns AuthError only when valid token has wrong use.
+func (s *AuthService) parseToken(t string, use string) (jwt.MapClaims, error) {
+	claims, err := s.verifyToken(t)
 	if err != nil {
-		return nil, false
+		return nil, err
+	}
+
+	if actual := tokenUse(claims); actual != use {
+		logger.Logf("WARN %s token is used as %s token", actual, use)
+		return nil, st.AuthError{Msg: fmt.Sprintf("Expected %s token, got %s token", use, actual), Status: 401}
 	}
-	key, err := jwt.ParseRSAPublicKeyFromPEM(keyData)
+
+	return claims, nil
+}
+
+// verifyToken verifies signature and expiration of the token and checks that it is not revoked
+func (s *AuthService) verifyToken(t string) (jwt.MapClaims, error) {
+	// Time based claims are validated with allowed clock skew by validateClaims
+	parser := jwt.Parser{SkipClaimsValidation: true}
+	token, err := parser.Parse(t, s.verificationKey)
 	if err != nil {
 		logger.Logf("WARN %s", err.Error())
-		return nil, false
+		return nil, err
 	}
 
-	token, err := jwt.Parse(t, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-		}
-		return key, nil
-	})
-	if err != nil {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("Token is not valid")
+	}
+
+	if err = s.validateClaims(claims); err != nil {
 		logger.Logf("WARN %s", err.Error())
-		return nil, false
+		return nil, err
 	}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		u, err := s.UserDao.GetByUsername(fmt.Sprintf("%s", claims["sub"]))
+	if id, _ := claims["jti"].(string); id != "" {
+		revoked, err := s.RevocationDao.IsRevoked(id)
 		if err != nil {
-			return nil, false
+			return nil, err
+		}
+		if revoked {
+			logger.Logf("WARN Revoked token %s is used", id)
+			return nil, fmt.Errorf("Token is revoked")
 		}
-		return u, true
 	}
-	return nil, false
+
+	return claims, nil
 }
 
-// GetUserByToken returns user by token
-func (s *AuthService) GetUserByToken(t string) (*st.User, error) {
-	keyData, err := ioutil.ReadFile(s.Config.PubKeyPath)
+// validateClaims checks time based claims allowing configured clock skew, issuer and audience.
+// Issuer and audience may be absent in legacy tokens until configured cutoff.
+func (s *AuthService) validateClaims(claims jwt.MapClaims) error {
+	now := time.Now().Unix()
+	skew := int64(s.Config.ClockSkew.Seconds())
+	legacy := s.Config.LegacyTokensAccepted(time.Now())
+
+	if !claims.VerifyExpiresAt(now-skew, true) {
+		return fmt.Errorf("Token is expired")
+	}
+	if !claims.VerifyNotBefore(now+skew, false) || !claims.VerifyIssuedAt(now+skew, false) {
+		return fmt.Errorf("Token is not valid yet")
+	}
+	if s.Config.Issuer != "" && !claims.VerifyIssuer(s.Config.Issuer, !legacy) {
+		return fmt.Errorf("Token issuer is not accepted")
+	}
+	if _, ok := claims["aud"]; !ok && legacy {
+		return nil
+	}
+	if s.Config.Audience != "" && !s.Config.AllowedAudience(claimString(claims, "aud")) {
+		return fmt.Errorf("Token audience is not accepted")
+	}
+	return nil
+}
+
+// authenticateToken returns owner of the valid token of expected use
+func (s *AuthService) authenticateToken(t string, use string) (*st.User, error) {
+	claims, err := s.parseToken(t, use)
+	if authErr, ok := err.(st.AuthError); ok {
+		return nil, authErr
+	}
 	if err != nil {
-		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+		return nil, st.AuthError{Msg: "Invalid token", Status: 401}
 	}
-	key, err := jwt.ParseRSAPublicKeyFromPEM(keyData)
+	// Subject of client credentials tokens is a client, which may clash with a username
+	if _, ok := claims["userId"]; !ok {
+		return nil, st.AuthError{Msg: "Invalid token", Status: 401}
+	}
+
+	u, err := s.UserDao.GetByUsername(fmt.Sprintf("%s", claims["sub"]))
 	if err != nil {
 		return nil, st.AuthError{Msg: err.Error(), Status: 500}
 	}
+	if u == nil {
+		return nil, st.AuthError{Msg: "Invalid token", Status: 401}
+	}
+	return u, nil
+}
+
+func (s *AuthService) validateToken(t string) (*st.User, bool) {
+	u, err := s.authenticateToken(t, accessTokenUse)
+	return u, err == nil
+}
+
+// tokenUse returns token_use claim. Tokens issued before the claim was introduced
+// are distinguished by userId claim, which only access tokens have.
+func tokenUse(claims jwt.MapClaims) string {
+	if use, ok := claims["token_use"].(string); ok {
+		return use
+	}
+	if _, ok := claims["userId"]; ok {
+		return accessTokenUse
+	}
+	return refreshTokenUse
+}
+
+// RevokeToken revokes access or refresh token following RFC 7009.
+// Invalid and expired tokens are ignored, revoking refresh token revokes its whole family.
+func (s *AuthService) RevokeToken(t string) error {
+	claims, err := s.verifyToken(t)
+	if err != nil {
+		logger.Logf("DEBUG Ignoring revocation of invalid token: %s", err.Error())
+		return nil
+	}
+
+	id, _ := claims["jti"].(string)
+	if id == "" {
+		return st.AuthError{Msg: "unsupported_token_type", Status: 400}
+	}
+	exp, _ := claims["exp"].(float64)
+
+	err = s.RevocationDao.Revoke(id, int64(exp))
+	if err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
 
-	token, err := jwt.Parse(t, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+	if tokenUse(claims) == refreshTokenUse {
+		stored, err := s.RefreshTokenDao.GetRefreshToken(id)
+		if err != nil {
+			return st.AuthError{Msg: err.Error(), Status: 500}
 		}
-		return key, nil
-	})
+		if stored != nil {
+			err = s.RefreshTokenDao.RevokeRefreshTokenFamily(stored.Family)
+			if err != nil {
+				return st.AuthError{Msg: err.Error(), Status: 500}
+			}
+		}
+	}
+
+	logger.Logf("INFO Token %s is revoked", id)
+	return nil
+}
+
+// IntrospectToken returns state and claims of the token following RFC 7662.
+// Available only for callers authenticated with access token.
+func (s *AuthService) IntrospectToken(callerToken string, t string) (*st.IntrospectionResp, error) {
+	if _, err := s.authenticateToken(callerToken, accessTokenUse); err != nil {
+		return nil, err
+	}
+
+	inactive := &st.IntrospectionResp{Active: false}
+
+	claims, err := s.verifyToken(t)
 	if err != nil {
-		return nil, st.AuthError{Msg: err.Error(), Status: 400}
+		return inactive, nil
 	}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		u, err := s.UserDao.GetByUsername(fmt.Sprintf("%s", claims["sub"]))
+	// Session tokens of login steps, e.g. MFA challenges, are not user tokens
+	use := tokenUse(claims)
+	if use != accessTokenUse && use != refreshTokenUse {
+		return inactive, nil
+	}
+	if use == refreshTokenUse {
+		stored, err := s.RefreshTokenDao.GetRefreshToken(claimString(claims, "jti"))
 		if err != nil {
 			return nil, st.AuthError{Msg: err.Error(), Status: 500}
 		}
-		return u, nil
+		if stored == nil || stored.Used || stored.Revoked {
+			return inactive, nil
+		}
+	}
+
+	if _, ok := claims["userId"]; !ok && claimString(claims, "client_id") != "" {
+		return s.introspectClientToken(claims)
+	}
+
+	username := fmt.Sprintf("%s", claims["sub"])
+	u, err := s.UserDao.GetByUsername(username)
+	if err != nil {
+		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if u == nil {
+		return inactive, nil
+	}
+
+	result := &st.IntrospectionResp{
+		Active:   true,
+		Sub:      username,
+		Username: username,
+		UserID:   u.ID,
+		TokenUse: tokenUse(claims),
+		Scope:    claimString(claims, "scope"),
+		Jti:      claimString(claims, "jti"),
+		Exp:      claimInt(claims, "exp"),
+		Iat:      claimInt(claims, "iat"),
+	}
+	return result, nil
+}
+
+// introspectClientToken returns state of client credentials token, which is active while its client exists
+func (s *AuthService) introspectClientToken(claims jwt.MapClaims) (*st.IntrospectionResp, error) {
+	clientID := claimString(claims, "client_id")
+	client, err := s.ClientDao.GetClient(clientID)
+	if err != nil {
+		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if client == nil {
+		return &st.IntrospectionResp{Active: false}, nil
+	}
+
+	result := &st.IntrospectionResp{
+		Active:   true,
+		Sub:      clientID,
+		ClientID: clientID,
+		TokenUse: tokenUse(claims),
+		Scope:    claimString(claims, "scope"),
+		Jti:      claimString(claims, "jti"),
+		Exp:      claimInt(claims, "exp"),
+		Iat:      claimInt(claims, "iat"),
+	}
+	return result, nil
+}
+
+// PruneRevokedTokens removes expired tokens from revocation list
+func (s *AuthService) PruneRevokedTokens() {
+	pruned, err := s.RevocationDao.PruneRevoked(time.Now().UTC().Unix())
+	if err != nil {
+		logger.Logf("ERROR Cannot prune revoked tokens: %s", err.Error())
+		return
+	}
+	logger.Logf("DEBUG Pruned %d revoked tokens", pruned)
+}
+
+// PruneRefreshTokens removes records of expired refresh tokens, such tokens are rejected before their records are read
+func (s *AuthService) PruneRefreshTokens() {
+	pruned, err := s.RefreshTokenDao.PruneRefreshTokens(time.Now().UTC().Unix())
+	if err != nil {
+		logger.Logf("ERROR Cannot prune refresh tokens: %s", err.Error())
+		return
+	}
+	logger.Logf("DEBUG Pruned %d refresh tokens", pruned)
+}
+
+func claimString(claims jwt.MapClaims, name string) string {
+	value, _ := claims[name].(string)
+	return value
+}
+
+func claimInt(claims jwt.MapClaims, name string) int64 {
+	value, _ := claims[name].(float64)
+	return int64(value)
+}
+
+// authTime returns Unix time of the authentication the token continues.
+// Tokens issued before it was carried fall back to their issue time.
+func authTime(claims jwt.MapClaims) int64 {
+	if t := claimInt(claims, "auth_time"); t > 0 {
+		return t
+	}
+	return claimInt(claims, "iat")
+}
+
+// GetUserByToken returns user by access token
+func (s *AuthService) GetUserByToken(t string) (*st.User, error) {
+	claims, err := s.parseToken(t, accessTokenUse)
+	if authErr, ok := err.(st.AuthError); ok {
+		return nil, authErr
+	}
+	if err != nil {
+		return nil, st.AuthError{Msg: err.Error(), Status: 400}
+	}
+	if _, ok := claims["userId"]; !ok {
+		return nil, st.AuthError{Msg: "Token is not issued for a user", Status: 400}
+	}
+
+	u, err := s.UserDao.GetByUsername(fmt.Sprintf("%s", claims["sub"]))
+	if err != nil {
+		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	return u, nil
+}
+
+// GetJWKS returns public keys which can be used for token verification
+func (s *AuthService) GetJWKS() *st.JSONWebKeySet {
+	result := &st.JSONWebKeySet{Keys: []st.JSONWebKey{}}
+	for _, key := range s.Keys.Keys() {
+		result.Keys = append(result.Keys, key.JWK)
+	}
+	return result
+}
+
+// RotateKeys reloads key pair from configured files and makes it active.
+// Replaced key stays valid for verification during configured retirement period.
+func (s *AuthService) RotateKeys(token string) (string, error) {
+	if _, err := s.authorize(token, keysRotatePermission); err != nil {
+		return "", err
+	}
+
+	next, err := reloadKeyRing(s.Keys, s.Config)
+	if err == errActiveKey {
+		return "", st.AuthError{Msg: err.Error(), Status: 409}
+	}
+	if err != nil {
+		logger.Logf("ERROR Cannot load key pair: %s", err.Error())
+		return "", st.AuthError{Msg: err.Error(), Status: 500}
 	}
-	return nil, nil
+
+	logger.Logf("INFO Signing key rotated, new key id %s", next.ID)
+
+	return next.ID, nil
 }
 
 // GetUserById returns user info for specific id
 func (s *AuthService) GetUserById(id int64, token string) (*st.UserInfo, error) {
-	_, ok := s.validateToken(token)
-	if !ok {
-		return nil, st.AuthError{Msg: "Invalid token", Status: 401}
+	if _, err := s.authenticateToken(token, accessTokenUse); err != nil {
+		return nil, err
 	}
 	u, err := s.UserDao.Get(id)
 	if err != nil {
@@ -322,9 +765,8 @@ func (s *AuthService) GetUserById(id int64, token string) (*st.UserInfo, error)
 
 // GetUserByUsername returns user info for username
 func (s *AuthService) GetUserByUsername(username string, token string) (*st.UserInfo, error) {
-	_, ok := s.validateToken(token)
-	if !ok {
-		return nil, st.AuthError{Msg: "Invalid token", Status: 401}
+	if _, err := s.authenticateToken(token, accessTokenUse); err != nil {
+		return nil, err
 	}
 	u, err := s.UserDao.GetByUsername(username)
 	if err != nil {
@@ -338,9 +780,8 @@ func (s *AuthService) GetUserByUsername(username string, token string) (*st.User
 
 // GetUsers returns all users info
 func (s *AuthService) GetUsers(token string) (*[]st.UserInfo, error) {
-	_, ok := s.validateToken(token)
-	if !ok {
-		return nil, st.AuthError{Msg: "Invalid token", Status: 401}
+	if _, err := s.authorize(token, usersReadPermission); err != nil {
+		return nil, err
 	}
 	us, err := s.UserDao.GetAll()
 	if err != nil {
@@ -359,7 +800,10 @@ func (s *AuthService) SendRecoveryEmail(username string) error {
 		return st.AuthError{Msg: "Username does not registered or email is absent", Status: 404}
 	}
 
-	code := generateCode(6)
+	code, err := generateCode(6)
+	if err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
 	err = s.Mailer.SendRecoveryCode(u.Email, code)
 	if err != nil {
 		logger.Logf("ERROR Email was not sent: " + err.Error())
@@ -372,7 +816,7 @@ func (s *AuthService) SendRecoveryEmail(username string) error {
 		return st.AuthError{Msg: err.Error(), Status: 500}
 	}
 
-	return s.UserDao.SetRecoveryCode(u.ID, hashedCode)
+	return s.UserDao.SetRecoveryCode(u.ID, hashedCode, time.Now().UTC().Unix())
 }
 
 // ExchangeRecoveryCode exchanges recovery code for a password resetting one
@@ -396,18 +840,22 @@ func (s *AuthService) ExchangeRecoveryCode(username string, code string) (string
 		return "", st.AuthError{Msg: generalErrorMsg, Status: 404}
 	}
 
-	if !crypto.Match(code, existingCodeHash) {
-		return "", st.AuthError{Msg: "Provided recovery code does not match", Status: 403}
+	lifetime, _, _ := s.Config.RecoveryCodeLimits()
+	if err = s.checkRecoveryCode(u, code, existingCodeHash, lifetime); err != nil {
+		return "", err
 	}
 
-	resetingCode := generateCode(10)
+	resetingCode, err := generateCode(10)
+	if err != nil {
+		return "", st.AuthError{Msg: err.Error(), Status: 500}
+	}
 	resetingCodeHash, err := crypto.Hash(resetingCode)
 	if err != nil {
 		logger.Logf("ERROR Failed to hash code, %s", err.Error())
 		return "", st.AuthError{Msg: err.Error(), Status: 500}
 	}
 
-	err = s.UserDao.SetResettingCode(u.ID, resetingCodeHash)
+	err = s.UserDao.SetResettingCode(u.ID, resetingCodeHash, time.Now().UTC().Unix())
 	if err != nil {
 		return "", st.AuthError{Msg: err.Error(), Status: 500}
 	}
@@ -432,8 +880,13 @@ func (s *AuthService) ResetPassword(username string, code string, newPassword st
 		return st.AuthError{Msg: err.Error(), Status: 500}
 	}
 
-	if !crypto.Match(code, existingCodeHash) {
-		return st.AuthError{Msg: "Provided recovery code does not match", Status: 403}
+	if existingCodeHash == "" {
+		return st.AuthError{Msg: generalErrorMsg, Status: 404}
+	}
+
+	_, lifetime, _ := s.Config.RecoveryCodeLimits()
+	if err = s.checkRecoveryCode(u, code, existingCodeHash, lifetime); err != nil {
+		return err
 	}
 
 	hashedPassword, err := crypto.Hash(newPassword)
@@ -450,16 +903,73 @@ func (s *AuthService) ResetPassword(username string, code string, newPassword st
 	return nil
 }
 
-func generateCode(size int) string {
-	rand.Seed(time.Now().UnixNano())
-	result := ""
+// checkRecoveryCode matches code against pending recovery or resetting code hash of the user.
+// Code is rejected after its lifetime, attempts are counted and wrong ones invalidate it at the limit.
+func (s *AuthService) checkRecoveryCode(u *st.User, code string, codeHash string, lifetime time.Duration) error {
+	if time.Unix(u.RecoveryIssuedAt, 0).Add(lifetime).Before(time.Now()) {
+		return st.AuthError{Msg: "Provided recovery code is expired", Status: 403}
+	}
 
-	for i := 0; i < size; i++ {
-		d := rand.Intn(10)
-		result += strconv.Itoa(d)
+	_, _, maxAttempts := s.Config.RecoveryCodeLimits()
+	matched, attempts, err := matchLimitedCode(code, codeHash, maxAttempts,
+		func() (int64, error) { return s.UserDao.AddRecoveryAttempt(u.ID) },
+		func() error {
+			logger.Logf("WARN Recovery codes of user %d are invalidated after too many wrong attempts", u.ID)
+			return s.UserDao.InvalidateRecoveryCodes(u.ID)
+		})
+	if err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if matched {
+		return nil
 	}
+	if attempts > int64(maxAttempts) {
+		return st.AuthError{Msg: "Too many wrong attempts, recovery process has to be initiated again", Status: 403}
+	}
+	return st.AuthError{Msg: "Provided recovery code does not match", Status: 403}
+}
 
-	return result
+// matchLimitedCode matches emailed code against its hash allowing maxAttempts to enter it. Attempt is
+// counted by reserve before the code is compared, so parallel guesses can not exceed the limit, and
+// the last allowed wrong one calls invalidate. Returns attempts including this one, reserve returns
+// zero when the code is used or replaced meanwhile.
+func matchLimitedCode(code, codeHash string, maxAttempts int, reserve func() (int64, error), invalidate func() error) (bool, int64, error) {
+	attempts, err := reserve()
+	if err != nil {
+		return false, 0, err
+	}
+	if attempts <= 0 || attempts > int64(maxAttempts) {
+		return false, attempts, nil
+	}
+	if crypto.Match(code, codeHash) {
+		return true, attempts, nil
+	}
+	if attempts == int64(maxAttempts) {
+		if err = invalidate(); err != nil {
+			return false, attempts, err
+		}
+	}
+	return false, attempts, nil
+}
+
+// generateTokenID generates random identifier for tokens
+func generateTokenID() string {
+	b := make([]byte, 16)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// generateCode generates code of random digits, codes are guessable when drawn from time seeded generator
+func generateCode(size int) (string, error) {
+	result := ""
+	for i := 0; i < size; i++ {
+		d, err := crand.Int(crand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		result += d.String()
+	}
+	return result, nil
 }
 
 func mapToUserInfoList(us *[]st.User) *[]st.UserInfo {
@@ -471,5 +981,5 @@ func mapToUserInfoList(us *[]st.User) *[]st.UserInfo {
 }
 
 func mapToUserInfo(u *st.User) *st.UserInfo {
-	return &st.UserInfo{ID: u.ID, Username: u.Username, FirstName: u.FirstName, LastName: u.LastName, Email: u.Email}
+	return &st.UserInfo{ID: u.ID, Username: u.Username, FirstName: u.FirstName, LastName: u.LastName, Email: u.Email, Groups: u.Groups}
 }
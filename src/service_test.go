@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/base64"
 	"io/ioutil"
 	"testing"
 	"time"
@@ -30,7 +31,7 @@ func TestAuthService_InviteUser(t *testing.T) {
 	dao.On("Save", mock.MatchedBy(userMatcher)).Return(42)
 	m := MailerMock{}
 	m.On("SendInviteCode", email, mock.MatchedBy(codeMatcher)).Return(nil)
-	s := AuthService{&m, &dao, createTestConfig()}
+	s := createTestService(&m, &dao, createTestConfig())
 
 	err := s.InviteUser(email, token)
 	assert.Nil(t, err)
@@ -44,10 +45,10 @@ func TestAuthService_InviteUser_Forbidden(t *testing.T) {
 
 	dao := dao.MockUserDao{}
 	dao.On("GetByUsername", user.Username).Return(&st.User{ID: user.ID + 1}, nil)
-	s := AuthService{&mailer, &dao, createTestConfig()}
+	s := createTestService(&mailer, &dao, createTestConfig())
 
 	err := s.InviteUser(email, token)
-	assert.Equal(t, st.AuthError{Msg: "Available only for admin", Status: 403}, err)
+	assert.Equal(t, st.AuthError{Msg: "Permission invites:create is required", Status: 403}, err)
 	dao.AssertExpectations(t)
 }
 
@@ -58,7 +59,7 @@ func TestAuthService_CreateUser(t *testing.T) {
 	dao.On("Save", &u).Return(1)
 	dao.On("GetByUsername", u.Username).Return(nil, nil)
 
-	s := AuthService{&mailer, &dao, createTestConfig()}
+	s := createTestService(&mailer, &dao, createTestConfig())
 	err := s.CreateUser(&u)
 
 	assert.Nil(t, err)
@@ -71,7 +72,7 @@ func TestAuthService_CreateUser_DuplicateHandling(t *testing.T) {
 	dao := dao.MockUserDao{}
 	dao.On("GetByUsername", u.Username).Return(&u, nil)
 
-	s := AuthService{&mailer, &dao, createTestConfig()}
+	s := createTestService(&mailer, &dao, createTestConfig())
 	err := s.CreateUser(&u)
 	assert.Equal(t, st.AuthError{Msg: "Username already exists", Status: 400}, err)
 }
@@ -84,14 +85,17 @@ func TestAuthService_BasicAuthToken(t *testing.T) {
 	dao := dao.MockUserDao{}
 	dao.On("GetByUsername", username).Return(&user, nil)
 
-	s := AuthService{&mailer, &dao, createTestConfig()}
-	accessToken, refreshToken, err := s.BasicAuthToken(username, password)
+	s := createTestService(&mailer, &dao, createTestConfig())
+	accessToken, refreshToken, err := s.BasicAuthToken(username, password, "", "")
 	assert.Nil(t, err)
 	assert.NotEmpty(t, accessToken)
 	assert.True(t, testJWTIntField(accessToken, "userId", 42))
 	assert.True(t, testJWTStringField(accessToken, "sub", "alle"))
+	assert.True(t, testJWTHeader(accessToken, "kid", s.Keys.Active().ID))
+	assert.True(t, testJWTStringField(accessToken, "token_use", "access"))
 	assert.NotEmpty(t, refreshToken)
 	assert.True(t, testJWTStringField(refreshToken, "sub", "alle"))
+	assert.True(t, testJWTStringField(refreshToken, "token_use", "refresh"))
 
 	expRaw := exctractField(accessToken, "exp", -1)
 	exp := int64(expRaw.(float64))
@@ -100,37 +104,224 @@ func TestAuthService_BasicAuthToken(t *testing.T) {
 
 	expRaw = exctractField(refreshToken, "exp", -1)
 	exp = int64(expRaw.(float64))
-	estimatedEx = time.Now().AddDate(1, 0, 0).UTC().Unix()
+	estimatedEx = time.Now().Add(defaultRefreshTokenLifetime).UTC().Unix()
 	assert.True(t, exp >= estimatedEx-1 && exp <= estimatedEx+1)
 
-	accessToken, refreshToken, err = s.BasicAuthToken(username, password+"xyz")
+	accessToken, refreshToken, err = s.BasicAuthToken(username, password+"xyz", "", "")
 	assert.Empty(t, accessToken)
 	assert.Empty(t, refreshToken)
 	assert.Equal(t, st.AuthError{Msg: "Username or password is wrong", Status: 403}, err)
 }
 
+func TestAuthService_BasicAuthToken_Audience(t *testing.T) {
+	user := createTestUser()
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	conf := createTestConfig()
+	conf.Issuer = "https://auth.example.com"
+	conf.Audience = "api"
+	conf.AccessTokenLifetime = 30 * time.Minute
+	conf.AudienceLifetimes = []string{"mobile=5m,720h"}
+
+	s := createTestService(&mailer, &dao, conf)
+	accessToken, refreshToken, err := s.BasicAuthToken(user.Username, "oakheart", "", "")
+	assert.Nil(t, err)
+	assert.True(t, testJWTStringField(accessToken, "iss", "https://auth.example.com"))
+	assert.True(t, testJWTStringField(accessToken, "aud", "api"))
+	assert.True(t, testJWTStringField(refreshToken, "aud", "api"))
+	iat := int64(exctractField(accessToken, "iat", -1).(float64))
+	assert.Equal(t, iat, int64(exctractField(accessToken, "nbf", -1).(float64)))
+	assert.Equal(t, iat+int64((30*time.Minute).Seconds()), int64(exctractField(accessToken, "exp", -1).(float64)))
+
+	accessToken, refreshToken, err = s.BasicAuthToken(user.Username, "oakheart", "mobile", "")
+	assert.Nil(t, err)
+	assert.True(t, testJWTStringField(accessToken, "aud", "mobile"))
+	iat = int64(exctractField(accessToken, "iat", -1).(float64))
+	assert.Equal(t, iat+int64((5*time.Minute).Seconds()), int64(exctractField(accessToken, "exp", -1).(float64)))
+	assert.Equal(t, iat+int64((720*time.Hour).Seconds()), int64(exctractField(refreshToken, "exp", -1).(float64)))
+	_, valid := s.validateToken(accessToken)
+	assert.True(t, valid)
+
+	_, _, err = s.BasicAuthToken(user.Username, "oakheart", "unknown", "")
+	assert.Equal(t, st.AuthError{Msg: "Unknown audience", Status: 400}, err)
+}
+
+func TestAuthService_ValidateToken_Claims(t *testing.T) {
+	user := createTestUser()
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	conf := createTestConfig()
+	conf.Issuer = "brightonum"
+	conf.Audience = "api"
+	conf.ClockSkew = time.Minute
+	s := createTestService(&mailer, &dao, conf)
+
+	now := time.Now().UTC()
+	sign := func(claims jwt.MapClaims) string {
+		claims["sub"] = user.Username
+		claims["userId"] = user.ID
+		token, _ := s.signToken(claims)
+		return token
+	}
+
+	_, valid := s.validateToken(sign(jwt.MapClaims{"iss": "brightonum", "aud": "api", "exp": now.Add(-30 * time.Second).Unix()}))
+	assert.True(t, valid)
+	_, valid = s.validateToken(sign(jwt.MapClaims{"iss": "brightonum", "aud": "api", "exp": now.Add(-2 * time.Minute).Unix()}))
+	assert.False(t, valid)
+	_, valid = s.validateToken(sign(jwt.MapClaims{"iss": "brightonum", "aud": "api", "exp": now.Add(time.Hour).Unix(), "nbf": now.Add(30 * time.Second).Unix()}))
+	assert.True(t, valid)
+	_, valid = s.validateToken(sign(jwt.MapClaims{"iss": "brightonum", "aud": "api", "exp": now.Add(time.Hour).Unix(), "nbf": now.Add(2 * time.Minute).Unix()}))
+	assert.False(t, valid)
+	_, valid = s.validateToken(sign(jwt.MapClaims{"iss": "other", "aud": "api", "exp": now.Add(time.Hour).Unix()}))
+	assert.False(t, valid)
+	_, valid = s.validateToken(sign(jwt.MapClaims{"iss": "brightonum", "aud": "other", "exp": now.Add(time.Hour).Unix()}))
+	assert.False(t, valid)
+	_, valid = s.validateToken(sign(jwt.MapClaims{"iss": "brightonum", "exp": now.Add(time.Hour).Unix()}))
+	assert.False(t, valid)
+}
+
+func TestAuthService_ValidateToken_LegacyClaims(t *testing.T) {
+	user := createTestUser()
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	conf := createTestConfig()
+	conf.Issuer = "brightonum"
+	conf.Audience = "api"
+	s := createTestService(&mailer, &dao, conf)
+
+	now := time.Now().UTC()
+	legacyToken, _ := s.signToken(jwt.MapClaims{"sub": user.Username, "userId": user.ID, "exp": now.Add(time.Hour).Unix()})
+	_, valid := s.validateToken(legacyToken)
+	assert.False(t, valid)
+
+	s.Config.LegacyTokensUntil = now.Add(time.Hour).Format(time.RFC3339)
+	_, valid = s.validateToken(legacyToken)
+	assert.True(t, valid)
+
+	// Present claims are checked anyway
+	otherToken, _ := s.signToken(jwt.MapClaims{"sub": user.Username, "userId": user.ID, "iss": "other", "exp": now.Add(time.Hour).Unix()})
+	_, valid = s.validateToken(otherToken)
+	assert.False(t, valid)
+
+	s.Config.LegacyTokensUntil = now.Add(-time.Hour).Format(time.RFC3339)
+	_, valid = s.validateToken(legacyToken)
+	assert.False(t, valid)
+}
+
 func TestAuthService_RefreshToken(t *testing.T) {
 	user := createTestUser()
 	username := user.Username
 	password := "oakheart"
 
+	tokenDao := dao.MockRefreshTokenDao{}
+	tokenDao.On("SaveRefreshToken", mock.Anything).Return(nil)
+	tokenDao.On("GetRefreshToken", mock.Anything).Return(&st.RefreshToken{Family: "family"}, nil)
+	tokenDao.On("MarkRefreshTokenUsed", mock.Anything).Return(true, nil)
+
 	dao := dao.MockUserDao{}
 	dao.On("GetByUsername", username).Return(&user, nil)
 
-	s := AuthService{&mailer, &dao, createTestConfig()}
-	accessToken, refreshToken, err := s.BasicAuthToken(username, password)
+	s := createTestService(&mailer, &dao, createTestConfig())
+	s.RefreshTokenDao = &tokenDao
+	accessToken, refreshToken, err := s.BasicAuthToken(username, password, "", "")
 	assert.Nil(t, err)
 	assert.NotEmpty(t, accessToken)
+	refreshTokenID := exctractField(refreshToken, "jti", "")
+	assert.NotEmpty(t, refreshTokenID)
+	assert.Equal(t, refreshTokenID, exctractField(refreshToken, "fam", ""))
 
-	refreshedToken, err := s.RefreshToken(refreshToken)
+	refreshedToken, rotatedRefreshToken, err := s.RefreshToken(refreshToken, "", "")
 	assert.Nil(t, err)
 	assert.NotEmpty(t, refreshedToken)
+	assert.True(t, testJWTStringField(rotatedRefreshToken, "fam", "family"))
+	assert.NotEqual(t, refreshTokenID, exctractField(rotatedRefreshToken, "jti", ""))
+	tokenDao.AssertCalled(t, "MarkRefreshTokenUsed", refreshTokenID)
 
-	refreshedToken, err = s.RefreshToken(refreshedToken + "xyz")
+	refreshedToken, _, err = s.RefreshToken(refreshedToken+"xyz", "", "")
 	assert.Empty(t, refreshedToken)
 	assert.Equal(t, st.AuthError{Msg: "Refresh token is not valid", Status: 403}, err)
 }
 
+func TestAuthService_RefreshToken_Reuse(t *testing.T) {
+	user := createTestUser()
+
+	tokenDao := dao.MockRefreshTokenDao{}
+	tokenDao.On("SaveRefreshToken", mock.Anything).Return(nil)
+	tokenDao.On("GetRefreshToken", mock.Anything).Return(&st.RefreshToken{Family: "family"}, nil)
+	tokenDao.On("MarkRefreshTokenUsed", mock.Anything).Return(true, nil).Once()
+	tokenDao.On("MarkRefreshTokenUsed", mock.Anything).Return(false, nil)
+	tokenDao.On("RevokeRefreshTokenFamily", "family").Return(nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := createTestService(&mailer, &dao, createTestConfig())
+	s.RefreshTokenDao = &tokenDao
+	_, refreshToken, err := s.BasicAuthToken(user.Username, "oakheart", "", "")
+	assert.Nil(t, err)
+
+	_, _, err = s.RefreshToken(refreshToken, "", "")
+	assert.Nil(t, err)
+
+	accessToken, rotatedRefreshToken, err := s.RefreshToken(refreshToken, "", "")
+	assert.Empty(t, accessToken)
+	assert.Empty(t, rotatedRefreshToken)
+	assert.Equal(t, st.AuthError{Msg: "Refresh token has been used already, all related tokens are revoked", Status: 403}, err)
+	tokenDao.AssertExpectations(t)
+}
+
+func TestAuthService_RefreshToken_RevokedFamily(t *testing.T) {
+	user := createTestUser()
+
+	tokenDao := dao.MockRefreshTokenDao{}
+	tokenDao.On("SaveRefreshToken", mock.Anything).Return(nil)
+	tokenDao.On("GetRefreshToken", mock.Anything).Return(&st.RefreshToken{Family: "family", Revoked: true}, nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := createTestService(&mailer, &dao, createTestConfig())
+	s.RefreshTokenDao = &tokenDao
+	_, refreshToken, err := s.BasicAuthToken(user.Username, "oakheart", "", "")
+	assert.Nil(t, err)
+
+	_, _, err = s.RefreshToken(refreshToken, "", "")
+	assert.Equal(t, st.AuthError{Msg: "Refresh token is not valid", Status: 403}, err)
+	tokenDao.AssertNotCalled(t, "MarkRefreshTokenUsed", mock.Anything)
+}
+
+func TestAuthService_RefreshToken_WrongTokenUse(t *testing.T) {
+	user := createTestUser()
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := createTestService(&mailer, &dao, createTestConfig())
+	accessToken, refreshToken, err := s.BasicAuthToken(user.Username, "oakheart", "", "")
+	assert.Nil(t, err)
+
+	refreshedToken, _, err := s.RefreshToken(accessToken, "", "")
+	assert.Empty(t, refreshedToken)
+	assert.Equal(t, st.AuthError{Msg: "Expected refresh token, got access token", Status: 401}, err)
+
+	refreshedToken, _, err = s.RefreshToken(issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath), "", "")
+	assert.Empty(t, refreshedToken)
+	assert.Equal(t, 401, err.(st.AuthError).Status)
+
+	us, err := s.GetUsers(refreshToken)
+	assert.Nil(t, us)
+	assert.Equal(t, st.AuthError{Msg: "Expected access token, got refresh token", Status: 401}, err)
+
+	_, err = s.GetUserByToken(refreshToken)
+	assert.Equal(t, st.AuthError{Msg: "Expected access token, got refresh token", Status: 401}, err)
+}
+
 func TestAuthService_GetUserByToken(t *testing.T) {
 	user := createTestUser()
 	username := user.Username
@@ -139,8 +330,8 @@ func TestAuthService_GetUserByToken(t *testing.T) {
 	dao := dao.MockUserDao{}
 	dao.On("GetByUsername", username).Return(&user, nil)
 
-	s := AuthService{&mailer, &dao, createTestConfig()}
-	token, _, err := s.BasicAuthToken(username, password)
+	s := createTestService(&mailer, &dao, createTestConfig())
+	token, _, err := s.BasicAuthToken(username, password, "", "")
 	assert.Nil(t, err)
 
 	u, err := s.GetUserByToken(token)
@@ -161,7 +352,7 @@ func TestAuthService_GetUsers(t *testing.T) {
 	dao.On("GetAll").Return(&[]st.User{user1, user2}, nil)
 	dao.On("GetByUsername", user1.Username).Return(&user1, nil)
 
-	s := AuthService{&mailer, &dao, createTestConfig()}
+	s := createTestService(&mailer, &dao, createTestConfig())
 
 	userInfo := createTestUserInfo()
 	userInfo2 := createAdditionalTestUserInfo()
@@ -180,7 +371,7 @@ func TestAuthService_UpdateUser(t *testing.T) {
 	dao.On("GetByUsername", user.Username).Return(&user, nil)
 	dao.On("Update", &user).Return(nil)
 
-	s := AuthService{&mailer, &dao, createTestConfig()}
+	s := createTestService(&mailer, &dao, createTestConfig())
 
 	err := s.UpdateUser(&user, token)
 	assert.Nil(t, err)
@@ -191,7 +382,7 @@ func TestAuthService_UpdateUserInvalidToken(t *testing.T) {
 	token := "invalid token"
 
 	dao := dao.MockUserDao{}
-	s := AuthService{&mailer, &dao, createTestConfig()}
+	s := createTestService(&mailer, &dao, createTestConfig())
 
 	err := s.UpdateUser(&user, token)
 	assert.Equal(t, st.AuthError{Msg: "Invalid token", Status: 401}, err)
@@ -205,7 +396,7 @@ func TestAuthService_DeleteUser(t *testing.T) {
 	dao.On("GetByUsername", user.Username).Return(&user, nil)
 	dao.On("DeleteById", user.ID).Return(nil)
 
-	s := AuthService{&mailer, &dao, createTestConfig()}
+	s := createTestService(&mailer, &dao, createTestConfig())
 
 	err := s.DeleteUser(user.ID, token)
 	assert.Nil(t, err)
@@ -228,11 +419,12 @@ func TestAuthService_SendRecoveryEmail(t *testing.T) {
 	dao.On(
 		"SetRecoveryCode",
 		user.ID,
-		mock.MatchedBy(func(hashedCode string) bool { return hashedCode != "" })).Return(nil)
+		mock.MatchedBy(func(hashedCode string) bool { return hashedCode != "" }),
+		mock.Anything).Return(nil)
 
 	dao.On("GetByUsername", user.Username).Return(&user, nil)
 
-	s := AuthService{&mailer, &dao, createTestConfig()}
+	s := createTestService(&mailer, &dao, createTestConfig())
 
 	err := s.SendRecoveryEmail(user.Username)
 	assert.Nil(t, err)
@@ -240,6 +432,7 @@ func TestAuthService_SendRecoveryEmail(t *testing.T) {
 
 func TestAuthService_ExchangeRecoveryCode(t *testing.T) {
 	user := createTestUser()
+	user.RecoveryIssuedAt = time.Now().Unix()
 	code := "267483"
 	hashedCode := "$2a$04$c12NAkAi9nOxkYM5vO7eUur2fd9M23M4roKPbroOvNhsBVF0mOmS."
 
@@ -247,12 +440,14 @@ func TestAuthService_ExchangeRecoveryCode(t *testing.T) {
 
 	dao.On("GetByUsername", user.Username).Return(&user, nil)
 	dao.On("GetRecoveryCode", user.ID).Return(hashedCode, nil)
+	dao.On("AddRecoveryAttempt", user.ID).Return(int64(1), nil)
 	dao.On(
 		"SetResettingCode",
 		user.ID,
-		mock.MatchedBy(func(hashedResettingCode string) bool { return hashedResettingCode != "" })).Return(nil)
+		mock.MatchedBy(func(hashedResettingCode string) bool { return hashedResettingCode != "" }),
+		mock.Anything).Return(nil)
 
-	s := AuthService{&mailer, &dao, createTestConfig()}
+	s := createTestService(&mailer, &dao, createTestConfig())
 
 	resettingCode, err := s.ExchangeRecoveryCode(user.Username, code)
 	assert.Nil(t, err)
@@ -261,6 +456,7 @@ func TestAuthService_ExchangeRecoveryCode(t *testing.T) {
 
 func TestAuthService_ResetPassword(t *testing.T) {
 	user := createTestUser()
+	user.RecoveryIssuedAt = time.Now().Unix()
 	code := "267483"
 	hashedCode := "$2a$04$c12NAkAi9nOxkYM5vO7eUur2fd9M23M4roKPbroOvNhsBVF0mOmS."
 
@@ -268,17 +464,396 @@ func TestAuthService_ResetPassword(t *testing.T) {
 
 	dao.On("GetByUsername", user.Username).Return(&user, nil)
 	dao.On("GetResettingCode", user.ID).Return(hashedCode, nil)
+	dao.On("AddRecoveryAttempt", user.ID).Return(int64(1), nil)
 	dao.On(
 		"ResetPassword",
 		user.ID,
 		mock.MatchedBy(func(hashedPassword string) bool { return hashedPassword != "" })).Return(nil)
 
-	s := AuthService{&mailer, &dao, createTestConfig()}
+	s := createTestService(&mailer, &dao, createTestConfig())
 
 	err := s.ResetPassword(user.Username, code, "kek")
 	assert.Nil(t, err)
 }
 
+func TestAuthService_ExchangeRecoveryCode_Expired(t *testing.T) {
+	user := createTestUser()
+	user.RecoveryIssuedAt = time.Now().Add(-time.Hour).Unix()
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+	dao.On("GetRecoveryCode", user.ID).Return(hashedCode, nil)
+
+	conf := createTestConfig()
+	conf.RecoveryCodeLifetime = 30 * time.Minute
+	s := createTestService(&mailer, &dao, conf)
+
+	_, err := s.ExchangeRecoveryCode(user.Username, code)
+	assert.Equal(t, 403, err.(st.AuthError).Status)
+	dao.AssertNotCalled(t, "SetResettingCode", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestAuthService_ResetPassword_WrongAttempts(t *testing.T) {
+	user := createTestUser()
+	user.RecoveryIssuedAt = time.Now().Unix()
+	user.RecoveryAttempts = 1
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+	dao.On("GetResettingCode", user.ID).Return(hashedCode, nil)
+	dao.On("AddRecoveryAttempt", user.ID).Return(int64(2), nil).Once()
+	dao.On("AddRecoveryAttempt", user.ID).Return(int64(3), nil).Once()
+	dao.On("AddRecoveryAttempt", user.ID).Return(int64(4), nil).Once()
+	dao.On("InvalidateRecoveryCodes", user.ID).Return(nil)
+
+	conf := createTestConfig()
+	conf.RecoveryCodeAttempts = 3
+	s := createTestService(&mailer, &dao, conf)
+
+	err := s.ResetPassword(user.Username, "000000", "kek")
+	assert.Equal(t, 403, err.(st.AuthError).Status)
+	dao.AssertNotCalled(t, "InvalidateRecoveryCodes", user.ID)
+
+	err = s.ResetPassword(user.Username, "000000", "kek")
+	assert.Equal(t, 403, err.(st.AuthError).Status)
+	dao.AssertCalled(t, "InvalidateRecoveryCodes", user.ID)
+
+	// Right code is rejected after the limit, even when it is read before the invalidation
+	err = s.ResetPassword(user.Username, code, "kek")
+	assert.Equal(t, 403, err.(st.AuthError).Status)
+	dao.AssertNotCalled(t, "ResetPassword", mock.Anything, mock.Anything)
+}
+
+func TestAuthService_GetJWKS(t *testing.T) {
+	dao := dao.MockUserDao{}
+	s := createTestService(&mailer, &dao, createTestConfig())
+
+	jwks := s.GetJWKS()
+	assert.Len(t, jwks.Keys, 1)
+
+	jwk := jwks.Keys[0]
+	assert.Equal(t, "RSA", jwk.Kty)
+	assert.Equal(t, "RS256", jwk.Alg)
+	assert.Equal(t, "sig", jwk.Use)
+	assert.Equal(t, "AQAB", jwk.E)
+	assert.NotEmpty(t, jwk.Kid)
+
+	keyData, _ := ioutil.ReadFile(createTestConfig().PubKeyPath)
+	key, _ := jwt.ParseRSAPublicKeyFromPEM(keyData)
+	n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	assert.Nil(t, err)
+	assert.Equal(t, key.N.Bytes(), n)
+}
+
+func TestAuthService_EllipticCurveKeys(t *testing.T) {
+	user := createTestUser()
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	for alg, crv := range map[string]string{"ES256": "P-256", "EdDSA": "Ed25519"} {
+		conf := createTestConfig()
+		if alg == "ES256" {
+			conf.PrivKeyPath = "../test_data/ec_private.pem"
+			conf.PubKeyPath = "../test_data/ec_public.pem"
+		} else {
+			conf.PrivKeyPath = "../test_data/ed25519_private.pem"
+			conf.PubKeyPath = "../test_data/ed25519_public.pem"
+		}
+
+		s := createTestService(&mailer, &dao, conf)
+		accessToken, _, err := s.BasicAuthToken(user.Username, "oakheart", "", "")
+		assert.Nil(t, err)
+		assert.True(t, testJWTHeader(accessToken, "alg", alg))
+
+		u, valid := s.validateToken(accessToken)
+		assert.True(t, valid)
+		assert.Equal(t, user.ID, u.ID)
+
+		jwk := s.GetJWKS().Keys[0]
+		assert.Equal(t, alg, jwk.Alg)
+		assert.Equal(t, crv, jwk.Crv)
+		assert.NotEmpty(t, jwk.X)
+		assert.Equal(t, s.Keys.Active().ID, jwk.Kid)
+	}
+}
+
+func TestAuthService_AlgorithmMismatch(t *testing.T) {
+	user := createTestUser()
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := createTestService(&mailer, &dao, createTestConfig())
+	key := s.Keys.Active()
+
+	// HS256 signed with public key bytes must not pass as RS256 token
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":    user.Username,
+		"userId": user.ID,
+		"exp":    time.Now().Add(time.Hour).UTC().Unix(),
+	})
+	token.Header["kid"] = key.ID
+	keyData, _ := ioutil.ReadFile(createTestConfig().PubKeyPath)
+	tokenString, err := token.SignedString(keyData)
+	assert.Nil(t, err)
+
+	_, valid := s.validateToken(tokenString)
+	assert.False(t, valid)
+}
+
+func TestAuthService_RotateKeys(t *testing.T) {
+	user := createTestUser()
+	adminToken := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := createTestService(&mailer, &dao, createTestConfig())
+	oldToken, _, err := s.BasicAuthToken(user.Username, "oakheart", "", "")
+	assert.Nil(t, err)
+	oldKid := s.Keys.Active().ID
+
+	_, err = s.RotateKeys(adminToken)
+	assert.Equal(t, st.AuthError{Msg: "Key files contain active key already", Status: 409}, err)
+
+	s.Config.PrivKeyPath = "../test_data/private2.pem"
+	s.Config.PubKeyPath = "../test_data/public2.pem"
+	s.Config.KeyRetirementPeriod = time.Hour
+	kid, err := s.RotateKeys(adminToken)
+	assert.Nil(t, err)
+	assert.NotEqual(t, oldKid, kid)
+
+	newToken, _, err := s.BasicAuthToken(user.Username, "oakheart", "", "")
+	assert.Nil(t, err)
+	assert.True(t, testJWTHeader(newToken, "kid", kid))
+
+	_, valid := s.validateToken(oldToken)
+	assert.True(t, valid)
+	_, valid = s.validateToken(newToken)
+	assert.True(t, valid)
+	assert.Len(t, s.GetJWKS().Keys, 2)
+}
+
+func TestAuthService_RotateKeys_Forbidden(t *testing.T) {
+	user := createTestUser()
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&st.User{ID: user.ID + 1}, nil)
+
+	s := createTestService(&mailer, &dao, createTestConfig())
+	_, err := s.RotateKeys(token)
+	assert.Equal(t, st.AuthError{Msg: "Permission keys:rotate is required", Status: 403}, err)
+}
+
+func TestAuthService_ValidateToken_RetiredKey(t *testing.T) {
+	user := createTestUser()
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := createTestService(&mailer, &dao, createTestConfig())
+	next, _ := loadSigningKey("../test_data/private2.pem", "../test_data/public2.pem")
+	s.Keys.Rotate(next, time.Now().Add(-time.Second))
+
+	_, valid := s.validateToken(token)
+	assert.False(t, valid)
+}
+
+func TestAuthService_RevokeToken(t *testing.T) {
+	user := createTestUser()
+
+	revocationDao := dao.MockRevocationDao{}
+	revocationDao.On("Revoke", mock.Anything, mock.Anything).Return(nil)
+	revocationDao.On("IsRevoked", mock.Anything).Return(false, nil).Once()
+	revocationDao.On("IsRevoked", mock.Anything).Return(true, nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := createTestService(&mailer, &dao, createTestConfig())
+	accessToken, _, err := s.BasicAuthToken(user.Username, "oakheart", "", "")
+	assert.Nil(t, err)
+	_, valid := s.validateToken(accessToken)
+	assert.True(t, valid)
+
+	s.RevocationDao = &revocationDao
+	err = s.RevokeToken(accessToken)
+	assert.Nil(t, err)
+	exp := int64(exctractField(accessToken, "exp", -1).(float64))
+	revocationDao.AssertCalled(t, "Revoke", exctractField(accessToken, "jti", ""), exp)
+
+	_, valid = s.validateToken(accessToken)
+	assert.False(t, valid)
+}
+
+func TestAuthService_RevokeToken_Refresh(t *testing.T) {
+	user := createTestUser()
+
+	tokenDao := dao.MockRefreshTokenDao{}
+	tokenDao.On("SaveRefreshToken", mock.Anything).Return(nil)
+	tokenDao.On("GetRefreshToken", mock.Anything).Return(&st.RefreshToken{Family: "family"}, nil)
+	tokenDao.On("RevokeRefreshTokenFamily", "family").Return(nil)
+	revocationDao := dao.MockRevocationDao{}
+	revocationDao.On("Revoke", mock.Anything, mock.Anything).Return(nil)
+	revocationDao.On("IsRevoked", mock.Anything).Return(false, nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := createTestService(&mailer, &dao, createTestConfig())
+	s.RefreshTokenDao = &tokenDao
+	s.RevocationDao = &revocationDao
+	_, refreshToken, err := s.BasicAuthToken(user.Username, "oakheart", "", "")
+	assert.Nil(t, err)
+
+	err = s.RevokeToken(refreshToken)
+	assert.Nil(t, err)
+	tokenDao.AssertExpectations(t)
+	revocationDao.AssertExpectations(t)
+}
+
+func TestAuthService_RevokeToken_Unsupported(t *testing.T) {
+	user := createTestUser()
+	revocationDao := dao.MockRevocationDao{}
+
+	dao := dao.MockUserDao{}
+	s := createTestService(&mailer, &dao, createTestConfig())
+	s.RevocationDao = &revocationDao
+
+	err := s.RevokeToken("invalid token")
+	assert.Nil(t, err)
+
+	err = s.RevokeToken(issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath))
+	assert.Equal(t, st.AuthError{Msg: "unsupported_token_type", Status: 400}, err)
+	revocationDao.AssertNotCalled(t, "Revoke", mock.Anything, mock.Anything)
+}
+
+func TestAuthService_IntrospectToken(t *testing.T) {
+	user := createTestUser()
+	callerToken := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+
+	tokenDao := dao.MockRefreshTokenDao{}
+	tokenDao.On("SaveRefreshToken", mock.Anything).Return(nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := createTestService(&mailer, &dao, createTestConfig())
+	s.RefreshTokenDao = &tokenDao
+	accessToken, refreshToken, err := s.BasicAuthToken(user.Username, "oakheart", "", "")
+	assert.Nil(t, err)
+	refreshID := exctractField(refreshToken, "jti", "").(string)
+	tokenDao.On("GetRefreshToken", refreshID).Return(&st.RefreshToken{ID: refreshID, Family: "family"}, nil).Once()
+
+	resp, err := s.IntrospectToken(callerToken, accessToken)
+	assert.Nil(t, err)
+	assert.True(t, resp.Active)
+	assert.Equal(t, "alle", resp.Sub)
+	assert.Equal(t, int64(42), resp.UserID)
+	assert.Equal(t, "access", resp.TokenUse)
+	assert.Equal(t, exctractField(accessToken, "jti", ""), resp.Jti)
+	assert.Equal(t, int64(exctractField(accessToken, "exp", -1).(float64)), resp.Exp)
+
+	resp, err = s.IntrospectToken(callerToken, refreshToken)
+	assert.Nil(t, err)
+	assert.True(t, resp.Active)
+	assert.Equal(t, "refresh", resp.TokenUse)
+
+	resp, err = s.IntrospectToken(callerToken, accessToken+"xyz")
+	assert.Nil(t, err)
+	assert.Equal(t, &st.IntrospectionResp{Active: false}, resp)
+}
+
+func TestAuthService_IntrospectToken_Inactive(t *testing.T) {
+	user := createTestUser()
+	user.TOTPEnabled = true
+	callerToken := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+
+	tokenDao := dao.MockRefreshTokenDao{}
+	tokenDao.On("SaveRefreshToken", mock.Anything).Return(nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	conf := createTestConfig()
+	conf.MFAChallengeLifetime = time.Minute
+	s := createTestService(&mailer, &dao, conf)
+	s.RefreshTokenDao = &tokenDao
+	refreshToken, err := s.issueRefreshToken(&user, "family", "", "", time.Now().Unix())
+	assert.Nil(t, err)
+	refreshID := exctractField(refreshToken, "jti", "").(string)
+
+	// Rotated refresh token
+	tokenDao.On("GetRefreshToken", refreshID).Return(&st.RefreshToken{ID: refreshID, Used: true}, nil).Once()
+	resp, err := s.IntrospectToken(callerToken, refreshToken)
+	assert.Nil(t, err)
+	assert.False(t, resp.Active)
+
+	// Refresh token of revoked family
+	tokenDao.On("GetRefreshToken", refreshID).Return(&st.RefreshToken{ID: refreshID, Revoked: true}, nil).Once()
+	resp, err = s.IntrospectToken(callerToken, refreshToken)
+	assert.Nil(t, err)
+	assert.False(t, resp.Active)
+
+	// Session token of login step
+	_, _, err = s.BasicAuthToken(user.Username, "oakheart", "", "")
+	mfaToken := err.(st.AuthError).MFAToken
+	assert.NotEmpty(t, mfaToken)
+	resp, err = s.IntrospectToken(callerToken, mfaToken)
+	assert.Nil(t, err)
+	assert.Equal(t, &st.IntrospectionResp{Active: false}, resp)
+}
+
+func TestAuthService_IntrospectToken_Unauthenticated(t *testing.T) {
+	user := createTestUser()
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := createTestService(&mailer, &dao, createTestConfig())
+	accessToken, refreshToken, err := s.BasicAuthToken(user.Username, "oakheart", "", "")
+	assert.Nil(t, err)
+
+	resp, err := s.IntrospectToken("invalid token", accessToken)
+	assert.Nil(t, resp)
+	assert.Equal(t, st.AuthError{Msg: "Invalid token", Status: 401}, err)
+
+	resp, err = s.IntrospectToken(refreshToken, accessToken)
+	assert.Nil(t, resp)
+	assert.Equal(t, 401, err.(st.AuthError).Status)
+}
+
+func TestAuthService_PruneRevokedTokens(t *testing.T) {
+	revocationDao := dao.MockRevocationDao{}
+	revocationDao.On("PruneRevoked", mock.MatchedBy(func(before int64) bool {
+		return before >= time.Now().Add(-time.Minute).Unix() && before <= time.Now().Unix()
+	})).Return(3, nil)
+
+	dao := dao.MockUserDao{}
+	s := createTestService(&mailer, &dao, createTestConfig())
+	s.RevocationDao = &revocationDao
+
+	s.PruneRevokedTokens()
+	revocationDao.AssertExpectations(t)
+}
+
+func TestAuthService_PruneRefreshTokens(t *testing.T) {
+	tokenDao := dao.MockRefreshTokenDao{}
+	tokenDao.On("PruneRefreshTokens", mock.MatchedBy(func(before int64) bool {
+		return before >= time.Now().Add(-time.Minute).Unix() && before <= time.Now().Unix()
+	})).Return(3, nil)
+
+	dao := dao.MockUserDao{}
+	s := createTestService(&mailer, &dao, createTestConfig())
+	s.RefreshTokenDao = &tokenDao
+
+	s.PruneRefreshTokens()
+	tokenDao.AssertExpectations(t)
+}
+
 func createTestUser() st.User {
 	return st.User{ID: 42, Username: "alle", FirstName: "test", LastName: "user", Email: "test@email.com", Password: "$2a$04$Mhlu1.a4QchlVgGQFc/0N.qAw9tsXqm1OMwjJRaPRCWn47bpsRa4S"}
 }
@@ -299,6 +874,15 @@ func createAdditionalTestUserInfo() st.UserInfo {
 	return st.UserInfo{ID: 43, Username: "alle2", FirstName: "test", LastName: "user", Email: "test@email.com"}
 }
 
+func createTestService(m Mailer, d dao.UserDao, conf Config) AuthService {
+	keys, _ := NewKeyRingFromConfig(conf)
+	tokenDao := dao.MockRefreshTokenDao{}
+	tokenDao.On("SaveRefreshToken", mock.Anything).Return(nil)
+	revocationDao := dao.MockRevocationDao{}
+	revocationDao.On("IsRevoked", mock.Anything).Return(false, nil)
+	return AuthService{Mailer: m, UserDao: d, RefreshTokenDao: &tokenDao, RevocationDao: &revocationDao, Config: conf, Keys: keys}
+}
+
 func createTestConfig() Config {
 	return Config{PrivKeyPath: "../test_data/private.pem", PubKeyPath: "../test_data/public.pem", AdminID: user.ID}
 }
@@ -325,6 +909,15 @@ func testJWTStringField(tokenStr string, fieldName string, fieldValue string) bo
 	return actualValue == fieldValue
 }
 
+func testJWTHeader(tokenStr string, headerName string, headerValue string) bool {
+	token, _, err := new(jwt.Parser).ParseUnverified(tokenStr, jwt.MapClaims{})
+	if err != nil {
+		return false
+	}
+
+	return token.Header[headerName] == headerValue
+}
+
 func exctractField(tokenStr string, fieldName string, defaultValue interface{}) interface{} {
 	token, _, err := new(jwt.Parser).ParseUnverified(tokenStr, jwt.MapClaims{})
 	if err != nil {
@@ -345,6 +938,11 @@ func exctractField(tokenStr string, fieldName string, defaultValue interface{})
 }
 
 func issueTestToken(userID int64, username string, privKeyPath string) string {
+	return issueTestTokenWithIssuer(userID, username, privKeyPath, "")
+}
+
+// issueTestTokenWithIssuer issues access token with iss claim, it is omitted when empty
+func issueTestTokenWithIssuer(userID int64, username string, privKeyPath string, issuer string) string {
 	keyData, err := ioutil.ReadFile(privKeyPath)
 	if err != nil {
 		return ""
@@ -354,11 +952,15 @@ func issueTestToken(userID int64, username string, privKeyPath string) string {
 		return ""
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+	claims := jwt.MapClaims{
 		"sub":    username,
 		"userId": userID,
 		"exp":    time.Now().Add(time.Hour).UTC().Unix(),
-	})
+	}
+	if issuer != "" {
+		claims["iss"] = issuer
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
 
 	tokenString, err := token.SignedString(key)
 	if err != nil {
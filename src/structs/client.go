@@ -0,0 +1,50 @@
+package structs
+
+import "encoding/json"
+
+// Client structure describes OAuth client application registered by admin
+type Client struct {
+	ID           string   `bson:"_id" json:"clientId" xorm:"pk varchar(64)"`
+	Name         string   `bson:"name" json:"name" xorm:"varchar(100)"`
+	RedirectURIs []string `bson:"redirectUris" json:"redirectUris" xorm:"json"`
+
+	// Confidential clients authenticate with secret and can use client credentials grant
+	Confidential bool `bson:"confidential" json:"confidential"`
+
+	// Scopes which can be requested with client credentials grant
+	Scopes []string `bson:"scopes" json:"scopes" xorm:"json"`
+
+	// Secret is returned only once on registration, only its hash is stored
+	Secret     string `bson:"-" json:"clientSecret,omitempty" xorm:"-"`
+	SecretHash string `bson:"secretHash" json:"-" xorm:"varchar(60)"`
+}
+
+// HasRedirectURI checks that redirect URI is registered for the client, URIs must match exactly
+func (c *Client) HasRedirectURI(uri string) bool {
+	for _, registered := range c.RedirectURIs {
+		if registered == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope checks that scope is allowed for the client
+func (c *Client) HasScope(scope string) bool {
+	for _, allowed := range c.Scopes {
+		if allowed == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func C2JSON(c *Client) []byte {
+	data, _ := json.Marshal(c)
+	return data
+}
+
+func CL2JSON(cs *[]Client) []byte {
+	data, _ := json.Marshal(cs)
+	return data
+}
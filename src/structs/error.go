@@ -4,8 +4,33 @@ package structs
 type AuthError struct {
 	Msg    string
 	Status int
+
+	// Code is optional RFC 6749 error code reported by OAuth endpoints
+	Code string
+
+	// MFAToken is challenge token of mfa_required error exchanged for tokens with the second factor
+	MFAToken string
+
+	// RetryAfter is number of seconds reported in Retry-After header of 429 response
+	RetryAfter int64
 }
 
 func (e AuthError) Error() string {
 	return e.Msg
 }
+
+// OAuthError error with RFC 6749 error code
+type OAuthError struct {
+	Code        string
+	Description string
+	Status      int
+	MFAToken    string
+	RetryAfter  int64
+}
+
+func (e OAuthError) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
@@ -0,0 +1,20 @@
+package structs
+
+import "encoding/json"
+
+// Group structure describes team or organization, its members get roles of the group
+type Group struct {
+	ID    string   `bson:"_id" json:"id" xorm:"pk varchar(64)"`
+	Name  string   `bson:"name" json:"name" xorm:"varchar(100)"`
+	Roles []string `bson:"roles" json:"roles" xorm:"json"`
+}
+
+func G2JSON(g *Group) []byte {
+	data, _ := json.Marshal(g)
+	return data
+}
+
+func GL2JSON(gs *[]Group) []byte {
+	data, _ := json.Marshal(gs)
+	return data
+}
@@ -0,0 +1,26 @@
+package structs
+
+import "encoding/json"
+
+// JSONWebKey represents public key in RFC 7517 format
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JSONWebKeySet represents set of public keys in RFC 7517 format
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+func JWKS2JSON(s *JSONWebKeySet) []byte {
+	data, _ := json.Marshal(s)
+	return data
+}
@@ -0,0 +1,10 @@
+package structs
+
+// LoginAttempts structure describes failed password attempts of username or client IP.
+// ID is the key, e.g. "user:sarah69" or "ip:192.0.2.1". Attempts are forgotten after ExpiresAt.
+type LoginAttempts struct {
+	ID          string `bson:"_id" json:"key" xorm:"pk varchar(300)"`
+	Failures    int64  `bson:"failures" json:"failures"`
+	LockedUntil int64  `bson:"lockedUntil" json:"lockedUntil"`
+	ExpiresAt   int64  `bson:"expiresAt" json:"expiresAt" xorm:"index"`
+}
@@ -0,0 +1,64 @@
+package structs
+
+import "encoding/json"
+
+// OpenIDConfiguration represents OpenID Provider Metadata from OpenID Connect Discovery 1.0
+type OpenIDConfiguration struct {
+	Issuer                           string   `json:"issuer"`
+	AuthorizationEndpoint            string   `json:"authorization_endpoint,omitempty"`
+	TokenEndpoint                    string   `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint      string   `json:"device_authorization_endpoint"`
+	UserInfoEndpoint                 string   `json:"userinfo_endpoint"`
+	JWKSURI                          string   `json:"jwks_uri"`
+	RevocationEndpoint               string   `json:"revocation_endpoint"`
+	IntrospectionEndpoint            string   `json:"introspection_endpoint"`
+	ScopesSupported                  []string `json:"scopes_supported"`
+	ResponseTypesSupported           []string `json:"response_types_supported"`
+	GrantTypesSupported              []string `json:"grant_types_supported"`
+	CodeChallengeMethodsSupported    []string `json:"code_challenge_methods_supported"`
+	TokenEndpointAuthMethods         []string `json:"token_endpoint_auth_methods_supported"`
+	SubjectTypesSupported            []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+	ClaimsSupported                  []string `json:"claims_supported"`
+}
+
+// OIDCUserInfo represents response of OpenID Connect UserInfo endpoint
+type OIDCUserInfo struct {
+	Sub               string `json:"sub"`
+	PreferredUsername string `json:"preferred_username"`
+	Name              string `json:"name,omitempty"`
+	GivenName         string `json:"given_name,omitempty"`
+	FamilyName        string `json:"family_name,omitempty"`
+	Email             string `json:"email,omitempty"`
+	UserID            int64  `json:"userId"`
+}
+
+// NewOIDCUserInfo maps user info to standard OpenID Connect claims
+func NewOIDCUserInfo(u *UserInfo) *OIDCUserInfo {
+	name := u.FirstName
+	if u.LastName != "" {
+		if name != "" {
+			name += " "
+		}
+		name += u.LastName
+	}
+	return &OIDCUserInfo{
+		Sub:               u.Username,
+		PreferredUsername: u.Username,
+		Name:              name,
+		GivenName:         u.FirstName,
+		FamilyName:        u.LastName,
+		Email:             u.Email,
+		UserID:            u.ID,
+	}
+}
+
+func OIDC2JSON(c *OpenIDConfiguration) []byte {
+	data, _ := json.Marshal(c)
+	return data
+}
+
+func OUI2JSON(u *OIDCUserInfo) []byte {
+	data, _ := json.Marshal(u)
+	return data
+}
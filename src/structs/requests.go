@@ -0,0 +1,33 @@
+package structs
+
+// AuthorizationRequest structure describes parameters of OAuth authorization request
+type AuthorizationRequest struct {
+	ResponseType        string
+	ClientID            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// TokenRequest structure describes parameters of RFC 6749 token request
+type TokenRequest struct {
+	GrantType    string
+	Username     string
+	Password     string
+	RefreshToken string
+	Code         string
+	RedirectURI  string
+	CodeVerifier string
+	DeviceCode   string
+	ClientID     string
+	ClientSecret string
+	Scope        string
+	Audience     string
+	Nonce        string
+
+	// ClientIP is address failed password attempts are counted for
+	ClientIP string
+}
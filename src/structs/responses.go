@@ -3,7 +3,8 @@ package structs
 import "encoding/json"
 
 type ErrorResp struct {
-	Error string `json:"error"`
+	Error    string `json:"error"`
+	MFAToken string `json:"mfaToken,omitempty"`
 }
 
 type IDResp struct {
@@ -13,6 +14,50 @@ type IDResp struct {
 type AccessAndRefreshTokenResp struct {
 	AccessToken  string `json:"accessToken"`
 	RefreshToken string `json:"refreshToken"`
+	IDToken      string `json:"idToken,omitempty"`
+}
+
+// OAuthTokenResp represents RFC 6749 access token response
+type OAuthTokenResp struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// OAuthErrorResp represents RFC 6749 error response
+type OAuthErrorResp struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+	MFAToken         string `json:"mfa_token,omitempty"`
+}
+
+// DeviceAuthorizationResp represents RFC 8628 device authorization response
+type DeviceAuthorizationResp struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+// TOTPEnrollmentResp contains TOTP secret in base32 and otpauth URI for authenticator apps
+type TOTPEnrollmentResp struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// BackupCodesResp contains generated backup codes, they are shown only once
+type BackupCodesResp struct {
+	Codes []string `json:"codes"`
+}
+
+// BackupCodesCountResp contains number of backup codes which are not used yet
+type BackupCodesCountResp struct {
+	Remaining int `json:"remaining"`
 }
 
 type AccessTokenResp struct {
@@ -23,6 +68,23 @@ type ExchangeCodeResponse struct {
 	Code string `json:"code"`
 }
 
+type KeyIDResp struct {
+	KeyID string `json:"kid"`
+}
+
+type IntrospectionResp struct {
+	Active   bool   `json:"active"`
+	Sub      string `json:"sub,omitempty"`
+	Username string `json:"username,omitempty"`
+	UserID   int64  `json:"userId,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+	TokenUse string `json:"token_use,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+	Jti      string `json:"jti,omitempty"`
+	Exp      int64  `json:"exp,omitempty"`
+	Iat      int64  `json:"iat,omitempty"`
+}
+
 func ER2JSON(r *ErrorResp) []byte {
 	data, _ := json.Marshal(r)
 	return data
@@ -47,3 +109,43 @@ func EC2JSON(r *ExchangeCodeResponse) []byte {
 	data, _ := json.Marshal(r)
 	return data
 }
+
+func KID2JSON(r *KeyIDResp) []byte {
+	data, _ := json.Marshal(r)
+	return data
+}
+
+func IR2JSON(r *IntrospectionResp) []byte {
+	data, _ := json.Marshal(r)
+	return data
+}
+
+func OTR2JSON(r *OAuthTokenResp) []byte {
+	data, _ := json.Marshal(r)
+	return data
+}
+
+func OER2JSON(r *OAuthErrorResp) []byte {
+	data, _ := json.Marshal(r)
+	return data
+}
+
+func DAR2JSON(r *DeviceAuthorizationResp) []byte {
+	data, _ := json.Marshal(r)
+	return data
+}
+
+func TE2JSON(r *TOTPEnrollmentResp) []byte {
+	data, _ := json.Marshal(r)
+	return data
+}
+
+func BC2JSON(r *BackupCodesResp) []byte {
+	data, _ := json.Marshal(r)
+	return data
+}
+
+func BCC2JSON(r *BackupCodesCountResp) []byte {
+	data, _ := json.Marshal(r)
+	return data
+}
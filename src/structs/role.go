@@ -0,0 +1,30 @@
+package structs
+
+import "encoding/json"
+
+// Role structure describes named set of permissions which can be assigned to users
+type Role struct {
+	Name        string   `bson:"_id" json:"name" xorm:"pk varchar(64)"`
+	Permissions []string `bson:"permissions" json:"permissions" xorm:"json"`
+}
+
+// UserAccess structure describes roles and permissions assigned to user directly
+type UserAccess struct {
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+}
+
+func R2JSON(r *Role) []byte {
+	data, _ := json.Marshal(r)
+	return data
+}
+
+func RL2JSON(rs *[]Role) []byte {
+	data, _ := json.Marshal(rs)
+	return data
+}
+
+func UA2JSON(a *UserAccess) []byte {
+	data, _ := json.Marshal(a)
+	return data
+}
@@ -0,0 +1,52 @@
+package structs
+
+// RefreshToken structure describes issued refresh token of a token family.
+// Family is started by password authentication and continued by every refresh.
+type RefreshToken struct {
+	ID        string `bson:"_id" xorm:"pk varchar(64)"`
+	Family    string `bson:"family" xorm:"varchar(64) index"`
+	UserID    int64  `bson:"userId"`
+	Used      bool   `bson:"used"`
+	Revoked   bool   `bson:"revoked"`
+	ExpiresAt int64  `bson:"expiresAt"`
+}
+
+// RevokedToken structure describes revoked token which is kept until its expiration
+type RevokedToken struct {
+	ID        string `bson:"_id" xorm:"pk varchar(64)"`
+	ExpiresAt int64  `bson:"expiresAt" xorm:"index"`
+}
+
+// AuthorizationCode structure describes issued OAuth authorization code.
+// Code itself is not stored, ID is its SHA-256 hash.
+type AuthorizationCode struct {
+	ID            string `bson:"_id" xorm:"pk varchar(64)"`
+	ClientID      string `bson:"clientId" xorm:"varchar(64)"`
+	RedirectURI   string `bson:"redirectUri" xorm:"varchar(500)"`
+	UserID        int64  `bson:"userId"`
+	Scope         string `bson:"scope" xorm:"varchar(200)"`
+	Nonce         string `bson:"nonce" xorm:"varchar(200)"`
+	CodeChallenge string `bson:"codeChallenge" xorm:"varchar(128)"`
+	ExpiresAt     int64  `bson:"expiresAt" xorm:"index"`
+}
+
+// Statuses of device authorization
+const (
+	DeviceAuthorizationPending  = "pending"
+	DeviceAuthorizationApproved = "approved"
+	DeviceAuthorizationDenied   = "denied"
+)
+
+// DeviceAuthorization structure describes RFC 8628 device authorization waiting for user decision.
+// Device code is not stored, ID is its SHA-256 hash.
+type DeviceAuthorization struct {
+	ID           string `bson:"_id" xorm:"pk varchar(64)"`
+	UserCode     string `bson:"userCode" xorm:"varchar(16) unique"`
+	ClientID     string `bson:"clientId" xorm:"varchar(64)"`
+	Scope        string `bson:"scope" xorm:"varchar(200)"`
+	Status       string `bson:"status" xorm:"varchar(16)"`
+	UserID       int64  `bson:"userId"`
+	Interval     int64  `bson:"interval"`
+	LastPolledAt int64  `bson:"lastPolledAt"`
+	ExpiresAt    int64  `bson:"expiresAt" xorm:"index"`
+}
@@ -4,17 +4,44 @@ import (
 	"encoding/json"
 )
 
-// User structure
+// User structure, fields managed by the service are tagged json:"-" and never read from user payloads
 type User struct {
-	ID            int64  `bson:"_id" xorm:"varchar(200)"`
+	ID            int64  `bson:"_id" xorm:"pk varchar(200)"`
 	Username      string `bson:"username" xorm:"varchar(50)"`
 	FirstName     string `bson:"firstName" xorm:"varchar(50)"`
 	LastName      string `bson:"lastName" xorm:"varchar(50)"`
 	Email         string `bson:"email" xorm:"varchar(50)"`
 	Password      string `bson:"password" xorm:"varchar(60)"`
 	InviteCode    string `bson:"inviteCode" xorm:"varchar(60)"`
-	RecoveryCode  string `bson:"recoveryCode" xorm:"varchar(60)"`
-	ResettingCode string `bson:"resettingCode" xorm:"varchar(60)"`
+	RecoveryCode  string `bson:"recoveryCode" xorm:"varchar(60)" json:"-"`
+	ResettingCode string `bson:"resettingCode" xorm:"varchar(60)" json:"-"`
+
+	// Issue time and attempts to use pending recovery or resetting code, only one of them is pending
+	RecoveryIssuedAt int64 `bson:"recoveryIssuedAt" xorm:"'recovery_issued_at'" json:"-"`
+	RecoveryAttempts int64 `bson:"recoveryAttempts" xorm:"'recovery_attempts'" json:"-"`
+
+	// Roles and Permissions are granted by admin, see UserAccess
+	Roles       []string `bson:"roles" xorm:"json" json:"-"`
+	Permissions []string `bson:"permissions" xorm:"json" json:"-"`
+
+	// Groups user is member of, managed via GroupDao
+	Groups []string `bson:"groups" xorm:"'member_of' json" json:"-"`
+
+	// TOTP secret encrypted with configured key, second factor is required once it is confirmed.
+	// TOTPCounter is the last accepted time step, codes can not be replayed.
+	TOTPSecret  string `bson:"totpSecret" xorm:"'totp_secret' varchar(200)" json:"-"`
+	TOTPEnabled bool   `bson:"totpEnabled" xorm:"'totp_enabled'" json:"-"`
+	TOTPCounter int64  `bson:"totpCounter" xorm:"'totp_counter'" json:"-"`
+
+	// Hashes of single use codes accepted instead of the second factor
+	BackupCodes []string `bson:"backupCodes" xorm:"'backup_codes' json" json:"-"`
+
+	// Pending passwordless login: hash of emailed code, id of signed link and attempts to guess the code,
+	// all are cleared once either of them is used or too many wrong codes are tried
+	LoginCode      string `bson:"loginCode" xorm:"'login_code' varchar(60)" json:"-"`
+	LoginNonce     string `bson:"loginNonce" xorm:"'login_nonce' varchar(64)" json:"-"`
+	LoginExpiresAt int64  `bson:"loginExpiresAt" xorm:"'login_expires_at'" json:"-"`
+	LoginAttempts  int64  `bson:"loginAttempts" xorm:"'login_attempts'" json:"-"`
 }
 
 // UserInfo structure
@@ -24,6 +51,8 @@ type UserInfo struct {
 	FirstName string `json:"firstName"`
 	LastName  string `json:"lastName"`
 	Email     string `json:"email"`
+
+	Groups []string `json:"groups,omitempty"`
 }
 
 func U2JSON(u *User) []byte {
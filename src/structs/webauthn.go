@@ -0,0 +1,107 @@
+package structs
+
+import "encoding/json"
+
+// WebAuthnCredential structure describes public key credential (passkey or security key) of user.
+// ID is base64url encoded credential id, PublicKey is COSE encoded key.
+type WebAuthnCredential struct {
+	ID        string `bson:"_id" json:"id" xorm:"pk varchar(400)"`
+	UserID    int64  `bson:"userId" json:"-" xorm:"'user_id' index"`
+	Name      string `bson:"name" json:"name" xorm:"varchar(100)"`
+	PublicKey []byte `bson:"publicKey" json:"-" xorm:"blob"`
+	SignCount int64  `bson:"signCount" json:"signCount"`
+	CreatedAt int64  `bson:"createdAt" json:"createdAt"`
+}
+
+// WebAuthnOptionsResp contains options of navigator.credentials.create() or get()
+// and session token which is sent back with the result of the ceremony
+type WebAuthnOptionsResp struct {
+	Session   string      `json:"session"`
+	PublicKey interface{} `json:"publicKey"`
+}
+
+// WebAuthnCreationOptions represents PublicKeyCredentialCreationOptions, binary values are base64url encoded
+type WebAuthnCreationOptions struct {
+	Challenge              string                         `json:"challenge"`
+	RP                     WebAuthnRelyingParty           `json:"rp"`
+	User                   WebAuthnUser                   `json:"user"`
+	PubKeyCredParams       []WebAuthnCredentialParam      `json:"pubKeyCredParams"`
+	Timeout                int64                          `json:"timeout"`
+	ExcludeCredentials     []WebAuthnCredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection WebAuthnAuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                         `json:"attestation"`
+}
+
+// WebAuthnRequestOptions represents PublicKeyCredentialRequestOptions, binary values are base64url encoded
+type WebAuthnRequestOptions struct {
+	Challenge        string                         `json:"challenge"`
+	RPID             string                         `json:"rpId"`
+	Timeout          int64                          `json:"timeout"`
+	AllowCredentials []WebAuthnCredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                         `json:"userVerification"`
+}
+
+type WebAuthnRelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type WebAuthnUser struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type WebAuthnCredentialParam struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+type WebAuthnCredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type WebAuthnAuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// WebAuthnFinishRequest contains session token of the ceremony and its result
+type WebAuthnFinishRequest struct {
+	Session    string                      `json:"session"`
+	Name       string                      `json:"name,omitempty"`
+	Credential WebAuthnPublicKeyCredential `json:"credential"`
+}
+
+// WebAuthnPublicKeyCredential represents PublicKeyCredential, binary values are base64url encoded
+type WebAuthnPublicKeyCredential struct {
+	ID       string                        `json:"id"`
+	RawID    string                        `json:"rawId"`
+	Type     string                        `json:"type"`
+	Response WebAuthnAuthenticatorResponse `json:"response"`
+}
+
+// WebAuthnAuthenticatorResponse contains fields of attestation or assertion response
+type WebAuthnAuthenticatorResponse struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject,omitempty"`
+	AuthenticatorData string `json:"authenticatorData,omitempty"`
+	Signature         string `json:"signature,omitempty"`
+	UserHandle        string `json:"userHandle,omitempty"`
+}
+
+func WO2JSON(r *WebAuthnOptionsResp) []byte {
+	data, _ := json.Marshal(r)
+	return data
+}
+
+func WC2JSON(c *WebAuthnCredential) []byte {
+	data, _ := json.Marshal(c)
+	return data
+}
+
+func WCL2JSON(cs *[]WebAuthnCredential) []byte {
+	data, _ := json.Marshal(cs)
+	return data
+}
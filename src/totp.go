@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/adderly/brightonum/src/crypto"
+	st "github.com/adderly/brightonum/src/structs"
+)
+
+const (
+	mfaTokenUse = "mfa"
+
+	// RFC 6238 parameters supported by common authenticator apps
+	totpPeriod     = 30
+	totpDigits     = 6
+	totpModulus    = 1000000
+	totpSecretSize = 20
+
+	// Number of time steps codes are accepted before and after the current one
+	totpSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// EnrollTOTP generates new TOTP secret of the user. Second factor is not required until it is
+// confirmed by ConfirmTOTP, enrolling again replaces unconfirmed secret.
+func (s *AuthService) EnrollTOTP(token string) (*st.TOTPEnrollmentResp, error) {
+	u, err := s.authenticateToken(token, accessTokenUse)
+	if err != nil {
+		return nil, err
+	}
+	if s.Config.MFAEncryptionKey == "" {
+		return nil, st.AuthError{Msg: "TOTP is not configured", Status: 501}
+	}
+	if u.TOTPEnabled {
+		return nil, st.AuthError{Msg: "TOTP is already enabled", Status: 409}
+	}
+
+	secret := make([]byte, totpSecretSize)
+	if _, err = rand.Read(secret); err != nil {
+		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	encrypted, err := crypto.Encrypt(secret, s.Config.MFAEncryptionKey)
+	if err != nil {
+		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if err = s.UserDao.SetTOTP(u.ID, encrypted, false); err != nil {
+		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+	}
+
+	encoded := totpEncoding.EncodeToString(secret)
+	logger.Logf("INFO TOTP is enrolled for user %d", u.ID)
+	return &st.TOTPEnrollmentResp{Secret: encoded, URI: s.totpURI(u, encoded)}, nil
+}
+
+// ConfirmTOTP enables enrolled TOTP secret once the user proves it is added to an authenticator
+func (s *AuthService) ConfirmTOTP(token, code string) error {
+	u, err := s.authenticateToken(token, accessTokenUse)
+	if err != nil {
+		return err
+	}
+	if u.TOTPEnabled {
+		return st.AuthError{Msg: "TOTP is already enabled", Status: 409}
+	}
+	if u.TOTPSecret == "" {
+		return st.AuthError{Msg: "TOTP is not enrolled", Status: 400}
+	}
+
+	if err = s.checkTOTP(u, code); err != nil {
+		return err
+	}
+	if err = s.UserDao.SetTOTP(u.ID, u.TOTPSecret, true); err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+
+	logger.Logf("INFO TOTP is enabled for user %d", u.ID)
+	return nil
+}
+
+// DisableTOTP removes TOTP secret and backup codes of the user,
+// current code or a backup code is required when it is enabled
+func (s *AuthService) DisableTOTP(token, code string) error {
+	u, err := s.authenticateToken(token, accessTokenUse)
+	if err != nil {
+		return err
+	}
+	if u.TOTPEnabled {
+		if err = s.checkSecondFactor(u, code); err != nil {
+			return err
+		}
+	}
+	if err = s.UserDao.SetTOTP(u.ID, "", false); err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if err = s.UserDao.SetBackupCodes(u.ID, []string{}); err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+
+	logger.Logf("INFO TOTP is disabled for user %d", u.ID)
+	return nil
+}
+
+// MFAToken exchanges challenge token issued instead of tokens and the second factor
+// for access and refresh tokens. Challenge token can be used only once.
+func (s *AuthService) MFAToken(challenge, code string) (string, string, error) {
+	invalidErr := st.AuthError{Msg: "Challenge token is not valid", Status: 401}
+
+	claims, err := s.parseToken(challenge, mfaTokenUse)
+	if err != nil {
+		return "", "", invalidErr
+	}
+	id, _ := claims["jti"].(string)
+	userID, _ := claims["userId"].(float64)
+	if id == "" {
+		return "", "", invalidErr
+	}
+
+	u, err := s.UserDao.GetByUsername(fmt.Sprintf("%s", claims["sub"]))
+	if err != nil {
+		return "", "", st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if u == nil || u.ID != int64(userID) {
+		return "", "", invalidErr
+	}
+
+	// Challenge is single use, it is revoked as well when the second factor gets locked
+	exp, _ := claims["exp"].(float64)
+	if err = s.checkSecondFactor(u, code); err != nil {
+		if authErr, ok := err.(st.AuthError); ok && authErr.Status == 429 {
+			if revokeErr := s.RevocationDao.Revoke(id, int64(exp)); revokeErr != nil {
+				return "", "", st.AuthError{Msg: revokeErr.Error(), Status: 500}
+			}
+		}
+		return "", "", err
+	}
+	if err = s.RevocationDao.Revoke(id, int64(exp)); err != nil {
+		return "", "", st.AuthError{Msg: err.Error(), Status: 500}
+	}
+
+	audience, _ := claims["aud"].(string)
+	audience, err = s.resolveAudience(audience)
+	if err != nil {
+		return "", "", err
+	}
+	authTime := time.Now().UTC().Unix()
+	tokenString, err := s.issueAccessToken(u, audience, authTime)
+	if err != nil {
+		return "", "", err
+	}
+	refreshTokenString, err := s.issueRefreshToken(u, "", "", audience, authTime)
+	if err != nil {
+		return "", "", err
+	}
+	return tokenString, refreshTokenString, nil
+}
+
+// mfaChallenge returns mfa_required error with challenge token for the user and audience
+func (s *AuthService) mfaChallenge(u *st.User, audience string) error {
+	claims := s.standardClaims(audience, s.Config.MFAChallengeLifetime)
+	claims["sub"] = u.Username
+	claims["userId"] = u.ID
+	claims["token_use"] = mfaTokenUse
+	claims["jti"] = generateTokenID()
+
+	t, err := s.signToken(claims)
+	if err != nil {
+		return err
+	}
+	return st.AuthError{Msg: "Second factor is required", Status: 401, Code: "mfa_required", MFAToken: t}
+}
+
+// checkCredentials checks password of the user from ip and the second factor when it is enabled
+func (s *AuthService) checkCredentials(username, password, code string, ip string) (*st.User, error) {
+	u, err := s.checkPassword(username, password, ip)
+	if err != nil {
+		return nil, err
+	}
+	if u.TOTPEnabled {
+		if err = s.checkSecondFactor(u, code); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// checkSecondFactor checks code of the second factor of the user, backup code is accepted as well.
+// Wrong codes are counted per user, the second factor is locked for lockout window after the limit.
+func (s *AuthService) checkSecondFactor(u *st.User, code string) error {
+	if code == "" {
+		return st.AuthError{Msg: "Authentication code is required", Status: 403}
+	}
+	if !u.TOTPEnabled {
+		return st.AuthError{Msg: "Second factor is not enabled", Status: 400}
+	}
+
+	attempts, err := s.reserveMFAAttempt(u)
+	if err != nil {
+		return err
+	}
+	if isBackupCode(code) {
+		err = s.checkBackupCode(u, code)
+	} else {
+		err = s.checkTOTP(u, code)
+	}
+	if authErr, ok := err.(st.AuthError); ok && authErr.Status == 403 && attempts != nil && attempts.Failures >= int64(s.Config.MFAMaxAttempts) {
+		logger.Logf("WARN Second factor of user %d is locked after %d wrong codes", u.ID, attempts.Failures)
+		return s.mfaLockedError(attempts)
+	}
+	if err != nil {
+		return err
+	}
+	return s.resetMFAAttempts(u)
+}
+
+// checkTOTP checks TOTP code against stored secret of the user, accepted code can not be used again
+func (s *AuthService) checkTOTP(u *st.User, code string) error {
+	wrongErr := st.AuthError{Msg: "Authentication code is wrong", Status: 403}
+
+	secret, err := crypto.Decrypt(u.TOTPSecret, s.Config.MFAEncryptionKey)
+	if err != nil {
+		logger.Logf("ERROR Cannot decrypt TOTP secret of user %d: %s", u.ID, err.Error())
+		return st.AuthError{Msg: "Cannot verify authentication code", Status: 500}
+	}
+
+	step := time.Now().UTC().Unix() / totpPeriod
+	for counter := step - totpSkew; counter <= step+totpSkew; counter++ {
+		if !hmac.Equal([]byte(totpCode(secret, counter)), []byte(code)) {
+			continue
+		}
+		fresh, err := s.UserDao.UseTOTPCounter(u.ID, counter)
+		if err != nil {
+			return st.AuthError{Msg: err.Error(), Status: 500}
+		}
+		if !fresh {
+			logger.Logf("WARN TOTP code of user %d is reused", u.ID)
+			return wrongErr
+		}
+		return nil
+	}
+	return wrongErr
+}
+
+// totpURI returns otpauth URI of the secret understood by authenticator apps
+func (s *AuthService) totpURI(u *st.User, secret string) string {
+	label := url.PathEscape(s.Config.TOTPIssuer + ":" + u.Username)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", s.Config.TOTPIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// totpCode computes RFC 4226 HOTP value of the counter, which is time step for TOTP
+func totpCode(secret []byte, counter int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%totpModulus)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adderly/brightonum/src/crypto"
+	"github.com/adderly/brightonum/src/dao"
+	st "github.com/adderly/brightonum/src/structs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const testMFAKey = "mfa-secret"
+
+var testTOTPSecret = []byte("12345678901234567890")
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 test vectors for SHA1, truncated to 6 digits
+	assert.Equal(t, "287082", totpCode(testTOTPSecret, 59/totpPeriod))
+	assert.Equal(t, "081804", totpCode(testTOTPSecret, 1111111109/totpPeriod))
+	assert.Equal(t, "005924", totpCode(testTOTPSecret, 1234567890/totpPeriod))
+	assert.Equal(t, "279037", totpCode(testTOTPSecret, 2000000000/totpPeriod))
+}
+
+func TestAuthService_EnrollTOTP(t *testing.T) {
+	user := createTestUser()
+	enabled := createAnotherTestUser()
+	enabled.TOTPEnabled = true
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+
+	var encrypted string
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+	dao.On("GetByUsername", enabled.Username).Return(&enabled, nil)
+	dao.On("SetTOTP", user.ID, mock.Anything, false).Return(nil).Run(func(args mock.Arguments) {
+		encrypted = args.String(1)
+	})
+
+	conf := createTestConfig()
+	conf.MFAEncryptionKey = testMFAKey
+	conf.TOTPIssuer = "brightonum"
+	s := createTestService(&mailer, &dao, conf)
+
+	resp, err := s.EnrollTOTP(token)
+	assert.Nil(t, err)
+	assert.Len(t, resp.Secret, 32)
+	assert.Equal(t, "otpauth://totp/brightonum:alle?algorithm=SHA1&digits=6&issuer=brightonum&period=30&secret="+resp.Secret, resp.URI)
+
+	secret, err := crypto.Decrypt(encrypted, testMFAKey)
+	assert.Nil(t, err)
+	assert.Equal(t, resp.Secret, totpEncoding.EncodeToString(secret))
+
+	_, err = s.EnrollTOTP(issueTestToken(enabled.ID, enabled.Username, conf.PrivKeyPath))
+	assert.Equal(t, st.AuthError{Msg: "TOTP is already enabled", Status: 409}, err)
+
+	s.Config.MFAEncryptionKey = ""
+	_, err = s.EnrollTOTP(token)
+	assert.Equal(t, st.AuthError{Msg: "TOTP is not configured", Status: 501}, err)
+}
+
+func TestAuthService_ConfirmTOTP(t *testing.T) {
+	encrypted, _ := crypto.Encrypt(testTOTPSecret, testMFAKey)
+	user := createTestUser()
+	user.TOTPSecret = encrypted
+	token := issueTestToken(user.ID, user.Username, createTestConfig().PrivKeyPath)
+	step := time.Now().UTC().Unix() / totpPeriod
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+	dao.On("UseTOTPCounter", user.ID, step).Return(true, nil).Once()
+	dao.On("UseTOTPCounter", user.ID, step).Return(false, nil)
+	dao.On("SetTOTP", user.ID, encrypted, true).Return(nil)
+
+	conf := createTestConfig()
+	conf.MFAEncryptionKey = testMFAKey
+	s := createTestService(&mailer, &dao, conf)
+
+	err := s.ConfirmTOTP(token, "000000x")
+	assert.Equal(t, st.AuthError{Msg: "Authentication code is wrong", Status: 403}, err)
+
+	err = s.ConfirmTOTP(token, totpCode(testTOTPSecret, step))
+	assert.Nil(t, err)
+	dao.AssertCalled(t, "SetTOTP", user.ID, encrypted, true)
+
+	// Code can not be replayed
+	err = s.ConfirmTOTP(token, totpCode(testTOTPSecret, step))
+	assert.Equal(t, st.AuthError{Msg: "Authentication code is wrong", Status: 403}, err)
+}
+
+func TestAuthService_MFAToken(t *testing.T) {
+	encrypted, _ := crypto.Encrypt(testTOTPSecret, testMFAKey)
+	user := createTestUser()
+	user.TOTPSecret = encrypted
+	user.TOTPEnabled = true
+	step := time.Now().UTC().Unix() / totpPeriod
+
+	revocationDao := dao.MockRevocationDao{}
+	revocationDao.On("IsRevoked", mock.Anything).Return(false, nil)
+	revocationDao.On("Revoke", mock.Anything, mock.Anything).Return(nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+	dao.On("UseTOTPCounter", user.ID, step-1).Return(true, nil)
+
+	conf := createTestConfig()
+	conf.MFAEncryptionKey = testMFAKey
+	conf.MFAChallengeLifetime = time.Minute
+	s := createTestService(&mailer, &dao, conf)
+	s.RevocationDao = &revocationDao
+
+	_, _, err := s.BasicAuthToken(user.Username, "oakheart", "", "")
+	authErr := err.(st.AuthError)
+	assert.Equal(t, "mfa_required", authErr.Code)
+	assert.Equal(t, 401, authErr.Status)
+	assert.True(t, testJWTStringField(authErr.MFAToken, "token_use", mfaTokenUse))
+
+	// Challenge token is not accepted as access token
+	_, err = s.GetUserByToken(authErr.MFAToken)
+	assert.NotNil(t, err)
+
+	_, _, err = s.MFAToken(authErr.MFAToken, "")
+	assert.Equal(t, st.AuthError{Msg: "Authentication code is required", Status: 403}, err)
+
+	accessToken, refreshToken, err := s.MFAToken(authErr.MFAToken, totpCode(testTOTPSecret, step-1))
+	assert.Nil(t, err)
+	assert.True(t, testJWTStringField(accessToken, "token_use", accessTokenUse))
+	assert.True(t, testJWTStringField(refreshToken, "token_use", refreshTokenUse))
+	revocationDao.AssertCalled(t, "Revoke", exctractField(authErr.MFAToken, "jti", ""), mock.Anything)
+
+	_, _, err = s.MFAToken(accessToken, totpCode(testTOTPSecret, step))
+	assert.Equal(t, st.AuthError{Msg: "Challenge token is not valid", Status: 401}, err)
+}
+
+func TestAuthService_MFAToken_AttemptLimit(t *testing.T) {
+	encrypted, _ := crypto.Encrypt(testTOTPSecret, testMFAKey)
+	user := createTestUser()
+	user.TOTPSecret = encrypted
+	user.TOTPEnabled = true
+	step := time.Now().UTC().Unix() / totpPeriod
+
+	revocationDao := dao.MockRevocationDao{}
+	revocationDao.On("IsRevoked", mock.Anything).Return(false, nil)
+	revocationDao.On("Revoke", mock.Anything, mock.Anything).Return(nil)
+
+	attemptDao := dao.MockLoginAttemptDao{}
+	attemptDao.On("GetLoginAttempts", "mfa:alle").Return(nil, nil)
+	for i := int64(1); i <= 3; i++ {
+		attemptDao.On("AddLoginFailure", "mfa:alle", mock.Anything).Return(&st.LoginAttempts{Failures: i, ExpiresAt: time.Now().Add(time.Hour).Unix()}, nil).Once()
+	}
+	attemptDao.On("AddLoginFailure", "mfa:alle", mock.Anything).Return(&st.LoginAttempts{Failures: 4, ExpiresAt: time.Now().Add(time.Hour).Unix()}, nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+	dao.On("UseTOTPCounter", user.ID, mock.Anything).Return(true, nil)
+
+	conf := createTestConfig()
+	conf.MFAEncryptionKey = testMFAKey
+	conf.MFAChallengeLifetime = time.Minute
+	conf.MFAMaxAttempts = 3
+	conf.LockoutWindow = time.Hour
+	s := createTestService(&mailer, &dao, conf)
+	s.RevocationDao = &revocationDao
+	s.LoginAttemptDao = &attemptDao
+
+	_, _, err := s.BasicAuthToken(user.Username, "oakheart", "", "")
+	challenge := err.(st.AuthError).MFAToken
+
+	for i := 0; i < 2; i++ {
+		_, _, err = s.MFAToken(challenge, "000000")
+		assert.Equal(t, 403, err.(st.AuthError).Status)
+	}
+	revocationDao.AssertNotCalled(t, "Revoke", mock.Anything, mock.Anything)
+
+	// Challenge is revoked after the last allowed wrong code
+	_, _, err = s.MFAToken(challenge, "000000")
+	assert.Equal(t, 429, err.(st.AuthError).Status)
+	assert.InDelta(t, 3600, err.(st.AuthError).RetryAfter, 2)
+	revocationDao.AssertCalled(t, "Revoke", exctractField(challenge, "jti", ""), mock.Anything)
+
+	// Next guess is rejected even with the right code and a fresh challenge
+	_, _, err = s.BasicAuthToken(user.Username, "oakheart", "", "")
+	challenge = err.(st.AuthError).MFAToken
+	_, _, err = s.MFAToken(challenge, totpCode(testTOTPSecret, step))
+	assert.Equal(t, 429, err.(st.AuthError).Status)
+	dao.AssertNotCalled(t, "UseTOTPCounter", mock.Anything, mock.Anything)
+	attemptDao.AssertNotCalled(t, "DeleteLoginAttempts", mock.Anything)
+}
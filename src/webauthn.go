@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	st "github.com/adderly/brightonum/src/structs"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	webAuthnTokenUse = "webauthn"
+
+	// Types of client data of registration and authentication ceremonies
+	webAuthnCreate = "webauthn.create"
+	webAuthnGet    = "webauthn.get"
+
+	webAuthnChallengeSize = 32
+)
+
+// COSE algorithms of supported credential public keys
+const (
+	coseAlgES256 = -7
+	coseAlgRS256 = -257
+)
+
+// Flags of authenticator data
+const (
+	authDataUserPresent = 0x01
+	authDataAttested    = 0x40
+)
+
+var webAuthnEncoding = base64.RawURLEncoding
+
+// authenticatorData is parsed authenticator data, credential is present in registration only
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+// coseKey is credential public key with its signature algorithm
+type coseKey struct {
+	Alg int64
+	Key crypto.PublicKey
+}
+
+// clientData represents fields of CollectedClientData checked by relying party
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// BeginWebAuthnRegistration starts registration of a new credential of the user.
+// Returns options for navigator.credentials.create() and session token of the ceremony.
+func (s *AuthService) BeginWebAuthnRegistration(token string) (*st.WebAuthnOptionsResp, error) {
+	u, err := s.authenticateToken(token, accessTokenUse)
+	if err != nil {
+		return nil, err
+	}
+	if s.Config.WebAuthnRPID == "" {
+		return nil, st.AuthError{Msg: "WebAuthn is not configured", Status: 501}
+	}
+
+	credentials, err := s.WebAuthnDao.GetWebAuthnCredentials(u.ID)
+	if err != nil {
+		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+	}
+
+	challenge, session, err := s.webAuthnSession(webAuthnCreate, s.Config.Audience, u)
+	if err != nil {
+		return nil, err
+	}
+
+	name := u.Username
+	displayName := u.FirstName + " " + u.LastName
+	if u.FirstName == "" && u.LastName == "" {
+		displayName = name
+	}
+	options := st.WebAuthnCreationOptions{
+		Challenge: challenge,
+		RP:        st.WebAuthnRelyingParty{ID: s.Config.WebAuthnRPID, Name: s.Config.WebAuthnRPName},
+		User:      st.WebAuthnUser{ID: webAuthnEncoding.EncodeToString(userHandle(u.ID)), Name: name, DisplayName: displayName},
+		PubKeyCredParams: []st.WebAuthnCredentialParam{
+			{Type: "public-key", Alg: coseAlgES256},
+			{Type: "public-key", Alg: coseAlgRS256},
+		},
+		Timeout:                s.Config.WebAuthnTimeout.Milliseconds(),
+		ExcludeCredentials:     credentialDescriptors(credentials),
+		AuthenticatorSelection: st.WebAuthnAuthenticatorSelection{ResidentKey: "preferred", UserVerification: "preferred"},
+		Attestation:            "none",
+	}
+	return &st.WebAuthnOptionsResp{Session: session, PublicKey: options}, nil
+}
+
+// FinishWebAuthnRegistration verifies attestation of the new credential and saves it.
+// Attestation statement is not verified, as none attestation is requested.
+func (s *AuthService) FinishWebAuthnRegistration(token string, req *st.WebAuthnFinishRequest) (*st.WebAuthnCredential, error) {
+	invalidErr := st.AuthError{Msg: "WebAuthn attestation is not valid", Status: 400}
+
+	u, err := s.authenticateToken(token, accessTokenUse)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := s.consumeWebAuthnSession(req.Session, webAuthnCreate)
+	if err != nil {
+		return nil, err
+	}
+	if userID, _ := claims["userId"].(float64); int64(userID) != u.ID {
+		return nil, invalidErr
+	}
+
+	if _, err = s.verifyClientData(req.Credential.Response.ClientDataJSON, webAuthnCreate, claims); err != nil {
+		logger.Logf("WARN Invalid client data: %s", err.Error())
+		return nil, invalidErr
+	}
+
+	ad, err := s.parseAttestation(req.Credential.Response.AttestationObject)
+	if err != nil {
+		logger.Logf("WARN Invalid attestation: %s", err.Error())
+		return nil, invalidErr
+	}
+	id := webAuthnEncoding.EncodeToString(ad.CredentialID)
+	if req.Credential.RawID != "" && req.Credential.RawID != id {
+		return nil, invalidErr
+	}
+
+	existing, err := s.WebAuthnDao.GetWebAuthnCredential(id)
+	if err != nil {
+		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if existing != nil {
+		return nil, st.AuthError{Msg: "Credential is already registered", Status: 409}
+	}
+
+	credential := &st.WebAuthnCredential{
+		ID:        id,
+		UserID:    u.ID,
+		Name:      req.Name,
+		PublicKey: ad.PublicKey,
+		SignCount: int64(ad.SignCount),
+		CreatedAt: time.Now().UTC().Unix(),
+	}
+	if err = s.WebAuthnDao.SaveWebAuthnCredential(credential); err != nil {
+		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+	}
+
+	logger.Logf("INFO WebAuthn credential is registered for user %d", u.ID)
+	return credential, nil
+}
+
+// BeginWebAuthnLogin starts authentication with WebAuthn credential for given audience.
+// Credentials of the user are allowed when username is given, otherwise any discoverable credential.
+// Returns options for navigator.credentials.get() and session token of the ceremony.
+func (s *AuthService) BeginWebAuthnLogin(username, audience string) (*st.WebAuthnOptionsResp, error) {
+	if s.Config.WebAuthnRPID == "" {
+		return nil, st.AuthError{Msg: "WebAuthn is not configured", Status: 501}
+	}
+	audience, err := s.resolveAudience(audience)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := []st.WebAuthnCredentialDescriptor{}
+	if username != "" {
+		u, err := s.UserDao.GetByUsername(username)
+		if err != nil {
+			return nil, st.AuthError{Msg: "Cannot extract user", Status: 500}
+		}
+		// Unknown user gets the same response to not reveal registered usernames
+		if u != nil {
+			credentials, err := s.WebAuthnDao.GetWebAuthnCredentials(u.ID)
+			if err != nil {
+				return nil, st.AuthError{Msg: err.Error(), Status: 500}
+			}
+			allowed = credentialDescriptors(credentials)
+		}
+	}
+
+	challenge, session, err := s.webAuthnSession(webAuthnGet, audience, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	options := st.WebAuthnRequestOptions{
+		Challenge:        challenge,
+		RPID:             s.Config.WebAuthnRPID,
+		Timeout:          s.Config.WebAuthnTimeout.Milliseconds(),
+		AllowCredentials: allowed,
+		UserVerification: "preferred",
+	}
+	return &st.WebAuthnOptionsResp{Session: session, PublicKey: options}, nil
+}
+
+// FinishWebAuthnLogin verifies assertion of the credential and issues access and refresh tokens
+// of its owner like BasicAuthToken. Sign count must grow unless authenticator does not count signatures.
+func (s *AuthService) FinishWebAuthnLogin(req *st.WebAuthnFinishRequest) (string, string, error) {
+	invalidErr := st.AuthError{Msg: "WebAuthn assertion is not valid", Status: 401}
+
+	claims, err := s.consumeWebAuthnSession(req.Session, webAuthnGet)
+	if err != nil {
+		return "", "", err
+	}
+
+	rawClientData, err := s.verifyClientData(req.Credential.Response.ClientDataJSON, webAuthnGet, claims)
+	if err != nil {
+		logger.Logf("WARN Invalid client data: %s", err.Error())
+		return "", "", invalidErr
+	}
+
+	id := req.Credential.RawID
+	if id == "" {
+		id = req.Credential.ID
+	}
+	credential, err := s.WebAuthnDao.GetWebAuthnCredential(id)
+	if err != nil {
+		return "", "", st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if credential == nil {
+		return "", "", invalidErr
+	}
+	if req.Credential.Response.UserHandle != "" {
+		handle, err := webAuthnEncoding.DecodeString(req.Credential.Response.UserHandle)
+		if err != nil || !bytes.Equal(handle, userHandle(credential.UserID)) {
+			return "", "", invalidErr
+		}
+	}
+
+	rawAuthData, err := webAuthnEncoding.DecodeString(req.Credential.Response.AuthenticatorData)
+	if err != nil {
+		return "", "", invalidErr
+	}
+	ad, err := s.verifyAuthenticatorData(rawAuthData)
+	if err != nil {
+		logger.Logf("WARN Invalid authenticator data: %s", err.Error())
+		return "", "", invalidErr
+	}
+
+	key, err := parseCOSEKey(credential.PublicKey)
+	if err != nil {
+		return "", "", st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	signature, err := webAuthnEncoding.DecodeString(req.Credential.Response.Signature)
+	if err != nil {
+		return "", "", invalidErr
+	}
+	clientDataHash := sha256.Sum256(rawClientData)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	if err = key.verify(signed, signature); err != nil {
+		logger.Logf("WARN Invalid signature of WebAuthn credential %s: %s", credential.ID, err.Error())
+		return "", "", invalidErr
+	}
+
+	if err = s.updateSignCount(credential, ad.SignCount); err != nil {
+		return "", "", err
+	}
+
+	u, err := s.UserDao.Get(credential.UserID)
+	if err != nil {
+		return "", "", st.AuthError{Msg: "Cannot extract user", Status: 500}
+	}
+	if u == nil {
+		return "", "", invalidErr
+	}
+
+	audience, _ := claims["aud"].(string)
+	authTime := time.Now().UTC().Unix()
+	accessToken, err := s.issueAccessToken(u, audience, authTime)
+	if err != nil {
+		return "", "", err
+	}
+	refreshToken, err := s.issueRefreshToken(u, "", "", audience, authTime)
+	if err != nil {
+		return "", "", err
+	}
+
+	logger.Logf("INFO User %d is authenticated with WebAuthn credential", u.ID)
+	return accessToken, refreshToken, nil
+}
+
+// GetWebAuthnCredentials returns credentials registered by the user
+func (s *AuthService) GetWebAuthnCredentials(token string) (*[]st.WebAuthnCredential, error) {
+	u, err := s.authenticateToken(token, accessTokenUse)
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := s.WebAuthnDao.GetWebAuthnCredentials(u.ID)
+	if err != nil {
+		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	return credentials, nil
+}
+
+// DeleteWebAuthnCredential deletes credential of the user
+func (s *AuthService) DeleteWebAuthnCredential(id string, token string) error {
+	u, err := s.authenticateToken(token, accessTokenUse)
+	if err != nil {
+		return err
+	}
+	credential, err := s.WebAuthnDao.GetWebAuthnCredential(id)
+	if err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if credential == nil || credential.UserID != u.ID {
+		return st.AuthError{Msg: "Credential does not exist", Status: 404}
+	}
+	if err = s.WebAuthnDao.DeleteWebAuthnCredential(id); err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	return nil
+}
+
+// webAuthnSession issues random challenge and session token of the ceremony keeping it till its end
+func (s *AuthService) webAuthnSession(ceremony string, audience string, u *st.User) (string, string, error) {
+	b := make([]byte, webAuthnChallengeSize)
+	if _, err := crand.Read(b); err != nil {
+		return "", "", st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	challenge := webAuthnEncoding.EncodeToString(b)
+
+	claims := s.standardClaims(audience, s.Config.WebAuthnTimeout)
+	claims["token_use"] = webAuthnTokenUse
+	claims["jti"] = generateTokenID()
+	claims["ceremony"] = ceremony
+	claims["challenge"] = challenge
+	if u != nil {
+		claims["sub"] = u.Username
+		claims["userId"] = u.ID
+	}
+
+	session, err := s.signToken(claims)
+	if err != nil {
+		return "", "", err
+	}
+	return challenge, session, nil
+}
+
+// consumeWebAuthnSession verifies session token of the ceremony and revokes it, so it can be used only once
+func (s *AuthService) consumeWebAuthnSession(session string, ceremony string) (jwt.MapClaims, error) {
+	invalidErr := st.AuthError{Msg: "WebAuthn session is not valid", Status: 400}
+
+	claims, err := s.parseToken(session, webAuthnTokenUse)
+	if err != nil {
+		return nil, invalidErr
+	}
+	id, _ := claims["jti"].(string)
+	if id == "" || claims["ceremony"] != ceremony {
+		return nil, invalidErr
+	}
+
+	exp, _ := claims["exp"].(float64)
+	if err = s.RevocationDao.Revoke(id, int64(exp)); err != nil {
+		return nil, st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	return claims, nil
+}
+
+// verifyClientData checks type, challenge and origin of client data, returning it decoded
+func (s *AuthService) verifyClientData(encoded string, ceremony string, claims jwt.MapClaims) ([]byte, error) {
+	raw, err := webAuthnEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	var data clientData
+	if err = json.Unmarshal(raw, &data); err != nil {
+		return nil, err
+	}
+
+	if data.Type != ceremony {
+		return nil, fmt.Errorf("Unexpected client data type %s", data.Type)
+	}
+	if challenge, _ := claims["challenge"].(string); challenge == "" || data.Challenge != challenge {
+		return nil, errors.New("Challenge does not match")
+	}
+	for _, origin := range s.webAuthnOrigins() {
+		if data.Origin == origin {
+			return raw, nil
+		}
+	}
+	return nil, fmt.Errorf("Origin %s is not allowed", data.Origin)
+}
+
+// webAuthnOrigins returns configured origins or the origin of relying party ID
+func (s *AuthService) webAuthnOrigins() []string {
+	if len(s.Config.WebAuthnOrigins) > 0 {
+		return s.Config.WebAuthnOrigins
+	}
+	return []string{"https://" + s.Config.WebAuthnRPID}
+}
+
+// parseAttestation extracts authenticator data with the new credential from attestation object
+func (s *AuthService) parseAttestation(encoded string) (*authenticatorData, error) {
+	raw, err := webAuthnEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	decoded, _, err := decodeCBOR(raw)
+	if err != nil {
+		return nil, err
+	}
+	attestation, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("Attestation object is not a map")
+	}
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, errors.New("Authenticator data is missing")
+	}
+
+	ad, err := s.verifyAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if ad.Flags&authDataAttested == 0 {
+		return nil, errors.New("Attested credential data is missing")
+	}
+	if _, err = parseCOSEKey(ad.PublicKey); err != nil {
+		return nil, err
+	}
+	return ad, nil
+}
+
+// verifyAuthenticatorData parses authenticator data and checks relying party and user presence
+func (s *AuthService) verifyAuthenticatorData(data []byte) (*authenticatorData, error) {
+	ad, err := parseAuthenticatorData(data)
+	if err != nil {
+		return nil, err
+	}
+	rpIDHash := sha256.Sum256([]byte(s.Config.WebAuthnRPID))
+	if !bytes.Equal(ad.RPIDHash, rpIDHash[:]) {
+		return nil, errors.New("Relying party ID does not match")
+	}
+	if ad.Flags&authDataUserPresent == 0 {
+		return nil, errors.New("User is not present")
+	}
+	return ad, nil
+}
+
+// updateSignCount stores new sign count of the credential. Sign count which does not grow
+// means that the credential may have been cloned, authenticators which do not count signatures send 0.
+func (s *AuthService) updateSignCount(credential *st.WebAuthnCredential, signCount uint32) error {
+	if signCount == 0 && credential.SignCount == 0 {
+		return nil
+	}
+	if int64(signCount) <= credential.SignCount {
+		logger.Logf("WARN Sign count of WebAuthn credential %s did not grow, it may be cloned", credential.ID)
+		return st.AuthError{Msg: "WebAuthn assertion is not valid", Status: 401}
+	}
+	updated, err := s.WebAuthnDao.SetWebAuthnSignCount(credential.ID, credential.SignCount, int64(signCount))
+	if err != nil {
+		return st.AuthError{Msg: err.Error(), Status: 500}
+	}
+	if !updated {
+		return st.AuthError{Msg: "WebAuthn assertion is not valid", Status: 401}
+	}
+	return nil
+}
+
+// parseAuthenticatorData parses authenticator data, attested credential is parsed when it is present
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("Authenticator data is too short")
+	}
+	ad := &authenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if ad.Flags&authDataAttested == 0 {
+		return ad, nil
+	}
+
+	// AAGUID is followed by length of credential id, the id and COSE key
+	rest := data[37:]
+	if len(rest) < 18 {
+		return nil, errors.New("Attested credential data is too short")
+	}
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLength {
+		return nil, errors.New("Attested credential data is too short")
+	}
+	ad.CredentialID = rest[:idLength]
+	rest = rest[idLength:]
+
+	_, extensions, err := decodeCBOR(rest)
+	if err != nil {
+		return nil, err
+	}
+	ad.PublicKey = rest[:len(rest)-len(extensions)]
+	return ad, nil
+}
+
+// parseCOSEKey parses RFC 8152 public key of supported algorithm
+func parseCOSEKey(data []byte) (*coseKey, error) {
+	decoded, _, err := decodeCBOR(data)
+	if err != nil {
+		return nil, err
+	}
+	params, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("COSE key is not a map")
+	}
+
+	alg, _ := params[int64(3)].(int64)
+	switch alg {
+	case coseAlgES256:
+		crv, _ := params[int64(-1)].(int64)
+		x, _ := params[int64(-2)].([]byte)
+		y, _ := params[int64(-3)].([]byte)
+		if params[int64(1)] != int64(2) || crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("Invalid ES256 key")
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("Invalid ES256 key")
+		}
+		return &coseKey{Alg: alg, Key: key}, nil
+	case coseAlgRS256:
+		n, _ := params[int64(-1)].([]byte)
+		e, _ := params[int64(-2)].([]byte)
+		if params[int64(1)] != int64(3) || len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("Invalid RS256 key")
+		}
+		exponent := new(big.Int).SetBytes(e)
+		return &coseKey{Alg: alg, Key: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}}, nil
+	}
+	return nil, fmt.Errorf("COSE algorithm %d is not supported", alg)
+}
+
+// verify checks signature of the data
+func (k *coseKey) verify(data []byte, signature []byte) error {
+	digest := sha256.Sum256(data)
+	switch key := k.Key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest[:], signature) {
+			return errors.New("Signature is not valid")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+	}
+	return errors.New("Key type is not supported")
+}
+
+// userHandle is user id of WebAuthn user entity, it does not contain personal information
+func userHandle(id int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(id))
+	return b
+}
+
+func credentialDescriptors(credentials *[]st.WebAuthnCredential) []st.WebAuthnCredentialDescriptor {
+	result := []st.WebAuthnCredentialDescriptor{}
+	for _, c := range *credentials {
+		result = append(result, st.WebAuthnCredentialDescriptor{Type: "public-key", ID: c.ID})
+	}
+	return result
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/adderly/brightonum/src/dao"
+	st "github.com/adderly/brightonum/src/structs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const testRPID = "example.com"
+const testOrigin = "https://example.com"
+
+func TestDecodeCBOR(t *testing.T) {
+	// Examples of RFC 8949 appendix A
+	examples := []struct {
+		hex   []byte
+		value interface{}
+	}{
+		{[]byte{0x00}, int64(0)},
+		{[]byte{0x17}, int64(23)},
+		{[]byte{0x18, 0x18}, int64(24)},
+		{[]byte{0x19, 0x03, 0xe8}, int64(1000)},
+		{[]byte{0x1b, 0x00, 0x00, 0x00, 0xe8, 0xd4, 0xa5, 0x10, 0x00}, int64(1000000000000)},
+		{[]byte{0x20}, int64(-1)},
+		{[]byte{0x38, 0x63}, int64(-100)},
+		{[]byte{0x39, 0x01, 0x00}, int64(-257)},
+		{[]byte{0x44, 0x01, 0x02, 0x03, 0x04}, []byte{1, 2, 3, 4}},
+		{[]byte{0x64, 0x49, 0x45, 0x54, 0x46}, "IETF"},
+		{[]byte{0x83, 0x01, 0x02, 0x03}, []interface{}{int64(1), int64(2), int64(3)}},
+		{[]byte{0xa2, 0x01, 0x02, 0x03, 0x04}, map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)}},
+		{[]byte{0xa1, 0x61, 0x61, 0x80}, map[interface{}]interface{}{"a": []interface{}{}}},
+		{[]byte{0xc1, 0x1a, 0x51, 0x4b, 0x67, 0xb0}, int64(1363896240)},
+		{[]byte{0xf4}, false},
+		{[]byte{0xf5}, true},
+		{[]byte{0xf6}, nil},
+	}
+	for _, e := range examples {
+		value, rest, err := decodeCBOR(e.hex)
+		assert.Nil(t, err)
+		assert.Equal(t, e.value, value)
+		assert.Empty(t, rest)
+	}
+
+	value, rest, err := decodeCBOR([]byte{0x01, 0x02})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), value)
+	assert.Equal(t, []byte{0x02}, rest)
+
+	invalid := [][]byte{
+		{},
+		{0x19, 0x03},
+		{0x44, 0x01, 0x02},
+		{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		{0x5f, 0x41, 0x01, 0xff},
+		{0xa1, 0x80, 0x01},
+		{0xfb, 0x3f, 0xf1, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9a},
+		{0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x00},
+	}
+	for _, data := range invalid {
+		_, _, err = decodeCBOR(data)
+		assert.NotNil(t, err, "%x", data)
+	}
+}
+
+func TestAuthService_WebAuthnRegistration(t *testing.T) {
+	user := createTestUser()
+	authenticator := newSoftAuthenticator()
+	existing := st.WebAuthnCredential{ID: "existing", UserID: user.ID}
+
+	var saved *st.WebAuthnCredential
+	webAuthnDao := dao.MockWebAuthnDao{}
+	webAuthnDao.On("GetWebAuthnCredentials", user.ID).Return(&[]st.WebAuthnCredential{existing}, nil)
+	webAuthnDao.On("GetWebAuthnCredential", authenticator.id()).Return(nil, nil)
+	webAuthnDao.On("SaveWebAuthnCredential", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		saved = args.Get(0).(*st.WebAuthnCredential)
+	})
+	revocationDao := dao.MockRevocationDao{}
+	revocationDao.On("IsRevoked", mock.Anything).Return(false, nil)
+	revocationDao.On("Revoke", mock.Anything, mock.Anything).Return(nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := createTestService(&mailer, &dao, createTestWebAuthnConfig())
+	s.WebAuthnDao = &webAuthnDao
+	s.RevocationDao = &revocationDao
+	token, _ := s.issueAccessToken(&user, s.Config.Audience, time.Now().Unix())
+
+	resp, err := s.BeginWebAuthnRegistration(token)
+	assert.Nil(t, err)
+	options := resp.PublicKey.(st.WebAuthnCreationOptions)
+	assert.Equal(t, st.WebAuthnRelyingParty{ID: testRPID, Name: "brightonum"}, options.RP)
+	assert.Equal(t, "AAAAAAAAACo", options.User.ID)
+	assert.Equal(t, "alle", options.User.Name)
+	assert.Equal(t, []st.WebAuthnCredentialDescriptor{{Type: "public-key", ID: "existing"}}, options.ExcludeCredentials)
+	assert.Equal(t, int64(60000), options.Timeout)
+	assert.True(t, testJWTStringField(resp.Session, "token_use", webAuthnTokenUse))
+
+	req := st.WebAuthnFinishRequest{Session: resp.Session, Name: "laptop", Credential: authenticator.create(options.Challenge, testOrigin)}
+	credential, err := s.FinishWebAuthnRegistration(token, &req)
+	assert.Nil(t, err)
+	assert.Equal(t, saved, credential)
+	assert.Equal(t, authenticator.id(), credential.ID)
+	assert.Equal(t, user.ID, credential.UserID)
+	assert.Equal(t, "laptop", credential.Name)
+	key, err := parseCOSEKey(credential.PublicKey)
+	assert.Nil(t, err)
+	assert.Equal(t, &authenticator.key.PublicKey, key.Key)
+
+	invalidErr := st.AuthError{Msg: "WebAuthn attestation is not valid", Status: 400}
+
+	resp, _ = s.BeginWebAuthnRegistration(token)
+	options = resp.PublicKey.(st.WebAuthnCreationOptions)
+	req = st.WebAuthnFinishRequest{Session: resp.Session, Credential: authenticator.create(options.Challenge, "https://evil.com")}
+	_, err = s.FinishWebAuthnRegistration(token, &req)
+	assert.Equal(t, invalidErr, err)
+
+	resp, _ = s.BeginWebAuthnRegistration(token)
+	req = st.WebAuthnFinishRequest{Session: resp.Session, Credential: authenticator.create("other", testOrigin)}
+	_, err = s.FinishWebAuthnRegistration(token, &req)
+	assert.Equal(t, invalidErr, err)
+
+	resp, _ = s.BeginWebAuthnRegistration(token)
+	options = resp.PublicKey.(st.WebAuthnCreationOptions)
+	authenticator.rpID = "evil.com"
+	req = st.WebAuthnFinishRequest{Session: resp.Session, Credential: authenticator.create(options.Challenge, testOrigin)}
+	_, err = s.FinishWebAuthnRegistration(token, &req)
+	assert.Equal(t, invalidErr, err)
+
+	_, err = s.FinishWebAuthnRegistration(token, &st.WebAuthnFinishRequest{Session: token})
+	assert.Equal(t, st.AuthError{Msg: "WebAuthn session is not valid", Status: 400}, err)
+
+	s.Config.WebAuthnRPID = ""
+	_, err = s.BeginWebAuthnRegistration(token)
+	assert.Equal(t, st.AuthError{Msg: "WebAuthn is not configured", Status: 501}, err)
+}
+
+func TestAuthService_WebAuthnLogin(t *testing.T) {
+	user := createTestUser()
+	authenticator := newSoftAuthenticator()
+	authenticator.signCount = 1
+	credential := st.WebAuthnCredential{ID: authenticator.id(), UserID: user.ID, PublicKey: authenticator.publicKey(), SignCount: 1}
+
+	webAuthnDao := dao.MockWebAuthnDao{}
+	webAuthnDao.On("GetWebAuthnCredentials", user.ID).Return(&[]st.WebAuthnCredential{credential}, nil)
+	webAuthnDao.On("GetWebAuthnCredential", credential.ID).Return(&credential, nil)
+	webAuthnDao.On("SetWebAuthnSignCount", credential.ID, int64(1), int64(2)).Return(true, nil)
+	revocationDao := dao.MockRevocationDao{}
+	revocationDao.On("IsRevoked", mock.Anything).Return(false, nil)
+	revocationDao.On("Revoke", mock.Anything, mock.Anything).Return(nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+	dao.On("GetByUsername", "unknown").Return(nil, nil)
+	dao.On("Get", user.ID).Return(&user, nil)
+
+	s := createTestService(&mailer, &dao, createTestWebAuthnConfig())
+	s.WebAuthnDao = &webAuthnDao
+	s.RevocationDao = &revocationDao
+
+	resp, err := s.BeginWebAuthnLogin(user.Username, "")
+	assert.Nil(t, err)
+	options := resp.PublicKey.(st.WebAuthnRequestOptions)
+	assert.Equal(t, testRPID, options.RPID)
+	assert.Equal(t, []st.WebAuthnCredentialDescriptor{{Type: "public-key", ID: credential.ID}}, options.AllowCredentials)
+
+	req := st.WebAuthnFinishRequest{Session: resp.Session, Credential: authenticator.get(options.Challenge, testOrigin)}
+	accessToken, refreshToken, err := s.FinishWebAuthnLogin(&req)
+	assert.Nil(t, err)
+	assert.True(t, testJWTStringField(accessToken, "sub", user.Username))
+	assert.True(t, testJWTStringField(refreshToken, "token_use", refreshTokenUse))
+	webAuthnDao.AssertCalled(t, "SetWebAuthnSignCount", credential.ID, int64(1), int64(2))
+
+	invalidErr := st.AuthError{Msg: "WebAuthn assertion is not valid", Status: 401}
+
+	// Sign count of cloned authenticator does not grow
+	resp, _ = s.BeginWebAuthnLogin("", "")
+	authenticator.signCount = 0
+	req = st.WebAuthnFinishRequest{Session: resp.Session, Credential: authenticator.get(resp.PublicKey.(st.WebAuthnRequestOptions).Challenge, testOrigin)}
+	_, _, err = s.FinishWebAuthnLogin(&req)
+	assert.Equal(t, invalidErr, err)
+
+	resp, _ = s.BeginWebAuthnLogin("", "")
+	req = st.WebAuthnFinishRequest{Session: resp.Session, Credential: authenticator.get(resp.PublicKey.(st.WebAuthnRequestOptions).Challenge, testOrigin)}
+	req.Credential.Response.Signature = "MEQCIGUK"
+	_, _, err = s.FinishWebAuthnLogin(&req)
+	assert.Equal(t, invalidErr, err)
+
+	resp, _ = s.BeginWebAuthnLogin("", "")
+	req = st.WebAuthnFinishRequest{Session: resp.Session, Credential: authenticator.get(resp.PublicKey.(st.WebAuthnRequestOptions).Challenge, testOrigin)}
+	req.Credential.Response.UserHandle = "AAAAAAAAACs"
+	_, _, err = s.FinishWebAuthnLogin(&req)
+	assert.Equal(t, invalidErr, err)
+
+	// Registration session is not accepted for login
+	_, err = s.BeginWebAuthnLogin("unknown", "")
+	assert.Nil(t, err)
+	token, _ := s.issueAccessToken(&user, s.Config.Audience, time.Now().Unix())
+	registration, _ := s.BeginWebAuthnRegistration(token)
+	req = st.WebAuthnFinishRequest{Session: registration.Session, Credential: authenticator.get(registration.PublicKey.(st.WebAuthnCreationOptions).Challenge, testOrigin)}
+	_, _, err = s.FinishWebAuthnLogin(&req)
+	assert.Equal(t, st.AuthError{Msg: "WebAuthn session is not valid", Status: 400}, err)
+}
+
+func TestAuthService_DeleteWebAuthnCredential(t *testing.T) {
+	user := createTestUser()
+
+	webAuthnDao := dao.MockWebAuthnDao{}
+	webAuthnDao.On("GetWebAuthnCredential", "own").Return(&st.WebAuthnCredential{ID: "own", UserID: user.ID}, nil)
+	webAuthnDao.On("GetWebAuthnCredential", "other").Return(&st.WebAuthnCredential{ID: "other", UserID: 43}, nil)
+	webAuthnDao.On("DeleteWebAuthnCredential", "own").Return(nil)
+
+	dao := dao.MockUserDao{}
+	dao.On("GetByUsername", user.Username).Return(&user, nil)
+
+	s := createTestService(&mailer, &dao, createTestWebAuthnConfig())
+	s.WebAuthnDao = &webAuthnDao
+	token, _ := s.issueAccessToken(&user, s.Config.Audience, time.Now().Unix())
+
+	err := s.DeleteWebAuthnCredential("own", token)
+	assert.Nil(t, err)
+	webAuthnDao.AssertCalled(t, "DeleteWebAuthnCredential", "own")
+
+	err = s.DeleteWebAuthnCredential("other", token)
+	assert.Equal(t, st.AuthError{Msg: "Credential does not exist", Status: 404}, err)
+	webAuthnDao.AssertNotCalled(t, "DeleteWebAuthnCredential", "other")
+}
+
+func createTestWebAuthnConfig() Config {
+	conf := createTestConfig()
+	conf.WebAuthnRPID = testRPID
+	conf.WebAuthnRPName = "brightonum"
+	conf.WebAuthnTimeout = time.Minute
+	// Defaults of the shipped config, sessions have to pass the claims check with them
+	conf.Issuer = "brightonum"
+	conf.Audience = "brightonum"
+	return conf
+}
+
+// softAuthenticator is software authenticator with ES256 key producing none attestation
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	rpID         string
+	signCount    uint32
+}
+
+func newSoftAuthenticator() *softAuthenticator {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	credentialID := make([]byte, 16)
+	crand.Read(credentialID)
+	return &softAuthenticator{key: key, credentialID: credentialID, rpID: testRPID}
+}
+
+func (a *softAuthenticator) id() string {
+	return webAuthnEncoding.EncodeToString(a.credentialID)
+}
+
+func (a *softAuthenticator) publicKey() []byte {
+	return encodeCBOR(cborMap{
+		1, 2,
+		3, coseAlgES256,
+		-1, 1,
+		-2, a.key.X.FillBytes(make([]byte, 32)),
+		-3, a.key.Y.FillBytes(make([]byte, 32)),
+	})
+}
+
+func (a *softAuthenticator) create(challenge, origin string) st.WebAuthnPublicKeyCredential {
+	attested := make([]byte, 18)
+	binary.BigEndian.PutUint16(attested[16:], uint16(len(a.credentialID)))
+	attested = append(append(attested, a.credentialID...), a.publicKey()...)
+
+	attestation := encodeCBOR(cborMap{
+		"fmt", "none",
+		"attStmt", cborMap{},
+		"authData", append(a.authData(authDataUserPresent|authDataAttested), attested...),
+	})
+	return st.WebAuthnPublicKeyCredential{
+		ID:    a.id(),
+		RawID: a.id(),
+		Type:  "public-key",
+		Response: st.WebAuthnAuthenticatorResponse{
+			ClientDataJSON:    a.clientData(webAuthnCreate, challenge, origin),
+			AttestationObject: webAuthnEncoding.EncodeToString(attestation),
+		},
+	}
+}
+
+func (a *softAuthenticator) get(challenge, origin string) st.WebAuthnPublicKeyCredential {
+	a.signCount++
+	authData := a.authData(authDataUserPresent)
+	clientData := a.clientData(webAuthnGet, challenge, origin)
+	rawClientData, _ := webAuthnEncoding.DecodeString(clientData)
+	clientDataHash := sha256.Sum256(rawClientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, _ := ecdsa.SignASN1(crand.Reader, a.key, digest[:])
+
+	return st.WebAuthnPublicKeyCredential{
+		ID:    a.id(),
+		RawID: a.id(),
+		Type:  "public-key",
+		Response: st.WebAuthnAuthenticatorResponse{
+			ClientDataJSON:    clientData,
+			AuthenticatorData: webAuthnEncoding.EncodeToString(authData),
+			Signature:         webAuthnEncoding.EncodeToString(signature),
+			UserHandle:        webAuthnEncoding.EncodeToString(userHandle(user.ID)),
+		},
+	}
+}
+
+func (a *softAuthenticator) authData(flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append(rpIDHash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], a.signCount)
+	return data
+}
+
+func (a *softAuthenticator) clientData(ceremony, challenge, origin string) string {
+	data, _ := json.Marshal(clientData{Type: ceremony, Challenge: challenge, Origin: origin})
+	return webAuthnEncoding.EncodeToString(data)
+}
+
+// cborMap is CBOR map as list of keys and values, which keeps encoding deterministic
+type cborMap []interface{}
+
+// encodeCBOR encodes values used by authenticators: integers, byte and text strings and maps
+func encodeCBOR(v interface{}) []byte {
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return cborHeader(1, uint64(-1-v))
+		}
+		return cborHeader(0, uint64(v))
+	case []byte:
+		return append(cborHeader(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHeader(3, uint64(len(v))), v...)
+	case cborMap:
+		data := cborHeader(5, uint64(len(v)/2))
+		for _, item := range v {
+			data = append(data, encodeCBOR(item)...)
+		}
+		return data
+	}
+	panic("unsupported CBOR value")
+}
+
+func cborHeader(major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return []byte{major<<5 | byte(arg)}
+	case arg <= 0xff:
+		return []byte{major<<5 | 24, byte(arg)}
+	case arg <= 0xffff:
+		data := []byte{major<<5 | 25, 0, 0}
+		binary.BigEndian.PutUint16(data[1:], uint16(arg))
+		return data
+	}
+	data := []byte{major<<5 | 26, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(data[1:], uint32(arg))
+	return data
+}